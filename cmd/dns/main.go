@@ -2,47 +2,197 @@ package main
 
 import (
 	"context"
+	"dns-server/internal/cache"
+	"dns-server/internal/config"
 	"dns-server/internal/constants"
+	"dns-server/internal/dnssec"
 	"dns-server/internal/handlers"
+	"dns-server/internal/hosts"
 	"dns-server/internal/logger"
 	"dns-server/internal/manager"
+	"dns-server/internal/notify"
+	"dns-server/internal/recursor"
+	"dns-server/internal/secondary"
 	"dns-server/internal/server"
+	"dns-server/internal/tsig"
+	"dns-server/internal/upstream"
+	"encoding/base64"
+	"flag"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-func serverInit() {
+func serverInit(configPath string) {
 	var err error
 	logger.NewLogger(
 		logger.WithLogFilePath("logs"),
 		logger.WithLevel("info"),
 	)
 
+	storageInit(configPath)
+
+	switch resolverCfg := constants.Config.Resolver; resolverCfg.Mode {
+	case "", "forward":
+		constants.Upstreams, err = newUpstreamPool(constants.Config.Upstream)
+		if err != nil {
+			log.Fatal().Msgf("Error while initialising upstreams -> %v", err)
+		}
+		constants.Resolver = constants.Upstreams
+	case "recursive":
+		constants.Resolver, err = recursor.New(
+			recursor.WithRootHints(resolverCfg.RootHints),
+			recursor.WithPort(resolverCfg.Port),
+			recursor.WithTimeout(resolverCfg.Timeout.Duration),
+		)
+		if err != nil {
+			log.Fatal().Msgf("Error while initialising recursive resolver -> %v", err)
+		}
+		log.Info().Msg("Resolving names recursively from the root servers")
+	default:
+		log.Fatal().Msgf("Unknown resolver mode %q, expected forward or recursive", resolverCfg.Mode)
+	}
+
+	if hostsCfg := constants.Config.Hosts; len(hostsCfg.Files) > 0 {
+		constants.Hosts = hosts.New(hostsCfg.Files, handlers.SetHosts,
+			hosts.WithTTL(hostsCfg.TTL.Duration),
+		)
+		constants.Hosts.Load()
+	}
+
+	constants.TransferACL, err = manager.ParseACL(constants.Config.Transfer.Allow)
+	if err != nil {
+		log.Fatal().Msgf("Invalid transfer ACL -> %v", err)
+	}
+
+	constants.UpdateACL, err = manager.ParseACL(constants.Config.Update.Allow)
+	if err != nil {
+		log.Fatal().Msgf("Invalid update ACL -> %v", err)
+	}
+
+	for _, target := range constants.Config.Transfer.Notify {
+		addr, err := manager.ServerAddr(target)
+		if err != nil {
+			log.Fatal().Msgf("Invalid NOTIFY target -> %v", err)
+		}
+		constants.NotifyTargets = append(constants.NotifyTargets, addr)
+	}
+	constants.Notifier = notify.New(
+		notify.WithRetries(constants.Config.Transfer.NotifyRetries),
+		notify.WithTimeout(constants.Config.Transfer.NotifyTimeout.Duration),
+		notify.WithKeyring(constants.TSIGKeys),
+		notify.WithKey(constants.Config.Transfer.NotifyKey),
+	)
+
+	constants.DNSSEC = dnssec.New(
+		dnssec.WithValidity(constants.Config.DNSSEC.SignatureValidity.Duration),
+		dnssec.WithMaxSignatures(constants.Config.DNSSEC.MaxSignatures),
+	)
+	handlers.LoadDNSSEC()
+
+	constants.Secondaries = secondary.New(handlers.ApplyTransfer,
+		secondary.WithKeyring(constants.TSIGKeys),
+	)
+	handlers.LoadSecondaries()
+
+	constants.Forwarders = manager.NewForwarderManager(
+		upstream.WithTimeout(constants.Config.Upstream.Timeout.Duration),
+		upstream.WithRetries(constants.Config.Upstream.Retries),
+	)
+	handlers.LoadForwarders()
+
+	if cacheCfg := constants.Config.Cache; cacheCfg.Enabled {
+		options := []cache.Option{
+			cache.WithMaxEntries(cacheCfg.MaxEntries),
+			cache.WithMaxTTL(cacheCfg.MaxTTL.Duration),
+			cache.WithMaxNegativeTTL(cacheCfg.MaxNegativeTTL.Duration),
+		}
+		if cacheCfg.Prefetch {
+			options = append(options, cache.WithPrefetch(cacheCfg.PrefetchMinHits, handlers.Prefetch))
+		}
+		if cacheCfg.ServeStale {
+			options = append(options, cache.WithServeStale(cacheCfg.MaxStale.Duration, cacheCfg.StaleTTL.Duration))
+		}
+		constants.Cache = cache.New(options...)
+	}
+}
+
+// storageInit loads the configuration and the records and zones stored in
+// Redis, which is all the zone command needs.
+func storageInit(configPath string) {
+	var err error
+	constants.Config, err = config.Load(configPath)
+	if err != nil {
+		log.Fatal().Msgf("Error while loading config %s -> %v", configPath, err)
+	}
+
 	constants.Redis, err = manager.NewRedisManager()
 	if err != nil {
 		log.Error().Msgf("Error while initialising Redis -> %v", err)
 	}
 
+	for _, k := range constants.Config.TSIGKeys {
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err == nil {
+			err = constants.TSIGKeys.Set(tsig.Key{Name: k.Name, Algorithm: k.Algorithm, Secret: secret})
+		}
+		if err != nil {
+			log.Fatal().Msgf("Invalid TSIG key %s -> %v", k.Name, err)
+		}
+	}
+	handlers.LoadTSIGKeys()
+
 	constants.ContextManager = manager.NewContextManager()
+	constants.Journal = manager.NewJournalManager(
+		manager.WithJournalSize(constants.Config.Transfer.JournalSize),
+	)
 	handlers.LoadRedisContext()
+	handlers.LoadZones()
+}
+
+func newUpstreamPool(cfg config.UpstreamConfig) (*upstream.Pool, error) {
+	upstreams := make([]*upstream.Upstream, 0, len(cfg.Servers))
+	for _, s := range cfg.Servers {
+		u, err := upstream.New(s.Address,
+			upstream.WithServerName(s.ServerName),
+			upstream.WithBootstrap(s.Bootstrap),
+		)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	return upstream.NewPool(upstreams,
+		upstream.WithStrategy(upstream.Strategy(cfg.Strategy)),
+		upstream.WithTimeout(cfg.Timeout.Duration),
+		upstream.WithRetries(cfg.Retries),
+	)
 }
 
 func serverClose() {
 	if constants.Redis != nil {
 		constants.Redis.Close()
 	}
+	if constants.Upstreams != nil {
+		constants.Upstreams.Close()
+	}
 }
 
 func main() {
-	serverInit()
+	if len(os.Args) > 1 && os.Args[1] == "zone" {
+		os.Exit(zoneCommand(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", "config.json", "path to the JSON configuration file")
+	flag.Parse()
+
+	serverInit(*configPath)
 	defer serverClose()
 
 	var wg sync.WaitGroup
@@ -50,46 +200,61 @@ func main() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 
+	if constants.Upstreams != nil {
+		constants.Upstreams.StartHealthChecks(rootCtx, constants.Config.Upstream.HealthCheckInterval.Duration)
+	}
+	constants.Forwarders.StartHealthChecks(rootCtx, constants.Config.Upstream.HealthCheckInterval.Duration)
+	if constants.Hosts != nil {
+		constants.Hosts.Watch(rootCtx, constants.Config.Hosts.ReloadInterval.Duration)
+	}
+	constants.Secondaries.Start(rootCtx)
+
 	// Start DNS server
+	dnsCfg := constants.Config.DNS
+	dnsServer := server.NewDNSServer(
+		server.WithDNSAddr(dnsCfg.Addr),
+		server.WithTCPIdleTimeout(dnsCfg.TCPIdleTimeout.Duration),
+		server.WithTCPMaxConnections(dnsCfg.TCPMaxConnections),
+		server.WithTCPMaxPipelined(dnsCfg.TCPMaxPipelined),
+		server.WithTLSAddr(constants.Config.DoT.Addr),
+		server.WithTLSCertificate(constants.Config.DoT.CertFile, constants.Config.DoT.KeyFile),
+		server.WithCertReloadInterval(constants.Config.DoT.ReloadInterval.Duration),
+	)
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer fmt.Println("Done listening")
-		addr := ":53"
-		pc, err := net.ListenPacket("udp", addr)
-		if err != nil {
+		if err := dnsServer.ServeUDP(rootCtx, &wg); err != nil {
 			panic(err)
 		}
-		defer pc.Close()
-		log.Info().Msgf("DNS server listening on %s", addr)
-
-		buf := make([]byte, 512)
-		for {
-			select {
-			case <-rootCtx.Done():
-				return
-			default:
-				// Set a read timeout to allow periodic context checking
-				pc.SetReadDeadline(time.Now().Add(1 * time.Second))
-				n, clientAddr, err := pc.ReadFrom(buf)
-				if err != nil {
-					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-						// Timeout occurred, continue to check context
-						continue
-					}
-					// Other error, log and continue
-					log.Error().Msgf("Error reading from connection: %v", err)
-					continue
-				}
-				wg.Add(1)
-				go handlers.HandleDNSQuery(rootCtx, &wg, pc, clientAddr, buf[:n])
-			}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := dnsServer.ServeTCP(rootCtx, &wg); err != nil {
+			log.Panic().Msgf("Failed to start DNS over TCP at addr %s -> error %v", dnsServer.GetAddr(), err)
 		}
 	}()
 
+	if constants.Config.DoT.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := dnsServer.ServeTLS(rootCtx, &wg); err != nil {
+				log.Error().Msgf("Failed to start DNS over TLS at addr %s -> error %v", dnsServer.GetTLSAddr(), err)
+			}
+		}()
+	}
+
 	// Start API server
 	go func() {
-		srv := server.NewServer()
+		apiCfg := constants.Config.API
+		srv := server.NewServer(
+			server.WithPort(apiCfg.Port),
+			server.WithHTTPSCertificate(apiCfg.CertFile, apiCfg.KeyFile),
+		)
 		if err := srv.StartBackend(); err != nil && err != http.ErrServerClosed {
 			log.Panic().Msgf("Failed to start server at addr %s -> error %v", srv.GetAddr(), err)
 		}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"dns-server/internal/constants"
+	"dns-server/internal/handlers"
+	"dns-server/internal/manager"
+	"dns-server/internal/zonefile"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const zoneUsage = `Usage:
+  dns-server zone import [-config file] [-api url] [-replace] <zone> <file>
+  dns-server zone export [-config file] <zone> [file]
+
+A file name of "-" reads from standard input; export writes to standard
+output when no file is given.
+
+Imports go through the API of the running server, so that it answers with
+the new records at once and notifies the secondaries. The API is looked for
+on the port in the configuration unless -api names it; when no server
+answers there, the zone is written to Redis directly.
+`
+
+// zoneCommand runs "dns-server zone import|export", which moves zones
+// between Redis and zone files. It returns the exit code.
+func zoneCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, zoneUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("zone "+args[0], flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, zoneUsage) }
+	configPath := fs.String("config", "config.json", "path to the JSON configuration file")
+	replace := fs.Bool("replace", false, "delete the names of the zone missing from the file")
+	apiURL := fs.String("api", "", "base URL of the API of the running server")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	// Only problems are worth reporting on the terminal.
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	var err error
+	switch args[0] {
+	case "import":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return 2
+		}
+		storageInit(*configPath)
+		err = importZone(fs.Arg(0), fs.Arg(1), *replace, *apiURL)
+	case "export":
+		if fs.NArg() < 1 || fs.NArg() > 2 {
+			fs.Usage()
+			return 2
+		}
+		storageInit(*configPath)
+		err = exportZone(fs.Arg(0), fs.Arg(1))
+	default:
+		fs.Usage()
+		return 2
+	}
+	serverClose()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zone %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func importZone(zone, path string, replace bool, apiURL string) error {
+	in, dir := io.Reader(os.Stdin), "."
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in, dir = f, filepath.Dir(path)
+	}
+
+	file, err := zonefile.Parse(in, zone, zonefile.WithIncludeDir(dir))
+	if err != nil {
+		return err
+	}
+
+	explicit := apiURL != ""
+	if !explicit {
+		apiURL = localAPI()
+	}
+	if explicit || apiAnswers(apiURL) {
+		return importThroughAPI(apiURL, zone, file, replace)
+	}
+
+	z, count, err := handlers.ImportZone(zone, file, replace)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d records into zone %s, serial %d\n", count, z.Name, z.Serial)
+	return nil
+}
+
+// localAPI returns the base URL of the API of a server running on this
+// host with the loaded configuration.
+func localAPI() string {
+	apiCfg := constants.Config.API
+	scheme := "http"
+	if apiCfg.CertFile != "" && apiCfg.KeyFile != "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://localhost:%d", scheme, apiCfg.Port)
+}
+
+var apiClient = &http.Client{Timeout: time.Minute}
+
+// apiAnswers reports whether a server answers health checks at apiURL.
+func apiAnswers(apiURL string) bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(apiURL + "/api/health")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// importThroughAPI sends file, with its $INCLUDE directives resolved, to
+// the import endpoint of the server at apiURL.
+func importThroughAPI(apiURL, zone string, file *zonefile.File, replace bool) error {
+	var body bytes.Buffer
+	if err := zonefile.WriteFile(&body, file); err != nil {
+		return err
+	}
+	endpoint := apiURL + "/api/zones/" + url.PathEscape(zone) + "/import"
+	if replace {
+		endpoint += "?replace=true"
+	}
+
+	resp, err := apiClient.Post(endpoint, "text/dns", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool         `json:"success"`
+		Message string       `json:"message"`
+		Data    manager.Zone `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected answer from %s: %s", apiURL, resp.Status)
+	}
+	if !result.Success {
+		return errors.New(result.Message)
+	}
+	fmt.Fprintf(os.Stderr, "%s into zone %s through %s, serial %d\n", result.Message, result.Data.Name, apiURL, result.Data.Serial)
+	return nil
+}
+
+func exportZone(zone, path string) error {
+	if path == "" || path == "-" {
+		return handlers.ExportZone(os.Stdout, zone)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := handlers.ExportZone(f, zone); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -72,14 +72,30 @@ function App() {
     }
   }
 
+  // Human readable value of a typed record
+  const recordValue = (record) => {
+    switch (record.type) {
+      case 'MX':
+        return `${record.priority || 0} ${record.target}`
+      case 'SRV':
+        return `${record.priority || 0} ${record.weight || 0} ${record.port || 0} ${record.target}`
+      case 'TXT':
+        return (record.text || []).map((text) => JSON.stringify(text)).join(' ')
+      case 'CAA':
+        return `${record.flags || 0} ${record.tag} "${record.value}"`
+      default:
+        return record.ip || record.target
+    }
+  }
+
   // Delete DNS record
-  const deleteRecord = async (domain) => {
-    if (!confirm(`Are you sure you want to delete the record for "${domain}"?`)) {
+  const deleteRecord = async (domain, type) => {
+    if (!confirm(`Are you sure you want to delete the ${type} record for "${domain}"?`)) {
       return
     }
 
     try {
-      const response = await fetch(`${API_BASE}/records/${encodeURIComponent(domain)}`, {
+      const response = await fetch(`${API_BASE}/records/${encodeURIComponent(domain)}?type=${encodeURIComponent(type)}`, {
         method: 'DELETE'
       })
 
@@ -226,7 +242,7 @@ function App() {
                   <div key={index} className="record-card">
                     <div className="record-header">
                       <div className="record-status active"></div>
-                      <div className="record-type">A Record</div>
+                      <div className="record-type">{record.type || 'A'} Record</div>
                     </div>
                     <div className="record-content">
                       <div className="record-field">
@@ -235,12 +251,12 @@ function App() {
                       </div>
                       <div className="record-field">
                         <label>Points to</label>
-                        <div className="record-value ip-value">{record.ip}</div>
+                        <div className="record-value ip-value">{recordValue(record)}</div>
                       </div>
                     </div>
                     <div className="record-actions">
                       <button
-                        onClick={() => deleteRecord(record.domain)}
+                        onClick={() => deleteRecord(record.domain, record.type)}
                         className="btn btn-danger btn-small"
                         title="Delete record"
                       >
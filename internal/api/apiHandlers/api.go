@@ -3,8 +3,10 @@ package apiHandler
 import (
 	"dns-server/internal/constants"
 	"dns-server/internal/handlers"
-	"net"
+	"dns-server/internal/manager"
+	"encoding/json"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -13,8 +15,20 @@ import (
 
 type DNSRecord struct {
 	Domain string `json:"domain" binding:"required"`
-	IP     string `json:"ip" binding:"required"`
-	TTL    int    `json:"ttl,omitempty"`
+	manager.Record
+}
+
+// UnmarshalJSON reads the domain besides the record, whose own
+// UnmarshalJSON would otherwise be used for the whole object.
+func (r *DNSRecord) UnmarshalJSON(b []byte) error {
+	var domain struct {
+		Domain string `json:"domain"`
+	}
+	if err := json.Unmarshal(b, &domain); err != nil {
+		return err
+	}
+	r.Domain = domain.Domain
+	return json.Unmarshal(b, &r.Record)
 }
 
 type APIResponse struct {
@@ -23,10 +37,6 @@ type APIResponse struct {
 	Data    any    `json:"data,omitempty"`
 }
 
-func validateIP(ip string) bool {
-	return net.ParseIP(ip) != nil
-}
-
 func validateDomain(domain string) bool {
 	if len(domain) == 0 || len(domain) > 253 {
 		return false
@@ -41,6 +51,21 @@ func validateDomain(domain string) bool {
 	return true
 }
 
+// checkCNAMEConflict enforces that a CNAME cannot coexist with other data
+// for the same name (RFC 1034 section 3.6.2).
+func checkCNAMEConflict(record DNSRecord) string {
+	existing, _ := constants.ContextManager.Lookup(record.Domain)
+	for _, r := range existing {
+		if r.SameData(record.Record) {
+			continue
+		}
+		if record.Type == "CNAME" || r.Type == "CNAME" {
+			return "A CNAME record cannot coexist with other records for " + record.Domain
+		}
+	}
+	return ""
+}
+
 // CORS middleware
 func CORSMiddleware() gin.HandlerFunc {
 	return gin.HandlerFunc(func(c *gin.Context) {
@@ -70,11 +95,13 @@ func GetRecords(c *gin.Context) {
 	// key := fmt.Sprintf("dns-%s:*",)
 	// Get all keys (domain names)
 	var records []DNSRecord
-	for domain, ip := range constants.ContextManager.GetContext() {
-		records = append(records, DNSRecord{
-			Domain: domain,
-			IP:     ip,
-		})
+	for domain, rrs := range constants.ContextManager.GetContext() {
+		for _, rr := range rrs {
+			records = append(records, DNSRecord{
+				Domain: domain,
+				Record: rr,
+			})
+		}
 	}
 
 	c.JSON(http.StatusOK, APIResponse{
@@ -103,10 +130,10 @@ func CreateRecord(c *gin.Context) {
 		return
 	}
 
-	if !validateIP(record.IP) {
+	if err := record.Normalize(); err != nil {
 		c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Message: "Invalid IP address",
+			Message: "Invalid record: " + err.Error(),
 		})
 		return
 	}
@@ -119,8 +146,23 @@ func CreateRecord(c *gin.Context) {
 		return
 	}
 
-	// Set TTL if provided, otherwise no expiration
-	ok := handlers.AddContext(record.Domain, record.IP)
+	if err := handlers.ReadOnly(record.Domain); err != nil {
+		c.JSON(http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if msg := checkCNAMEConflict(record); msg != "" {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: msg,
+		})
+		return
+	}
+
+	ok := handlers.AddContext(record.Domain, record.Record)
 	if !ok {
 		c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
@@ -129,7 +171,7 @@ func CreateRecord(c *gin.Context) {
 		return
 	}
 
-	log.Info().Msgf("Created DNS record: %s -> %s", record.Domain, record.IP)
+	log.Info().Msgf("Created DNS record: %s %s", record.Domain, record.Type)
 	c.JSON(http.StatusCreated, APIResponse{
 		Success: true,
 		Message: "DNS record created successfully",
@@ -137,9 +179,11 @@ func CreateRecord(c *gin.Context) {
 	})
 }
 
-// DELETE /api/records/:domain - Delete a DNS record
+// DELETE /api/records/:domain?type= - Delete the records of a domain,
+// optionally only those of one type
 func DeleteRecord(c *gin.Context) {
 	domain := strings.TrimSpace(c.Param("domain"))
+	rrType := strings.ToUpper(strings.TrimSpace(c.Query("type")))
 
 	if domain == "" {
 		c.JSON(http.StatusBadRequest, APIResponse{
@@ -148,6 +192,13 @@ func DeleteRecord(c *gin.Context) {
 		})
 		return
 	}
+	if rrType != "" && !slices.Contains(manager.RecordTypes, rrType) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid record type " + rrType + ", expected one of " + strings.Join(manager.RecordTypes, ", "),
+		})
+		return
+	}
 	if constants.Redis == nil {
 		c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
@@ -156,22 +207,61 @@ func DeleteRecord(c *gin.Context) {
 		return
 	}
 
-	ok := handlers.RemoveContext(domain)
-	if !ok {
+	if err := handlers.ReadOnly(domain); err != nil {
+		c.JSON(http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	found, err := handlers.RemoveContext(domain, rrType)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
-			Message: "Failed to delete DNS record",
+			Message: "Failed to delete DNS record: " + err.Error(),
+		})
+		return
+	}
+	if !found {
+		message := "No records for " + domain
+		if rrType != "" {
+			message = "No " + rrType + " records for " + domain
+		}
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: message,
 		})
 		return
 	}
 
-	log.Info().Msgf("Deleted DNS record: %s", domain)
+	log.Info().Msgf("Deleted DNS record: %s %s", domain, rrType)
 	c.JSON(http.StatusOK, APIResponse{
 		Success: true,
 		Message: "DNS record deleted successfully",
 	})
 }
 
+// POST /api/records/reload - Read the records from Redis again, after they
+// were changed there without going through the API
+func ReloadRecords(c *gin.Context) {
+	if err := handlers.ReloadRecords(); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Failed to reload DNS records: " + err.Error(),
+		})
+		return
+	}
+
+	records := constants.ContextManager.GetContext()
+	log.Info().Msgf("Reloaded the records of %d names from Redis", len(records))
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "DNS records reloaded",
+		Data:    gin.H{"names": len(records)},
+	})
+}
+
 // Health check endpoint
 func HealthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, APIResponse{
@@ -180,6 +270,19 @@ func HealthCheck(c *gin.Context) {
 	})
 }
 
+// GET /api/metrics - Listener metrics
+func GetMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: gin.H{
+			"dot":        constants.DoTMetrics.Snapshot(),
+			"upstreams":  constants.Upstreams.Status(),
+			"forwarders": constants.Forwarders.Status(),
+			"cache":      cacheStats(),
+		},
+	})
+}
+
 // StartAPIServer starts the Gin HTTP API server
 func StartAPIServer(port string) {
 	// Set Gin to release mode for production
@@ -0,0 +1,79 @@
+package apiHandler
+
+import (
+	"dns-server/internal/cache"
+	"dns-server/internal/constants"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+func cacheStats() *cache.Stats {
+	if constants.Cache == nil {
+		return nil
+	}
+	stats := constants.Cache.Stats()
+	return &stats
+}
+
+// GET /api/cache?top=20 - Cache counters and the most served entries
+func GetCache(c *gin.Context) {
+	if constants.Cache == nil {
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: "Cache is disabled",
+		})
+		return
+	}
+
+	top, err := strconv.Atoi(c.DefaultQuery("top", "20"))
+	if err != nil || top < 0 {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid top parameter",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: gin.H{
+			"stats":   constants.Cache.Stats(),
+			"popular": constants.Cache.Popular(top),
+		},
+	})
+}
+
+// POST /api/cache/flush?name= - Flush the response cache, or only the
+// entries of one name
+func FlushCache(c *gin.Context) {
+	if constants.Cache == nil {
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: "Cache is disabled",
+		})
+		return
+	}
+
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		constants.Cache.Flush()
+		log.Info().Msg("Flushed DNS cache")
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: "Cache flushed",
+		})
+		return
+	}
+
+	n := constants.Cache.FlushName(name)
+	log.Info().Msgf("Flushed %d cache entries for %s", n, name)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Cache flushed for " + name,
+		Data:    gin.H{"removed": n},
+	})
+}
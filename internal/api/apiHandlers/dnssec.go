@@ -0,0 +1,223 @@
+package apiHandler
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/dnssec"
+	"dns-server/internal/handlers"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// DNSSECInfo describes how a zone is signed, without its private keys.
+type DNSSECInfo struct {
+	Zone string `json:"zone"`
+	dnssec.Settings
+	Keys    []DNSSECKeyInfo `json:"keys"`
+	DS      []DSInfo        `json:"ds"`
+	Created time.Time       `json:"created"`
+}
+
+// DNSSECKeyInfo describes a signing key of a zone.
+type DNSSECKeyInfo struct {
+	// Role is "ksk" for the key signing key and "zsk" for the zone
+	// signing key.
+	Role      string `json:"role"`
+	KeyTag    uint16 `json:"key_tag"`
+	Algorithm string `json:"algorithm"`
+	// DNSKEY is the record published at the apex.
+	DNSKEY string `json:"dnskey"`
+}
+
+// DSInfo is a DS record to publish in the parent zone.
+type DSInfo struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest"`
+	// Record is the whole record in zone file format.
+	Record string `json:"record"`
+}
+
+// GET /api/zones/:zone/dnssec - Show the keys and settings a zone is
+// signed with
+func GetDNSSEC(c *gin.Context) {
+	sz, ok := signedZone(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    dnssecInfo(sz),
+	})
+}
+
+// POST /api/zones/:zone/dnssec - Sign a zone, generating its keys, or
+// change whether it uses NSEC or NSEC3. Changing the algorithm replaces
+// the keys, and the DS record in the parent with them.
+func SignZone(c *gin.Context) {
+	var settings dnssec.Settings
+	if err := c.ShouldBindJSON(&settings); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid JSON format: " + err.Error(),
+		})
+		return
+	}
+
+	zone, ok := constants.Zones.Get(c.Param("zone"))
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Zone not found",
+		})
+		return
+	}
+	if zone.Secondary() {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "Zone " + zone.Name + " is a secondary and is signed by its primaries",
+		})
+		return
+	}
+
+	if constants.Redis == nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Redis connection not available",
+		})
+		return
+	}
+
+	sz, existed, err := handlers.SignZone(zone.Name, settings)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Failed to sign zone: " + err.Error(),
+		})
+		return
+	}
+
+	status, action := http.StatusCreated, "signed"
+	if existed {
+		status, action = http.StatusOK, "updated"
+	}
+	log.Info().Msgf("Zone %s %s with %s, KSK %d, ZSK %d", sz.Name, action, sz.Algorithm, sz.KSK.Tag(), sz.ZSK.Tag())
+	c.JSON(status, APIResponse{
+		Success: true,
+		Message: "Zone " + action + " successfully",
+		Data:    dnssecInfo(sz),
+	})
+}
+
+// DELETE /api/zones/:zone/dnssec - Stop signing a zone and delete its keys
+func UnsignZone(c *gin.Context) {
+	zone, ok := constants.Zones.Get(c.Param("zone"))
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Zone not found",
+		})
+		return
+	}
+
+	found, err := handlers.UnsignZone(zone.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Failed to unsign zone: " + err.Error(),
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Zone " + zone.Name + " is not signed",
+		})
+		return
+	}
+
+	log.Info().Msgf("Stopped signing zone %s", zone.Name)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Zone unsigned successfully",
+	})
+}
+
+// GET /api/zones/:zone/ds - Get the DS record to add to the parent zone
+func GetDS(c *gin.Context) {
+	sz, ok := signedZone(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    dsInfo(sz),
+	})
+}
+
+// signedZone returns the keys of the zone named in the request, answering
+// with an error when it is not signed.
+func signedZone(c *gin.Context) (*dnssec.Zone, bool) {
+	zone, ok := constants.Zones.Get(c.Param("zone"))
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Zone not found",
+		})
+		return nil, false
+	}
+	sz, ok := constants.DNSSEC.Get(zone.Name)
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Zone " + zone.Name + " is not signed",
+		})
+		return nil, false
+	}
+	return sz, true
+}
+
+func dnssecInfo(sz *dnssec.Zone) DNSSECInfo {
+	zone, _ := constants.Zones.Get(sz.Name)
+	info := DNSSECInfo{Zone: sz.Name, Settings: sz.Settings, DS: dsInfo(sz), Created: sz.Created}
+	keys := []struct {
+		role string
+		key  *dnssec.Key
+	}{{"ksk", sz.KSK}, {"zsk", sz.ZSK}}
+	for _, k := range keys {
+		info.Keys = append(info.Keys, DNSSECKeyInfo{
+			Role:      k.role,
+			KeyTag:    k.key.Tag(),
+			Algorithm: dnssec.AlgorithmName(k.key.Algorithm),
+			DNSKEY:    dnsmsg.NewRR(sz.Name, zone.TTL, k.key.DNSKEY()).String(),
+		})
+	}
+	return info
+}
+
+func dsInfo(sz *dnssec.Zone) []DSInfo {
+	zone, _ := constants.Zones.Get(sz.Name)
+	rr, err := sz.DS(zone.TTL)
+	if err != nil {
+		log.Error().Msgf("Error computing DS record of zone %s -> %v", sz.Name, err)
+		return []DSInfo{}
+	}
+	ds := rr.Data.(*dnsmsg.DS)
+	return []DSInfo{{
+		KeyTag:     ds.KeyTag,
+		Algorithm:  ds.Algorithm,
+		DigestType: ds.DigestType,
+		Digest:     strings.ToUpper(hex.EncodeToString(ds.Digest)),
+		Record:     rr.String(),
+	}}
+}
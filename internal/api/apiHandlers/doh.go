@@ -0,0 +1,66 @@
+package apiHandler
+
+import (
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/handlers"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// GET /dns-query?dns= and POST /dns-query - DNS over HTTPS (RFC 8484)
+func DNSQuery(c *gin.Context) {
+	var req []byte
+	switch c.Request.Method {
+	case http.MethodGet:
+		param := c.Query("dns")
+		if param == "" {
+			c.String(http.StatusBadRequest, "missing dns parameter")
+			return
+		}
+		var err error
+		req, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid dns parameter: %v", err)
+			return
+		}
+	case http.MethodPost:
+		if ct := c.ContentType(); ct != dnsMessageType {
+			c.String(http.StatusUnsupportedMediaType, "unsupported content type %q", ct)
+			return
+		}
+		var err error
+		req, err = io.ReadAll(io.LimitReader(c.Request.Body, 0xFFFF+1))
+		if err != nil {
+			c.String(http.StatusBadRequest, "error reading body: %v", err)
+			return
+		}
+		if len(req) > 0xFFFF {
+			c.String(http.StatusRequestEntityTooLarge, "DNS message too large")
+			return
+		}
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP(c.ClientIP())}
+	res := handlers.HandleDNSMessage(c.Request.Context(), req, addr, "https")
+	if res == nil {
+		c.String(http.StatusBadRequest, "invalid DNS message")
+		return
+	}
+
+	if resp, err := dnsmsg.Parse(res); err != nil {
+		log.Error().Msgf("Error parsing DoH response for %s: %v", addr, err)
+	} else if ttl, ok := resp.MinTTL(); ok {
+		c.Header("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+
+	c.Data(http.StatusOK, dnsMessageType, res)
+}
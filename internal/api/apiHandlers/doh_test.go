@@ -0,0 +1,188 @@
+package apiHandler
+
+import (
+	"bytes"
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resolverFunc is an upstream answering with a function.
+type resolverFunc func(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error)
+
+func (f resolverFunc) Exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	return f(ctx, req)
+}
+
+// resolveFixture serves the zone example.com, whose negative answers may be
+// cached for 30 seconds, and answers A queries for other names upstream
+// with 198.51.100.1 and a TTL of 120.
+func resolveFixture(t *testing.T) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	zones, records, redis := constants.Zones, constants.ContextManager, constants.Redis
+	resolver, cache := constants.Resolver, constants.Cache
+	t.Cleanup(func() {
+		constants.Zones, constants.ContextManager, constants.Redis = zones, records, redis
+		constants.Resolver, constants.Cache = resolver, cache
+	})
+
+	z := manager.Zone{Name: "example.com", NS: []string{"ns1.example.com"}, TTL: 3600, Minimum: 30}
+	if err := z.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	constants.Zones = manager.NewZoneManager()
+	constants.Zones.Set(z)
+	constants.ContextManager = manager.NewContextManager()
+	constants.ContextManager.AddRP("www.example.com", []manager.Record{{Type: "A", TTL: 300, IP: "192.0.2.1"}})
+	constants.ContextManager.AddRP("mixed.example.com", []manager.Record{
+		{Type: "A", TTL: 300, IP: "192.0.2.2"},
+		{Type: "A", TTL: 60, IP: "192.0.2.3"},
+	})
+	constants.ContextManager.AddRP("txt.example.com", []manager.Record{{Type: "TXT", TTL: 300, Text: manager.Text{"v=spf1 -all", `a "quoted" string`}}})
+	// Queries are answered from the records in memory, so the store only
+	// needs to be there.
+	constants.Redis = &manager.Redis{}
+	constants.Cache = nil
+	constants.Resolver = resolverFunc(func(_ context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+		resp := req.Reply()
+		resp.Header.RecursionAvailable = true
+		if q := req.Questions[0]; q.Type == dnsmsg.TypeA {
+			resp.Answers = []dnsmsg.ResourceRecord{dnsmsg.NewRR(q.Name, 120, &dnsmsg.A{IP: net.IPv4(198, 51, 100, 1)})}
+		}
+		return resp, nil
+	})
+}
+
+func wireQuery(t *testing.T, id uint16, name string, qtype dnsmsg.Type) []byte {
+	t.Helper()
+	m := &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: name, Type: qtype, Class: dnsmsg.ClassINET}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func dohRouter() *gin.Engine {
+	r := gin.New()
+	r.GET("/dns-query", DNSQuery)
+	r.POST("/dns-query", DNSQuery)
+	return r
+}
+
+func TestDNSQueryRequests(t *testing.T) {
+	resolveFixture(t)
+	query := wireQuery(t, 0x1234, "www.example.com", dnsmsg.TypeA)
+	response := wireQuery(t, 0x1234, "www.example.com", dnsmsg.TypeA)
+	response[2] |= 0x80
+
+	get := func(param string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/dns-query?dns="+param, nil)
+	}
+	post := func(contentType string, body []byte) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"get", get(base64.RawURLEncoding.EncodeToString(query)), http.StatusOK},
+		// RFC 8484 asks for no padding, but padded parameters are accepted.
+		{"get with padding", get(base64.URLEncoding.EncodeToString(query)), http.StatusOK},
+		{"get without parameter", httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+		{"get with standard base64", get(strings.NewReplacer("-", "+", "_", "/").Replace(base64.RawURLEncoding.EncodeToString(append(query, 0xFB, 0xFF)))), http.StatusBadRequest},
+		{"post", post(dnsMessageType, query), http.StatusOK},
+		{"post with parameters in the content type", post(dnsMessageType+"; charset=binary", query), http.StatusOK},
+		{"post without content type", post("", query), http.StatusUnsupportedMediaType},
+		{"post as json", post("application/json", query), http.StatusUnsupportedMediaType},
+		{"post over 65535 bytes", post(dnsMessageType, make([]byte, 0x10000)), http.StatusRequestEntityTooLarge},
+		{"post shorter than a header", post(dnsMessageType, query[:5]), http.StatusBadRequest},
+		{"post a response", post(dnsMessageType, response), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			dohRouter().ServeHTTP(w, tt.req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d (%s), want %d", w.Code, w.Body, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != dnsMessageType {
+				t.Errorf("content type %q", ct)
+			}
+			resp, err := dnsmsg.Parse(w.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Header.ID != 0x1234 || resp.Header.RCode != dnsmsg.RCodeSuccess || len(resp.Answers) != 1 {
+				t.Errorf("response %v", resp)
+			}
+		})
+	}
+}
+
+func TestDNSQueryCacheControl(t *testing.T) {
+	resolveFixture(t)
+	malformed := wireQuery(t, 1, "www.example.com", dnsmsg.TypeA)
+	malformed = malformed[:len(malformed)-2]
+
+	tests := []struct {
+		name  string
+		query []byte
+		rcode dnsmsg.RCode
+		// want is the expected Cache-Control header, empty for none.
+		want string
+	}{
+		{"answer", wireQuery(t, 1, "www.example.com", dnsmsg.TypeA), dnsmsg.RCodeSuccess, "max-age=300"},
+		{"lowest ttl of the answers", wireQuery(t, 1, "mixed.example.com", dnsmsg.TypeA), dnsmsg.RCodeSuccess, "max-age=60"},
+		{"forwarded", wireQuery(t, 1, "www.example.net", dnsmsg.TypeA), dnsmsg.RCodeSuccess, "max-age=120"},
+		// Negative answers are cached for the SOA minimum.
+		{"nodata", wireQuery(t, 1, "www.example.com", dnsmsg.TypeAAAA), dnsmsg.RCodeSuccess, "max-age=30"},
+		{"nxdomain", wireQuery(t, 1, "missing.example.com", dnsmsg.TypeA), dnsmsg.RCodeNameError, "max-age=30"},
+		{"no answer and no soa", wireQuery(t, 1, "www.example.net", dnsmsg.TypeAAAA), dnsmsg.RCodeSuccess, ""},
+		{"format error", malformed, dnsmsg.RCodeFormatError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(tt.query))
+			req.Header.Set("Content-Type", dnsMessageType)
+			w := httptest.NewRecorder()
+			dohRouter().ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d (%s)", w.Code, w.Body)
+			}
+			resp, err := dnsmsg.Parse(w.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Header.RCode != tt.rcode {
+				t.Errorf("got %s, want %s", resp.Header.RCode, tt.rcode)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package apiHandler
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/handlers"
+	"dns-server/internal/manager"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// GET /api/forwarders - List the conditional forwarding rules
+func GetForwarders(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    constants.Forwarders.List(),
+	})
+}
+
+// POST /api/forwarders - Create or replace the forwarding rule for a suffix
+func CreateForwarder(c *gin.Context) {
+	var forwarder manager.Forwarder
+	if err := c.ShouldBindJSON(&forwarder); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid JSON format: " + err.Error(),
+		})
+		return
+	}
+
+	if err := forwarder.Normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid forwarder: " + err.Error(),
+		})
+		return
+	}
+
+	if constants.Redis == nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Redis connection not available",
+		})
+		return
+	}
+
+	if err := handlers.AddForwarder(forwarder); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Failed to create forwarder: " + err.Error(),
+		})
+		return
+	}
+
+	log.Info().Msgf("Created forwarder for %s -> %s", forwarder.Suffix, strings.Join(forwarder.Servers, ", "))
+	c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Message: "Forwarder created successfully",
+		Data:    forwarder,
+	})
+}
+
+// DELETE /api/forwarders/:suffix - Delete the forwarding rule for a suffix
+func DeleteForwarder(c *gin.Context) {
+	suffix := strings.TrimSpace(c.Param("suffix"))
+	if suffix == "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Domain suffix is required",
+		})
+		return
+	}
+
+	found, err := handlers.RemoveForwarder(suffix)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Failed to delete forwarder: " + err.Error(),
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "No forwarder for " + suffix,
+		})
+		return
+	}
+
+	log.Info().Msgf("Deleted forwarder for %s", suffix)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Forwarder deleted successfully",
+	})
+}
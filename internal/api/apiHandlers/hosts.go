@@ -0,0 +1,17 @@
+package apiHandler
+
+import (
+	"dns-server/internal/constants"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/hosts - List the hosts files served as records and when they
+// were last loaded
+func GetHosts(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    constants.Hosts.Status(),
+	})
+}
@@ -0,0 +1,123 @@
+package apiHandler
+
+import (
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/handlers"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JSONQuestion and JSONRecord follow the application/dns-json format used
+// by dns.google and Cloudflare.
+type JSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type JSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type JSONResponse struct {
+	Status    uint16         `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []JSONQuestion `json:"Question"`
+	Answer    []JSONRecord   `json:"Answer,omitempty"`
+	Authority []JSONRecord   `json:"Authority,omitempty"`
+	Comment   string         `json:"Comment,omitempty"`
+}
+
+// GET /api/resolve?name=&type= - Resolve a name and return the answer as JSON
+func ResolveName(c *gin.Context) {
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" || (name != "." && !validateDomain(strings.TrimSuffix(name, "."))) {
+		c.JSON(http.StatusBadRequest, JSONResponse{
+			Status:  uint16(dnsmsg.RCodeFormatError),
+			Comment: "Invalid name",
+		})
+		return
+	}
+
+	qtype, ok := parseQueryType(c.DefaultQuery("type", "A"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, JSONResponse{
+			Status:  uint16(dnsmsg.RCodeFormatError),
+			Comment: "Invalid type",
+		})
+		return
+	}
+
+	query := &dnsmsg.Message{
+		Header: dnsmsg.Header{
+			ID:               uint16(rand.Uint32()),
+			RecursionDesired: true,
+			CheckingDisabled: queryFlag(c, "cd"),
+		},
+		Questions: []dnsmsg.Question{{Name: dnsmsg.CanonicalName(name), Type: qtype, Class: dnsmsg.ClassINET}},
+	}
+	query.SetEDNS(&dnsmsg.EDNS{UDPSize: 0xFFFF, DO: queryFlag(c, "do")})
+
+	addr := &net.TCPAddr{IP: net.ParseIP(c.ClientIP())}
+	resp := handlers.Resolve(c.Request.Context(), query, addr)
+
+	out := JSONResponse{
+		Status:    uint16(resp.Header.RCode),
+		TC:        resp.Header.Truncated,
+		RD:        resp.Header.RecursionDesired,
+		RA:        resp.Header.RecursionAvailable,
+		AD:        resp.Header.AuthenticData,
+		CD:        resp.Header.CheckingDisabled,
+		Answer:    jsonRecords(resp.Answers),
+		Authority: jsonRecords(resp.Authority),
+	}
+	for _, q := range resp.Questions {
+		out.Question = append(out.Question, JSONQuestion{Name: dnsmsg.Fqdn(q.Name), Type: uint16(q.Type)})
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// parseQueryType accepts a mnemonic such as "AAAA" or a numeric type.
+func parseQueryType(s string) (dnsmsg.Type, bool) {
+	if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return dnsmsg.Type(n), true
+	}
+	return dnsmsg.ParseType(strings.ToUpper(s))
+}
+
+func queryFlag(c *gin.Context, key string) bool {
+	v := strings.ToLower(c.Query(key))
+	return v == "1" || v == "true"
+}
+
+func jsonRecords(rrs []dnsmsg.ResourceRecord) []JSONRecord {
+	var out []JSONRecord
+	for _, rr := range rrs {
+		if rr.Type == dnsmsg.TypeOPT {
+			continue
+		}
+		data := ""
+		if rr.Data != nil {
+			data = rr.Data.String()
+		}
+		out = append(out, JSONRecord{
+			Name: dnsmsg.Fqdn(rr.Name),
+			Type: uint16(rr.Type),
+			TTL:  rr.TTL,
+			Data: data,
+		})
+	}
+	return out
+}
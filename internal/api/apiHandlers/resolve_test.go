@@ -0,0 +1,106 @@
+package apiHandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResolveName(t *testing.T) {
+	resolveFixture(t)
+	r := gin.New()
+	r.GET("/api/resolve", ResolveName)
+
+	soa := JSONRecord{Name: "example.com.", Type: 6, TTL: 30, Data: "ns.example.com. hostmaster.example.com. 1 3600 600 86400 30"}
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   JSONResponse
+	}{
+		{"a record", "name=www.example.com", http.StatusOK, JSONResponse{
+			RD: true, RA: true,
+			Question: []JSONQuestion{{Name: "www.example.com.", Type: 1}},
+			Answer:   []JSONRecord{{Name: "www.example.com.", Type: 1, TTL: 300, Data: "192.0.2.1"}},
+		}},
+		{"trailing dot and upper case", "name=WWW.Example.COM.&type=a", http.StatusOK, JSONResponse{
+			RD: true, RA: true,
+			Question: []JSONQuestion{{Name: "www.example.com.", Type: 1}},
+			Answer:   []JSONRecord{{Name: "www.example.com.", Type: 1, TTL: 300, Data: "192.0.2.1"}},
+		}},
+		{"txt strings", "name=txt.example.com&type=TXT", http.StatusOK, JSONResponse{
+			RD: true, RA: true,
+			Question: []JSONQuestion{{Name: "txt.example.com.", Type: 16}},
+			Answer:   []JSONRecord{{Name: "txt.example.com.", Type: 16, TTL: 300, Data: `"v=spf1 -all" "a \"quoted\" string"`}},
+		}},
+		{"numeric type", "name=www.example.com&type=28", http.StatusOK, JSONResponse{
+			RD: true, RA: true,
+			Question:  []JSONQuestion{{Name: "www.example.com.", Type: 28}},
+			Authority: []JSONRecord{soa},
+		}},
+		{"nxdomain", "name=missing.example.com", http.StatusOK, JSONResponse{
+			Status: 3, RD: true, RA: true,
+			Question:  []JSONQuestion{{Name: "missing.example.com.", Type: 1}},
+			Authority: []JSONRecord{soa},
+		}},
+		{"forwarded with cd", "name=www.example.net&cd=1", http.StatusOK, JSONResponse{
+			RD: true, RA: true, CD: true,
+			Question: []JSONQuestion{{Name: "www.example.net.", Type: 1}},
+			Answer:   []JSONRecord{{Name: "www.example.net.", Type: 1, TTL: 120, Data: "198.51.100.1"}},
+		}},
+		{"missing name", "type=A", http.StatusBadRequest, JSONResponse{Status: 1, Comment: "Invalid name"}},
+		{"empty label", "name=www..example.com", http.StatusBadRequest, JSONResponse{Status: 1, Comment: "Invalid name"}},
+		{"unknown type", "name=www.example.com&type=BOGUS", http.StatusBadRequest, JSONResponse{Status: 1, Comment: "Invalid type"}},
+		{"type out of range", "name=www.example.com&type=65536", http.StatusBadRequest, JSONResponse{Status: 1, Comment: "Invalid type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/resolve?"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d (%s), want %d", w.Code, w.Body, tt.status)
+			}
+			var got JSONResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestResolveNameFields checks the field names clients of dns.google and
+// Cloudflare expect.
+func TestResolveNameFields(t *testing.T) {
+	resolveFixture(t)
+	r := gin.New()
+	r.GET("/api/resolve", ResolveName)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/resolve?name=www.example.com", nil))
+
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"Status", "TC", "RD", "RA", "AD", "CD", "Question", "Answer"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("no %s field in %s", key, w.Body)
+		}
+	}
+	// Empty sections are left out.
+	if _, ok := got["Authority"]; ok {
+		t.Errorf("empty Authority field in %s", w.Body)
+	}
+	answer := got["Answer"].([]any)[0].(map[string]any)
+	for _, key := range []string{"name", "type", "TTL", "data"} {
+		if _, ok := answer[key]; !ok {
+			t.Errorf("no %s field in the answer %v", key, answer)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package apiHandler
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/handlers"
+	"dns-server/internal/tsig"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// TSIGKeyInfo describes a TSIG key without its secret.
+type TSIGKeyInfo struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	// Source is "config" for keys of the configuration file, which cannot
+	// be changed through the API, and "api" otherwise.
+	Source string `json:"source"`
+}
+
+// GET /api/tsig - List the TSIG keys, without their secrets
+func GetTSIGKeys(c *gin.Context) {
+	keys := constants.TSIGKeys.List()
+	infos := make([]TSIGKeyInfo, 0, len(keys))
+	for _, k := range keys {
+		infos = append(infos, keyInfo(k))
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    infos,
+	})
+}
+
+// GET /api/tsig/:name - Get a single TSIG key, without its secret
+func GetTSIGKey(c *gin.Context) {
+	key, ok := constants.TSIGKeys.Get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "TSIG key not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    keyInfo(key),
+	})
+}
+
+func keyInfo(k tsig.Key) TSIGKeyInfo {
+	source := "api"
+	if handlers.ConfigKey(k.Name) {
+		source = "config"
+	}
+	return TSIGKeyInfo{Name: k.Name, Algorithm: k.Algorithm, Source: source}
+}
+
+// POST /api/tsig - Create a TSIG key. A secret is generated when none is
+// given; the response is the only time it is returned.
+func CreateTSIGKey(c *gin.Context) {
+	var key tsig.Key
+	if err := c.ShouldBindJSON(&key); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid JSON format: " + err.Error(),
+		})
+		return
+	}
+
+	if _, exists := constants.TSIGKeys.Get(key.Name); exists {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "TSIG key " + key.Name + " already exists",
+		})
+		return
+	}
+
+	storeTSIGKey(c, key, http.StatusCreated, "created")
+}
+
+// PUT /api/tsig/:name - Replace the secret or algorithm of a TSIG key,
+// e.g. to rotate it. A new secret is generated when none is given, and the
+// algorithm is kept when none is given.
+func UpdateTSIGKey(c *gin.Context) {
+	var key tsig.Key
+	if err := c.ShouldBindJSON(&key); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid JSON format: " + err.Error(),
+		})
+		return
+	}
+
+	old, ok := constants.TSIGKeys.Get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "TSIG key not found",
+		})
+		return
+	}
+	key.Name = old.Name
+	if key.Algorithm == "" {
+		key.Algorithm = old.Algorithm
+	}
+
+	storeTSIGKey(c, key, http.StatusOK, "updated")
+}
+
+// storeTSIGKey stores key and answers with it, secret included.
+func storeTSIGKey(c *gin.Context, key tsig.Key, status int, action string) {
+	if handlers.ConfigKey(key.Name) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "Key " + key.Name + " is defined in the configuration file",
+		})
+		return
+	}
+
+	if constants.Redis == nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Redis connection not available",
+		})
+		return
+	}
+
+	key, err := handlers.AddTSIGKey(key)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Failed to store TSIG key: " + err.Error(),
+		})
+		return
+	}
+
+	log.Info().Msgf("TSIG key %s (%s) %s", key.Name, key.Algorithm, action)
+	c.JSON(status, APIResponse{
+		Success: true,
+		Message: "TSIG key " + action + " successfully",
+		Data:    key,
+	})
+}
+
+// DELETE /api/tsig/:name - Delete a TSIG key
+func DeleteTSIGKey(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("name"))
+	if name == "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Key name is required",
+		})
+		return
+	}
+
+	if handlers.ConfigKey(name) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "Key " + name + " is defined in the configuration file",
+		})
+		return
+	}
+
+	found, err := handlers.RemoveTSIGKey(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Failed to delete TSIG key: " + err.Error(),
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "No TSIG key " + name,
+		})
+		return
+	}
+
+	log.Info().Msgf("Deleted TSIG key %s", name)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "TSIG key deleted successfully",
+	})
+}
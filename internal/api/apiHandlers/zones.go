@@ -0,0 +1,198 @@
+package apiHandler
+
+import (
+	"bytes"
+	"dns-server/internal/constants"
+	"dns-server/internal/handlers"
+	"dns-server/internal/manager"
+	"dns-server/internal/zonefile"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// GET /api/zones - List the zones the server is authoritative for
+func GetZones(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    constants.Zones.List(),
+	})
+}
+
+// GET /api/zones/:zone - Get a single zone
+func GetZone(c *gin.Context) {
+	zone, ok := constants.Zones.Get(c.Param("zone"))
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Zone not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    zone,
+	})
+}
+
+// POST /api/zones - Create a zone, or update the SOA parameters of an
+// existing one
+func CreateZone(c *gin.Context) {
+	var zone manager.Zone
+	if err := c.ShouldBindJSON(&zone); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid JSON format: " + err.Error(),
+		})
+		return
+	}
+
+	if err := zone.Normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid zone: " + err.Error(),
+		})
+		return
+	}
+
+	if constants.Redis == nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Redis connection not available",
+		})
+		return
+	}
+
+	zone, err := handlers.AddZone(zone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Failed to create zone: " + err.Error(),
+		})
+		return
+	}
+
+	log.Info().Msgf("Created zone %s with serial %d", zone.Name, zone.Serial)
+	c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Message: "Zone created successfully",
+		Data:    zone,
+	})
+}
+
+// DELETE /api/zones/:zone - Delete a zone; its records are kept
+func DeleteZone(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("zone"))
+
+	found, err := handlers.RemoveZone(name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Failed to delete zone: " + err.Error(),
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Zone not found",
+		})
+		return
+	}
+
+	log.Info().Msgf("Deleted zone %s", name)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Zone deleted successfully",
+	})
+}
+
+// maxZoneFileSize bounds the zone files accepted by ImportZone.
+const maxZoneFileSize = 32 << 20
+
+// POST /api/zones/:zone/import - Import a zone file sent as the request
+// body; ?replace=true also deletes the names missing from the file
+func ImportZone(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("zone"))
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxZoneFileSize)
+	file, err := zonefile.Parse(body, name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid zone file: " + err.Error(),
+		})
+		return
+	}
+
+	if constants.Redis == nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Redis connection not available",
+		})
+		return
+	}
+
+	replace := c.Query("replace") == "true" || c.Query("replace") == "1"
+	zone, count, err := handlers.ImportZone(name, file, replace)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Failed to import zone: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Imported %d records", count),
+		Data:    zone,
+	})
+}
+
+// GET /api/zones/:zone/export - Download a zone and its records as a zone
+// file
+func ExportZone(c *gin.Context) {
+	zone, ok := constants.Zones.Get(c.Param("zone"))
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Zone not found",
+		})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := handlers.ExportZone(&buf, zone.Name); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Failed to export zone: " + err.Error(),
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", zone.Name+".zone"))
+	c.Data(http.StatusOK, "text/dns; charset=utf-8", buf.Bytes())
+}
+
+// GET /api/secondaries - Show how the secondary zones keep up with their
+// primaries
+func GetSecondaries(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    constants.Secondaries.Status(),
+	})
+}
+
+// GET /api/notify - Show the last NOTIFY sent to every secondary for every
+// zone
+func GetNotifyStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    constants.Notifier.Status(),
+	})
+}
@@ -7,12 +7,41 @@ import (
 )
 
 func HandleFuncs(r *gin.Engine) {
+	r.GET("/dns-query", apiHandler.DNSQuery)
+	r.POST("/dns-query", apiHandler.DNSQuery)
+
 	api := r.Group("/api")
 	{
 		api.GET("/records", apiHandler.GetRecords)
 		api.POST("/records", apiHandler.CreateRecord)
 		api.DELETE("/records/:domain", apiHandler.DeleteRecord)
+		api.POST("/records/reload", apiHandler.ReloadRecords)
+		api.GET("/zones", apiHandler.GetZones)
+		api.POST("/zones", apiHandler.CreateZone)
+		api.GET("/zones/:zone", apiHandler.GetZone)
+		api.DELETE("/zones/:zone", apiHandler.DeleteZone)
+		api.POST("/zones/:zone/import", apiHandler.ImportZone)
+		api.GET("/zones/:zone/export", apiHandler.ExportZone)
+		api.GET("/zones/:zone/dnssec", apiHandler.GetDNSSEC)
+		api.POST("/zones/:zone/dnssec", apiHandler.SignZone)
+		api.DELETE("/zones/:zone/dnssec", apiHandler.UnsignZone)
+		api.GET("/zones/:zone/ds", apiHandler.GetDS)
+		api.GET("/secondaries", apiHandler.GetSecondaries)
+		api.GET("/notify", apiHandler.GetNotifyStatus)
+		api.GET("/tsig", apiHandler.GetTSIGKeys)
+		api.POST("/tsig", apiHandler.CreateTSIGKey)
+		api.GET("/tsig/:name", apiHandler.GetTSIGKey)
+		api.PUT("/tsig/:name", apiHandler.UpdateTSIGKey)
+		api.DELETE("/tsig/:name", apiHandler.DeleteTSIGKey)
+		api.GET("/forwarders", apiHandler.GetForwarders)
+		api.POST("/forwarders", apiHandler.CreateForwarder)
+		api.DELETE("/forwarders/:suffix", apiHandler.DeleteForwarder)
+		api.GET("/hosts", apiHandler.GetHosts)
+		api.GET("/cache", apiHandler.GetCache)
+		api.POST("/cache/flush", apiHandler.FlushCache)
+		api.GET("/resolve", apiHandler.ResolveName)
 		api.GET("/health", apiHandler.HealthCheck)
+		api.GET("/metrics", apiHandler.GetMetrics)
 	}
 
 }
@@ -0,0 +1,471 @@
+// Package cache stores upstream DNS responses for reuse until their TTL
+// runs out.
+package cache
+
+import (
+	"cmp"
+	"container/list"
+	"dns-server/internal/dnsmsg"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Key identifies a cached response. The DO bit is part of the key because
+// responses to DNSSEC-aware clients carry extra records.
+type Key struct {
+	Name  string
+	Type  dnsmsg.Type
+	Class dnsmsg.Class
+	DO    bool
+}
+
+// NewKey builds the cache key for question q asked with the given DO bit.
+func NewKey(q dnsmsg.Question, do bool) Key {
+	return Key{Name: dnsmsg.CanonicalName(q.Name), Type: q.Type, Class: q.Class, DO: do}
+}
+
+type entry struct {
+	key     Key
+	msg     *dnsmsg.Message
+	stored  time.Time
+	expires time.Time
+	// hits counts how often the entry was served, across refreshes.
+	hits        int64
+	prefetching bool
+}
+
+// PrefetchFunc refreshes the response cached for key, normally by
+// resolving it again and calling Set.
+type PrefetchFunc func(key Key)
+
+// Cache is a size-bounded store of responses that evicts the least
+// recently used entry when full.
+type Cache struct {
+	maxEntries     int
+	maxTTL         time.Duration
+	maxNegativeTTL time.Duration
+	// maxStale is how long expired entries are kept to be served when
+	// upstreams fail (RFC 8767). Zero disables serving stale data.
+	maxStale time.Duration
+	staleTTL uint32
+
+	prefetch        PrefetchFunc
+	prefetchMinHits int64
+
+	mu      sync.Mutex
+	entries map[Key]*list.Element
+	lru     *list.List
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	prefetches atomic.Int64
+	stale      atomic.Int64
+}
+
+// Stats is a snapshot of the cache counters.
+type Stats struct {
+	Entries    int   `json:"entries"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Prefetches int64 `json:"prefetches"`
+	Stale      int64 `json:"stale_served"`
+}
+
+// EntryInfo describes a cached response and how often it was served.
+type EntryInfo struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	DO    bool   `json:"do,omitempty"`
+	Hits  int64  `json:"hits"`
+	TTL   int64  `json:"ttl"`
+	Stale bool   `json:"stale,omitempty"`
+}
+
+type Option func(*Cache)
+
+func New(options ...Option) *Cache {
+	c := &Cache{
+		maxEntries:     10000,
+		maxTTL:         24 * time.Hour,
+		maxNegativeTTL: time.Hour,
+		staleTTL:       30,
+		entries:        make(map[Key]*list.Element),
+		lru:            list.New(),
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c
+}
+
+func WithMaxEntries(n int) Option {
+	return func(c *Cache) {
+		c.maxEntries = n
+	}
+}
+
+// WithMaxTTL caps how long a positive response is kept, whatever its TTL.
+func WithMaxTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.maxTTL = ttl
+	}
+}
+
+// WithMaxNegativeTTL caps how long NXDOMAIN and NODATA responses are kept
+// (RFC 2308 section 5).
+func WithMaxNegativeTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.maxNegativeTTL = ttl
+	}
+}
+
+// WithServeStale keeps expired entries for up to maxStale so they can be
+// served with staleTTL when no upstream answers (RFC 8767).
+func WithServeStale(maxStale, staleTTL time.Duration) Option {
+	return func(c *Cache) {
+		c.maxStale = maxStale
+		c.staleTTL = uint32(staleTTL / time.Second)
+	}
+}
+
+// WithPrefetch makes the cache call fn for entries that were served at
+// least minHits times once less than a tenth of their TTL is left, so that
+// popular names are refreshed before they expire.
+func WithPrefetch(minHits int, fn PrefetchFunc) Option {
+	return func(c *Cache) {
+		c.prefetchMinHits = int64(minHits)
+		c.prefetch = fn
+	}
+}
+
+// Get returns a copy of the response cached for key with its TTLs reduced
+// by the time spent in the cache. Expired entries are not returned.
+func (c *Cache) Get(key Key) (*dnsmsg.Message, bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok && !now.Before(el.Value.(*entry).expires) {
+		if now.After(el.Value.(*entry).expires.Add(c.maxStale)) {
+			c.remove(el)
+		}
+		ok = false
+	}
+	if !ok {
+		c.mu.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	e := el.Value.(*entry)
+	e.hits++
+	prefetch := c.shouldPrefetch(e, now)
+	c.mu.Unlock()
+
+	c.hits.Add(1)
+	if prefetch {
+		c.prefetches.Add(1)
+		go func() {
+			c.prefetch(key)
+			c.mu.Lock()
+			e.prefetching = false
+			c.mu.Unlock()
+		}()
+	}
+	return decay(e.msg, uint32(now.Sub(e.stored)/time.Second)), true
+}
+
+// shouldPrefetch reports whether e is popular and close enough to expiry
+// to be refreshed, and claims the refresh so it starts only once. It must
+// be called with c.mu held.
+func (c *Cache) shouldPrefetch(e *entry, now time.Time) bool {
+	if c.prefetch == nil || e.prefetching || e.hits < c.prefetchMinHits {
+		return false
+	}
+	lifetime := e.expires.Sub(e.stored)
+	if e.expires.Sub(now) > lifetime/10 {
+		return false
+	}
+	e.prefetching = true
+	return true
+}
+
+// GetStale returns the expired response cached for key, as long as it
+// expired less than the max-stale age ago, with every TTL set to the
+// stale TTL. It is meant for when the response cannot be refreshed.
+func (c *Cache) GetStale(key Key) (*dnsmsg.Message, bool) {
+	if c.maxStale <= 0 {
+		return nil, false
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok || now.After(el.Value.(*entry).expires.Add(c.maxStale)) {
+		c.mu.Unlock()
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	e.hits++
+	c.mu.Unlock()
+
+	c.stale.Add(1)
+	return withTTL(e.msg, c.staleTTL), true
+}
+
+// Set caches msg under key for as long as its TTLs allow. Responses that
+// must not be reused, such as errors, truncated replies and answers with a
+// zero TTL, are ignored.
+func (c *Cache) Set(key Key, msg *dnsmsg.Message) {
+	ttl, ok := c.ttl(msg)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	e := &entry{
+		key:     key,
+		msg:     cacheable(msg, uint32(ttl/time.Second)),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e.hits = el.Value.(*entry).hits
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// ttl returns how long msg may be cached. Negative answers are kept for
+// the SOA TTL capped by the SOA minimum, and are not cached without an
+// SOA (RFC 2308 section 5).
+func (c *Cache) ttl(msg *dnsmsg.Message) (time.Duration, bool) {
+	if msg.Header.Truncated {
+		return 0, false
+	}
+	negative := msg.Header.RCode == dnsmsg.RCodeNameError || len(msg.Answers) == 0
+	if msg.Header.RCode != dnsmsg.RCodeSuccess && msg.Header.RCode != dnsmsg.RCodeNameError {
+		return 0, false
+	}
+
+	seconds, ok := msg.MinTTL()
+	if !ok || seconds == 0 {
+		return 0, false
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if negative {
+		return min(ttl, c.maxNegativeTTL), true
+	}
+	return min(ttl, c.maxTTL), true
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*entry).key)
+}
+
+// Flush removes every entry.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[Key]*list.Element)
+	c.lru.Init()
+}
+
+// FlushName removes every entry for name, whatever its type, and returns
+// how many were removed.
+func (c *Cache) FlushName(name string) int {
+	return c.FlushNames([]string{name})
+}
+
+// FlushNames removes every entry for any of names, whatever its type, and
+// returns how many were removed. The cache is scanned once, however many
+// names there are.
+func (c *Cache) FlushNames(names []string) int {
+	if len(names) == 0 {
+		return 0
+	}
+	set := nameSet(names)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if set[key.Name] {
+			c.remove(el)
+			n++
+		}
+	}
+	return n
+}
+
+// FlushSubtree removes every entry for name and the names below it and
+// returns how many were removed.
+func (c *Cache) FlushSubtree(name string) int {
+	return c.FlushSubtrees([]string{name})
+}
+
+// FlushSubtrees removes every entry for any of names and the names below
+// them and returns how many were removed. The cache is scanned once,
+// however many names there are.
+func (c *Cache) FlushSubtrees(names []string) int {
+	if len(names) == 0 {
+		return 0
+	}
+	set := nameSet(names)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if underAny(key.Name, set) {
+			c.remove(el)
+			n++
+		}
+	}
+	return n
+}
+
+func nameSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[dnsmsg.CanonicalName(name)] = true
+	}
+	return set
+}
+
+// underAny reports whether name or one of its ancestors is in set.
+func underAny(name string, set map[string]bool) bool {
+	for {
+		if set[name] {
+			return true
+		}
+		if name == "" {
+			return false
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			name = ""
+		} else {
+			name = name[i+1:]
+		}
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return Stats{
+		Entries:    entries,
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Prefetches: c.prefetches.Load(),
+		Stale:      c.stale.Load(),
+	}
+}
+
+// Popular returns up to n entries, most served first.
+func (c *Cache) Popular(n int) []EntryInfo {
+	now := time.Now()
+
+	c.mu.Lock()
+	infos := make([]EntryInfo, 0, len(c.entries))
+	for _, el := range c.entries {
+		e := el.Value.(*entry)
+		infos = append(infos, EntryInfo{
+			Name:  e.key.Name,
+			Type:  e.key.Type.String(),
+			DO:    e.key.DO,
+			Hits:  e.hits,
+			TTL:   max(int64(e.expires.Sub(now)/time.Second), 0),
+			Stale: !now.Before(e.expires),
+		})
+	}
+	c.mu.Unlock()
+
+	slices.SortFunc(infos, func(a, b EntryInfo) int {
+		return cmp.Compare(b.Hits, a.Hits)
+	})
+	return infos[:min(n, len(infos))]
+}
+
+// cacheable returns the parts of msg worth keeping. The OPT record is
+// dropped since every response gets its own. For negative answers the SOA
+// TTL is lowered to ttl so clients do not cache them for longer than we do
+// (RFC 2308 section 5).
+func cacheable(msg *dnsmsg.Message, ttl uint32) *dnsmsg.Message {
+	out := &dnsmsg.Message{
+		Header:    msg.Header,
+		Questions: msg.Questions,
+		Answers:   msg.Answers,
+		Authority: msg.Authority,
+	}
+	if len(msg.Answers) == 0 {
+		out.Authority = make([]dnsmsg.ResourceRecord, len(msg.Authority))
+		for i, rr := range msg.Authority {
+			if rr.Type == dnsmsg.TypeSOA {
+				rr.TTL = min(rr.TTL, ttl)
+			}
+			out.Authority[i] = rr
+		}
+	}
+	for _, rr := range msg.Additional {
+		if rr.Type != dnsmsg.TypeOPT {
+			out.Additional = append(out.Additional, rr)
+		}
+	}
+	return out
+}
+
+// withTTL copies msg with every TTL set to ttl.
+func withTTL(msg *dnsmsg.Message, ttl uint32) *dnsmsg.Message {
+	out := decay(msg, 0)
+	for _, section := range [][]dnsmsg.ResourceRecord{out.Answers, out.Authority, out.Additional} {
+		for i := range section {
+			section[i].TTL = ttl
+		}
+	}
+	return out
+}
+
+// decay copies msg with every TTL lowered by age seconds.
+func decay(msg *dnsmsg.Message, age uint32) *dnsmsg.Message {
+	out := &dnsmsg.Message{
+		Header:     msg.Header,
+		Questions:  append([]dnsmsg.Question(nil), msg.Questions...),
+		Answers:    decayRRs(msg.Answers, age),
+		Authority:  decayRRs(msg.Authority, age),
+		Additional: decayRRs(msg.Additional, age),
+	}
+	return out
+}
+
+func decayRRs(rrs []dnsmsg.ResourceRecord, age uint32) []dnsmsg.ResourceRecord {
+	if rrs == nil {
+		return nil
+	}
+	out := make([]dnsmsg.ResourceRecord, len(rrs))
+	for i, rr := range rrs {
+		if rr.TTL > age {
+			rr.TTL -= age
+		} else {
+			rr.TTL = 0
+		}
+		out[i] = rr
+	}
+	return out
+}
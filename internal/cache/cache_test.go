@@ -0,0 +1,370 @@
+package cache
+
+import (
+	"dns-server/internal/dnsmsg"
+	"net"
+	"testing"
+	"time"
+)
+
+func question(name string, t dnsmsg.Type) dnsmsg.Question {
+	return dnsmsg.Question{Name: name, Type: t, Class: dnsmsg.ClassINET}
+}
+
+func key(name string, t dnsmsg.Type) Key {
+	return NewKey(question(name, t), false)
+}
+
+// answer is a response to an A query for name with one record.
+func answer(name string, ttl uint32) *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 1, Response: true},
+		Questions: []dnsmsg.Question{question(name, dnsmsg.TypeA)},
+		Answers:   []dnsmsg.ResourceRecord{dnsmsg.NewRR(name, ttl, &dnsmsg.A{IP: net.IPv4(192, 0, 2, 1).To4()})},
+	}
+}
+
+// negative is an NXDOMAIN or NODATA response for name with the SOA of
+// example.com in the authority section.
+func negative(name string, rcode dnsmsg.RCode, soaTTL, minimum uint32) *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 1, Response: true, RCode: rcode},
+		Questions: []dnsmsg.Question{question(name, dnsmsg.TypeA)},
+		Authority: []dnsmsg.ResourceRecord{dnsmsg.NewRR("example.com", soaTTL, &dnsmsg.SOA{
+			MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 1,
+			Refresh: 3600, Retry: 600, Expire: 86400, Minimum: minimum,
+		})},
+	}
+}
+
+// age makes the entry for k look as if it was stored d earlier.
+func age(t *testing.T, c *Cache, k Key, d time.Duration) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[k]
+	if !ok {
+		t.Fatalf("%v is not cached", k)
+	}
+	e := el.Value.(*entry)
+	e.stored = e.stored.Add(-d)
+	e.expires = e.expires.Add(-d)
+}
+
+// lifetime returns how long the entry for k is kept.
+func lifetime(c *Cache, k Key) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[k]
+	if !ok {
+		return 0, false
+	}
+	e := el.Value.(*entry)
+	return e.expires.Sub(e.stored), true
+}
+
+func TestGetDecaysTTL(t *testing.T) {
+	c := New()
+	k := key("www.example.com", dnsmsg.TypeA)
+	msg := answer("www.example.com", 300)
+	msg.SetEDNS(&dnsmsg.EDNS{UDPSize: 1232})
+	c.Set(k, msg)
+
+	age(t, c, k, 100*time.Second)
+	got, ok := c.Get(k)
+	if !ok {
+		t.Fatal("entry not found")
+	}
+	if ttl := got.Answers[0].TTL; ttl != 200 {
+		t.Errorf("TTL after 100s = %d, want 200", ttl)
+	}
+	if got.EDNS() != nil {
+		t.Error("the OPT record of the upstream response was cached")
+	}
+
+	// The entry is a copy, so changing it leaves the cache alone.
+	got.Answers[0].TTL = 1
+	if again, _ := c.Get(k); again.Answers[0].TTL != 200 {
+		t.Errorf("TTL after changing a returned copy = %d, want 200", again.Answers[0].TTL)
+	}
+
+	age(t, c, k, 200*time.Second)
+	if _, ok := c.Get(k); ok {
+		t.Error("expired entry returned")
+	}
+}
+
+func TestCachedLifetime(t *testing.T) {
+	truncated := answer("www.example.com", 300)
+	truncated.Header.Truncated = true
+	servfail := answer("www.example.com", 300)
+	servfail.Header.RCode = dnsmsg.RCodeServerFailure
+	noSOA := negative("www.example.com", dnsmsg.RCodeNameError, 300, 300)
+	noSOA.Authority = nil
+
+	tests := []struct {
+		name string
+		msg  *dnsmsg.Message
+		want time.Duration // zero when the response is not cached
+	}{
+		{"answer", answer("www.example.com", 300), 300 * time.Second},
+		{"answer above the max TTL", answer("www.example.com", 172800), 24 * time.Hour},
+		{"zero TTL", answer("www.example.com", 0), 0},
+		{"truncated", truncated, 0},
+		{"server failure", servfail, 0},
+
+		// RFC 2308 section 5: the lower of the SOA TTL and its minimum,
+		// capped by the max negative TTL.
+		{"NXDOMAIN with the SOA minimum", negative("www.example.com", dnsmsg.RCodeNameError, 3600, 300), 300 * time.Second},
+		{"NXDOMAIN with the SOA TTL", negative("www.example.com", dnsmsg.RCodeNameError, 60, 300), 60 * time.Second},
+		{"NODATA", negative("www.example.com", dnsmsg.RCodeSuccess, 3600, 900), 900 * time.Second},
+		{"negative above the max negative TTL", negative("www.example.com", dnsmsg.RCodeNameError, 86400, 86400), time.Hour},
+		{"negative without an SOA", noSOA, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			k := key("www.example.com", dnsmsg.TypeA)
+			c.Set(k, tt.msg)
+			got, ok := lifetime(c, k)
+			if tt.want == 0 {
+				if ok {
+					t.Errorf("cached for %v, want not cached", got)
+				}
+				return
+			}
+			if !ok || got != tt.want {
+				t.Errorf("cached for %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegativeSOATTL(t *testing.T) {
+	c := New()
+	k := key("missing.example.com", dnsmsg.TypeA)
+	c.Set(k, negative("missing.example.com", dnsmsg.RCodeNameError, 3600, 300))
+
+	got, ok := c.Get(k)
+	if !ok {
+		t.Fatal("negative answer not cached")
+	}
+	// Clients must not keep the answer longer than the cache does.
+	if ttl := got.Authority[0].TTL; ttl != 300 {
+		t.Errorf("SOA TTL = %d, want 300", ttl)
+	}
+	if got.Header.RCode != dnsmsg.RCodeNameError {
+		t.Errorf("RCODE = %s, want NXDOMAIN", got.Header.RCode)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	c := New(WithMaxEntries(2))
+	a, b, d := key("a.example", dnsmsg.TypeA), key("b.example", dnsmsg.TypeA), key("d.example", dnsmsg.TypeA)
+	c.Set(a, answer("a.example", 300))
+	c.Set(b, answer("b.example", 300))
+
+	// Using a makes b the least recently used entry.
+	if _, ok := c.Get(a); !ok {
+		t.Fatal("a not cached")
+	}
+	c.Set(d, answer("d.example", 300))
+
+	if _, ok := c.Get(b); ok {
+		t.Error("the least recently used entry was kept")
+	}
+	for _, k := range []Key{a, d} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%s was evicted", k.Name)
+		}
+	}
+	if n := c.Stats().Entries; n != 2 {
+		t.Errorf("%d entries, want 2", n)
+	}
+
+	// Replacing an entry does not count against the limit.
+	c.Set(a, answer("a.example", 600))
+	if _, ok := c.Get(d); !ok {
+		t.Error("replacing an entry evicted another")
+	}
+}
+
+func TestShouldPrefetch(t *testing.T) {
+	now := time.Now()
+	prefetch := func(Key) {}
+
+	tests := []struct {
+		name        string
+		prefetch    PrefetchFunc
+		hits        int64
+		left        time.Duration // of a 100s lifetime
+		prefetching bool
+		want        bool
+	}{
+		{"popular and about to expire", prefetch, 3, 5 * time.Second, false, true},
+		{"at a tenth of the lifetime", prefetch, 3, 10 * time.Second, false, true},
+		{"more than a tenth left", prefetch, 3, 11 * time.Second, false, false},
+		{"not popular", prefetch, 2, 5 * time.Second, false, false},
+		{"already prefetching", prefetch, 3, 5 * time.Second, true, false},
+		{"prefetch disabled", nil, 3, 5 * time.Second, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithPrefetch(3, tt.prefetch))
+			e := &entry{
+				stored:      now.Add(tt.left - 100*time.Second),
+				expires:     now.Add(tt.left),
+				hits:        tt.hits,
+				prefetching: tt.prefetching,
+			}
+			if got := c.shouldPrefetch(e, now); got != tt.want {
+				t.Errorf("shouldPrefetch = %t, want %t", got, tt.want)
+			}
+			if tt.want && !e.prefetching {
+				t.Error("the refresh was not claimed")
+			}
+		})
+	}
+}
+
+func TestGetPrefetchesOnce(t *testing.T) {
+	refreshed := make(chan Key, 2)
+	c := New(WithPrefetch(2, func(k Key) { refreshed <- k }))
+	k := key("www.example.com", dnsmsg.TypeA)
+	c.Set(k, answer("www.example.com", 100))
+	age(t, c, k, 95*time.Second)
+
+	for range 3 {
+		if _, ok := c.Get(k); !ok {
+			t.Fatal("entry not found")
+		}
+	}
+	select {
+	case got := <-refreshed:
+		if got != k {
+			t.Errorf("prefetched %v, want %v", got, k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no prefetch")
+	}
+	select {
+	case <-refreshed:
+		t.Error("prefetched twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := c.Stats().Prefetches; n != 1 {
+		t.Errorf("%d prefetches counted, want 1", n)
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	k := key("www.example.com", dnsmsg.TypeA)
+
+	t.Run("within max stale", func(t *testing.T) {
+		c := New(WithServeStale(time.Hour, 30*time.Second))
+		c.Set(k, answer("www.example.com", 300))
+		if _, ok := c.GetStale(k); !ok {
+			t.Error("fresh entry not returned")
+		}
+		age(t, c, k, 300*time.Second+30*time.Minute)
+		if _, ok := c.Get(k); ok {
+			t.Error("Get returned an expired entry")
+		}
+		got, ok := c.GetStale(k)
+		if !ok {
+			t.Fatal("stale entry not returned")
+		}
+		if ttl := got.Answers[0].TTL; ttl != 30 {
+			t.Errorf("stale TTL = %d, want 30", ttl)
+		}
+		if n := c.Stats().Stale; n != 2 {
+			t.Errorf("%d stale answers counted, want 2", n)
+		}
+	})
+	t.Run("past max stale", func(t *testing.T) {
+		c := New(WithServeStale(time.Hour, 30*time.Second))
+		c.Set(k, answer("www.example.com", 300))
+		age(t, c, k, 300*time.Second+time.Hour+time.Second)
+		if _, ok := c.GetStale(k); ok {
+			t.Error("entry past max stale returned")
+		}
+		// Get drops it for good.
+		c.Get(k)
+		if n := c.Stats().Entries; n != 0 {
+			t.Errorf("%d entries left, want 0", n)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		c := New()
+		c.Set(k, answer("www.example.com", 300))
+		age(t, c, k, 301*time.Second)
+		if _, ok := c.GetStale(k); ok {
+			t.Error("stale entry returned without serve-stale")
+		}
+		// Without serve-stale nothing is kept past expiry.
+		c.Get(k)
+		if n := c.Stats().Entries; n != 0 {
+			t.Errorf("%d entries left, want 0", n)
+		}
+	})
+}
+
+func TestFlush(t *testing.T) {
+	names := []string{"example.com", "www.example.com", "a.b.example.com", "notexample.com", "example.net"}
+	fill := func() *Cache {
+		c := New()
+		for _, name := range names {
+			c.Set(key(name, dnsmsg.TypeA), answer(name, 300))
+			c.Set(key(name, dnsmsg.TypeAAAA), answer(name, 300))
+		}
+		return c
+	}
+	cached := func(c *Cache) map[string]int {
+		got := make(map[string]int)
+		for _, name := range names {
+			for _, typ := range []dnsmsg.Type{dnsmsg.TypeA, dnsmsg.TypeAAAA} {
+				if _, ok := c.Get(key(name, typ)); ok {
+					got[name]++
+				}
+			}
+		}
+		return got
+	}
+
+	tests := []struct {
+		name    string
+		flush   func(c *Cache) int
+		removed int
+		left    []string
+	}{
+		{"name", func(c *Cache) int { return c.FlushName("WWW.example.com.") }, 2,
+			[]string{"example.com", "a.b.example.com", "notexample.com", "example.net"}},
+		{"names", func(c *Cache) int { return c.FlushNames([]string{"example.com", "example.net", "missing.example"}) }, 4,
+			[]string{"www.example.com", "a.b.example.com", "notexample.com"}},
+		{"subtree", func(c *Cache) int { return c.FlushSubtree("example.com") }, 6,
+			[]string{"notexample.com", "example.net"}},
+		{"subtree of a name below", func(c *Cache) int { return c.FlushSubtree("b.example.com") }, 2,
+			[]string{"example.com", "www.example.com", "notexample.com", "example.net"}},
+		{"subtrees", func(c *Cache) int { return c.FlushSubtrees([]string{"www.example.com", "example.net"}) }, 4,
+			[]string{"example.com", "a.b.example.com", "notexample.com"}},
+		{"root", func(c *Cache) int { return c.FlushSubtree(".") }, 10, nil},
+		{"nothing", func(c *Cache) int { return c.FlushSubtrees(nil) }, 0, names},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fill()
+			if n := tt.flush(c); n != tt.removed {
+				t.Errorf("removed %d entries, want %d", n, tt.removed)
+			}
+			got := cached(c)
+			if len(got) != len(tt.left) {
+				t.Errorf("left %v, want %v", got, tt.left)
+			}
+			for _, name := range tt.left {
+				if got[name] != 2 {
+					t.Errorf("%s has %d entries left, want 2", name, got[name])
+				}
+			}
+		})
+	}
+}
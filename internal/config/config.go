@@ -0,0 +1,331 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is the server configuration read from a JSON file. Any field left
+// out of the file keeps its default value.
+type Config struct {
+	DNS      DNSConfig      `json:"dns"`
+	DoT      DoTConfig      `json:"dot"`
+	API      APIConfig      `json:"api"`
+	Resolver ResolverConfig `json:"resolver"`
+	Upstream UpstreamConfig `json:"upstream"`
+	Cache    CacheConfig    `json:"cache"`
+	Hosts    HostsConfig    `json:"hosts"`
+	Transfer TransferConfig `json:"transfer"`
+	Update   UpdateConfig   `json:"update"`
+	DNSSEC   DNSSECConfig   `json:"dnssec"`
+	// LocalZones are zones such as "lan" or "home.arpa" answered
+	// authoritatively without being created through the API. None are by
+	// default, so names under them keep being forwarded.
+	LocalZones []string `json:"local_zones"`
+	// PrivateReverseZones answers reverse lookups for private and special
+	// purpose address ranges locally instead of forwarding them (RFC 6303).
+	// It is on by default; a forwarding rule for one of the ranges sends
+	// its lookups to the router that owns it instead.
+	PrivateReverseZones bool `json:"private_reverse_zones"`
+	// TSIGKeys are the shared secrets requests and transfers can be
+	// signed with.
+	TSIGKeys []TSIGKey `json:"tsig_keys"`
+}
+
+// DNSConfig configures the DNS listeners.
+type DNSConfig struct {
+	// Addr is the address the UDP and TCP listeners bind to.
+	Addr string `json:"addr"`
+	// TCPIdleTimeout closes TCP connections that send no query for this long.
+	TCPIdleTimeout Duration `json:"tcp_idle_timeout"`
+	// TCPMaxConnections limits the number of concurrent TCP connections.
+	TCPMaxConnections int `json:"tcp_max_connections"`
+	// TCPMaxPipelined limits the queries processed at once on a connection.
+	TCPMaxPipelined int `json:"tcp_max_pipelined"`
+	// MaxUDPSize caps the EDNS UDP payload size offered to clients and
+	// upstreams. 1232 avoids IP fragmentation on common paths.
+	MaxUDPSize int `json:"max_udp_size"`
+	// ForwardEDNSOptions passes EDNS options such as client subnet through
+	// to upstreams and back instead of stripping them.
+	ForwardEDNSOptions bool `json:"forward_edns_options"`
+}
+
+// DoTConfig configures the DNS-over-TLS listener.
+type DoTConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Addr     string `json:"addr"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ReloadInterval is how often the certificate files are checked for
+	// changes.
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+// APIConfig configures the HTTP backend serving the REST API and DNS over
+// HTTPS. Browsers only use DoH over HTTPS, so a certificate should be set
+// when /dns-query is used.
+type APIConfig struct {
+	Port     int    `json:"port"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// ResolverConfig selects how names outside the local data are resolved.
+type ResolverConfig struct {
+	// Mode is "forward" to ask the upstream servers, or "recursive" to
+	// resolve iteratively starting from the root servers.
+	Mode string `json:"mode"`
+	// RootHints overrides the root server addresses used in recursive
+	// mode. Entries are IPs or IP:port pairs.
+	RootHints []string `json:"root_hints"`
+	// Port is the port authoritative servers are queried on.
+	Port int `json:"port"`
+	// Timeout bounds a query to one authoritative server.
+	Timeout Duration `json:"timeout"`
+}
+
+// UpstreamConfig configures the resolvers that queries for names outside
+// the local zones are forwarded to.
+type UpstreamConfig struct {
+	// Servers lists the upstreams, either as plain addresses or as objects
+	// carrying TLS settings.
+	Servers []UpstreamServer `json:"servers"`
+	// Strategy is one of "failover", "round_robin", "fastest" or
+	// "parallel".
+	Strategy string `json:"strategy"`
+	// Timeout bounds a single attempt against one upstream.
+	Timeout Duration `json:"timeout"`
+	// Retries is how many extra attempts each upstream gets before the
+	// next one is tried.
+	Retries int `json:"retries"`
+	// HealthCheckInterval is how often every upstream is probed. Zero
+	// disables health checks.
+	HealthCheckInterval Duration `json:"health_check_interval"`
+}
+
+// CacheConfig configures the cache of forwarded responses.
+type CacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxEntries bounds the number of cached responses.
+	MaxEntries int `json:"max_entries"`
+	// MaxTTL caps how long a positive response is kept.
+	MaxTTL Duration `json:"max_ttl"`
+	// MaxNegativeTTL caps how long NXDOMAIN and NODATA responses are kept.
+	MaxNegativeTTL Duration `json:"max_negative_ttl"`
+	// Prefetch refreshes entries served at least PrefetchMinHits times
+	// shortly before they expire.
+	Prefetch        bool `json:"prefetch"`
+	PrefetchMinHits int  `json:"prefetch_min_hits"`
+	// ServeStale answers from expired entries when no upstream responds
+	// (RFC 8767). Entries are kept for MaxStale after expiry and served
+	// with StaleTTL.
+	ServeStale bool     `json:"serve_stale"`
+	MaxStale   Duration `json:"max_stale"`
+	StaleTTL   Duration `json:"stale_ttl"`
+}
+
+// HostsConfig configures the hosts files served next to the records in
+// Redis.
+type HostsConfig struct {
+	// Files lists hosts files such as "/etc/hosts".
+	Files []string `json:"files"`
+	// TTL is the TTL of the records read from the files.
+	TTL Duration `json:"ttl"`
+	// ReloadInterval is how often the files are checked for changes. Zero
+	// disables reloading.
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+// TransferConfig controls zone transfers (AXFR and IXFR) to secondary
+// servers.
+type TransferConfig struct {
+	// Allow lists the IPs and CIDR ranges of the secondaries allowed to
+	// transfer zones. Transfers are refused when it is empty.
+	Allow []string `json:"allow"`
+	// RequireTSIG refuses transfer requests that are not signed with one
+	// of the TSIG keys, even from allowed addresses.
+	RequireTSIG bool `json:"require_tsig"`
+	// JournalSize is the number of changes kept per zone for IXFR. Older
+	// serials get a full transfer.
+	JournalSize int `json:"journal_size"`
+	// Notify lists the secondaries, as IP or IP:port, sent a NOTIFY
+	// whenever the serial of a zone advances (RFC 1996).
+	Notify []string `json:"notify"`
+	// NotifyRetries is how many times a NOTIFY is resent when the
+	// secondary does not answer.
+	NotifyRetries int `json:"notify_retries"`
+	// NotifyTimeout is how long to wait for the answer to a NOTIFY.
+	NotifyTimeout Duration `json:"notify_timeout"`
+	// NotifyKey names the TSIG key NOTIFY messages are signed with for
+	// zones that do not name their own.
+	NotifyKey string `json:"notify_key"`
+}
+
+// UpdateConfig controls dynamic updates (RFC 2136) of the local zones.
+type UpdateConfig struct {
+	// Allow lists the IPs and CIDR ranges allowed to send updates that are
+	// not signed. Unsigned updates are refused when it is empty.
+	Allow []string `json:"allow"`
+	// Keys restricts signed updates to the named TSIG keys. Any known key
+	// is accepted when it is empty.
+	Keys []string `json:"keys"`
+}
+
+// DNSSECConfig controls the online signing of the zones DNSSEC is
+// enabled for.
+type DNSSECConfig struct {
+	// SignatureValidity is how long the RRSIG records made are valid.
+	// Signatures are cached and renewed once a quarter of it has passed.
+	SignatureValidity Duration `json:"signature_validity"`
+	// MaxSignatures bounds the number of cached signatures.
+	MaxSignatures int `json:"max_signatures"`
+}
+
+// TSIGKey is a TSIG shared secret (RFC 8945).
+type TSIGKey struct {
+	Name string `json:"name"`
+	// Algorithm defaults to "hmac-sha256".
+	Algorithm string `json:"algorithm"`
+	// Secret is base64 encoded, as generated by tsig-keygen.
+	Secret string `json:"secret"`
+}
+
+// UpstreamServer is a single upstream resolver. In the configuration file
+// it is either an address string or an object with the fields below.
+type UpstreamServer struct {
+	// Address is e.g. "1.1.1.1", "tcp://9.9.9.9:53",
+	// "tls://one.one.one.one" or "https://cloudflare-dns.com/dns-query".
+	Address string `json:"address"`
+	// ServerName overrides the name the TLS certificate is checked against.
+	ServerName string `json:"server_name,omitempty"`
+	// Bootstrap lists IPs used to reach an upstream given by hostname
+	// without resolving it first.
+	Bootstrap []string `json:"bootstrap,omitempty"`
+}
+
+func (s *UpstreamServer) UnmarshalJSON(b []byte) error {
+	var address string
+	if err := json.Unmarshal(b, &address); err == nil {
+		*s = UpstreamServer{Address: address}
+		return nil
+	}
+
+	type plain UpstreamServer
+	var v plain
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Address == "" {
+		return fmt.Errorf("upstream server without address: %s", string(b))
+	}
+	*s = UpstreamServer(v)
+	return nil
+}
+
+// Duration is a time.Duration that is written as a string such as "10s" in
+// the configuration file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		d.Duration = time.Duration(value * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		d.Duration = parsed
+	default:
+		return fmt.Errorf("invalid duration %s", string(b))
+	}
+	return nil
+}
+
+func Default() *Config {
+	return &Config{
+		DNS: DNSConfig{
+			Addr:              ":53",
+			TCPIdleTimeout:    Duration{10 * time.Second},
+			TCPMaxConnections: 256,
+			TCPMaxPipelined:   16,
+			MaxUDPSize:        1232,
+		},
+		DoT: DoTConfig{
+			Addr:           ":853",
+			ReloadInterval: Duration{time.Minute},
+		},
+		API: APIConfig{
+			Port: 8080,
+		},
+		Resolver: ResolverConfig{
+			Mode:    "forward",
+			Port:    53,
+			Timeout: Duration{2 * time.Second},
+		},
+		Upstream: UpstreamConfig{
+			Servers:             []UpstreamServer{{Address: "1.1.1.1"}, {Address: "1.0.0.1"}},
+			Strategy:            "failover",
+			Timeout:             Duration{2 * time.Second},
+			Retries:             0,
+			HealthCheckInterval: Duration{30 * time.Second},
+		},
+		Cache: CacheConfig{
+			Enabled:         true,
+			MaxEntries:      10000,
+			MaxTTL:          Duration{24 * time.Hour},
+			MaxNegativeTTL:  Duration{time.Hour},
+			Prefetch:        true,
+			PrefetchMinHits: 3,
+			ServeStale:      true,
+			MaxStale:        Duration{24 * time.Hour},
+			StaleTTL:        Duration{30 * time.Second},
+		},
+		Hosts: HostsConfig{
+			TTL:            Duration{time.Minute},
+			ReloadInterval: Duration{5 * time.Second},
+		},
+		Transfer: TransferConfig{
+			JournalSize:   100,
+			NotifyRetries: 5,
+			NotifyTimeout: Duration{2 * time.Second},
+		},
+		DNSSEC: DNSSECConfig{
+			SignatureValidity: Duration{7 * 24 * time.Hour},
+			MaxSignatures:     10000,
+		},
+		PrivateReverseZones: true,
+	}
+}
+
+// Load reads the configuration at path on top of the defaults. A missing
+// file is not an error; the defaults are returned instead.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
@@ -1,8 +1,35 @@
 package constants
 
-import "dns-server/internal/manager"
+import (
+	"dns-server/internal/cache"
+	"dns-server/internal/config"
+	"dns-server/internal/dnssec"
+	"dns-server/internal/hosts"
+	"dns-server/internal/manager"
+	"dns-server/internal/metrics"
+	"dns-server/internal/notify"
+	"dns-server/internal/secondary"
+	"dns-server/internal/tsig"
+	"dns-server/internal/upstream"
+)
 
 var Redis *manager.Redis
 var ContextManager *manager.ContextManager
+var Zones = manager.NewZoneManager()
+var Config = config.Default()
+var DoTMetrics = &metrics.Listener{}
+var Upstreams *upstream.Pool
+var Resolver upstream.Resolver
+var Forwarders = manager.NewForwarderManager()
+var Cache *cache.Cache
+var Hosts *hosts.Source
+var Journal = manager.NewJournalManager()
+var TransferACL manager.ACL
+var UpdateACL manager.ACL
+var TSIGKeys = tsig.NewKeyring()
+var Secondaries *secondary.Manager
+var Notifier *notify.Notifier
+var NotifyTargets []string
+var DNSSEC *dnssec.Manager
 
 const BuildPath = "dist"
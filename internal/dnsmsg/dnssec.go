@@ -0,0 +1,372 @@
+package dnsmsg
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Base32Hex is the encoding of hashed owner names in NSEC3 records (RFC
+// 5155 section 3.3).
+var Base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// DS is a delegation signer record (RFC 4034 section 5), published in the
+// parent zone to authenticate a DNSKEY of the child.
+type DS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (*DS) Type() Type { return TypeDS }
+
+func (r *DS) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.KeyTag, r.Algorithm, r.DigestType, strings.ToUpper(hex.EncodeToString(r.Digest)))
+}
+
+func (r *DS) pack(b *builder) error {
+	b.u16(r.KeyTag)
+	b.u8(r.Algorithm)
+	b.u8(r.DigestType)
+	b.bytes(r.Digest)
+	return nil
+}
+
+// DNSKEY is a public key of a signed zone (RFC 4034 section 2).
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func (*DNSKEY) Type() Type { return TypeDNSKEY }
+
+func (r *DNSKEY) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Flags, r.Protocol, r.Algorithm, base64.StdEncoding.EncodeToString(r.PublicKey))
+}
+
+func (r *DNSKEY) pack(b *builder) error {
+	b.u16(r.Flags)
+	b.u8(r.Protocol)
+	b.u8(r.Algorithm)
+	b.bytes(r.PublicKey)
+	return nil
+}
+
+// RRSIG is the signature of an RRset (RFC 4034 section 3). Expiration and
+// Inception are in seconds since the epoch, modulo 2^32.
+type RRSIG struct {
+	TypeCovered Type
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+func (*RRSIG) Type() Type { return TypeRRSIG }
+
+func (r *RRSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %s %d %s %s",
+		r.TypeCovered, r.Algorithm, r.Labels, r.OriginalTTL,
+		sigTime(r.Expiration), sigTime(r.Inception), r.KeyTag, Fqdn(r.SignerName),
+		base64.StdEncoding.EncodeToString(r.Signature))
+}
+
+// sigTime renders a signature time as YYYYMMDDHHmmSS (RFC 4034 section
+// 3.2).
+func sigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+func (r *RRSIG) pack(b *builder) error {
+	b.u16(uint16(r.TypeCovered))
+	b.u8(r.Algorithm)
+	b.u8(r.Labels)
+	b.u32(r.OriginalTTL)
+	b.u32(r.Expiration)
+	b.u32(r.Inception)
+	b.u16(r.KeyTag)
+	// Names in DNSSEC records are never compressed (RFC 4034 section 3.1.7).
+	if err := b.name(r.SignerName, false); err != nil {
+		return err
+	}
+	b.bytes(r.Signature)
+	return nil
+}
+
+// NSEC links an owner name to the next one of the zone in canonical order
+// and lists the types the owner has (RFC 4034 section 4).
+type NSEC struct {
+	NextName string
+	Types    []Type
+}
+
+func (*NSEC) Type() Type { return TypeNSEC }
+
+func (r *NSEC) String() string {
+	return strings.TrimSpace(Fqdn(r.NextName) + " " + typeList(r.Types))
+}
+
+func (r *NSEC) pack(b *builder) error {
+	if err := b.name(r.NextName, false); err != nil {
+		return err
+	}
+	packTypeBitmap(b, r.Types)
+	return nil
+}
+
+// NSEC3 is the hashed counterpart of NSEC (RFC 5155 section 3). Its owner
+// is the hash of a name, and NextHashed the raw hash of the next one.
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []Type
+}
+
+// NSEC3OptOut is the flag of NSEC3 records whose span may cover insecure
+// delegations (RFC 5155 section 3.1.2.1).
+const NSEC3OptOut = 0x01
+
+func (*NSEC3) Type() Type { return TypeNSEC3 }
+
+func (r *NSEC3) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s",
+		r.HashAlgorithm, r.Flags, r.Iterations, saltString(r.Salt),
+		strings.ToLower(Base32Hex.EncodeToString(r.NextHashed)), typeList(r.Types)))
+}
+
+func (r *NSEC3) pack(b *builder) error {
+	if len(r.Salt) > 255 || len(r.NextHashed) > 255 {
+		return fmt.Errorf("NSEC3 salt or hash exceeds 255 bytes")
+	}
+	b.u8(r.HashAlgorithm)
+	b.u8(r.Flags)
+	b.u16(r.Iterations)
+	b.u8(uint8(len(r.Salt)))
+	b.bytes(r.Salt)
+	b.u8(uint8(len(r.NextHashed)))
+	b.bytes(r.NextHashed)
+	packTypeBitmap(b, r.Types)
+	return nil
+}
+
+// NSEC3PARAM publishes at the apex the parameters of the NSEC3 chain of a
+// zone (RFC 5155 section 4).
+type NSEC3PARAM struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+}
+
+func (*NSEC3PARAM) Type() Type { return TypeNSEC3PARAM }
+
+func (r *NSEC3PARAM) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.HashAlgorithm, r.Flags, r.Iterations, saltString(r.Salt))
+}
+
+func (r *NSEC3PARAM) pack(b *builder) error {
+	if len(r.Salt) > 255 {
+		return fmt.Errorf("NSEC3PARAM salt exceeds 255 bytes")
+	}
+	b.u8(r.HashAlgorithm)
+	b.u8(r.Flags)
+	b.u16(r.Iterations)
+	b.u8(uint8(len(r.Salt)))
+	b.bytes(r.Salt)
+	return nil
+}
+
+// saltString renders an NSEC3 salt, which is "-" when empty.
+func saltString(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(salt))
+}
+
+func typeList(types []Type) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+	return strings.Join(names, " ")
+}
+
+// packTypeBitmap writes the type bit maps field of NSEC and NSEC3 records
+// (RFC 4034 section 4.1.2): one bitmap per window of 256 types, leaving
+// out empty windows and trailing zero octets.
+func packTypeBitmap(b *builder, types []Type) {
+	types = slices.Clone(types)
+	slices.Sort(types)
+	types = slices.Compact(types)
+
+	for len(types) > 0 {
+		window := types[0] >> 8
+		var bitmap [32]byte
+		n := 0
+		for len(types) > 0 && types[0]>>8 == window {
+			low := types[0] & 0xFF
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			n = int(low/8) + 1
+			types = types[1:]
+		}
+		b.u8(uint8(window))
+		b.u8(uint8(n))
+		b.bytes(bitmap[:n])
+	}
+}
+
+func parseTypeBitmap(data []byte) ([]Type, error) {
+	var types []Type
+	last := -1
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, ErrBadRDLength
+		}
+		window, n := int(data[0]), int(data[1])
+		if window <= last || n == 0 || n > 32 || len(data) < 2+n {
+			return nil, ErrBadRDLength
+		}
+		for i, octet := range data[2 : 2+n] {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, Type(window<<8|i*8+bit))
+				}
+			}
+		}
+		last = window
+		data = data[2+n:]
+	}
+	return types, nil
+}
+
+// parseDNSSEC decodes the data of the DNSSEC record types. ok is false for
+// other types.
+func parseDNSSEC(msg []byte, off, end int, t Type) (data RData, ok bool, err error) {
+	raw := msg[off:end]
+	switch t {
+	case TypeDS:
+		if len(raw) < 4 {
+			return nil, true, ErrBadRDLength
+		}
+		return &DS{
+			KeyTag:     binary.BigEndian.Uint16(raw),
+			Algorithm:  raw[2],
+			DigestType: raw[3],
+			Digest:     append([]byte(nil), raw[4:]...),
+		}, true, nil
+	case TypeDNSKEY:
+		if len(raw) < 4 {
+			return nil, true, ErrBadRDLength
+		}
+		return &DNSKEY{
+			Flags:     binary.BigEndian.Uint16(raw),
+			Protocol:  raw[2],
+			Algorithm: raw[3],
+			PublicKey: append([]byte(nil), raw[4:]...),
+		}, true, nil
+	case TypeRRSIG:
+		if len(raw) < 19 {
+			return nil, true, ErrBadRDLength
+		}
+		signer, next, err := readName(msg[:end], off+18)
+		if err != nil {
+			return nil, true, err
+		}
+		return &RRSIG{
+			TypeCovered: Type(binary.BigEndian.Uint16(raw)),
+			Algorithm:   raw[2],
+			Labels:      raw[3],
+			OriginalTTL: binary.BigEndian.Uint32(raw[4:]),
+			Expiration:  binary.BigEndian.Uint32(raw[8:]),
+			Inception:   binary.BigEndian.Uint32(raw[12:]),
+			KeyTag:      binary.BigEndian.Uint16(raw[16:]),
+			SignerName:  signer,
+			Signature:   append([]byte(nil), msg[next:end]...),
+		}, true, nil
+	case TypeNSEC:
+		name, next, err := readName(msg[:end], off)
+		if err != nil {
+			return nil, true, err
+		}
+		types, err := parseTypeBitmap(msg[next:end])
+		if err != nil {
+			return nil, true, err
+		}
+		return &NSEC{NextName: name, Types: types}, true, nil
+	case TypeNSEC3, TypeNSEC3PARAM:
+		if len(raw) < 5 || len(raw) < 5+int(raw[4]) {
+			return nil, true, ErrBadRDLength
+		}
+		saltEnd := 5 + int(raw[4])
+		salt := append([]byte(nil), raw[5:saltEnd]...)
+		iterations := binary.BigEndian.Uint16(raw[2:])
+		if t == TypeNSEC3PARAM {
+			if saltEnd != len(raw) {
+				return nil, true, ErrBadRDLength
+			}
+			return &NSEC3PARAM{HashAlgorithm: raw[0], Flags: raw[1], Iterations: iterations, Salt: salt}, true, nil
+		}
+		if len(raw) < saltEnd+1 || len(raw) < saltEnd+1+int(raw[saltEnd]) {
+			return nil, true, ErrBadRDLength
+		}
+		hashEnd := saltEnd + 1 + int(raw[saltEnd])
+		types, err := parseTypeBitmap(raw[hashEnd:])
+		if err != nil {
+			return nil, true, err
+		}
+		return &NSEC3{
+			HashAlgorithm: raw[0],
+			Flags:         raw[1],
+			Iterations:    iterations,
+			Salt:          salt,
+			NextHashed:    append([]byte(nil), raw[saltEnd+1:hashEnd]...),
+			Types:         types,
+		}, true, nil
+	}
+	return nil, false, nil
+}
+
+// CanonicalRData returns data in the canonical wire form DNSSEC signs and
+// digests (RFC 4034 section 6.2): names are lowercase and uncompressed.
+func CanonicalRData(data RData) ([]byte, error) {
+	b := &builder{canonical: true}
+	if err := data.pack(b); err != nil {
+		return nil, err
+	}
+	return b.buf, nil
+}
+
+// CanonicalRR returns rr in canonical wire form, as it appears in the data
+// an RRSIG signs (RFC 4034 section 3.1.8.1).
+func CanonicalRR(rr ResourceRecord) ([]byte, error) {
+	b := &builder{canonical: true}
+	if err := b.rr(rr); err != nil {
+		return nil, err
+	}
+	return b.buf, nil
+}
+
+// WireName returns name in canonical wire form.
+func WireName(name string) ([]byte, error) {
+	b := &builder{canonical: true}
+	if err := b.name(name, false); err != nil {
+		return nil, err
+	}
+	return b.buf, nil
+}
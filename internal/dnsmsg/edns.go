@@ -0,0 +1,118 @@
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrMultipleOPT = errors.New("dnsmsg: more than one OPT record")
+
+// EDNSOption is a single option carried in an OPT record.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPT is the data of the EDNS(0) pseudo-record (RFC 6891). The UDP payload
+// size, version, DO bit and extended RCODE live in the class and TTL fields
+// of the record and are accessed through EDNS.
+type OPT struct {
+	Options []EDNSOption
+}
+
+func (*OPT) Type() Type { return TypeOPT }
+
+func (r *OPT) String() string {
+	parts := make([]string, len(r.Options))
+	for i, o := range r.Options {
+		parts[i] = fmt.Sprintf("%d:%s", o.Code, hex.EncodeToString(o.Data))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r *OPT) pack(b *builder) error {
+	for _, o := range r.Options {
+		if len(o.Data) > 0xFFFF {
+			return ErrTooLarge
+		}
+		b.u16(o.Code)
+		b.u16(uint16(len(o.Data)))
+		b.bytes(o.Data)
+	}
+	return nil
+}
+
+func parseOPT(data []byte) (*OPT, error) {
+	r := &OPT{}
+	for i := 0; i < len(data); {
+		if i+4 > len(data) {
+			return nil, ErrBadRDLength
+		}
+		code := binary.BigEndian.Uint16(data[i:])
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if i+4+n > len(data) {
+			return nil, ErrBadRDLength
+		}
+		r.Options = append(r.Options, EDNSOption{Code: code, Data: append([]byte(nil), data[i+4:i+4+n]...)})
+		i += 4 + n
+	}
+	return r, nil
+}
+
+// EDNS is the decoded view of a message's OPT record.
+type EDNS struct {
+	UDPSize uint16
+	Version uint8
+	DO      bool
+	Options []EDNSOption
+}
+
+const ednsDOBit = 1 << 15
+
+// EDNS returns the EDNS parameters of m, or nil when m has no OPT record.
+func (m *Message) EDNS() *EDNS {
+	for _, rr := range m.Additional {
+		if rr.Type != TypeOPT {
+			continue
+		}
+		e := &EDNS{
+			UDPSize: uint16(rr.Class),
+			Version: uint8(rr.TTL >> 16),
+			DO:      rr.TTL&ednsDOBit != 0,
+		}
+		if opt, ok := rr.Data.(*OPT); ok {
+			e.Options = opt.Options
+		}
+		return e
+	}
+	return nil
+}
+
+// SetEDNS replaces the OPT record of m with one describing e. A nil e
+// removes EDNS from the message.
+func (m *Message) SetEDNS(e *EDNS) {
+	additional := m.Additional[:0:0]
+	for _, rr := range m.Additional {
+		if rr.Type != TypeOPT {
+			additional = append(additional, rr)
+		}
+	}
+	if e != nil {
+		ttl := uint32(e.Version) << 16
+		if e.DO {
+			ttl |= ednsDOBit
+		}
+		rr := ResourceRecord{
+			Name:  "",
+			Type:  TypeOPT,
+			Class: Class(e.UDPSize),
+			TTL:   ttl,
+			Data:  &OPT{Options: e.Options},
+		}
+		additional = append(additional, rr)
+	}
+	m.Additional = additional
+}
@@ -0,0 +1,124 @@
+package dnsmsg
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// optRR returns a wire-format OPT record with the given payload size, TTL
+// field and rdata.
+func optRR(size uint16, ttl uint32, rdata []byte) []byte {
+	return concat(
+		[]byte{0, 0, 41, byte(size >> 8), byte(size)},
+		[]byte{byte(ttl >> 24), byte(ttl >> 16), byte(ttl >> 8), byte(ttl)},
+		[]byte{byte(len(rdata) >> 8), byte(len(rdata))},
+		rdata,
+	)
+}
+
+func TestParseOPT(t *testing.T) {
+	tests := []struct {
+		name  string
+		rr    []byte
+		want  *EDNS
+		rcode RCode
+		err   error
+	}{
+		{"plain", optRR(1232, 0, nil), &EDNS{UDPSize: 1232}, RCodeSuccess, nil},
+		{"DO bit", optRR(4096, ednsDOBit, nil), &EDNS{UDPSize: 4096, DO: true}, RCodeSuccess, nil},
+		{"version 1", optRR(512, 1<<16, nil), &EDNS{UDPSize: 512, Version: 1}, RCodeSuccess, nil},
+		{"extended rcode", optRR(512, 1<<24, nil), &EDNS{UDPSize: 512}, RCodeBadVersion, nil},
+		{"options", optRR(1232, 0, []byte{0, 8, 0, 3, 0, 1, 24, 0, 10, 0, 0}), &EDNS{UDPSize: 1232, Options: []EDNSOption{
+			{Code: 8, Data: []byte{0, 1, 24}},
+			{Code: 10},
+		}}, RCodeSuccess, nil},
+		{"truncated option header", optRR(1232, 0, []byte{0, 8, 0}), nil, 0, ErrBadRDLength},
+		{"option past rdata", optRR(1232, 0, []byte{0, 8, 0, 4, 0, 1}), nil, 0, ErrBadRDLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse(concat(header(0, 0, 0, 1), tt.rr))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Parse error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := m.EDNS(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EDNS = %+v, want %+v", got, tt.want)
+			}
+			if m.Header.RCode != tt.rcode {
+				t.Errorf("RCode = %v, want %v", m.Header.RCode, tt.rcode)
+			}
+		})
+	}
+}
+
+func TestSetEDNS(t *testing.T) {
+	m := &Message{Additional: []ResourceRecord{NewRR("ns1.example.com", 300, &A{IP: []byte{192, 0, 2, 1}})}}
+	if m.EDNS() != nil {
+		t.Fatal("EDNS without an OPT record")
+	}
+
+	// Setting EDNS twice leaves a single OPT record after the others.
+	m.SetEDNS(&EDNS{UDPSize: 4096})
+	m.SetEDNS(&EDNS{UDPSize: 1232, Version: 1, DO: true})
+	if len(m.Additional) != 2 || m.Additional[1].Type != TypeOPT {
+		t.Fatalf("additional section %v", m.Additional)
+	}
+	if e := m.EDNS(); e.UDPSize != 1232 || e.Version != 1 || !e.DO {
+		t.Errorf("EDNS = %+v", e)
+	}
+
+	m.SetEDNS(nil)
+	if len(m.Additional) != 1 || m.EDNS() != nil {
+		t.Errorf("additional section %v after removing EDNS", m.Additional)
+	}
+}
+
+func TestPackLimitKeepsOPT(t *testing.T) {
+	glue := NewRR("ns1.example.com", 60, &TXT{Text: []string{strings.Repeat("g", 200)}})
+	answer := NewRR("example.com", 60, &TXT{Text: []string{strings.Repeat("a", 200)}})
+	tests := []struct {
+		name       string
+		answers    int
+		limit      int
+		truncated  bool
+		additional int
+	}{
+		{"fits", 1, 1232, false, 2},
+		// Optional records go before the answers do.
+		{"additional dropped", 1, 400, false, 1},
+		{"answers dropped", 3, 400, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{
+				Header:     Header{Response: true, RCode: RCodeBadVersion},
+				Questions:  []Question{{Name: "example.com", Type: TypeTXT, Class: ClassINET}},
+				Additional: []ResourceRecord{glue},
+			}
+			for range tt.answers {
+				m.Answers = append(m.Answers, answer)
+			}
+			m.SetEDNS(&EDNS{UDPSize: 1232, DO: true})
+
+			b, err := m.PackLimit(tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Parse(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) > tt.limit || got.Header.Truncated != tt.truncated || len(got.Additional) != tt.additional {
+				t.Errorf("PackLimit gave %d bytes, TC=%t, %d additional records", len(b), got.Header.Truncated, len(got.Additional))
+			}
+			if e := got.EDNS(); e == nil || e.UDPSize != 1232 || !e.DO || got.Header.RCode != RCodeBadVersion {
+				t.Errorf("EDNS %+v with %s after truncation", e, got.Header.RCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+// Package dnsmsg implements parsing and building of DNS wire-format
+// messages (RFC 1035) with full support for name compression.
+package dnsmsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const headerLen = 12
+
+var (
+	ErrShortMessage = errors.New("dnsmsg: message too short")
+	ErrBadLabel     = errors.New("dnsmsg: invalid label")
+	ErrLabelTooLong = errors.New("dnsmsg: label exceeds 63 bytes")
+	ErrNameTooLong  = errors.New("dnsmsg: name exceeds 255 bytes")
+	ErrPointerLoop  = errors.New("dnsmsg: invalid compression pointer")
+	ErrBadRDLength  = errors.New("dnsmsg: rdata length mismatch")
+	ErrTooLarge     = errors.New("dnsmsg: message exceeds 65535 bytes")
+)
+
+// Header is the fixed 12 byte message header. Section counts are not kept
+// here; they are derived from the Message sections when packing.
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             Opcode
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
+	RCode              RCode
+}
+
+func (h Header) flags() uint16 {
+	f := uint16(h.Opcode&0x0F)<<11 | uint16(h.RCode&0x0F)
+	if h.Response {
+		f |= 1 << 15
+	}
+	if h.Authoritative {
+		f |= 1 << 10
+	}
+	if h.Truncated {
+		f |= 1 << 9
+	}
+	if h.RecursionDesired {
+		f |= 1 << 8
+	}
+	if h.RecursionAvailable {
+		f |= 1 << 7
+	}
+	if h.AuthenticData {
+		f |= 1 << 5
+	}
+	if h.CheckingDisabled {
+		f |= 1 << 4
+	}
+	return f
+}
+
+func (h *Header) setFlags(f uint16) {
+	h.Response = f&(1<<15) != 0
+	h.Opcode = Opcode(f>>11) & 0x0F
+	h.Authoritative = f&(1<<10) != 0
+	h.Truncated = f&(1<<9) != 0
+	h.RecursionDesired = f&(1<<8) != 0
+	h.RecursionAvailable = f&(1<<7) != 0
+	h.AuthenticData = f&(1<<5) != 0
+	h.CheckingDisabled = f&(1<<4) != 0
+	h.RCode = RCode(f & 0x0F)
+}
+
+// ParseHeader decodes only the header of msg. It is useful for building an
+// error response to a message that cannot be parsed in full.
+func ParseHeader(msg []byte) (Header, error) {
+	var h Header
+	if len(msg) < headerLen {
+		return h, ErrShortMessage
+	}
+	h.ID = binary.BigEndian.Uint16(msg[0:2])
+	h.setFlags(binary.BigEndian.Uint16(msg[2:4]))
+	return h, nil
+}
+
+// Question is an entry of the question section.
+type Question struct {
+	Name  string
+	Type  Type
+	Class Class
+}
+
+func (q Question) String() string {
+	return fmt.Sprintf("%s\t%s\t%s", Fqdn(q.Name), q.Class, q.Type)
+}
+
+// ResourceRecord is an entry of the answer, authority or additional section.
+type ResourceRecord struct {
+	Name  string
+	Type  Type
+	Class Class
+	TTL   uint32
+	Data  RData
+}
+
+// NewRR builds an IN-class record whose type is taken from data.
+func NewRR(name string, ttl uint32, data RData) ResourceRecord {
+	return ResourceRecord{
+		Name:  name,
+		Type:  data.Type(),
+		Class: ClassINET,
+		TTL:   ttl,
+		Data:  data,
+	}
+}
+
+func (rr ResourceRecord) String() string {
+	data := ""
+	if rr.Data != nil {
+		data = rr.Data.String()
+	}
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", Fqdn(rr.Name), rr.TTL, rr.Class, rr.Type, data)
+}
+
+// Message is a complete DNS message.
+type Message struct {
+	Header     Header
+	Questions  []Question
+	Answers    []ResourceRecord
+	Authority  []ResourceRecord
+	Additional []ResourceRecord
+}
+
+// Reply returns an empty response to m that echoes its ID, opcode, RD bit
+// and question section.
+func (m *Message) Reply() *Message {
+	return &Message{
+		Header: Header{
+			ID:                 m.Header.ID,
+			Response:           true,
+			Opcode:             m.Header.Opcode,
+			RecursionDesired:   m.Header.RecursionDesired,
+			RecursionAvailable: true,
+			CheckingDisabled:   m.Header.CheckingDisabled,
+		},
+		Questions: append([]Question(nil), m.Questions...),
+	}
+}
+
+// MinTTL returns the lowest TTL of the answer section. For negative answers
+// it falls back to the SOA TTL capped by the SOA minimum (RFC 2308 section
+// 5). ok is false when the message carries no TTL at all.
+func (m *Message) MinTTL() (ttl uint32, ok bool) {
+	for _, rr := range m.Answers {
+		if !ok || rr.TTL < ttl {
+			ttl, ok = rr.TTL, true
+		}
+	}
+	if ok {
+		return ttl, true
+	}
+	for _, rr := range m.Authority {
+		if soa, isSOA := rr.Data.(*SOA); isSOA {
+			return min(rr.TTL, soa.Minimum), true
+		}
+	}
+	return 0, false
+}
+
+func (m *Message) String() string {
+	var sb strings.Builder
+	h := m.Header
+	fmt.Fprintf(&sb, ";; opcode: %s, status: %s, id: %d\n", h.Opcode, h.RCode, h.ID)
+	fmt.Fprintf(&sb, ";; flags: qr=%t aa=%t tc=%t rd=%t ra=%t ad=%t cd=%t\n",
+		h.Response, h.Authoritative, h.Truncated, h.RecursionDesired, h.RecursionAvailable, h.AuthenticData, h.CheckingDisabled)
+	for _, q := range m.Questions {
+		sb.WriteString(";" + q.String() + "\n")
+	}
+	for _, section := range [][]ResourceRecord{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			sb.WriteString(rr.String() + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// Parse decodes a wire-format message.
+func Parse(msg []byte) (*Message, error) {
+	h, err := ParseHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Header: h}
+
+	qdCount := int(binary.BigEndian.Uint16(msg[4:6]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:8]))
+	nsCount := int(binary.BigEndian.Uint16(msg[8:10]))
+	arCount := int(binary.BigEndian.Uint16(msg[10:12]))
+
+	off := headerLen
+	for i := 0; i < qdCount; i++ {
+		var q Question
+		q.Name, off, err = readName(msg, off)
+		if err != nil {
+			return nil, fmt.Errorf("question %d: %w", i, err)
+		}
+		if off+4 > len(msg) {
+			return nil, ErrShortMessage
+		}
+		q.Type = Type(binary.BigEndian.Uint16(msg[off:]))
+		q.Class = Class(binary.BigEndian.Uint16(msg[off+2:]))
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+
+	sections := []struct {
+		count int
+		dst   *[]ResourceRecord
+	}{
+		{anCount, &m.Answers},
+		{nsCount, &m.Authority},
+		{arCount, &m.Additional},
+	}
+	for _, s := range sections {
+		for i := 0; i < s.count; i++ {
+			var rr ResourceRecord
+			rr, off, err = readRR(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			*s.dst = append(*s.dst, rr)
+		}
+	}
+
+	// The upper eight bits of an extended RCODE are carried in the OPT
+	// record (RFC 6891 section 6.1.3).
+	opts := 0
+	for _, rr := range m.Additional {
+		if rr.Type == TypeOPT {
+			opts++
+			m.Header.RCode |= RCode(rr.TTL>>24) << 4
+		}
+	}
+	if opts > 1 {
+		return nil, ErrMultipleOPT
+	}
+
+	return m, nil
+}
+
+func readRR(msg []byte, off int) (ResourceRecord, int, error) {
+	var rr ResourceRecord
+	var err error
+	rr.Name, off, err = readName(msg, off)
+	if err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(msg) {
+		return rr, 0, ErrShortMessage
+	}
+	rr.Type = Type(binary.BigEndian.Uint16(msg[off:]))
+	rr.Class = Class(binary.BigEndian.Uint16(msg[off+2:]))
+	rr.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+rdLen > len(msg) {
+		return rr, 0, ErrShortMessage
+	}
+	rr.Data, err = parseRData(msg, off, rdLen, rr.Type)
+	if err != nil {
+		return rr, 0, fmt.Errorf("%s record %q: %w", rr.Type, rr.Name, err)
+	}
+	return rr, off + rdLen, nil
+}
+
+// Pack encodes m into wire format, compressing names where permitted.
+func (m *Message) Pack() ([]byte, error) {
+	b := newBuilder()
+	b.u16(m.Header.ID)
+	b.u16(m.Header.flags())
+	b.u16(uint16(len(m.Questions)))
+	b.u16(uint16(len(m.Answers)))
+	b.u16(uint16(len(m.Authority)))
+	b.u16(uint16(len(m.Additional)))
+
+	for _, q := range m.Questions {
+		if err := b.name(q.Name, true); err != nil {
+			return nil, err
+		}
+		b.u16(uint16(q.Type))
+		b.u16(uint16(q.Class))
+	}
+	for _, section := range [][]ResourceRecord{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if rr.Type == TypeOPT {
+				rr.TTL = rr.TTL&0x00FFFFFF | uint32(m.Header.RCode>>4)<<24
+			}
+			if err := b.rr(rr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(b.buf) > 0xFFFF {
+		return nil, ErrTooLarge
+	}
+	return b.buf, nil
+}
+
+// PackLimit encodes m so that it fits in limit bytes, as required for UDP
+// responses. The additional section, apart from the OPT record, is dropped
+// first since it is optional; if the answer still does not fit, only the
+// question is sent with the TC bit set so the client retries over TCP.
+func (m *Message) PackLimit(limit int) ([]byte, error) {
+	b, err := m.Pack()
+	if err != nil || len(b) <= limit {
+		return b, err
+	}
+
+	trimmed := *m
+	trimmed.Additional = nil
+	if e := m.EDNS(); e != nil {
+		trimmed.SetEDNS(e)
+	}
+	if b, err = trimmed.Pack(); err != nil || len(b) <= limit {
+		return b, err
+	}
+
+	trimmed.Header.Truncated = true
+	trimmed.Answers = nil
+	trimmed.Authority = nil
+	return trimmed.Pack()
+}
+
+// builder accumulates a wire-format message and remembers where each name
+// suffix was written so later occurrences can be replaced by pointers.
+type builder struct {
+	buf         []byte
+	compression map[string]int
+	// canonical writes names in the canonical form DNSSEC signs (RFC 4034
+	// section 6.2): lowercase and never compressed.
+	canonical bool
+}
+
+func newBuilder() *builder {
+	return &builder{
+		buf:         make([]byte, 0, 512),
+		compression: make(map[string]int),
+	}
+}
+
+func (b *builder) u8(v uint8) {
+	b.buf = append(b.buf, v)
+}
+
+func (b *builder) u16(v uint16) {
+	b.buf = binary.BigEndian.AppendUint16(b.buf, v)
+}
+
+func (b *builder) u32(v uint32) {
+	b.buf = binary.BigEndian.AppendUint32(b.buf, v)
+}
+
+func (b *builder) bytes(v []byte) {
+	b.buf = append(b.buf, v...)
+}
+
+// name writes n, reusing a previously written suffix when compress is set.
+// Every suffix written is recorded so later names can point at it.
+func (b *builder) name(n string, compress bool) error {
+	labels, err := SplitLabels(n)
+	if err != nil {
+		return fmt.Errorf("%w: %q", err, n)
+	}
+	if b.canonical {
+		for _, l := range labels {
+			b.u8(uint8(len(l)))
+			b.bytes(bytes.ToLower(l))
+		}
+		b.u8(0)
+		return nil
+	}
+	for i := range labels {
+		key := suffixKey(labels[i:])
+		if compress {
+			if ptr, ok := b.compression[key]; ok {
+				b.u16(0xC000 | uint16(ptr))
+				return nil
+			}
+		}
+		if len(b.buf) < 0x4000 {
+			if _, ok := b.compression[key]; !ok {
+				b.compression[key] = len(b.buf)
+			}
+		}
+		b.u8(uint8(len(labels[i])))
+		b.bytes(labels[i])
+	}
+	b.u8(0)
+	return nil
+}
+
+func suffixKey(labels [][]byte) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(strings.ToLower(string(l)))
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+func (b *builder) rr(rr ResourceRecord) error {
+	// The owner of a TSIG record is the key name in canonical form (RFC
+	// 8945 section 4.2), which rules out compression.
+	if err := b.name(rr.Name, rr.Type != TypeTSIG); err != nil {
+		return err
+	}
+	b.u16(uint16(rr.Type))
+	b.u16(uint16(rr.Class))
+	b.u32(rr.TTL)
+
+	lenOff := len(b.buf)
+	b.u16(0)
+	if rr.Data != nil {
+		if err := rr.Data.pack(b); err != nil {
+			return fmt.Errorf("%s record %q: %w", rr.Type, rr.Name, err)
+		}
+	}
+	rdLen := len(b.buf) - lenOff - 2
+	if rdLen > 0xFFFF {
+		return ErrTooLarge
+	}
+	binary.BigEndian.PutUint16(b.buf[lenOff:], uint16(rdLen))
+	return nil
+}
@@ -0,0 +1,267 @@
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// allTypes returns one record of every type the package models, plus one it
+// does not.
+func allTypes() []ResourceRecord {
+	return []ResourceRecord{
+		NewRR("example.com", 300, &A{IP: net.IPv4(192, 0, 2, 1).To4()}),
+		NewRR("example.com", 300, &AAAA{IP: net.ParseIP("2001:db8::1")}),
+		NewRR("example.com", 300, &NS{Host: "ns1.example.com"}),
+		NewRR("www.example.com", 300, &CNAME{Target: "example.com"}),
+		NewRR("1.2.0.192.in-addr.arpa", 300, &PTR{Target: "host.example.com"}),
+		NewRR("example.com", 300, &MX{Preference: 10, Exchange: "mail.example.com"}),
+		NewRR("example.com", 300, &TXT{Text: []string{"v=spf1 -all", ""}}),
+		NewRR("example.com", 300, &SOA{
+			MName: "ns1.example.com", RName: "hostmaster.example.com",
+			Serial: 2024010101, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 60,
+		}),
+		NewRR("_sip._tcp.example.com", 300, &SRV{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com"}),
+		NewRR("example.com", 300, &CAA{Flags: 0, Tag: "issue", Value: "letsencrypt.org"}),
+		NewRR("example.com", 300, &DS{KeyTag: 12345, Algorithm: 13, DigestType: 2, Digest: []byte{1, 2, 3, 4}}),
+		NewRR("example.com", 300, &DNSKEY{Flags: 257, Protocol: 3, Algorithm: 13, PublicKey: []byte{5, 6, 7, 8}}),
+		NewRR("example.com", 300, &RRSIG{
+			TypeCovered: TypeA, Algorithm: 13, Labels: 2, OriginalTTL: 300,
+			Expiration: 1700000000, Inception: 1690000000, KeyTag: 12345,
+			SignerName: "example.com", Signature: []byte{9, 10, 11},
+		}),
+		NewRR("example.com", 300, &NSEC{NextName: "www.example.com", Types: []Type{TypeA, TypeNS, TypeSOA, TypeRRSIG, TypeNSEC, TypeCAA}}),
+		NewRR("2t7b4g4vsa5smi47k61mv5bv1a22bojr.example.com", 300, &NSEC3{
+			HashAlgorithm: 1, Flags: NSEC3OptOut, Iterations: 12, Salt: []byte{0xaa, 0xbb},
+			NextHashed: []byte{1, 2, 3, 4, 5}, Types: []Type{TypeA, TypeRRSIG},
+		}),
+		NewRR("example.com", 0, &NSEC3PARAM{HashAlgorithm: 1, Iterations: 12, Salt: []byte{0xaa, 0xbb}}),
+		NewRR("example.com", 300, &Unknown{RRType: 65280, Data: []byte{0xde, 0xad}}),
+		NewRR("hmac-key", 0, &TSIG{
+			Algorithm: "hmac-sha256", TimeSigned: 1700000000, Fudge: 300,
+			MAC: []byte{1, 2, 3}, OriginalID: 42,
+		}),
+	}
+}
+
+func TestPackParseRoundTrip(t *testing.T) {
+	for _, rr := range allTypes() {
+		t.Run(rr.Type.String(), func(t *testing.T) {
+			m := &Message{
+				Header:    Header{ID: 0x1234, Response: true, Authoritative: true, RCode: RCodeSuccess},
+				Questions: []Question{{Name: rr.Name, Type: rr.Type, Class: ClassINET}},
+				Answers:   []ResourceRecord{rr},
+			}
+			b, err := m.Pack()
+			if err != nil {
+				t.Fatalf("Pack: %v", err)
+			}
+			got, err := Parse(b)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Errorf("round trip mismatch\n got: %v\nwant: %v", got, m)
+			}
+		})
+	}
+}
+
+func TestPackCompressesNames(t *testing.T) {
+	m := &Message{
+		Questions: []Question{{Name: "www.example.com", Type: TypeA, Class: ClassINET}},
+		Answers: []ResourceRecord{
+			NewRR("www.example.com", 60, &CNAME{Target: "web.example.com"}),
+			NewRR("web.example.com", 60, &A{IP: net.IPv4(192, 0, 2, 1).To4()}),
+		},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Question name (17) + type/class, then two records whose owners and
+	// target are pointers or a single label in front of one.
+	if len(b) > headerLen+21+(2+10+6)+(2+10+4)+10 {
+		t.Errorf("packed message is %d bytes, names were not compressed", len(b))
+	}
+	if _, err := Parse(b); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+}
+
+func TestPackEDNSExtendedRCode(t *testing.T) {
+	m := &Message{Header: Header{Response: true, RCode: RCodeBadVersion}}
+	m.SetEDNS(&EDNS{UDPSize: 1232, DO: true})
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Header.RCode != RCodeBadVersion {
+		t.Errorf("RCode = %v, want %v", got.Header.RCode, RCodeBadVersion)
+	}
+	e := got.EDNS()
+	if e == nil || e.UDPSize != 1232 || !e.DO {
+		t.Errorf("EDNS = %+v, want size 1232 with DO", e)
+	}
+}
+
+// header returns a message header with the given section counts.
+func header(qd, an, ns, ar uint16) []byte {
+	b := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(b[4:], qd)
+	binary.BigEndian.PutUint16(b[6:], an)
+	binary.BigEndian.PutUint16(b[8:], ns)
+	binary.BigEndian.PutUint16(b[10:], ar)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestParseMalformed(t *testing.T) {
+	longLabel := append([]byte{63}, strings.Repeat("a", 63)...)
+	var longName []byte
+	for range 5 {
+		longName = append(longName, longLabel...)
+	}
+	longName = append(longName, 0)
+
+	// chain holds a root name followed by maxPointers+1 pointers, each to
+	// the one before it.
+	chain := []byte{0}
+	for i := range maxPointers + 1 {
+		off := headerLen + 2*i
+		if i > 0 {
+			off--
+		}
+		chain = append(chain, 0xC0|byte(off>>8), byte(off))
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want error
+	}{
+		{"short header", []byte{0, 1, 2}, ErrShortMessage},
+		{"missing question", header(1, 0, 0, 0), ErrShortMessage},
+		{"pointer to itself", concat(header(1, 0, 0, 0), []byte{0xC0, headerLen, 0, 1, 0, 1}), ErrPointerLoop},
+		{"forward pointer", concat(header(1, 0, 0, 0), []byte{0xC0, headerLen + 2, 0, 0, 1, 0, 1}), ErrPointerLoop},
+		{"pointer past end", concat(header(1, 0, 0, 0), []byte{0xFF, 0xFF, 0, 1, 0, 1}), ErrPointerLoop},
+		{"truncated pointer", concat(header(1, 0, 0, 0), []byte{0xC0}), ErrShortMessage},
+		{"label past end", concat(header(1, 0, 0, 0), []byte{10, 'a', 'b'}), ErrShortMessage},
+		{"label over 63 bytes", concat(header(1, 0, 0, 0), []byte{64}, []byte(strings.Repeat("a", 64)), []byte{0, 0, 1, 0, 1}), ErrBadLabel},
+		{"name over 255 bytes", concat(header(1, 0, 0, 0), longName, []byte{0, 1, 0, 1}), ErrNameTooLong},
+		{"truncated record header", concat(header(0, 1, 0, 0), []byte{0, 0, 1, 0, 1}), ErrShortMessage},
+		{"truncated rdata", concat(header(0, 1, 0, 0), []byte{0, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0}), ErrShortMessage},
+		{"wrong A length", concat(header(0, 1, 0, 0), []byte{0, 0, 1, 0, 1, 0, 0, 0, 60, 0, 3, 192, 0, 2}), ErrBadRDLength},
+		{"MX name past rdata", concat(header(0, 1, 0, 0), []byte{0, 0, 15, 0, 1, 0, 0, 0, 60, 0, 4, 0, 10, 3, 'a'}, []byte("bc"), []byte{0}), ErrShortMessage},
+		{"TXT string past rdata", concat(header(0, 1, 0, 0), []byte{0, 0, 16, 0, 1, 0, 0, 0, 60, 0, 2, 5, 'a'}), ErrBadRDLength},
+		{"bad NSEC bitmap", concat(header(0, 1, 0, 0), []byte{0, 0, 47, 0, 1, 0, 0, 0, 60, 0, 3, 0, 0, 0}), ErrBadRDLength},
+		{"two OPT records", concat(header(0, 0, 0, 2), []byte{0, 0, 41, 4, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 0, 41, 4, 0, 0, 0, 0, 0, 0, 0}), ErrMultipleOPT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.msg)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Parse error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("pointer chain", func(t *testing.T) {
+		msg := concat(header(0, 0, 0, 0), chain)
+		if _, _, err := readName(msg, len(msg)-2); !errors.Is(err, ErrPointerLoop) {
+			t.Errorf("readName error = %v, want %v", err, ErrPointerLoop)
+		}
+		if name, _, err := readName(msg, len(msg)-4); err != nil || name != "" {
+			t.Errorf("readName = %q, %v, want the root name", name, err)
+		}
+	})
+}
+
+// TestParseTruncated parses every prefix of a valid message, none of which
+// may panic or succeed with records missing.
+func TestParseTruncated(t *testing.T) {
+	m := &Message{
+		Header:    Header{ID: 1, Response: true},
+		Questions: []Question{{Name: "example.com", Type: TypeANY, Class: ClassINET}},
+		Answers:   allTypes(),
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range len(b) {
+		if _, err := Parse(b[:n]); err == nil {
+			t.Errorf("Parse of the first %d of %d bytes succeeded", n, len(b))
+		}
+	}
+}
+
+func TestSplitLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		want [][]byte
+		err  error
+	}{
+		{"", nil, nil},
+		{".", nil, nil},
+		{"example.com.", [][]byte{[]byte("example"), []byte("com")}, nil},
+		{`a\.b.com`, [][]byte{[]byte("a.b"), []byte("com")}, nil},
+		{`\065\000.com`, [][]byte{{'A', 0}, []byte("com")}, nil},
+		{"a..com", nil, ErrBadLabel},
+		{`\256.com`, nil, ErrBadLabel},
+		{`com\`, nil, ErrBadLabel},
+		{strings.Repeat("a", 64) + ".com", nil, ErrLabelTooLong},
+		{strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com", nil, ErrNameTooLong},
+	}
+	for _, tt := range tests {
+		got, err := SplitLabels(tt.name)
+		if !errors.Is(err, tt.err) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitLabels(%q) = %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestPackRejectsBadNames(t *testing.T) {
+	for _, name := range []string{
+		strings.Repeat("a", 64) + ".com",
+		strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com",
+		"a..com",
+	} {
+		m := &Message{Answers: []ResourceRecord{NewRR(name, 60, &A{IP: net.IPv4(192, 0, 2, 1)})}}
+		if _, err := m.Pack(); err == nil {
+			t.Errorf("Pack of owner %q succeeded", name)
+		}
+	}
+}
+
+func TestPackLimitTruncates(t *testing.T) {
+	m := &Message{Questions: []Question{{Name: "example.com", Type: TypeTXT, Class: ClassINET}}}
+	for range 10 {
+		m.Answers = append(m.Answers, NewRR("example.com", 60, &TXT{Text: []string{strings.Repeat("x", 100)}}))
+	}
+	b, err := m.PackLimit(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > 512 || !got.Header.Truncated || len(got.Answers) != 0 || len(got.Questions) != 1 {
+		t.Errorf("PackLimit gave %d bytes, TC=%t, %d answers", len(b), got.Header.Truncated, len(got.Answers))
+	}
+}
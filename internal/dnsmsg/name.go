@@ -0,0 +1,176 @@
+package dnsmsg
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLabelLen = 63
+	maxNameLen  = 255
+
+	// maxPointers bounds how many compression pointers a single name may
+	// follow, which protects the parser against pointer loops.
+	maxPointers = 16
+)
+
+// readName decodes the (possibly compressed) domain name starting at off
+// and returns it in presentation form without the trailing dot, together
+// with the offset of the first byte after the name in the original stream.
+func readName(msg []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	end := -1
+	wireLen := 0
+	pointers := 0
+
+	for {
+		if off >= len(msg) {
+			return "", 0, ErrShortMessage
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				return sb.String(), end, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, ErrShortMessage
+			}
+			wireLen += c + 1
+			if wireLen+1 > maxNameLen {
+				return "", 0, ErrNameTooLong
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			writeLabel(&sb, msg[off+1:off+1+c])
+			off += c + 1
+		case 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, ErrShortMessage
+			}
+			pointers++
+			if pointers > maxPointers {
+				return "", 0, ErrPointerLoop
+			}
+			ptr := int(msg[off]&0x3F)<<8 | int(msg[off+1])
+			if ptr >= off {
+				// Only backward references are legal; anything else can
+				// only be used to build a loop.
+				return "", 0, ErrPointerLoop
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = ptr
+		default:
+			return "", 0, ErrBadLabel
+		}
+	}
+}
+
+// writeLabel appends a raw label to sb, escaping characters that would
+// otherwise be ambiguous in presentation form.
+func writeLabel(sb *strings.Builder, label []byte) {
+	for _, b := range label {
+		switch {
+		case b == '.' || b == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b < '!' || b > '~':
+			sb.WriteByte('\\')
+			s := strconv.Itoa(int(b))
+			sb.WriteString(strings.Repeat("0", 3-len(s)))
+			sb.WriteString(s)
+		default:
+			sb.WriteByte(b)
+		}
+	}
+}
+
+// SplitLabels splits a presentation-form name into its raw wire labels,
+// resolving escapes. The root name ("" or ".") has no labels.
+func SplitLabels(name string) ([][]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil, nil
+	}
+
+	var labels [][]byte
+	var cur []byte
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch c {
+		case '.':
+			if len(cur) == 0 {
+				return nil, ErrBadLabel
+			}
+			labels = append(labels, cur)
+			cur = nil
+		case '\\':
+			if i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]) {
+				n, _ := strconv.Atoi(name[i+1 : i+4])
+				if n > 255 {
+					return nil, ErrBadLabel
+				}
+				cur = append(cur, byte(n))
+				i += 3
+			} else if i+1 < len(name) {
+				cur = append(cur, name[i+1])
+				i++
+			} else {
+				return nil, ErrBadLabel
+			}
+		default:
+			cur = append(cur, c)
+		}
+		if len(cur) > maxLabelLen {
+			return nil, ErrLabelTooLong
+		}
+	}
+	if len(cur) == 0 {
+		return nil, ErrBadLabel
+	}
+	labels = append(labels, cur)
+
+	total := 1
+	for _, l := range labels {
+		total += len(l) + 1
+	}
+	if total > maxNameLen {
+		return nil, ErrNameTooLong
+	}
+	return labels, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// CanonicalName returns the lower-cased form of name without a trailing
+// dot, which is the form used for comparisons and map keys.
+func CanonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Fqdn returns name with a trailing dot, as used in presentation format.
+func Fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// IsSubdomain reports whether child is equal to or below parent. Both names
+// are compared case-insensitively.
+func IsSubdomain(child, parent string) bool {
+	child = CanonicalName(child)
+	parent = CanonicalName(parent)
+	if parent == "" {
+		return true
+	}
+	return child == parent || strings.HasSuffix(child, "."+parent)
+}
@@ -0,0 +1,368 @@
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RData is the type-specific payload of a resource record.
+type RData interface {
+	// Type returns the record type the data belongs to.
+	Type() Type
+	// String returns the data in zone file presentation format.
+	String() string
+
+	pack(b *builder) error
+}
+
+type A struct {
+	IP net.IP
+}
+
+func (*A) Type() Type { return TypeA }
+
+func (r *A) String() string { return r.IP.String() }
+
+func (r *A) pack(b *builder) error {
+	ip := r.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("%v is not an IPv4 address", r.IP)
+	}
+	b.bytes(ip)
+	return nil
+}
+
+type AAAA struct {
+	IP net.IP
+}
+
+func (*AAAA) Type() Type { return TypeAAAA }
+
+func (r *AAAA) String() string { return r.IP.String() }
+
+func (r *AAAA) pack(b *builder) error {
+	ip := r.IP.To16()
+	if ip == nil {
+		return fmt.Errorf("%v is not an IPv6 address", r.IP)
+	}
+	b.bytes(ip)
+	return nil
+}
+
+type NS struct {
+	Host string
+}
+
+func (*NS) Type() Type { return TypeNS }
+
+func (r *NS) String() string { return Fqdn(r.Host) }
+
+func (r *NS) pack(b *builder) error { return b.name(r.Host, true) }
+
+type CNAME struct {
+	Target string
+}
+
+func (*CNAME) Type() Type { return TypeCNAME }
+
+func (r *CNAME) String() string { return Fqdn(r.Target) }
+
+func (r *CNAME) pack(b *builder) error { return b.name(r.Target, true) }
+
+type PTR struct {
+	Target string
+}
+
+func (*PTR) Type() Type { return TypePTR }
+
+func (r *PTR) String() string { return Fqdn(r.Target) }
+
+func (r *PTR) pack(b *builder) error { return b.name(r.Target, true) }
+
+type MX struct {
+	Preference uint16
+	Exchange   string
+}
+
+func (*MX) Type() Type { return TypeMX }
+
+func (r *MX) String() string {
+	return fmt.Sprintf("%d %s", r.Preference, Fqdn(r.Exchange))
+}
+
+func (r *MX) pack(b *builder) error {
+	b.u16(r.Preference)
+	return b.name(r.Exchange, true)
+}
+
+type TXT struct {
+	Text []string
+}
+
+func (*TXT) Type() Type { return TypeTXT }
+
+func (r *TXT) String() string {
+	parts := make([]string, len(r.Text))
+	for i, t := range r.Text {
+		parts[i] = quoteString(t)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r *TXT) pack(b *builder) error {
+	if len(r.Text) == 0 {
+		// A TXT record must hold at least one (possibly empty) string.
+		b.u8(0)
+		return nil
+	}
+	for _, t := range r.Text {
+		if len(t) > 255 {
+			return fmt.Errorf("TXT string exceeds 255 bytes")
+		}
+		b.u8(uint8(len(t)))
+		b.bytes([]byte(t))
+	}
+	return nil
+}
+
+type SOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (*SOA) Type() Type { return TypeSOA }
+
+func (r *SOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d",
+		Fqdn(r.MName), Fqdn(r.RName), r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum)
+}
+
+func (r *SOA) pack(b *builder) error {
+	if err := b.name(r.MName, true); err != nil {
+		return err
+	}
+	if err := b.name(r.RName, true); err != nil {
+		return err
+	}
+	b.u32(r.Serial)
+	b.u32(r.Refresh)
+	b.u32(r.Retry)
+	b.u32(r.Expire)
+	b.u32(r.Minimum)
+	return nil
+}
+
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (*SRV) Type() Type { return TypeSRV }
+
+func (r *SRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, Fqdn(r.Target))
+}
+
+func (r *SRV) pack(b *builder) error {
+	b.u16(r.Priority)
+	b.u16(r.Weight)
+	b.u16(r.Port)
+	// RFC 2782 forbids compressing the SRV target.
+	return b.name(r.Target, false)
+}
+
+type CAA struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+func (*CAA) Type() Type { return TypeCAA }
+
+func (r *CAA) String() string {
+	return fmt.Sprintf("%d %s %s", r.Flags, r.Tag, quoteString(r.Value))
+}
+
+func (r *CAA) pack(b *builder) error {
+	if len(r.Tag) == 0 || len(r.Tag) > 255 {
+		return fmt.Errorf("invalid CAA tag length %d", len(r.Tag))
+	}
+	b.u8(r.Flags)
+	b.u8(uint8(len(r.Tag)))
+	b.bytes([]byte(r.Tag))
+	b.bytes([]byte(r.Value))
+	return nil
+}
+
+// Unknown holds the raw data of a record type this package does not model,
+// using the RFC 3597 generic presentation format.
+type Unknown struct {
+	RRType Type
+	Data   []byte
+}
+
+func (r *Unknown) Type() Type { return r.RRType }
+
+func (r *Unknown) String() string {
+	return fmt.Sprintf("\\# %d %s", len(r.Data), hex.EncodeToString(r.Data))
+}
+
+func (r *Unknown) pack(b *builder) error {
+	b.bytes(r.Data)
+	return nil
+}
+
+func parseRData(msg []byte, off, length int, t Type) (RData, error) {
+	if length == 0 {
+		// Empty data is only meaningful for meta records such as OPT or
+		// UPDATE deletions; it is left as nil.
+		return nil, nil
+	}
+	end := off + length
+	data := msg[off:end]
+
+	// Embedded names are decoded against msg[:end] so they cannot run
+	// past the record data.
+	readRDName := func(at int) (string, int, error) {
+		return readName(msg[:end], at)
+	}
+
+	switch t {
+	case TypeA:
+		if length != net.IPv4len {
+			return nil, ErrBadRDLength
+		}
+		return &A{IP: net.IP(append([]byte(nil), data...))}, nil
+	case TypeAAAA:
+		if length != net.IPv6len {
+			return nil, ErrBadRDLength
+		}
+		return &AAAA{IP: net.IP(append([]byte(nil), data...))}, nil
+	case TypeNS, TypeCNAME, TypePTR:
+		name, next, err := readRDName(off)
+		if err != nil {
+			return nil, err
+		}
+		if next != end {
+			return nil, ErrBadRDLength
+		}
+		switch t {
+		case TypeNS:
+			return &NS{Host: name}, nil
+		case TypeCNAME:
+			return &CNAME{Target: name}, nil
+		default:
+			return &PTR{Target: name}, nil
+		}
+	case TypeMX:
+		if length < 3 {
+			return nil, ErrBadRDLength
+		}
+		name, next, err := readRDName(off + 2)
+		if err != nil {
+			return nil, err
+		}
+		if next != end {
+			return nil, ErrBadRDLength
+		}
+		return &MX{Preference: binary.BigEndian.Uint16(data), Exchange: name}, nil
+	case TypeTXT:
+		r := &TXT{}
+		for i := 0; i < len(data); {
+			n := int(data[i])
+			if i+1+n > len(data) {
+				return nil, ErrBadRDLength
+			}
+			r.Text = append(r.Text, string(data[i+1:i+1+n]))
+			i += 1 + n
+		}
+		return r, nil
+	case TypeSOA:
+		mname, next, err := readRDName(off)
+		if err != nil {
+			return nil, err
+		}
+		rname, next, err := readRDName(next)
+		if err != nil {
+			return nil, err
+		}
+		if next+20 != end {
+			return nil, ErrBadRDLength
+		}
+		return &SOA{
+			MName:   mname,
+			RName:   rname,
+			Serial:  binary.BigEndian.Uint32(msg[next:]),
+			Refresh: binary.BigEndian.Uint32(msg[next+4:]),
+			Retry:   binary.BigEndian.Uint32(msg[next+8:]),
+			Expire:  binary.BigEndian.Uint32(msg[next+12:]),
+			Minimum: binary.BigEndian.Uint32(msg[next+16:]),
+		}, nil
+	case TypeSRV:
+		if length < 7 {
+			return nil, ErrBadRDLength
+		}
+		name, next, err := readRDName(off + 6)
+		if err != nil {
+			return nil, err
+		}
+		if next != end {
+			return nil, ErrBadRDLength
+		}
+		return &SRV{
+			Priority: binary.BigEndian.Uint16(data),
+			Weight:   binary.BigEndian.Uint16(data[2:]),
+			Port:     binary.BigEndian.Uint16(data[4:]),
+			Target:   name,
+		}, nil
+	case TypeOPT:
+		return parseOPT(data)
+	case TypeTSIG:
+		return parseTSIG(msg, off, end)
+	case TypeCAA:
+		if length < 2 || 2+int(data[1]) > length {
+			return nil, ErrBadRDLength
+		}
+		tagEnd := 2 + int(data[1])
+		return &CAA{
+			Flags: data[0],
+			Tag:   string(data[2:tagEnd]),
+			Value: string(data[tagEnd:]),
+		}, nil
+	}
+	if r, ok, err := parseDNSSEC(msg, off, end, t); ok {
+		return r, err
+	}
+
+	return &Unknown{RRType: t, Data: append([]byte(nil), data...)}, nil
+}
+
+// quoteString renders a character-string in presentation format.
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			sb.WriteString("\\" + fmt.Sprintf("%03d", c))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,41 @@
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ReadStream reads one message framed with the two byte length prefix used
+// by DNS over TCP (RFC 1035 section 4.2.2).
+func ReadStream(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(prefix[:]))
+	if n < headerLen {
+		return nil, ErrShortMessage
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteStream writes msg with its two byte length prefix in a single write
+// so that concurrent responses on a connection never interleave.
+func WriteStream(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return ErrTooLarge
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
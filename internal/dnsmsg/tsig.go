@@ -0,0 +1,113 @@
+package dnsmsg
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// TSIG is a transaction signature (RFC 8945 section 4.2). It is always the
+// last record of a message, owned by the name of the key.
+type TSIG struct {
+	Algorithm string
+	// TimeSigned is in seconds since the epoch and is sent as 48 bits.
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      RCode
+	OtherData  []byte
+}
+
+func (*TSIG) Type() Type { return TypeTSIG }
+
+func (r *TSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %d %s %d",
+		Fqdn(r.Algorithm), r.TimeSigned, r.Fudge, len(r.MAC), base64.StdEncoding.EncodeToString(r.MAC),
+		r.OriginalID, r.Error, len(r.OtherData))
+}
+
+func (r *TSIG) pack(b *builder) error {
+	// The algorithm name is never compressed (RFC 8945 section 4.2).
+	if err := b.name(r.Algorithm, false); err != nil {
+		return err
+	}
+	b.u16(uint16(r.TimeSigned >> 32))
+	b.u32(uint32(r.TimeSigned))
+	b.u16(r.Fudge)
+	b.u16(uint16(len(r.MAC)))
+	b.bytes(r.MAC)
+	b.u16(r.OriginalID)
+	b.u16(uint16(r.Error))
+	b.u16(uint16(len(r.OtherData)))
+	b.bytes(r.OtherData)
+	return nil
+}
+
+func parseTSIG(msg []byte, off, end int) (*TSIG, error) {
+	alg, next, err := readName(msg[:end], off)
+	if err != nil {
+		return nil, err
+	}
+	if next+10 > end {
+		return nil, ErrBadRDLength
+	}
+	r := &TSIG{
+		Algorithm:  alg,
+		TimeSigned: uint64(binary.BigEndian.Uint16(msg[next:]))<<32 | uint64(binary.BigEndian.Uint32(msg[next+2:])),
+		Fudge:      binary.BigEndian.Uint16(msg[next+6:]),
+	}
+	macLen := int(binary.BigEndian.Uint16(msg[next+8:]))
+	next += 10
+	if next+macLen+6 > end {
+		return nil, ErrBadRDLength
+	}
+	r.MAC = append([]byte(nil), msg[next:next+macLen]...)
+	next += macLen
+	r.OriginalID = binary.BigEndian.Uint16(msg[next:])
+	r.Error = RCode(binary.BigEndian.Uint16(msg[next+2:]))
+	otherLen := int(binary.BigEndian.Uint16(msg[next+4:]))
+	next += 6
+	if next+otherLen != end {
+		return nil, ErrBadRDLength
+	}
+	r.OtherData = append([]byte(nil), msg[next:end]...)
+	return r, nil
+}
+
+// WithoutLastRecord returns a copy of msg without its last additional
+// record and with ARCOUNT lowered to match. This is the form of a message
+// a TSIG record signs (RFC 8945 section 4.3.3).
+func WithoutLastRecord(msg []byte) ([]byte, error) {
+	if len(msg) < headerLen {
+		return nil, ErrShortMessage
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+	if counts[3] == 0 {
+		return nil, fmt.Errorf("dnsmsg: message has no additional records")
+	}
+
+	off := headerLen
+	var err error
+	for i := 0; i < counts[0]; i++ {
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	for i := 0; i < counts[1]+counts[2]+counts[3]-1; i++ {
+		if _, off, err = readRR(msg, off); err != nil {
+			return nil, err
+		}
+	}
+	if off > len(msg) {
+		return nil, ErrShortMessage
+	}
+
+	out := append([]byte(nil), msg[:off]...)
+	binary.BigEndian.PutUint16(out[10:], uint16(counts[3]-1))
+	return out, nil
+}
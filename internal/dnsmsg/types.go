@@ -0,0 +1,178 @@
+package dnsmsg
+
+import "strconv"
+
+// Type is a resource record type (RFC 1035 section 3.2.2).
+type Type uint16
+
+const (
+	TypeA          Type = 1
+	TypeNS         Type = 2
+	TypeCNAME      Type = 5
+	TypeSOA        Type = 6
+	TypePTR        Type = 12
+	TypeMX         Type = 15
+	TypeTXT        Type = 16
+	TypeAAAA       Type = 28
+	TypeSRV        Type = 33
+	TypeOPT        Type = 41
+	TypeDS         Type = 43
+	TypeRRSIG      Type = 46
+	TypeNSEC       Type = 47
+	TypeDNSKEY     Type = 48
+	TypeNSEC3      Type = 50
+	TypeNSEC3PARAM Type = 51
+	TypeTSIG       Type = 250
+	TypeIXFR       Type = 251
+	TypeAXFR       Type = 252
+	TypeANY        Type = 255
+	TypeCAA        Type = 257
+)
+
+var typeNames = map[Type]string{
+	TypeA:          "A",
+	TypeNS:         "NS",
+	TypeCNAME:      "CNAME",
+	TypeSOA:        "SOA",
+	TypePTR:        "PTR",
+	TypeMX:         "MX",
+	TypeTXT:        "TXT",
+	TypeAAAA:       "AAAA",
+	TypeSRV:        "SRV",
+	TypeOPT:        "OPT",
+	TypeDS:         "DS",
+	TypeRRSIG:      "RRSIG",
+	TypeNSEC:       "NSEC",
+	TypeDNSKEY:     "DNSKEY",
+	TypeNSEC3:      "NSEC3",
+	TypeNSEC3PARAM: "NSEC3PARAM",
+	TypeTSIG:       "TSIG",
+	TypeIXFR:       "IXFR",
+	TypeAXFR:       "AXFR",
+	TypeANY:        "ANY",
+	TypeCAA:        "CAA",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// ParseType converts a mnemonic such as "AAAA" or the generic "TYPE28" form
+// into a Type.
+func ParseType(s string) (Type, bool) {
+	for t, name := range typeNames {
+		if name == s {
+			return t, true
+		}
+	}
+	if len(s) > 4 && s[:4] == "TYPE" {
+		n, err := strconv.ParseUint(s[4:], 10, 16)
+		if err == nil {
+			return Type(n), true
+		}
+	}
+	return 0, false
+}
+
+// Class is a resource record class (RFC 1035 section 3.2.4).
+type Class uint16
+
+const (
+	ClassINET  Class = 1
+	ClassCHAOS Class = 3
+	ClassNONE  Class = 254
+	ClassANY   Class = 255
+)
+
+var classNames = map[Class]string{
+	ClassINET:  "IN",
+	ClassCHAOS: "CH",
+	ClassNONE:  "NONE",
+	ClassANY:   "ANY",
+}
+
+func (c Class) String() string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+// Opcode is the kind of query carried in the header.
+type Opcode uint8
+
+const (
+	OpcodeQuery  Opcode = 0
+	OpcodeStatus Opcode = 2
+	OpcodeNotify Opcode = 4
+	OpcodeUpdate Opcode = 5
+)
+
+var opcodeNames = map[Opcode]string{
+	OpcodeQuery:  "QUERY",
+	OpcodeStatus: "STATUS",
+	OpcodeNotify: "NOTIFY",
+	OpcodeUpdate: "UPDATE",
+}
+
+func (o Opcode) String() string {
+	if name, ok := opcodeNames[o]; ok {
+		return name
+	}
+	return "OPCODE" + strconv.Itoa(int(o))
+}
+
+// RCode is a response code.
+type RCode uint16
+
+const (
+	RCodeSuccess        RCode = 0
+	RCodeFormatError    RCode = 1
+	RCodeServerFailure  RCode = 2
+	RCodeNameError      RCode = 3
+	RCodeNotImplemented RCode = 4
+	RCodeRefused        RCode = 5
+	RCodeYXDomain       RCode = 6
+	RCodeYXRRSet        RCode = 7
+	RCodeNXRRSet        RCode = 8
+	RCodeNotAuth        RCode = 9
+	RCodeNotZone        RCode = 10
+
+	// Extended RCODEs need the upper bits carried in the OPT record.
+	RCodeBadVersion RCode = 16
+
+	// TSIG errors are only carried in the TSIG record (RFC 8945 section
+	// 3). BADSIG shares its value with BADVERS.
+	RCodeBadSig   RCode = 16
+	RCodeBadKey   RCode = 17
+	RCodeBadTime  RCode = 18
+	RCodeBadTrunc RCode = 22
+)
+
+var rcodeNames = map[RCode]string{
+	RCodeSuccess:        "NOERROR",
+	RCodeFormatError:    "FORMERR",
+	RCodeServerFailure:  "SERVFAIL",
+	RCodeNameError:      "NXDOMAIN",
+	RCodeNotImplemented: "NOTIMP",
+	RCodeRefused:        "REFUSED",
+	RCodeYXDomain:       "YXDOMAIN",
+	RCodeYXRRSet:        "YXRRSET",
+	RCodeNXRRSet:        "NXRRSET",
+	RCodeNotAuth:        "NOTAUTH",
+	RCodeNotZone:        "NOTZONE",
+	RCodeBadVersion:     "BADVERS",
+	RCodeBadKey:         "BADKEY",
+	RCodeBadTime:        "BADTIME",
+	RCodeBadTrunc:       "BADTRUNC",
+}
+
+func (r RCode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(r))
+}
@@ -0,0 +1,312 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"slices"
+	"strings"
+)
+
+// nsec3SHA1 is the only NSEC3 hash algorithm (RFC 5155 section 11).
+const nsec3SHA1 = 1
+
+// Contents lists the types every owner name of a zone has, leaving out the
+// DNSSEC types the signer adds itself. The apex must be included.
+type Contents map[string][]dnsmsg.Type
+
+// Denial is what a negative or wildcard answer has to prove.
+type Denial int
+
+const (
+	// NameError proves that the name does not exist (NXDOMAIN).
+	NameError Denial = iota
+	// NoData proves that the name exists without the queried type.
+	NoData
+	// WildcardAnswer proves that the name does not exist itself, so a
+	// wildcard could answer for it.
+	WildcardAnswer
+	// WildcardNoData proves that the name does not exist and that the
+	// wildcard that would answer for it lacks the queried type.
+	WildcardNoData
+)
+
+// Chain is the NSEC or NSEC3 chain of a zone, built from its contents at
+// one version.
+type Chain struct {
+	zone    *Zone
+	version uint64
+	// names are the owners with records in canonical order, each with the
+	// types of its NSEC record. exists also has the empty non-terminals.
+	names  []string
+	types  map[string][]dnsmsg.Type
+	exists map[string]bool
+	// hashes are the NSEC3 owners in hash order, each with the name it was
+	// hashed from.
+	hashes []hashedName
+}
+
+type hashedName struct {
+	hash []byte
+	name string
+}
+
+// Chain returns the denial chain of z. It is rebuilt from contents only
+// when version differs from that of the chain built last, so version must
+// change whenever the contents do.
+func (m *Manager) Chain(z *Zone, version uint64, contents func() Contents) *Chain {
+	m.cacheMu.Lock()
+	c, ok := m.chains[z.Name]
+	m.cacheMu.Unlock()
+	if ok && c.zone == z && c.version == version {
+		return c
+	}
+
+	c = buildChain(z, version, contents())
+	m.cacheMu.Lock()
+	m.chains[z.Name] = c
+	m.cacheMu.Unlock()
+	return c
+}
+
+func buildChain(z *Zone, version uint64, contents Contents) *Chain {
+	c := &Chain{
+		zone:    z,
+		version: version,
+		types:   make(map[string][]dnsmsg.Type),
+		exists:  make(map[string]bool),
+	}
+	contents[z.Name] = append(slices.Clone(contents[z.Name]), dnsmsg.TypeDNSKEY)
+	if z.NSEC3 {
+		contents[z.Name] = append(contents[z.Name], dnsmsg.TypeNSEC3PARAM)
+	}
+
+	for name, types := range contents {
+		if !dnsmsg.IsSubdomain(name, z.Name) || len(types) == 0 {
+			continue
+		}
+		types = append(slices.Clone(types), dnsmsg.TypeRRSIG)
+		if !z.NSEC3 {
+			types = append(types, dnsmsg.TypeNSEC)
+		}
+		c.types[name] = types
+		for n := name; n != z.Name && !c.exists[n]; n = parent(n) {
+			c.exists[n] = true
+		}
+		c.exists[z.Name] = true
+	}
+
+	if !z.NSEC3 {
+		for name := range c.types {
+			c.names = append(c.names, name)
+		}
+		slices.SortFunc(c.names, manager.CompareNames)
+		return c
+	}
+
+	salt := z.salt()
+	for name := range c.exists {
+		if z.OptOut && name != z.Name && insecureDelegation(c.types[name]) {
+			continue
+		}
+		c.hashes = append(c.hashes, hashedName{hash: hashName(name, salt, z.Iterations), name: name})
+	}
+	slices.SortFunc(c.hashes, func(a, b hashedName) int { return bytes.Compare(a.hash, b.hash) })
+	return c
+}
+
+// insecureDelegation reports whether a name owning types is a delegation
+// without DS records, which opt-out leaves out of the NSEC3 chain.
+func insecureDelegation(types []dnsmsg.Type) bool {
+	for _, t := range types {
+		if t != dnsmsg.TypeNS && t != dnsmsg.TypeRRSIG {
+			return false
+		}
+	}
+	return slices.Contains(types, dnsmsg.TypeNS)
+}
+
+// Deny returns the NSEC or NSEC3 records proving denial for qname, with
+// the given TTL, which is the negative caching TTL of the zone.
+func (c *Chain) Deny(qname string, denial Denial, ttl uint32) []dnsmsg.ResourceRecord {
+	qname = dnsmsg.CanonicalName(qname)
+	if !dnsmsg.IsSubdomain(qname, c.zone.Name) {
+		return nil
+	}
+	if c.zone.NSEC3 {
+		return dedupe(c.denyNSEC3(qname, denial, ttl))
+	}
+	return dedupe(c.denyNSEC(qname, denial, ttl))
+}
+
+// denyNSEC builds the proofs of RFC 4035 section 3.1.3.
+func (c *Chain) denyNSEC(qname string, denial Denial, ttl uint32) []dnsmsg.ResourceRecord {
+	switch denial {
+	case NoData:
+		if _, ok := c.types[qname]; ok {
+			return []dnsmsg.ResourceRecord{c.nsec(qname, ttl)}
+		}
+		// An empty non-terminal is proven by the record covering it.
+		return []dnsmsg.ResourceRecord{c.coverNSEC(qname, ttl)}
+	case WildcardAnswer:
+		return []dnsmsg.ResourceRecord{c.coverNSEC(qname, ttl)}
+	case WildcardNoData:
+		ce := c.closestEncloser(qname)
+		return []dnsmsg.ResourceRecord{c.coverNSEC(qname, ttl), c.coverNSEC("*."+ce, ttl)}
+	}
+	ce := c.closestEncloser(qname)
+	return []dnsmsg.ResourceRecord{c.coverNSEC(qname, ttl), c.coverNSEC("*."+ce, ttl)}
+}
+
+// nsec returns the NSEC record owned by name, which is in the chain.
+func (c *Chain) nsec(name string, ttl uint32) dnsmsg.ResourceRecord {
+	i, _ := slices.BinarySearchFunc(c.names, name, manager.CompareNames)
+	next := c.names[(i+1)%len(c.names)]
+	return dnsmsg.NewRR(name, ttl, &dnsmsg.NSEC{NextName: next, Types: c.types[name]})
+}
+
+// coverNSEC returns the NSEC record matching or covering name: the one of
+// the last owner that sorts before it.
+func (c *Chain) coverNSEC(name string, ttl uint32) dnsmsg.ResourceRecord {
+	i, found := slices.BinarySearchFunc(c.names, name, manager.CompareNames)
+	if !found {
+		// The apex sorts before every name of the zone, so i > 0.
+		i--
+	}
+	return c.nsec(c.names[max(i, 0)], ttl)
+}
+
+// denyNSEC3 builds the proofs of RFC 5155 section 7.2.
+func (c *Chain) denyNSEC3(qname string, denial Denial, ttl uint32) []dnsmsg.ResourceRecord {
+	ce, next := c.closestProvable(qname)
+	var rrs []dnsmsg.ResourceRecord
+	switch denial {
+	case NoData:
+		if rr, ok := c.matchNSEC3(qname, ttl); ok {
+			return []dnsmsg.ResourceRecord{rr}
+		}
+		// The name was opted out, so only the closest encloser and the
+		// opt-out span covering the next closer name are proven.
+		fallthrough
+	case NameError:
+		if rr, ok := c.matchNSEC3(ce, ttl); ok {
+			rrs = append(rrs, rr)
+		}
+		rrs = append(rrs, c.coverNSEC3(next, ttl))
+		if denial == NameError {
+			rrs = append(rrs, c.coverNSEC3("*."+ce, ttl))
+		}
+	case WildcardAnswer:
+		rrs = append(rrs, c.coverNSEC3(next, ttl))
+	case WildcardNoData:
+		if rr, ok := c.matchNSEC3(ce, ttl); ok {
+			rrs = append(rrs, rr)
+		}
+		rrs = append(rrs, c.coverNSEC3(next, ttl))
+		if rr, ok := c.matchNSEC3("*."+ce, ttl); ok {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// closestEncloser returns the closest existing ancestor of qname.
+func (c *Chain) closestEncloser(qname string) string {
+	for n := parent(qname); ; n = parent(n) {
+		if c.exists[n] || n == c.zone.Name || n == "" {
+			return n
+		}
+	}
+}
+
+// closestProvable returns the closest ancestor of qname that has an NSEC3
+// record, along with the next closer name: the name one label longer on
+// the way to qname (RFC 5155 section 1.3).
+func (c *Chain) closestProvable(qname string) (ce, next string) {
+	next = qname
+	for n := parent(qname); ; n = parent(n) {
+		if n == c.zone.Name || n == "" || c.exists[n] && c.inNSEC3(n) {
+			return n, next
+		}
+		next = n
+	}
+}
+
+func (c *Chain) inNSEC3(name string) bool {
+	_, found := c.searchHash(hashName(name, c.zone.salt(), c.zone.Iterations))
+	return found
+}
+
+func (c *Chain) searchHash(hash []byte) (int, bool) {
+	return slices.BinarySearchFunc(c.hashes, hash, func(h hashedName, target []byte) int {
+		return bytes.Compare(h.hash, target)
+	})
+}
+
+// matchNSEC3 returns the NSEC3 record of name when it is in the chain.
+func (c *Chain) matchNSEC3(name string, ttl uint32) (dnsmsg.ResourceRecord, bool) {
+	i, found := c.searchHash(hashName(name, c.zone.salt(), c.zone.Iterations))
+	if !found {
+		return dnsmsg.ResourceRecord{}, false
+	}
+	return c.nsec3(i, ttl), true
+}
+
+// coverNSEC3 returns the NSEC3 record whose span covers the hash of name.
+func (c *Chain) coverNSEC3(name string, ttl uint32) dnsmsg.ResourceRecord {
+	i, found := c.searchHash(hashName(name, c.zone.salt(), c.zone.Iterations))
+	if !found {
+		// The last hash covers the span wrapping around to the first.
+		i = (i - 1 + len(c.hashes)) % len(c.hashes)
+	}
+	return c.nsec3(i, ttl)
+}
+
+func (c *Chain) nsec3(i int, ttl uint32) dnsmsg.ResourceRecord {
+	h := c.hashes[i]
+	next := c.hashes[(i+1)%len(c.hashes)]
+	owner := strings.ToLower(dnsmsg.Base32Hex.EncodeToString(h.hash)) + "." + c.zone.Name
+	return dnsmsg.NewRR(owner, ttl, &dnsmsg.NSEC3{
+		HashAlgorithm: nsec3SHA1,
+		Flags:         c.zone.nsec3Flags(),
+		Iterations:    c.zone.Iterations,
+		Salt:          c.zone.salt(),
+		NextHashed:    next.hash,
+		Types:         c.types[h.name],
+	})
+}
+
+// hashName computes the NSEC3 hash of name (RFC 5155 section 5).
+func hashName(name string, salt []byte, iterations uint16) []byte {
+	wire, err := dnsmsg.WireName(name)
+	if err != nil {
+		return nil
+	}
+	h := sha1.Sum(append(wire, salt...))
+	for range iterations {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return h[:]
+}
+
+// parent returns name without its first label.
+func parent(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i < 0 {
+		return ""
+	}
+	return name[i+1:]
+}
+
+func dedupe(rrs []dnsmsg.ResourceRecord) []dnsmsg.ResourceRecord {
+	seen := make(map[string]bool, len(rrs))
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if !seen[rr.Name] {
+			seen[rr.Name] = true
+			out = append(out, rr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,239 @@
+package dnssec
+
+import (
+	"bytes"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHashName(t *testing.T) {
+	// RFC 5155 appendix A: salt aabbccdd and 12 additional iterations.
+	salt, _ := hex.DecodeString("aabbccdd")
+	tests := map[string]string{
+		"example":       "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example":     "35mthgpgcu1qg68fab165klnsnk3dpvl",
+		"ai.example":    "gjeqe526plbf1g8mklp59enfd789njgi",
+		"ns1.example":   "2t7b4g4vsa5smi47k61mv5bv1a22bojr",
+		"ns2.example":   "q04jkcevqvmu85r014c7dkba38o0ji5r",
+		"w.example":     "k8udemvp1j2f7eg6jebps17vp3n8i58h",
+		"*.w.example":   "r53bq7cc2uvmubfu5ocmm6pers9tk9en",
+		"x.w.example":   "b4um86eghhds6nea196smvmlo4ors995",
+		"y.w.example":   "ji6neoaepv8b5o6k4ev33abha8ht9fgc",
+		"x.y.w.example": "2vptu5timamqttgl4luu9kg21e0aor3s",
+		"xx.example":    "t644ebqk9bibcna874givr6joj62mlhv",
+	}
+	for name, want := range tests {
+		got := strings.ToLower(dnsmsg.Base32Hex.EncodeToString(hashName(name, salt, 12)))
+		if got != want {
+			t.Errorf("hash of %s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+// exampleContents is the zone of RFC 4035 appendix A without its DNSSEC
+// records: a.example is a delegation and w.example an empty non-terminal.
+func exampleContents() Contents {
+	return Contents{
+		"example":       {dnsmsg.TypeSOA, dnsmsg.TypeNS, dnsmsg.TypeMX},
+		"a.example":     {dnsmsg.TypeNS},
+		"ai.example":    {dnsmsg.TypeA, dnsmsg.TypeAAAA},
+		"ns1.example":   {dnsmsg.TypeA},
+		"ns2.example":   {dnsmsg.TypeA},
+		"*.w.example":   {dnsmsg.TypeMX},
+		"x.w.example":   {dnsmsg.TypeMX},
+		"x.y.w.example": {dnsmsg.TypeMX},
+		"xx.example":    {dnsmsg.TypeA},
+	}
+}
+
+func exampleChain(s Settings) *Chain {
+	return buildChain(&Zone{Name: "example", Settings: s}, 1, exampleContents())
+}
+
+func TestNSECChainIsCanonical(t *testing.T) {
+	c := exampleChain(Settings{})
+	want := []string{"example", "a.example", "ai.example", "ns1.example", "ns2.example", "*.w.example", "x.w.example", "x.y.w.example", "xx.example"}
+	if !slices.Equal(c.names, want) {
+		t.Errorf("chain %v, want %v", c.names, want)
+	}
+	if !c.exists["w.example"] || !c.exists["y.w.example"] {
+		t.Error("empty non-terminals are missing")
+	}
+	apex := c.types["example"]
+	for _, typ := range []dnsmsg.Type{dnsmsg.TypeDNSKEY, dnsmsg.TypeRRSIG, dnsmsg.TypeNSEC} {
+		if !slices.Contains(apex, typ) {
+			t.Errorf("apex types %v lack %s", apex, typ)
+		}
+	}
+}
+
+func TestDenyNSEC(t *testing.T) {
+	c := exampleChain(Settings{})
+	type span struct{ owner, next string }
+
+	tests := []struct {
+		name   string
+		qname  string
+		denial Denial
+		want   []span
+	}{
+		// The covering record and the one covering the wildcard of the
+		// closest encloser, *.example, which sorts right after the apex.
+		{"name error", "b.example", NameError, []span{{"ai.example", "ns1.example"}, {"example", "a.example"}}},
+		{"name error after the last name", "zz.example", NameError, []span{{"xx.example", "example"}, {"example", "a.example"}}},
+		{"no data", "ai.example", NoData, []span{{"ai.example", "ns1.example"}}},
+		{"empty non-terminal", "w.example", NoData, []span{{"ns2.example", "*.w.example"}}},
+		{"wildcard answer", "z.w.example", WildcardAnswer, []span{{"x.y.w.example", "xx.example"}}},
+		{"wildcard no data", "z.w.example", WildcardNoData, []span{{"x.y.w.example", "xx.example"}, {"*.w.example", "x.w.example"}}},
+		{"outside the zone", "example.com", NameError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []span
+			for _, rr := range c.Deny(tt.qname, tt.denial, 3600) {
+				nsec, ok := rr.Data.(*dnsmsg.NSEC)
+				if !ok || rr.TTL != 3600 {
+					t.Fatalf("proof record %v", rr)
+				}
+				got = append(got, span{rr.Name, nsec.NextName})
+				if manager.CompareNames(rr.Name, nsec.NextName) >= 0 && nsec.NextName != "example" {
+					t.Errorf("NSEC of %s points back to %s", rr.Name, nsec.NextName)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Deny(%s) = %v, want %v", tt.qname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDenyNSEC3(t *testing.T) {
+	salt := "aabbccdd"
+	c := exampleChain(Settings{NSEC3: true, Iterations: 12, Salt: salt})
+	rawSalt, _ := hex.DecodeString(salt)
+	hash := func(name string) []byte { return hashName(name, rawSalt, 12) }
+
+	// proof checks that rr is the NSEC3 record owned by the hash of name
+	// when match is set, and that it covers that hash otherwise.
+	proof := func(t *testing.T, rr dnsmsg.ResourceRecord, name string, match bool) {
+		t.Helper()
+		nsec3, ok := rr.Data.(*dnsmsg.NSEC3)
+		if !ok {
+			t.Fatalf("proof record %v", rr)
+		}
+		label, _, _ := strings.Cut(rr.Name, ".")
+		owner, err := dnsmsg.Base32Hex.DecodeString(strings.ToUpper(label))
+		if err != nil || !strings.HasSuffix(rr.Name, ".example") {
+			t.Fatalf("NSEC3 owner %s", rr.Name)
+		}
+		if nsec3.Iterations != 12 || !bytes.Equal(nsec3.Salt, rawSalt) || nsec3.HashAlgorithm != nsec3SHA1 {
+			t.Errorf("NSEC3 parameters %v", nsec3)
+		}
+		h := hash(name)
+		if match {
+			if !bytes.Equal(owner, h) {
+				t.Errorf("%s does not match %s", rr.Name, name)
+			}
+			return
+		}
+		next := nsec3.NextHashed
+		covered := bytes.Compare(owner, h) < 0 && bytes.Compare(h, next) < 0
+		if bytes.Compare(next, owner) <= 0 {
+			// The last record covers the span wrapping around.
+			covered = bytes.Compare(owner, h) < 0 || bytes.Compare(h, next) < 0
+		}
+		if !covered {
+			t.Errorf("%s does not cover %s", rr.Name, name)
+		}
+	}
+
+	t.Run("chain", func(t *testing.T) {
+		// Every name and empty non-terminal, in hash order.
+		if len(c.hashes) != 11 {
+			t.Fatalf("chain has %d hashes, want 11", len(c.hashes))
+		}
+		if !slices.IsSortedFunc(c.hashes, func(a, b hashedName) int { return bytes.Compare(a.hash, b.hash) }) {
+			t.Error("chain is not in hash order")
+		}
+	})
+	t.Run("name error", func(t *testing.T) {
+		// RFC 5155 appendix B.1: closest encloser x.w.example, next closer
+		// c.x.w.example and wildcard *.x.w.example.
+		rrs := c.Deny("a.c.x.w.example", NameError, 3600)
+		if len(rrs) != 3 {
+			t.Fatalf("%d proof records, want 3", len(rrs))
+		}
+		proof(t, rrs[0], "x.w.example", true)
+		proof(t, rrs[1], "c.x.w.example", false)
+		proof(t, rrs[2], "*.x.w.example", false)
+	})
+	t.Run("no data", func(t *testing.T) {
+		rrs := c.Deny("ns1.example", NoData, 3600)
+		if len(rrs) != 1 {
+			t.Fatalf("%d proof records, want 1", len(rrs))
+		}
+		proof(t, rrs[0], "ns1.example", true)
+		if types := rrs[0].Data.(*dnsmsg.NSEC3).Types; slices.Contains(types, dnsmsg.TypeNSEC) || !slices.Contains(types, dnsmsg.TypeA) {
+			t.Errorf("NSEC3 of ns1.example has types %v", types)
+		}
+	})
+	t.Run("empty non-terminal", func(t *testing.T) {
+		rrs := c.Deny("y.w.example", NoData, 3600)
+		if len(rrs) != 1 {
+			t.Fatalf("%d proof records, want 1", len(rrs))
+		}
+		proof(t, rrs[0], "y.w.example", true)
+	})
+	t.Run("wildcard no data", func(t *testing.T) {
+		// RFC 5155 appendix B.4.
+		rrs := c.Deny("a.z.w.example", WildcardNoData, 3600)
+		if len(rrs) != 3 {
+			t.Fatalf("%d proof records, want 3", len(rrs))
+		}
+		proof(t, rrs[0], "w.example", true)
+		proof(t, rrs[1], "z.w.example", false)
+		proof(t, rrs[2], "*.w.example", true)
+	})
+	t.Run("opt-out leaves insecure delegations out", func(t *testing.T) {
+		c := exampleChain(Settings{NSEC3: true, OptOut: true, Iterations: 12, Salt: salt})
+		for _, h := range c.hashes {
+			if h.name == "a.example" {
+				t.Error("the delegation a.example is in the chain")
+			}
+		}
+		rrs := c.Deny("a.example", NoData, 3600)
+		if len(rrs) != 2 {
+			t.Fatalf("%d proof records, want 2", len(rrs))
+		}
+		proof(t, rrs[0], "example", true)
+		proof(t, rrs[1], "a.example", false)
+		if flags := rrs[1].Data.(*dnsmsg.NSEC3).Flags; flags&dnsmsg.NSEC3OptOut == 0 {
+			t.Error("the covering record lacks the opt-out flag")
+		}
+	})
+}
+
+func TestChainCache(t *testing.T) {
+	m := New()
+	z := &Zone{Name: "example"}
+	builds := 0
+	contents := func() Contents {
+		builds++
+		return exampleContents()
+	}
+
+	first := m.Chain(z, 1, contents)
+	if m.Chain(z, 1, contents) != first || builds != 1 {
+		t.Errorf("chain of the same version was built %d times", builds)
+	}
+	if m.Chain(z, 2, contents) == first || builds != 2 {
+		t.Error("chain was not rebuilt for a new version")
+	}
+	if m.Chain(&Zone{Name: "example"}, 2, contents) == first || builds != 3 {
+		t.Error("chain was not rebuilt for new keys")
+	}
+}
@@ -0,0 +1,403 @@
+package dnssec
+
+import (
+	"crypto/sha256"
+	"dns-server/internal/dnsmsg"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultValidity is how long the signatures made are valid.
+	DefaultValidity = 7 * 24 * time.Hour
+	// DefaultMaxSignatures bounds the number of cached signatures.
+	DefaultMaxSignatures = 10000
+	// MaxIterations is the largest number of additional NSEC3 hash
+	// iterations accepted. RFC 9276 recommends none at all, and validators
+	// may treat zones using many as insecure.
+	MaxIterations = 100
+	// inceptionSkew backdates signatures for validators whose clocks are
+	// behind.
+	inceptionSkew = time.Hour
+)
+
+// Settings choose how a zone is signed and how it denies existence.
+type Settings struct {
+	// Algorithm is the signing algorithm, ecdsap256sha256 by default.
+	Algorithm string `json:"algorithm"`
+	// NSEC3 selects hashed denial of existence (RFC 5155) over NSEC.
+	NSEC3 bool `json:"nsec3"`
+	// OptOut leaves names that only own NS records, i.e. insecure
+	// delegations, out of the NSEC3 chain.
+	OptOut     bool   `json:"opt_out,omitempty"`
+	Iterations uint16 `json:"iterations,omitempty"`
+	// Salt is the NSEC3 salt in hex. RFC 9276 recommends none.
+	Salt string `json:"salt,omitempty"`
+}
+
+// Normalize canonicalises the algorithm name and checks the NSEC3
+// parameters.
+func (s *Settings) Normalize() error {
+	alg, err := ParseAlgorithm(s.Algorithm)
+	if err != nil {
+		return err
+	}
+	s.Algorithm = AlgorithmName(alg)
+
+	s.Salt = strings.ToLower(strings.TrimSpace(s.Salt))
+	if s.Salt == "-" {
+		s.Salt = ""
+	}
+	if !s.NSEC3 {
+		if s.OptOut || s.Iterations != 0 || s.Salt != "" {
+			return fmt.Errorf("opt_out, iterations and salt only apply to NSEC3")
+		}
+		return nil
+	}
+	if s.Iterations > MaxIterations {
+		return fmt.Errorf("at most %d NSEC3 iterations are allowed", MaxIterations)
+	}
+	if salt, err := hex.DecodeString(s.Salt); err != nil || len(salt) > 255 {
+		return fmt.Errorf("invalid NSEC3 salt %q, expected up to 255 bytes in hex", s.Salt)
+	}
+	return nil
+}
+
+func (s Settings) salt() []byte {
+	salt, _ := hex.DecodeString(s.Salt)
+	return salt
+}
+
+func (s Settings) nsec3Flags() uint8 {
+	if s.OptOut {
+		return dnsmsg.NSEC3OptOut
+	}
+	return 0
+}
+
+// Zone holds the keys a zone is signed with. The key signing key signs the
+// DNSKEY RRset and the zone signing key everything else.
+type Zone struct {
+	Name string `json:"name"`
+	Settings
+	KSK     *Key      `json:"ksk"`
+	ZSK     *Key      `json:"zsk"`
+	Created time.Time `json:"created"`
+}
+
+// NewZone generates the keys to sign the zone name with.
+func NewZone(name string, s Settings) (*Zone, error) {
+	if err := s.Normalize(); err != nil {
+		return nil, err
+	}
+	alg, _ := ParseAlgorithm(s.Algorithm)
+	ksk, err := GenerateKey(alg, FlagKSK)
+	if err != nil {
+		return nil, err
+	}
+	zsk, err := GenerateKey(alg, FlagZSK)
+	if err != nil {
+		return nil, err
+	}
+	return &Zone{
+		Name:     dnsmsg.CanonicalName(name),
+		Settings: s,
+		KSK:      ksk,
+		ZSK:      zsk,
+		Created:  time.Now().UTC(),
+	}, nil
+}
+
+// DNSKEYs returns the DNSKEY RRset published at the apex.
+func (z *Zone) DNSKEYs(ttl uint32) []dnsmsg.ResourceRecord {
+	return []dnsmsg.ResourceRecord{
+		dnsmsg.NewRR(z.Name, ttl, z.KSK.DNSKEY()),
+		dnsmsg.NewRR(z.Name, ttl, z.ZSK.DNSKEY()),
+	}
+}
+
+// DS returns the record to publish in the parent zone to delegate trust
+// to the key signing key.
+func (z *Zone) DS(ttl uint32) (dnsmsg.ResourceRecord, error) {
+	ds, err := DS(z.Name, z.KSK.DNSKEY())
+	if err != nil {
+		return dnsmsg.ResourceRecord{}, err
+	}
+	return dnsmsg.NewRR(z.Name, ttl, ds), nil
+}
+
+// NSEC3PARAM returns the NSEC3PARAM record of the apex, which has no flags
+// set (RFC 5155 section 4.1.2). ok is false for zones using NSEC.
+func (z *Zone) NSEC3PARAM(ttl uint32) (dnsmsg.ResourceRecord, bool) {
+	if !z.NSEC3 {
+		return dnsmsg.ResourceRecord{}, false
+	}
+	return dnsmsg.NewRR(z.Name, ttl, &dnsmsg.NSEC3PARAM{
+		HashAlgorithm: nsec3SHA1,
+		Iterations:    z.Iterations,
+		Salt:          z.salt(),
+	}), true
+}
+
+// DecodeZone parses a value stored in the Redis "dnssec" hash.
+func DecodeZone(value string) (*Zone, error) {
+	var z Zone
+	if err := json.Unmarshal([]byte(value), &z); err != nil {
+		return nil, err
+	}
+	if z.KSK == nil || z.ZSK == nil {
+		return nil, fmt.Errorf("zone %s has no keys", z.Name)
+	}
+	z.Name = dnsmsg.CanonicalName(z.Name)
+	return &z, z.Normalize()
+}
+
+// EncodeZone serialises z, private keys included, for storage in the Redis
+// "dnssec" hash.
+func EncodeZone(z *Zone) (string, error) {
+	b, err := json.Marshal(z)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Manager holds the signed zones and caches the signatures and denial
+// chains made for them.
+type Manager struct {
+	zones         map[string]*Zone
+	validity      time.Duration
+	maxSignatures int
+	mu            sync.RWMutex
+
+	signatures map[[sha256.Size]byte]cachedSignature
+	chains     map[string]*Chain
+	cacheMu    sync.Mutex
+}
+
+// cachedSignature is an RRSIG that is reused until refresh, long before
+// it expires.
+type cachedSignature struct {
+	sig     *dnsmsg.RRSIG
+	refresh time.Time
+}
+
+type Option func(*Manager)
+
+// WithValidity sets how long signatures are valid. Cached signatures are
+// replaced once a quarter of that time has passed.
+func WithValidity(validity time.Duration) Option {
+	return func(m *Manager) {
+		if validity > inceptionSkew {
+			m.validity = validity
+		}
+	}
+}
+
+// WithMaxSignatures bounds how many signatures are cached.
+func WithMaxSignatures(n int) Option {
+	return func(m *Manager) {
+		if n > 0 {
+			m.maxSignatures = n
+		}
+	}
+}
+
+func New(options ...Option) *Manager {
+	m := &Manager{
+		zones:         make(map[string]*Zone),
+		validity:      DefaultValidity,
+		maxSignatures: DefaultMaxSignatures,
+		signatures:    make(map[[sha256.Size]byte]cachedSignature),
+		chains:        make(map[string]*Chain),
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+// Get returns the keys of the zone name when it is signed.
+func (m *Manager) Get(name string) (*Zone, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	z, ok := m.zones[dnsmsg.CanonicalName(name)]
+	return z, ok
+}
+
+// Set starts signing a zone, or replaces its keys and settings.
+func (m *Manager) Set(z *Zone) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zones[z.Name] = z
+}
+
+// Remove stops signing the zone name and reports whether it was signed.
+func (m *Manager) Remove(name string) bool {
+	name = dnsmsg.CanonicalName(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.zones[name]
+	delete(m.zones, name)
+	return ok
+}
+
+// Load replaces the signed zones with the contents of the Redis "dnssec"
+// hash. Entries that cannot be decoded are logged and skipped.
+func (m *Manager) Load(value map[string]string) {
+	zones := make(map[string]*Zone, len(value))
+	for name, raw := range value {
+		z, err := DecodeZone(raw)
+		if err != nil {
+			log.Error().Msgf("Skipping invalid DNSSEC keys of zone %s -> %v", name, err)
+			continue
+		}
+		zones[z.Name] = z
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zones = zones
+}
+
+// Sign returns the RRSIG record covering rrset, whose records share owner,
+// type, class and TTL. For an RRset synthesized from a wildcard, wildcard
+// is the owner of the wildcard; it is empty otherwise. Signatures are
+// cached, so signing the same RRset again is cheap.
+func (m *Manager) Sign(z *Zone, rrset []dnsmsg.ResourceRecord, wildcard string, now time.Time) (dnsmsg.ResourceRecord, error) {
+	first := rrset[0]
+	key := z.ZSK
+	if first.Type == dnsmsg.TypeDNSKEY {
+		key = z.KSK
+	}
+	owner := dnsmsg.CanonicalName(first.Name)
+	signed := owner
+	if wildcard != "" {
+		signed = dnsmsg.CanonicalName(wildcard)
+	}
+	labels, err := dnsmsg.SplitLabels(signed)
+	if err != nil {
+		return dnsmsg.ResourceRecord{}, err
+	}
+	// The asterisk label of a wildcard is not counted (RFC 4034 section
+	// 3.1.3).
+	count := len(labels)
+	if count > 0 && string(labels[0]) == "*" {
+		count--
+	}
+
+	sig := &dnsmsg.RRSIG{
+		TypeCovered: first.Type,
+		Algorithm:   key.Algorithm,
+		Labels:      uint8(count),
+		OriginalTTL: first.TTL,
+		KeyTag:      key.Tag(),
+		SignerName:  z.Name,
+	}
+	records, err := canonicalRRSet(rrset, signed)
+	if err != nil {
+		return dnsmsg.ResourceRecord{}, err
+	}
+
+	id := signatureID(z.Name, sig, records)
+	if cached, ok := m.cachedSignature(id, now); ok {
+		return dnsmsg.NewRR(owner, first.TTL, cached), nil
+	}
+
+	sig.Inception = uint32(now.Add(-inceptionSkew).Unix())
+	sig.Expiration = uint32(now.Add(m.validity).Unix())
+	data, err := dnsmsg.CanonicalRData(sig)
+	if err != nil {
+		return dnsmsg.ResourceRecord{}, err
+	}
+	for _, r := range records {
+		data = append(data, r...)
+	}
+	if sig.Signature, err = key.sign(data); err != nil {
+		return dnsmsg.ResourceRecord{}, err
+	}
+
+	m.storeSignature(id, sig, now)
+	return dnsmsg.NewRR(owner, first.TTL, sig), nil
+}
+
+// canonicalRRSet returns the records of rrset in canonical wire form,
+// owned by signed, sorted by their data and without duplicates (RFC 4034
+// section 6.3).
+func canonicalRRSet(rrset []dnsmsg.ResourceRecord, signed string) ([][]byte, error) {
+	records := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdata, err := dnsmsg.CanonicalRData(rr.Data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rdata)
+	}
+	slices.SortFunc(records, func(a, b []byte) int { return strings.Compare(string(a), string(b)) })
+	records = slices.CompactFunc(records, func(a, b []byte) bool { return string(a) == string(b) })
+
+	first := rrset[0]
+	head, err := dnsmsg.WireName(signed)
+	if err != nil {
+		return nil, err
+	}
+	head = binary.BigEndian.AppendUint16(head, uint16(first.Type))
+	head = binary.BigEndian.AppendUint16(head, uint16(first.Class))
+	head = binary.BigEndian.AppendUint32(head, first.TTL)
+	for i, rdata := range records {
+		rr := binary.BigEndian.AppendUint16(slices.Clone(head), uint16(len(rdata)))
+		records[i] = append(rr, rdata...)
+	}
+	return records, nil
+}
+
+// signatureID identifies what a signature covers and who makes it, which
+// is everything it signs but the validity period.
+func signatureID(zone string, sig *dnsmsg.RRSIG, records [][]byte) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %d %d %d %d\x00", zone, sig.KeyTag, sig.Algorithm, sig.Labels, sig.TypeCovered)
+	for _, r := range records {
+		binary.Write(h, binary.BigEndian, uint16(len(r)))
+		h.Write(r)
+	}
+	var id [sha256.Size]byte
+	h.Sum(id[:0])
+	return id
+}
+
+func (m *Manager) cachedSignature(id [sha256.Size]byte, now time.Time) (*dnsmsg.RRSIG, bool) {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+	cached, ok := m.signatures[id]
+	if !ok || now.After(cached.refresh) {
+		return nil, false
+	}
+	return cached.sig, true
+}
+
+// storeSignature caches sig. When the cache is full the signatures due
+// for refresh are dropped, and everything if that is not enough.
+func (m *Manager) storeSignature(id [sha256.Size]byte, sig *dnsmsg.RRSIG, now time.Time) {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+	if len(m.signatures) >= m.maxSignatures {
+		for k, cached := range m.signatures {
+			if now.After(cached.refresh) {
+				delete(m.signatures, k)
+			}
+		}
+		if len(m.signatures) >= m.maxSignatures {
+			clear(m.signatures)
+		}
+	}
+	m.signatures[id] = cachedSignature{sig: sig, refresh: now.Add(m.validity / 4)}
+}
@@ -0,0 +1,190 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"dns-server/internal/dnsmsg"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1700000000, 0)
+
+func testZone(t *testing.T, algorithm string) *Zone {
+	t.Helper()
+	z, err := NewZone("Example.COM.", Settings{Algorithm: algorithm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func aRR(name, ip string) dnsmsg.ResourceRecord {
+	return dnsmsg.NewRR(name, 300, &dnsmsg.A{IP: net.ParseIP(ip).To4()})
+}
+
+// signedData builds the data an RRSIG signs (RFC 4034 section 3.1.8.1)
+// from the fields of sig and the records of rrset, owned by owner. Only A
+// and DNSKEY records are supported, so that nothing of the signer is
+// reused.
+func signedData(t *testing.T, sig *dnsmsg.RRSIG, owner string, rrset []dnsmsg.ResourceRecord) []byte {
+	t.Helper()
+	wireName := func(name string) []byte {
+		var b []byte
+		for label := range bytes.SplitSeq([]byte(name), []byte(".")) {
+			b = append(b, byte(len(label)))
+			b = append(b, bytes.ToLower(label)...)
+		}
+		return append(b, 0)
+	}
+
+	data := binary.BigEndian.AppendUint16(nil, uint16(sig.TypeCovered))
+	data = append(data, sig.Algorithm, sig.Labels)
+	data = binary.BigEndian.AppendUint32(data, sig.OriginalTTL)
+	data = binary.BigEndian.AppendUint32(data, sig.Expiration)
+	data = binary.BigEndian.AppendUint32(data, sig.Inception)
+	data = binary.BigEndian.AppendUint16(data, sig.KeyTag)
+	data = append(data, wireName(sig.SignerName)...)
+
+	var rdatas [][]byte
+	for _, rr := range rrset {
+		switch d := rr.Data.(type) {
+		case *dnsmsg.A:
+			rdatas = append(rdatas, d.IP.To4())
+		case *dnsmsg.DNSKEY:
+			rdata := binary.BigEndian.AppendUint16(nil, d.Flags)
+			rdatas = append(rdatas, append(append(rdata, d.Protocol, d.Algorithm), d.PublicKey...))
+		default:
+			t.Fatalf("unsupported record %v", rr)
+		}
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	for _, rdata := range rdatas {
+		data = append(data, wireName(owner)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(rrset[0].Type))
+		data = binary.BigEndian.AppendUint16(data, uint16(dnsmsg.ClassINET))
+		data = binary.BigEndian.AppendUint32(data, sig.OriginalTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data
+}
+
+// verify checks the signature of sig over data with key.
+func verify(key *dnsmsg.DNSKEY, sig *dnsmsg.RRSIG, data []byte) error {
+	switch key.Algorithm {
+	case ECDSAP256SHA256:
+		if len(key.PublicKey) != 64 || len(sig.Signature) != 64 {
+			return errors.New("bad ECDSA key or signature size")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(key.PublicKey[:32]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[32:]),
+		}
+		r := new(big.Int).SetBytes(sig.Signature[:32])
+		s := new(big.Int).SetBytes(sig.Signature[32:])
+		digest := sha256.Sum256(data)
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return errors.New("ECDSA signature does not verify")
+		}
+	case ED25519:
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, sig.Signature) {
+			return errors.New("Ed25519 signature does not verify")
+		}
+	default:
+		return ErrAlgorithm
+	}
+	return nil
+}
+
+func TestSignaturesVerify(t *testing.T) {
+	for _, algorithm := range []string{"ecdsap256sha256", "ed25519"} {
+		t.Run(algorithm, func(t *testing.T) {
+			z := testZone(t, algorithm)
+			m := New()
+
+			tests := []struct {
+				name     string
+				rrset    []dnsmsg.ResourceRecord
+				wildcard string
+				key      *Key
+				labels   uint8
+			}{
+				{"A RRset", []dnsmsg.ResourceRecord{aRR("WWW.example.com", "192.0.2.2"), aRR("www.example.com", "192.0.2.1")}, "", z.ZSK, 3},
+				{"wildcard answer", []dnsmsg.ResourceRecord{aRR("host.example.com", "192.0.2.1")}, "*.example.com", z.ZSK, 2},
+				{"DNSKEY RRset", z.DNSKEYs(3600), "", z.KSK, 2},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					rr, err := m.Sign(z, tt.rrset, tt.wildcard, now)
+					if err != nil {
+						t.Fatal(err)
+					}
+					sig := rr.Data.(*dnsmsg.RRSIG)
+					if rr.Name != dnsmsg.CanonicalName(tt.rrset[0].Name) || rr.TTL != tt.rrset[0].TTL {
+						t.Errorf("RRSIG owned by %s with TTL %d", rr.Name, rr.TTL)
+					}
+					if sig.TypeCovered != tt.rrset[0].Type || sig.Labels != tt.labels || sig.SignerName != "example.com" {
+						t.Errorf("RRSIG covers %s with %d labels, signed by %s", sig.TypeCovered, sig.Labels, sig.SignerName)
+					}
+					if sig.KeyTag != KeyTag(tt.key.DNSKEY()) || sig.Algorithm != tt.key.Algorithm {
+						t.Errorf("RRSIG made with key %d algorithm %d, want key %d", sig.KeyTag, sig.Algorithm, tt.key.Tag())
+					}
+					if start, end := int64(sig.Inception), int64(sig.Expiration); now.Unix() < start || now.Unix() > end {
+						t.Errorf("RRSIG valid from %d to %d, not at %d", start, end, now.Unix())
+					}
+
+					owner := tt.rrset[0].Name
+					if tt.wildcard != "" {
+						owner = tt.wildcard
+					}
+					if err := verify(tt.key.DNSKEY(), sig, signedData(t, sig, owner, tt.rrset)); err != nil {
+						t.Error(err)
+					}
+					other := z.KSK
+					if tt.key == z.KSK {
+						other = z.ZSK
+					}
+					if verify(other.DNSKEY(), sig, signedData(t, sig, owner, tt.rrset)) == nil {
+						t.Error("signature verifies with the other key")
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	z := testZone(t, "")
+	m := New(WithValidity(4 * time.Hour))
+	rrset := []dnsmsg.ResourceRecord{aRR("www.example.com", "192.0.2.1")}
+
+	sign := func(rrset []dnsmsg.ResourceRecord, at time.Time) *dnsmsg.RRSIG {
+		t.Helper()
+		rr, err := m.Sign(z, rrset, "", at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr.Data.(*dnsmsg.RRSIG)
+	}
+
+	first := sign(rrset, now)
+	if again := sign(rrset, now.Add(time.Hour)); again != first {
+		t.Error("signing the same RRset again made a new signature")
+	}
+	if other := sign([]dnsmsg.ResourceRecord{aRR("www.example.com", "192.0.2.9")}, now); other == first {
+		t.Error("a different RRset got the cached signature")
+	}
+	if refreshed := sign(rrset, now.Add(time.Hour+time.Second)); refreshed == first || refreshed.Inception <= first.Inception {
+		t.Error("the signature was not replaced after a quarter of its validity")
+	}
+}
@@ -0,0 +1,225 @@
+// Package dnssec signs the answers of local zones online (RFC 4033, 4034
+// and 4035) and proves that names or types do not exist with NSEC or NSEC3
+// records (RFC 5155).
+package dnssec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"dns-server/internal/dnsmsg"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Signing algorithms (RFC 8624 section 3.1). ECDSAP256SHA256 is the
+// default.
+const (
+	ECDSAP256SHA256 uint8 = 13
+	ED25519         uint8 = 15
+)
+
+var algorithmNames = map[uint8]string{
+	ECDSAP256SHA256: "ecdsap256sha256",
+	ED25519:         "ed25519",
+}
+
+// DNSKEY flags of the two keys of a zone (RFC 4034 section 2.1.1). Both are
+// zone keys; the key signing key also has the secure entry point bit,
+// marking it as the key the DS record in the parent refers to.
+const (
+	FlagZSK uint16 = 0x0100
+	FlagKSK uint16 = 0x0101
+)
+
+// DigestSHA256 is the DS digest type published for the zones (RFC 4509).
+const DigestSHA256 uint8 = 2
+
+var ErrAlgorithm = errors.New("dnssec: unsupported algorithm")
+
+// ParseAlgorithm converts an algorithm mnemonic or number into its number.
+// The empty string selects the default algorithm.
+func ParseAlgorithm(s string) (uint8, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return ECDSAP256SHA256, nil
+	}
+	for alg, name := range algorithmNames {
+		if name == s || strconv.Itoa(int(alg)) == s {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q, expected ecdsap256sha256 or ed25519", ErrAlgorithm, s)
+}
+
+// AlgorithmName returns the mnemonic of alg.
+func AlgorithmName(alg uint8) string {
+	if name, ok := algorithmNames[alg]; ok {
+		return name
+	}
+	return strconv.Itoa(int(alg))
+}
+
+// Key is a signing key of a zone.
+type Key struct {
+	Flags     uint16
+	Algorithm uint8
+	private   crypto.Signer
+	dnskey    *dnsmsg.DNSKEY
+}
+
+// GenerateKey creates a key for alg with the given DNSKEY flags.
+func GenerateKey(alg uint8, flags uint16) (*Key, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case ECDSAP256SHA256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ED25519:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, ErrAlgorithm
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newKey(alg, flags, private)
+}
+
+func newKey(alg uint8, flags uint16, private crypto.Signer) (*Key, error) {
+	k := &Key{Flags: flags, Algorithm: alg, private: private}
+	var public []byte
+	switch pub := private.Public().(type) {
+	case *ecdsa.PublicKey:
+		if alg != ECDSAP256SHA256 {
+			return nil, ErrAlgorithm
+		}
+		ecdh, err := pub.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		// The key is the uncompressed point without its 0x04 prefix (RFC
+		// 6605 section 4).
+		public = ecdh.Bytes()[1:]
+	case ed25519.PublicKey:
+		if alg != ED25519 {
+			return nil, ErrAlgorithm
+		}
+		public = pub
+	default:
+		return nil, ErrAlgorithm
+	}
+	k.dnskey = &dnsmsg.DNSKEY{Flags: flags, Protocol: 3, Algorithm: alg, PublicKey: public}
+	return k, nil
+}
+
+// DNSKEY returns the public key as a DNSKEY record.
+func (k *Key) DNSKEY() *dnsmsg.DNSKEY {
+	return k.dnskey
+}
+
+// Tag returns the key tag RRSIG and DS records identify the key with.
+func (k *Key) Tag() uint16 {
+	return KeyTag(k.dnskey)
+}
+
+// sign signs data: ECDSA signatures are the two 32 byte integers r and s
+// (RFC 6605 section 4), Ed25519 ones are 64 bytes (RFC 8080 section 4).
+func (k *Key) sign(data []byte) ([]byte, error) {
+	switch private := k.private.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(private, data), nil
+	}
+	return nil, ErrAlgorithm
+}
+
+// keyJSON is how keys are stored: the private key is in PKCS #8 form.
+type keyJSON struct {
+	Flags      uint16 `json:"flags"`
+	Algorithm  uint8  `json:"algorithm"`
+	PrivateKey []byte `json:"private_key"`
+}
+
+func (k *Key) MarshalJSON() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(keyJSON{Flags: k.Flags, Algorithm: k.Algorithm, PrivateKey: der})
+}
+
+func (k *Key) UnmarshalJSON(b []byte) error {
+	var raw keyJSON
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(raw.PrivateKey)
+	if err != nil {
+		return err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return ErrAlgorithm
+	}
+	key, err := newKey(raw.Algorithm, raw.Flags, private)
+	if err != nil {
+		return err
+	}
+	*k = *key
+	return nil
+}
+
+// KeyTag computes the key tag of a DNSKEY (RFC 4034 appendix B).
+func KeyTag(key *dnsmsg.DNSKEY) uint16 {
+	rdata, err := dnsmsg.CanonicalRData(key)
+	if err != nil {
+		return 0
+	}
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac & 0xFFFF)
+}
+
+// DS returns the SHA-256 delegation signer record of the key owned by
+// owner (RFC 4034 section 5.1.4).
+func DS(owner string, key *dnsmsg.DNSKEY) (*dnsmsg.DS, error) {
+	name, err := dnsmsg.WireName(owner)
+	if err != nil {
+		return nil, err
+	}
+	rdata, err := dnsmsg.CanonicalRData(key)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(append(name, rdata...))
+	return &dnsmsg.DS{
+		KeyTag:     KeyTag(key),
+		Algorithm:  key.Algorithm,
+		DigestType: DigestSHA256,
+		Digest:     digest[:],
+	}, nil
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/dnssec"
+	"dns-server/internal/manager"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// dnssecKey is the Redis hash holding the keys and settings of the signed
+// zones, keyed by zone name.
+const dnssecKey = "dnssec"
+
+// SignZone starts signing the zone name with s, or changes how a signed
+// zone denies existence. Keys are generated when the zone is first signed
+// and replaced only when the algorithm changes, which breaks the chain of
+// trust until the parent has the new DS record. It reports whether the
+// zone was signed before.
+func SignZone(name string, s dnssec.Settings) (*dnssec.Zone, bool, error) {
+	z, ok := constants.Zones.Get(name)
+	if !ok {
+		return nil, false, errZoneNotFound
+	}
+	if z.Secondary() {
+		return nil, false, errSecondaryZone
+	}
+	if err := s.Normalize(); err != nil {
+		return nil, false, err
+	}
+	if constants.Redis == nil {
+		return nil, false, errStorageUnavailable
+	}
+
+	old, signed := constants.DNSSEC.Get(z.Name)
+	var sz *dnssec.Zone
+	if signed && old.Algorithm == s.Algorithm {
+		copied := *old
+		copied.Settings = s
+		sz = &copied
+	} else {
+		var err error
+		if sz, err = dnssec.NewZone(z.Name, s); err != nil {
+			return nil, signed, err
+		}
+	}
+
+	value, err := dnssec.EncodeZone(sz)
+	if err != nil {
+		return nil, signed, err
+	}
+	if err := constants.Redis.HSet(context.Background(), dnssecKey, sz.Name, value); err != nil {
+		log.Error().Msgf("Error storing DNSSEC keys of zone %s -> %v", sz.Name, err)
+		return nil, signed, err
+	}
+	constants.DNSSEC.Set(sz)
+	touchZone(sz.Name)
+	return sz, signed, nil
+}
+
+// UnsignZone stops signing the zone name and deletes its keys. It reports
+// whether the zone was signed.
+func UnsignZone(name string) (bool, error) {
+	name = dnsmsg.CanonicalName(name)
+	if constants.DNSSEC == nil {
+		return false, nil
+	}
+	if _, ok := constants.DNSSEC.Get(name); !ok {
+		return false, nil
+	}
+	if constants.Redis == nil {
+		return false, errStorageUnavailable
+	}
+
+	if err := constants.Redis.HDel(context.Background(), dnssecKey, name); err != nil {
+		return false, err
+	}
+	constants.DNSSEC.Remove(name)
+	touchZone(name)
+	return true, nil
+}
+
+// LoadDNSSEC reads the keys of the signed zones from Redis.
+func LoadDNSSEC() error {
+	if constants.Redis == nil {
+		return errStorageUnavailable
+	}
+
+	res, err := constants.Redis.HGetAll(context.Background(), dnssecKey)
+	if err != nil {
+		log.Error().Msgf("Error while loading DNSSEC keys -> %v", err)
+		return err
+	}
+
+	constants.DNSSEC.Load(res)
+	return nil
+}
+
+// signedZone returns the keys of zone when it is signed.
+func signedZone(zone manager.Zone) (*dnssec.Zone, bool) {
+	if constants.DNSSEC == nil || zone.Secondary() {
+		return nil, false
+	}
+	return constants.DNSSEC.Get(zone.Name)
+}
+
+// wantsDNSSEC reports whether the client asked for DNSSEC records by
+// setting the DO bit (RFC 3225).
+func wantsDNSSEC(query *dnsmsg.Message) bool {
+	e := query.EDNS()
+	return e != nil && e.DO
+}
+
+// addDenial adds to the authority section of resp the NSEC or NSEC3
+// records proving denial for name, when zone is signed and the client
+// wants them.
+func addDenial(query, resp *dnsmsg.Message, zone manager.Zone, name string, denial dnssec.Denial) {
+	sz, ok := signedZone(zone)
+	if !ok || !wantsDNSSEC(query) {
+		return
+	}
+	// The chain depends on the zones as well as the records, since names
+	// in a child zone are left out. Both generations only grow, so their
+	// sum changes whenever either does.
+	version := constants.ContextManager.Generation() + constants.Zones.Generation()
+	chain := constants.DNSSEC.Chain(sz, version, func() dnssec.Contents {
+		return zoneContents(zone)
+	})
+	resp.Authority = append(resp.Authority, chain.Deny(name, denial, zone.NegativeSOA().TTL)...)
+}
+
+// zoneContents returns the types every name of zone owns as queries see
+// them, with the SOA and NS records of the apex.
+func zoneContents(zone manager.Zone) dnssec.Contents {
+	contents := dnssec.Contents{zone.Name: {dnsmsg.TypeSOA, dnsmsg.TypeNS}}
+	for name, records := range constants.ContextManager.Served(zone.Name) {
+		if owner, _ := constants.Zones.Find(name); owner.Name != zone.Name {
+			continue
+		}
+		for _, r := range records {
+			if t, ok := dnsmsg.ParseType(r.Type); ok {
+				contents[name] = append(contents[name], t)
+			}
+		}
+	}
+	return contents
+}
+
+// signResponse adds RRSIG records to the answer and authority sections of
+// resp for the RRsets owned by signed zones, when the client wants them.
+func signResponse(query, resp *dnsmsg.Message) {
+	if constants.DNSSEC == nil || !wantsDNSSEC(query) {
+		return
+	}
+	now := time.Now()
+	resp.Answers = signSection(resp.Answers, true, now)
+	resp.Authority = signSection(resp.Authority, false, now)
+}
+
+// signSection returns rrs with a signature after every RRset of a signed
+// zone. Answers may have been synthesized from a wildcard, which their
+// signatures have to tell (RFC 4035 section 2.2). The records of an RRset
+// are given the lowest TTL among them, since they are signed with one.
+func signSection(rrs []dnsmsg.ResourceRecord, answers bool, now time.Time) []dnsmsg.ResourceRecord {
+	type rrsetKey struct {
+		name  string
+		rtype dnsmsg.Type
+		class dnsmsg.Class
+	}
+	var order []rrsetKey
+	rrsets := make(map[rrsetKey][]dnsmsg.ResourceRecord)
+	for _, rr := range rrs {
+		key := rrsetKey{dnsmsg.CanonicalName(rr.Name), rr.Type, rr.Class}
+		if _, ok := rrsets[key]; !ok {
+			order = append(order, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	out := make([]dnsmsg.ResourceRecord, 0, len(rrs)+len(order))
+	for _, key := range order {
+		rrset := rrsets[key]
+		ttl := rrset[0].TTL
+		for _, rr := range rrset {
+			ttl = min(ttl, rr.TTL)
+		}
+		for i := range rrset {
+			rrset[i].TTL = ttl
+		}
+		out = append(out, rrset...)
+
+		if key.rtype == dnsmsg.TypeRRSIG || key.class != dnsmsg.ClassINET {
+			continue
+		}
+		owner := key.name
+		if key.rtype == dnsmsg.TypeNSEC3 {
+			// NSEC3 owners are hashes right below the apex.
+			_, owner, _ = strings.Cut(owner, ".")
+		}
+		zone, ok := zoneFor(owner)
+		if !ok {
+			continue
+		}
+		sz, ok := signedZone(zone)
+		if !ok {
+			continue
+		}
+		wildcard := ""
+		if answers {
+			wildcard, _ = constants.ContextManager.Wildcard(key.name)
+		}
+		sig, err := constants.DNSSEC.Sign(sz, rrset, wildcard, now)
+		if err != nil {
+			log.Error().Msgf("Error signing %s %s -> %v", key.name, key.rtype, err)
+			continue
+		}
+		out = append(out, sig)
+	}
+	return out
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/dnssec"
+	"dns-server/internal/manager"
+	"testing"
+)
+
+func TestDenialFollowsChildZones(t *testing.T) {
+	setZones(t, manager.Zone{Name: "example.com", NS: []string{"ns1.example.com"}})
+	setRecords(t, map[string][]manager.Record{
+		"www.example.com":      {{Type: "A", TTL: 300, IP: "192.0.2.1"}},
+		"host.sub.example.com": {{Type: "A", TTL: 300, IP: "192.0.2.2"}},
+	})
+	saved := constants.DNSSEC
+	constants.DNSSEC = dnssec.New()
+	t.Cleanup(func() { constants.DNSSEC = saved })
+	sz, err := dnssec.NewZone("example.com", dnssec.Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	constants.DNSSEC.Set(sz)
+
+	// covering returns the owner of the NSEC record covering
+	// t.example.com, which sorts between sub.example.com and
+	// www.example.com.
+	query := testQuery("t.example.com", dnsmsg.TypeA)
+	query.SetEDNS(&dnsmsg.EDNS{UDPSize: 1232, DO: true})
+	covering := func() string {
+		t.Helper()
+		zone, _ := constants.Zones.Get("example.com")
+		resp := query.Reply()
+		addDenial(query, resp, zone, "t.example.com", dnssec.NameError)
+		if len(resp.Authority) == 0 {
+			t.Fatal("no denial of existence")
+		}
+		return resp.Authority[0].Name
+	}
+
+	if got := covering(); got != "host.sub.example.com" {
+		t.Fatalf("covered by %s, want host.sub.example.com", got)
+	}
+
+	// Once sub.example.com is a zone of its own, its names leave the chain
+	// of the parent although no record changed.
+	child := manager.Zone{Name: "sub.example.com"}
+	if err := child.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	constants.Zones.Set(child)
+	if got := covering(); got != "example.com" {
+		t.Errorf("covered by %s after adding the child zone, want example.com", got)
+	}
+
+	constants.Zones.Remove("sub.example.com")
+	if got := covering(); got != "host.sub.example.com" {
+		t.Errorf("covered by %s after removing the child zone, want host.sub.example.com", got)
+	}
+}
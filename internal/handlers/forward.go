@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/cache"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errNoResolver = errors.New("no upstream resolver configured")
+
+// prefetchTimeout bounds a background refresh of a cached response.
+const prefetchTimeout = 10 * time.Second
+
+// forwardQuery answers query from the response cache, or sends it to the
+// servers of the most specific forwarding rule covering its name, or to the
+// default upstreams. When no upstream answers, an expired cached response
+// is served instead if there is one (RFC 8767). The reply carries the ID
+// and question of query.
+func forwardQuery(ctx context.Context, query *dnsmsg.Message) (*dnsmsg.Message, error) {
+	if resp, ok := cachedResponse(query); ok {
+		return resp, nil
+	}
+	return forwardUncached(ctx, query)
+}
+
+// cachedResponse returns the cached response to query, if there is one.
+func cachedResponse(query *dnsmsg.Message) (*dnsmsg.Message, bool) {
+	if constants.Cache == nil {
+		return nil, false
+	}
+	q := query.Questions[0]
+	resp, ok := constants.Cache.Get(cache.NewKey(q, clientDO(query)))
+	if !ok {
+		return nil, false
+	}
+	log.Debug().Msgf("Cache hit for %s %s", q.Name, q.Type)
+	return withQuery(resp, query), true
+}
+
+// forwardUncached is forwardQuery for a query already missing from the
+// cache.
+func forwardUncached(ctx context.Context, query *dnsmsg.Message) (*dnsmsg.Message, error) {
+	q := query.Questions[0]
+	key := cache.NewKey(q, clientDO(query))
+
+	resp, err := exchangeUpstream(ctx, key, upstreamQuery(query))
+	if err != nil {
+		if constants.Cache != nil {
+			if stale, ok := constants.Cache.GetStale(key); ok {
+				log.Warn().Msgf("Serving stale answer for %s %s: %v", q.Name, q.Type, err)
+				return withQuery(stale, query), nil
+			}
+		}
+		return nil, err
+	}
+	return withQuery(resp, query), nil
+}
+
+// exchangeUpstream sends query to the servers responsible for its name, or
+// resolves it recursively, and caches the reply under key unless the
+// forwarding rule forbids it.
+func exchangeUpstream(ctx context.Context, key cache.Key, query *dnsmsg.Message) (*dnsmsg.Message, error) {
+	name := query.Questions[0].Name
+	resolver := constants.Resolver
+	noCache := false
+	if rule, pool, ok := constants.Forwarders.Match(name); ok {
+		log.Debug().Msgf("Forwarding query for %s to the servers for %s", name, rule.Suffix)
+		resolver, noCache = pool, rule.NoCache
+	} else {
+		log.Debug().Msgf("Resolving %s upstream", name)
+	}
+	if resolver == nil {
+		return nil, errNoResolver
+	}
+
+	resp, err := resolver.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if constants.Cache != nil && !noCache {
+		constants.Cache.Set(key, resp)
+	}
+	return resp, nil
+}
+
+// Prefetch refreshes the cached response for key in the background before
+// it expires, so popular names are always answered from the cache.
+func Prefetch(key cache.Key) {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+
+	query := &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: key.Name, Type: key.Type, Class: key.Class}},
+	}
+	query.SetEDNS(&dnsmsg.EDNS{UDPSize: uint16(serverUDPSize()), DO: key.DO})
+
+	log.Debug().Msgf("Prefetching %s %s", key.Name, key.Type)
+	if _, err := exchangeUpstream(ctx, key, query); err != nil {
+		log.Debug().Msgf("Prefetch of %s %s failed: %v", key.Name, key.Type, err)
+	}
+}
+
+// withQuery makes resp answer query, keeping the ID and the exact spelling
+// of the question the client sent.
+func withQuery(resp, query *dnsmsg.Message) *dnsmsg.Message {
+	resp.Header.ID = query.Header.ID
+	resp.Questions = append([]dnsmsg.Question(nil), query.Questions...)
+	return resp
+}
+
+func clientDO(query *dnsmsg.Message) bool {
+	e := query.EDNS()
+	return e != nil && e.DO
+}
+
+// upstreamQuery derives the message sent upstream from a client query. The
+// client's additional section is not forwarded; instead we advertise our
+// own EDNS payload size, keep the client's DO bit and pass its EDNS options
+// along only when configured to.
+func upstreamQuery(query *dnsmsg.Message) *dnsmsg.Message {
+	up := &dnsmsg.Message{
+		Header:    query.Header,
+		Questions: query.Questions,
+	}
+
+	e := &dnsmsg.EDNS{UDPSize: uint16(serverUDPSize())}
+	if client := query.EDNS(); client != nil {
+		e.DO = client.DO
+		if constants.Config.DNS.ForwardEDNSOptions {
+			e.Options = client.Options
+		}
+	}
+	up.SetEDNS(e)
+	return up
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/manager"
+
+	"github.com/rs/zerolog/log"
+)
+
+// forwardersKey is the Redis hash holding the conditional forwarding rules,
+// keyed by domain suffix.
+const forwardersKey = "forwarders"
+
+// AddForwarder stores f, replacing any rule for the same suffix.
+func AddForwarder(f manager.Forwarder) error {
+	if err := f.Normalize(); err != nil {
+		return err
+	}
+	if constants.Redis == nil {
+		return errStorageUnavailable
+	}
+
+	value, err := manager.EncodeForwarder(f)
+	if err != nil {
+		return err
+	}
+	// Build the rule first so an unusable server never reaches Redis.
+	if err := constants.Forwarders.Set(f); err != nil {
+		return err
+	}
+	if err := constants.Redis.HSet(context.Background(), forwardersKey, f.Suffix, value); err != nil {
+		log.Error().Msgf("Error storing forwarder for %s -> %v", f.Suffix, err)
+		LoadForwarders()
+		return err
+	}
+	// Answers cached before the rule came from elsewhere, and a no_cache
+	// rule must not keep serving them.
+	forgetCachedSubtree(f.Suffix)
+	return nil
+}
+
+// RemoveForwarder deletes the rule for suffix and reports whether it
+// existed.
+func RemoveForwarder(suffix string) (bool, error) {
+	if constants.Redis == nil {
+		return false, errStorageUnavailable
+	}
+	suffix = manager.ForwarderSuffix(suffix)
+
+	if err := constants.Redis.HDel(context.Background(), forwardersKey, suffix); err != nil {
+		return false, err
+	}
+	removed := constants.Forwarders.Remove(suffix)
+	if removed {
+		forgetCachedSubtree(suffix)
+	}
+	return removed, nil
+}
+
+// LoadForwarders reads the forwarding rules from Redis.
+func LoadForwarders() error {
+	if constants.Redis == nil {
+		return errStorageUnavailable
+	}
+
+	res, err := constants.Redis.HGetAll(context.Background(), forwardersKey)
+	if err != nil {
+		log.Error().Msgf("Error while loading forwarders -> %v", err)
+		return err
+	}
+
+	constants.Forwarders.Load(res)
+	return nil
+}
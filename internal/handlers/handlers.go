@@ -3,47 +3,62 @@ package handlers
 import (
 	"context"
 	"dns-server/internal/constants"
-	"encoding/binary"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"errors"
+	"fmt"
 	"net"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-func getIpForDN(domainName string) string {
+var errStorageUnavailable = errors.New("record storage is not available")
+
+// getRecordsForDN returns the locally stored records that answer queries
+// for domainName, which may come from a wildcard, and how they matched. An
+// error means the store could not be consulted.
+//
+// The records are kept current by the writes made through this package;
+// records changed in Redis by other means are picked up by ReloadRecords.
+func getRecordsForDN(domainName string) ([]manager.Record, manager.MatchKind, error) {
 	if constants.Redis == nil {
 		log.Error().Msg("There is Redis connection available")
-		return ""
+		return nil, manager.NoMatch, errStorageUnavailable
 	}
 
-	val, ok := constants.ContextManager.GetContext()[domainName]
-
-	if !ok {
-		log.Error().Msgf("No IP found for domain -> %s in context reloading context", domainName)
-		LoadRedisContext()
-		val, ok = constants.ContextManager.GetContext()[domainName]
-		if !ok {
-			log.Error().Msgf("No IP found for domain -> %s in context reloading context", domainName)
-			return "error"
-		}
+	records, kind := constants.ContextManager.Match(domainName)
+	if kind == manager.NoMatch {
+		log.Debug().Msgf("No records found for domain -> %s", domainName)
 	}
-
-	return val
+	return records, kind, nil
 }
 
+// minUDPSize is the payload size every client supports (RFC 1035 section
+// 2.3.4); larger UDP responses need the client to advertise EDNS.
+const minUDPSize = 512
+
 func HandleDNSQuery(ctx context.Context, wg *sync.WaitGroup, pc net.PacketConn, addr net.Addr, req []byte) {
 	defer wg.Done()
 
 	// Log the raw query for debugging mobile data issues
 	log.Debug().Msgf("Received DNS query from %s, length: %d bytes", addr.String(), len(req))
 
-	// Minimum DNS query size check
-	if len(req) < 12 {
-		log.Error().Msgf("DNS query too short from %s: %d bytes (minimum 12 required)", addr.String(), len(req))
+	res := HandleDNSMessage(ctx, req, addr, "udp")
+	if res == nil {
 		return
 	}
+	pc.WriteTo(res, addr)
+}
 
+// HandleDNSMessage runs a wire-format query received over network through
+// the resolution path and returns the packed response. UDP responses are
+// truncated to the payload size negotiated with EDNS. It returns nil when
+// no response should be sent. It is shared by every DNS transport.
+func HandleDNSMessage(ctx context.Context, req []byte, addr net.Addr, network string) []byte {
 	// Additional safety: check if we have basic DNS header
 	defer func() {
 		if r := recover(); r != nil {
@@ -51,257 +66,340 @@ func HandleDNSQuery(ctx context.Context, wg *sync.WaitGroup, pc net.PacketConn,
 		}
 	}()
 
-	txid := req[0:2] // transaction ID
-	flags := []byte{0x81, 0x80}
-
-	// Check DNS header flags to identify unusual queries
-	qr := (req[2] & 0x80) >> 7 // Query/Response bit
-	if qr != 0 {
-		log.Warn().Msgf("Received DNS response instead of query from %s", addr.String())
-		return
+	query, resp, signer := processQuery(ctx, req, addr)
+	if resp == nil {
+		return nil
 	}
 
-	qdCount := binary.BigEndian.Uint16(req[4:6])
-	if qdCount == 0 {
-		log.Warn().Msgf("DNS query with no questions from %s", addr.String())
-		return
+	maxSize := 0xFFFF
+	if network == "udp" {
+		maxSize = udpPayloadSize(query)
 	}
 
-	if qdCount > 10 { // Reasonable limit to prevent abuse
-		log.Warn().Msgf("DNS query with too many questions (%d) from %s", qdCount, addr.String())
-		return
+	var res []byte
+	var err error
+	if signer != nil {
+		res, err = signer.pack(resp, maxSize)
+	} else {
+		res, err = resp.PackLimit(maxSize)
+	}
+	if err != nil {
+		log.Error().Msgf("Error building DNS response for %s: %v", addr.String(), err)
+		return nil
 	}
 
-	// Find end of question section (offset) with bounds checking
-	off := 12
-	questionCount := 0
-
-	for off < len(req) && req[off] != 0 && questionCount < int(qdCount) {
-		if off >= len(req) {
-			log.Error().Msgf("Malformed DNS query from %s: unexpected end of packet", addr.String())
-			return
-		}
-
-		labelLen := int(req[off])
-		if labelLen == 0 {
-			break
-		}
-
-		// Check for DNS compression pointers (mobile networks sometimes use these)
-		if labelLen >= 192 { // 0xC0 indicates compression
-			log.Debug().Msgf("DNS compression pointer detected from %s", addr.String())
-			off += 2 // Skip compression pointer
-			break
-		}
+	log.Debug().Msgf("Sending DNS response to %s over %s: %s with %d answers", addr.String(), network, resp.Header.RCode, len(resp.Answers))
+	return res
+}
 
-		// Validate label length is reasonable
-		if labelLen > 63 { // DNS labels can't be longer than 63 bytes
-			log.Error().Msgf("Invalid DNS label length %d from %s", labelLen, addr.String())
-			return
-		}
+// udpPayloadSize returns the largest UDP response query may receive: the
+// size the client advertises with EDNS, capped by the server maximum.
+func udpPayloadSize(query *dnsmsg.Message) int {
+	if query == nil {
+		return minUDPSize
+	}
+	e := query.EDNS()
+	if e == nil {
+		return minUDPSize
+	}
+	return min(max(int(e.UDPSize), minUDPSize), serverUDPSize())
+}
 
-		// Check if we have enough bytes for the label
-		if off+1+labelLen >= len(req) {
-			log.Error().Msgf("Malformed DNS query from %s: label extends beyond packet (off=%d, labelLen=%d, reqLen=%d)",
-				addr.String(), off, labelLen, len(req))
-			return
-		}
-		off += labelLen + 1
+func serverUDPSize() int {
+	return max(constants.Config.DNS.MaxUDPSize, minUDPSize)
+}
 
-		// Safety check to prevent infinite loops
-		if off > 512 { // DNS packets shouldn't be larger than 512 bytes over UDP
-			log.Error().Msgf("DNS query too large from %s: %d bytes", addr.String(), off)
-			return
+// processQuery parses req and produces the response to send back, along
+// with the signer to pack it with when the request was signed. The
+// response is nil when nothing should be sent, e.g. for packets that are
+// too short to carry a header or that are responses themselves; the query
+// is nil when req could not be parsed.
+func processQuery(ctx context.Context, req []byte, addr net.Addr) (*dnsmsg.Message, *dnsmsg.Message, *responseSigner) {
+	query, err := dnsmsg.Parse(req)
+	if err != nil {
+		log.Error().Msgf("Malformed DNS query from %s: %v", addr.String(), err)
+		h, herr := dnsmsg.ParseHeader(req)
+		if herr != nil || h.Response {
+			return nil, nil, nil
 		}
+		return nil, &dnsmsg.Message{Header: dnsmsg.Header{
+			ID:       h.ID,
+			Response: true,
+			Opcode:   h.Opcode,
+			RCode:    dnsmsg.RCodeFormatError,
+		}}, nil
 	}
 
-	// Check if we have enough bytes for the remaining fields (qtype + qclass)
-	if off+5 > len(req) {
-		log.Error().Msgf("Malformed DNS query from %s: insufficient bytes for qtype and qclass (off=%d, reqLen=%d)",
-			addr.String(), off, len(req))
-		return
+	// Check DNS header flags to identify unusual queries
+	if query.Header.Response {
+		log.Warn().Msgf("Received DNS response instead of query from %s", addr.String())
+		return query, nil, nil
 	}
 
-	off += 5 // zero byte + qtype(2) + qclass(2)
+	// Signed requests are authenticated against the message as received,
+	// and their responses signed with the same key.
+	signer, reject, err := authenticate(req, query, time.Now())
+	if err != nil {
+		log.Warn().Msgf("Rejecting %s from %s -> %v", query.Header.Opcode, addr.String(), err)
+		return query, reject, signer
+	}
 
-	// Bounds check for question extraction
-	if off-4 > len(req) || off-4 < 12 {
-		log.Error().Msgf("Malformed DNS query from %s: invalid question section bounds", addr.String())
-		return
+	if query.Header.Opcode == dnsmsg.OpcodeUpdate {
+		return query, handleUpdate(query, addr, signer), signer
 	}
+	return query, Resolve(ctx, query, addr), signer
+}
 
-	question := req[12 : off-4]
-	domain := parseName(question)
+// Resolve answers an already parsed query from addr through the same path
+// as queries received on the DNS listeners.
+func Resolve(ctx context.Context, query *dnsmsg.Message, addr net.Addr) *dnsmsg.Message {
+	resp := handleQuery(ctx, query, addr)
+	setResponseEDNS(query, resp)
+	return resp
+}
 
-	// Validate domain name
-	if domain == "" {
-		log.Warn().Msgf("Empty domain name from %s", addr.String())
+// setResponseEDNS gives resp an OPT record advertising our own payload size
+// when the query used EDNS, and strips it otherwise (RFC 6891 section 7).
+func setResponseEDNS(query, resp *dnsmsg.Message) {
+	e := query.EDNS()
+	if e == nil {
+		resp.SetEDNS(nil)
+		if resp.Header.RCode > 0x0F {
+			resp.Header.RCode = dnsmsg.RCodeServerFailure
+		}
 		return
 	}
 
-	if len(domain) > 253 { // Max domain name length
-		log.Warn().Msgf("Domain name too long (%d chars) from %s: %s", len(domain), addr.String(), domain)
-		return
+	out := &dnsmsg.EDNS{
+		UDPSize: uint16(serverUDPSize()),
+		DO:      e.DO,
 	}
-
-	log.Info().Msgf("Domain name received from %s: %s", addr.String(), domain)
-
-	// TODO: use dynamic domain
-	ipstr := getIpForDN(domain)
-	switch ipstr {
-	case "":
-		forwardTo := "1.1.1.1:53"
-		log.Debug().Msgf("Forwarding query for %s from %s to %s", domain, addr.String(), forwardTo)
-		forwardAndRespond(pc, addr, req, forwardTo)
-		return
-	case "error":
-		log.Error().Msgf("Error retrieving IP for domain %s from %s", domain, addr.String())
-		return
+	if constants.Config.DNS.ForwardEDNSOptions {
+		if upstream := resp.EDNS(); upstream != nil {
+			out.Options = upstream.Options
+		}
 	}
+	resp.SetEDNS(out)
+}
 
-	res := append([]byte{}, txid...)
-	res = append(res, flags...)
-	res = append(res, req[4:6]...) // QDCOUNT
-	res = append(res, 0x00, 0x01)  // ANCOUNT
-	res = append(res, 0x00, 0x00)  // NSCOUNT
-	res = append(res, 0x00, 0x00)  // ARCOUNT
-
-	// Question - bounds check
-	if off > len(req) || 12 > len(req) {
-		log.Error().Msgf("Malformed DNS query from %s: invalid question for response", addr.String())
-		return
+// handleQuery validates a parsed query and resolves it, always producing a
+// response with the appropriate RCODE.
+func handleQuery(ctx context.Context, query *dnsmsg.Message, addr net.Addr) *dnsmsg.Message {
+	if query.Header.Opcode == dnsmsg.OpcodeNotify {
+		return handleNotify(query, addr)
+	}
+	if query.Header.Opcode != dnsmsg.OpcodeQuery {
+		log.Warn().Msgf("Unsupported opcode %s from %s", query.Header.Opcode, addr.String())
+		return errorReply(query, dnsmsg.RCodeNotImplemented)
 	}
-	res = append(res, req[12:off]...)
 
-	// Answer section
-	res = append(res, 0xc0, 0x0c)             // Name pointer to offset 12
-	res = append(res, 0x00, 0x01)             // Type A
-	res = append(res, 0x00, 0x01)             // Class IN
-	res = append(res, 0x00, 0x00, 0x00, 0x3c) // TTL 60s
-	res = append(res, 0x00, 0x04)             // RDLENGTH
+	if e := query.EDNS(); e != nil && e.Version != 0 {
+		log.Warn().Msgf("Unsupported EDNS version %d from %s", e.Version, addr.String())
+		return errorReply(query, dnsmsg.RCodeBadVersion)
+	}
 
-	ip := net.ParseIP(ipstr).To4()
-	if ip == nil {
-		log.Error().Msgf("Invalid IP address %s for domain %s from %s", ipstr, domain, addr.String())
-		return
+	if len(query.Questions) != 1 {
+		log.Warn().Msgf("DNS query with %d questions from %s", len(query.Questions), addr.String())
+		return errorReply(query, dnsmsg.RCodeFormatError)
 	}
-	res = append(res, ip...)
 
-	log.Debug().Msgf("Sending DNS response to %s for %s -> %s", addr.String(), domain, ipstr)
-	pc.WriteTo(res, addr)
-}
+	question := query.Questions[0]
+	log.Info().Msgf("Domain name received from %s: %s %s", addr.String(), question.Name, question.Type)
 
-func forwardAndRespond(pc net.PacketConn, addr net.Addr, req []byte, forwardAddr string) {
-	conn, err := net.Dial("udp", forwardAddr)
-	if err != nil {
-		return
+	if question.Class != dnsmsg.ClassINET && question.Class != dnsmsg.ClassANY {
+		return errorReply(query, dnsmsg.RCodeRefused)
+	}
+	if question.Type == dnsmsg.TypeAXFR || question.Type == dnsmsg.TypeIXFR {
+		return errorReply(query, dnsmsg.RCodeRefused)
 	}
-	defer conn.Close()
 
-	conn.Write(req)
-	reply := make([]byte, 512)
-	n, err := conn.Read(reply)
+	resp, err := resolve(ctx, query)
 	if err != nil {
-		return
+		log.Error().Msgf("Error resolving %s for %s: %v", question.Name, addr.String(), err)
+		return errorReply(query, dnsmsg.RCodeServerFailure)
 	}
-	pc.WriteTo(reply[:n], addr)
+	signResponse(query, resp)
+	return resp
 }
 
-func parseName(q []byte) string {
-	var parts []string
-	i := 0
-	maxIterations := 100 // Prevent infinite loops
-	iterations := 0
+// errorReply returns an empty response to query carrying rcode.
+func errorReply(query *dnsmsg.Message, rcode dnsmsg.RCode) *dnsmsg.Message {
+	resp := query.Reply()
+	resp.Header.RCode = rcode
+	return resp
+}
 
-	for i < len(q) && iterations < maxIterations {
-		iterations++
+// AddContext stores record for domainName, replacing any existing record
+// with the same data so that only its TTL is updated.
+func AddContext(domainName string, record manager.Record) bool {
+	domainName = dnsmsg.CanonicalName(domainName)
+	if ReadOnly(domainName) != nil {
+		return false
+	}
+	defer nameLocks.lock(domainName)()
 
-		if i >= len(q) {
-			log.Error().Msg("Malformed DNS name: index out of bounds")
-			break
+	existing, _ := constants.ContextManager.Lookup(domainName)
+	records := make([]manager.Record, 0, len(existing)+1)
+	for _, r := range existing {
+		if !r.SameData(record) {
+			records = append(records, r)
 		}
+	}
+	records = append(records, record)
 
-		length := int(q[i])
-		if length == 0 {
-			break
-		}
+	return storeRecords(domainName, records)
+}
 
-		// Check for DNS compression pointers
-		if length >= 192 { // 0xC0 indicates compression
-			log.Debug().Msg("DNS compression pointer in name parsing")
-			// For now, we'll just stop parsing at compression pointers
-			// A full implementation would follow the pointer
-			break
-		}
+// RemoveContext deletes the records stored for domainName. When rrType is
+// set only records of that type are removed. It reports whether any record
+// was removed; nothing is written when none matched.
+func RemoveContext(domainName string, rrType string) (bool, error) {
+	domainName = dnsmsg.CanonicalName(domainName)
+	if rrType != "" && !slices.Contains(manager.RecordTypes, rrType) {
+		return false, fmt.Errorf("unsupported record type %q, expected one of %s", rrType, strings.Join(manager.RecordTypes, ", "))
+	}
+	if err := ReadOnly(domainName); err != nil {
+		return false, err
+	}
+	defer nameLocks.lock(domainName)()
 
-		// Validate label length
-		if length > 63 { // DNS labels can't be longer than 63 bytes
-			log.Error().Msgf("Invalid DNS label length in parseName: %d", length)
-			break
+	existing, ok := constants.ContextManager.Lookup(domainName)
+	if !ok {
+		return false, nil
+	}
+	var records []manager.Record
+	if rrType != "" {
+		for _, r := range existing {
+			if r.Type != rrType {
+				records = append(records, r)
+			}
 		}
-
-		// Bounds check for label
-		if i+1+length > len(q) {
-			log.Error().Msgf("Malformed DNS name: label extends beyond data (i=%d, length=%d, qLen=%d)", i, length, len(q))
-			break
+		if len(records) == len(existing) {
+			return false, nil
 		}
+	}
 
-		i++
-		if i+length <= len(q) {
-			labelBytes := q[i : i+length]
-			// Validate that label contains valid characters
-			label := string(labelBytes)
-			if len(label) > 0 {
-				parts = append(parts, label)
-			}
-		}
-		i += length
+	if !storeRecords(domainName, records) {
+		return false, errors.New("failed to store the records of " + domainName)
 	}
+	return true, nil
+}
 
-	if iterations >= maxIterations {
-		log.Error().Msg("DNS name parsing exceeded maximum iterations")
+// storeRecords replaces the records stored for domainName and advances the
+// serial of the enclosing zone, which stays locked from the write until
+// the change is journaled. Names outside every zone have no serial, so
+// their changes are neither journaled nor announced with NOTIFY.
+func storeRecords(domainName string, records []manager.Record) bool {
+	z, inZone := constants.Zones.Find(domainName)
+	if inZone {
+		defer zoneLocks.lock(z.Name)()
+	}
+	if err := writeRecords(domainName, records); err != nil {
+		return false
 	}
 
-	result := strings.Join(parts, ".")
-	log.Debug().Msgf("Parsed DNS name: %s", result)
-	return result
+	if inZone {
+		advanceSerial(z.Name)
+	}
+	return true
 }
 
-func AddContext(domainName string, port string) bool {
+// writeRecords replaces the records stored for domainName, deleting the
+// name when records is empty. Unlike storeRecords it leaves the serial of
+// the enclosing zone alone.
+func writeRecords(domainName string, records []manager.Record) error {
+	if len(records) == 0 {
+		err := constants.Redis.HDel(context.Background(), "dns", domainName)
+		if err != nil {
+			return err
+		}
+
+		constants.ContextManager.RemoveRP(domainName)
+		return nil
+	}
 
-	err := constants.Redis.HSet(context.Background(), "dns", domainName, port)
+	value, err := manager.EncodeRecords(records)
 	if err != nil {
-		return false
+		log.Error().Msgf("Error encoding records for %s -> %v", domainName, err)
+		return err
 	}
 
-	constants.ContextManager.AddRP(domainName, port)
+	err = constants.Redis.HSet(context.Background(), "dns", domainName, value)
+	if err != nil {
+		return err
+	}
 
-	return true
+	constants.ContextManager.AddRP(domainName, records)
+	forgetCached(map[string][]manager.Record{domainName: records})
+	return nil
 }
 
-func RemoveContext(domainName string) bool {
-	err := constants.Redis.HDel(context.Background(), "dns", domainName)
-	if err != nil {
-		return false
+// SetHosts replaces the records read from hosts files.
+func SetHosts(records map[string][]manager.Record) {
+	constants.ContextManager.SetHosts(records)
+	forgetCached(records)
+}
+
+// forgetCached drops the cached upstream answers that the records of each
+// name now override, since names outside our zones are looked up in the
+// cache before the local records. Those are the answers for the name and
+// the names below it, which a wildcard may answer, and for the reverse
+// names of its addresses. The cache is scanned once for all of them, so
+// that large hosts files and reloads stay cheap.
+func forgetCached(records map[string][]manager.Record) {
+	if constants.Cache == nil || len(records) == 0 {
+		return
 	}
+	subtrees := make([]string, 0, len(records))
+	var reverse []string
+	for domainName, rs := range records {
+		subtrees = append(subtrees, strings.TrimPrefix(domainName, "*."))
+		for _, r := range rs {
+			if r.Type != "A" && r.Type != "AAAA" || r.NoPTR {
+				continue
+			}
+			if ip := net.ParseIP(r.IP); ip != nil {
+				reverse = append(reverse, manager.ReverseName(ip))
+			}
+		}
+	}
+	constants.Cache.FlushSubtrees(subtrees)
+	constants.Cache.FlushNames(reverse)
+}
 
-	constants.ContextManager.RemoveRP(domainName)
+// forgetCachedSubtree drops the cached answers for name and the names
+// below it after a zone or forwarding rule for name changed how they are
+// resolved.
+func forgetCachedSubtree(name string) {
+	if constants.Cache != nil {
+		constants.Cache.FlushSubtree(name)
+	}
+}
 
-	return true
+func LoadRedisContext() map[string][]manager.Record {
+	if err := ReloadRecords(); err != nil {
+		return nil
+	}
+
+	return constants.ContextManager.GetContext()
 }
 
-func LoadRedisContext() map[string]string {
+// ReloadRecords reads every record from Redis again, replacing those held
+// in memory. It is only needed at startup and after the records were
+// changed in Redis without going through the server.
+func ReloadRecords() error {
 	if constants.Redis == nil {
-		return nil
+		return errStorageUnavailable
 	}
 
 	res, err := constants.Redis.HGetAll(context.Background(), "dns")
 	if err != nil {
 		log.Error().Msgf("Error while loading Redis context -> %v", err)
-		return nil
+		return err
 	}
 
 	constants.ContextManager.LoadContext(res)
+	forgetCached(constants.ContextManager.GetContext())
 
-	return constants.ContextManager.GetContext()
+	return nil
 }
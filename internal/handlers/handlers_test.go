@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"strings"
+	"testing"
+)
+
+func TestRemoveContextWithoutMatch(t *testing.T) {
+	setZones(t, manager.Zone{Name: "example.com"}, manager.Zone{Name: "sec.example", Primaries: []string{"192.0.2.53"}})
+	records := []manager.Record{{Type: "A", TTL: 300, IP: "192.0.2.1"}}
+	setRecords(t, map[string][]manager.Record{"www.example.com": records})
+
+	// None of these reach the store, which is not available here.
+	tests := []struct {
+		name    string
+		domain  string
+		rrType  string
+		wantErr bool
+	}{
+		{"missing name", "ftp.example.com", "", false},
+		{"missing name with type", "ftp.example.com", "A", false},
+		{"no records of type", "www.example.com", "TXT", false},
+		{"unknown type", "www.example.com", "BOGUS", true},
+		{"secondary zone", "www.sec.example", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := RemoveContext(tt.domain, tt.rrType)
+			if found || (err != nil) != tt.wantErr {
+				t.Fatalf("RemoveContext = %t, %v; want nothing removed, error %t", found, err, tt.wantErr)
+			}
+		})
+	}
+	if got, _ := constants.ContextManager.Lookup("www.example.com"); len(got) != 1 {
+		t.Errorf("www.example.com has %d records left, want 1", len(got))
+	}
+}
+
+func TestUDPPayloadSize(t *testing.T) {
+	saved := constants.Config.DNS.MaxUDPSize
+	t.Cleanup(func() { constants.Config.DNS.MaxUDPSize = saved })
+
+	tests := []struct {
+		name    string
+		edns    *dnsmsg.EDNS
+		maxSize int
+		want    int
+	}{
+		{"no edns", nil, 1232, 512},
+		{"small advertised size", &dnsmsg.EDNS{UDPSize: 100}, 1232, 512},
+		{"advertised size", &dnsmsg.EDNS{UDPSize: 1000}, 1232, 1000},
+		{"capped by the server", &dnsmsg.EDNS{UDPSize: 4096}, 1232, 1232},
+		{"server maximum below 512", &dnsmsg.EDNS{UDPSize: 4096}, 100, 512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			constants.Config.DNS.MaxUDPSize = tt.maxSize
+			query := testQuery("example.com", dnsmsg.TypeA)
+			query.SetEDNS(tt.edns)
+			if got := udpPayloadSize(query); got != tt.want {
+				t.Errorf("udpPayloadSize = %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if got := udpPayloadSize(nil); got != minUDPSize {
+		t.Errorf("udpPayloadSize of an unparsed query = %d, want %d", got, minUDPSize)
+	}
+}
+
+func TestEDNSResponses(t *testing.T) {
+	rcodeFixture(t)
+	txt := func(n int) []manager.Record {
+		var records []manager.Record
+		for i := range n {
+			records = append(records, manager.Record{Type: "TXT", TTL: 300, Text: manager.Text{strings.Repeat(string(rune('a'+i)), 200)}})
+		}
+		return records
+	}
+	constants.ContextManager.AddRP("medium.example.com", txt(3))
+	constants.ContextManager.AddRP("big.example.com", txt(10))
+	saved := constants.Config.DNS.MaxUDPSize
+	constants.Config.DNS.MaxUDPSize = 1232
+	t.Cleanup(func() { constants.Config.DNS.MaxUDPSize = saved })
+
+	tests := []struct {
+		name      string
+		network   string
+		qname     string
+		qtype     dnsmsg.Type
+		edns      *dnsmsg.EDNS
+		rcode     dnsmsg.RCode
+		truncated bool
+		answers   int
+		// maxLen is the largest response allowed, or 0 for no limit.
+		maxLen int
+	}{
+		{"no edns", "udp", "www.example.com", dnsmsg.TypeA, nil, dnsmsg.RCodeSuccess, false, 1, 512},
+		{"over 512 without edns", "udp", "medium.example.com", dnsmsg.TypeTXT, nil, dnsmsg.RCodeSuccess, true, 0, 512},
+		{"within advertised size", "udp", "medium.example.com", dnsmsg.TypeTXT, &dnsmsg.EDNS{UDPSize: 4096}, dnsmsg.RCodeSuccess, false, 3, 1232},
+		{"over advertised size", "udp", "medium.example.com", dnsmsg.TypeTXT, &dnsmsg.EDNS{UDPSize: 600}, dnsmsg.RCodeSuccess, true, 0, 600},
+		{"over server maximum", "udp", "big.example.com", dnsmsg.TypeTXT, &dnsmsg.EDNS{UDPSize: 4096}, dnsmsg.RCodeSuccess, true, 0, 1232},
+		{"tcp is not truncated", "tcp", "big.example.com", dnsmsg.TypeTXT, nil, dnsmsg.RCodeSuccess, false, 10, 0},
+		{"do bit", "udp", "www.example.com", dnsmsg.TypeA, &dnsmsg.EDNS{UDPSize: 1232, DO: true}, dnsmsg.RCodeSuccess, false, 1, 1232},
+		{"unsupported version", "udp", "www.example.com", dnsmsg.TypeA, &dnsmsg.EDNS{UDPSize: 1232, Version: 1}, dnsmsg.RCodeBadVersion, false, 0, 1232},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := testQuery(tt.qname, tt.qtype)
+			query.SetEDNS(tt.edns)
+			res := HandleDNSMessage(context.Background(), packQuery(t, query), testAddr, tt.network)
+			resp, err := dnsmsg.Parse(res)
+			if err != nil {
+				t.Fatalf("unparsable response: %v", err)
+			}
+			if resp.Header.RCode != tt.rcode || resp.Header.Truncated != tt.truncated || len(resp.Answers) != tt.answers {
+				t.Errorf("got %s, TC=%t, %d answers; want %s, TC=%t, %d answers",
+					resp.Header.RCode, resp.Header.Truncated, len(resp.Answers), tt.rcode, tt.truncated, tt.answers)
+			}
+			if tt.maxLen > 0 && len(res) > tt.maxLen {
+				t.Errorf("%d byte response, want at most %d", len(res), tt.maxLen)
+			}
+
+			// The response carries EDNS only when the query did, with our
+			// own payload size and the client's DO bit.
+			e := resp.EDNS()
+			switch {
+			case tt.edns == nil && e != nil:
+				t.Errorf("EDNS %+v in the response to a query without it", e)
+			case tt.edns != nil && e == nil:
+				t.Error("no EDNS in the response")
+			case e != nil && (e.UDPSize != 1232 || e.DO != tt.edns.DO || e.Version != 0):
+				t.Errorf("response EDNS %+v", e)
+			}
+		})
+	}
+}
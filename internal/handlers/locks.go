@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"slices"
+	"sync"
+)
+
+// zoneLocks serialises the changes of each zone, so that its serial only
+// moves forward and every change is journaled against the one before it.
+var zoneLocks keyedMutex
+
+// nameLocks serialises the changes of the records of each name, which are
+// read, changed and written back as a whole.
+var nameLocks keyedMutex
+
+// keyedMutex holds one mutex per key. A mutex only exists while it is held
+// or waited for.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the mutex of key and returns the function that unlocks it.
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// lockAll locks the mutexes of keys in sorted order, so that callers
+// locking overlapping sets of keys cannot deadlock, and returns the
+// function that unlocks them.
+func (k *keyedMutex) lockAll(keys []string) func() {
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	unlocks := make([]func(), len(keys))
+	for i, key := range keys {
+		unlocks[i] = k.lock(key)
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestKeyedMutexSerialisesKey(t *testing.T) {
+	var k keyedMutex
+	// The map itself is only read; each key has its own counter.
+	counts := map[string]*int{"a.example": new(int), "b.example": new(int)}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		key := []string{"a.example", "b.example"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer k.lock(key)()
+			// Read-modify-write that loses increments unless serialised.
+			n := *counts[key]
+			*counts[key] = n + 1
+		}()
+	}
+	// Overlapping sets of keys in different orders do not deadlock.
+	for i := 0; i < 20; i++ {
+		keys := []string{"a.example", "b.example", "a.example"}
+		if i%2 == 1 {
+			keys = []string{"b.example", "a.example"}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer k.lockAll(keys)()
+			*counts["a.example"]++
+			*counts["b.example"]++
+		}()
+	}
+	wg.Wait()
+
+	if *counts["a.example"] != 70 || *counts["b.example"] != 70 {
+		t.Errorf("counts %d and %d, want 70 each", *counts["a.example"], *counts["b.example"])
+	}
+	if len(k.locks) != 0 {
+		t.Errorf("%d mutexes left after every lock was released", len(k.locks))
+	}
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/dnssec"
+	"dns-server/internal/manager"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxCNAMEChain bounds how many CNAME records are followed for one query.
+const maxCNAMEChain = 8
+
+// resolve answers query from the local records, following CNAME chains,
+// and forwards anything that is not known locally. Names inside one of our
+// zones are answered authoritatively and never forwarded unless a more
+// specific forwarding rule covers them. An error means the query could not
+// be answered and the client should get SERVFAIL.
+func resolve(ctx context.Context, query *dnsmsg.Message) (*dnsmsg.Message, error) {
+	q := query.Questions[0]
+	resp := query.Reply()
+	_, resp.Header.Authoritative = zoneFor(q.Name)
+	if !resp.Header.Authoritative {
+		// Most names outside our zones are answered upstream, so the
+		// cache comes first. Local records evict the cached answers they
+		// override when they are written.
+		if cached, ok := cachedResponse(query); ok {
+			return cached, nil
+		}
+	}
+
+	name := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		zone, inZone := zoneFor(name)
+		if inZone && zone.Expired(time.Now()) {
+			return nil, errZoneExpired
+		}
+		records, kind, err := getRecordsForDN(name)
+		if err != nil {
+			if inZone {
+				return nil, err
+			}
+			// The store only matters for names we are authoritative for.
+			kind = manager.NoMatch
+		}
+		if kind == manager.EmptyNonTerminal && !inZone {
+			// Outside our zones only names with records of their own
+			// are kept from being forwarded.
+			kind = manager.NoMatch
+		}
+		if kind == manager.WildcardMatch {
+			log.Debug().Msgf("Answering %s from a wildcard", name)
+		}
+		isApex := inZone && dnsmsg.CanonicalName(name) == zone.Name
+		// The apex always exists since it owns the SOA record.
+		found := kind != manager.NoMatch || isApex
+
+		if !found {
+			if inZone {
+				resp.Header.RCode = dnsmsg.RCodeNameError
+				resp.Authority = append(resp.Authority, zone.NegativeSOA())
+				addDenial(query, resp, zone, name, dnssec.NameError)
+				return resp, nil
+			}
+			if i == 0 {
+				return forwardUncached(ctx, query)
+			}
+			// A local CNAME points outside of our data, so the rest of the
+			// chain is resolved upstream.
+			return chaseUpstream(ctx, resp, dnsmsg.Question{Name: name, Type: q.Type, Class: q.Class})
+		}
+
+		answers, cname := matchRecords(name, records, q.Type)
+		if isApex {
+			answers = append(apexAnswers(zone, records, q.Type), answers...)
+		}
+		resp.Answers = append(resp.Answers, answers...)
+		if len(answers) > 0 || cname != nil {
+			if kind == manager.WildcardMatch {
+				// The name itself must be shown not to exist for the
+				// wildcard to apply (RFC 4035 section 3.1.3.3).
+				addDenial(query, resp, zone, name, dnssec.WildcardAnswer)
+			}
+		}
+		if len(answers) > 0 {
+			return resp, nil
+		}
+		if cname == nil {
+			// The name exists but has no data of the requested type.
+			if inZone {
+				resp.Authority = append(resp.Authority, zone.NegativeSOA())
+				denial := dnssec.NoData
+				if kind == manager.WildcardMatch {
+					denial = dnssec.WildcardNoData
+				}
+				addDenial(query, resp, zone, name, denial)
+			}
+			return resp, nil
+		}
+
+		log.Debug().Msgf("Following CNAME %s -> %s", name, cname.Target)
+		rr, err := cname.RR(name)
+		if err != nil {
+			return nil, err
+		}
+		resp.Answers = append(resp.Answers, rr)
+		name = cname.Target
+	}
+
+	log.Warn().Msgf("CNAME chain for %s exceeds %d records", q.Name, maxCNAMEChain)
+	return resp, nil
+}
+
+// matchRecords returns the records of name that answer qtype. When there is
+// no direct match but name is an alias, the CNAME record is returned so the
+// caller can follow it.
+func matchRecords(name string, records []manager.Record, qtype dnsmsg.Type) ([]dnsmsg.ResourceRecord, *manager.Record) {
+	var answers []dnsmsg.ResourceRecord
+	var cname *manager.Record
+	for i, r := range records {
+		t, _ := dnsmsg.ParseType(r.Type)
+		if t == dnsmsg.TypeCNAME {
+			cname = &records[i]
+		}
+		if qtype != dnsmsg.TypeANY && t != qtype {
+			continue
+		}
+		rr, err := r.RR(name)
+		if err != nil {
+			log.Error().Msgf("Skipping invalid %s record for %s -> %v", r.Type, name, err)
+			continue
+		}
+		answers = append(answers, rr)
+	}
+	return answers, cname
+}
+
+// chaseUpstream resolves q upstream and appends the result to resp.
+func chaseUpstream(ctx context.Context, resp *dnsmsg.Message, q dnsmsg.Question) (*dnsmsg.Message, error) {
+	sub := &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmsg.Question{q},
+	}
+	up, err := forwardQuery(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.RCode = up.Header.RCode
+	resp.Answers = append(resp.Answers, up.Answers...)
+	resp.Authority = append(resp.Authority, up.Authority...)
+	return resp, nil
+}
+
+// zoneFor returns the most specific zone name falls under. A forwarding
+// rule more specific than the zone hands the name to other servers, and so
+// does a rule for an implicit zone itself, such as one sending a private
+// reverse zone to the router that owns the range.
+func zoneFor(name string) (manager.Zone, bool) {
+	zone, ok := constants.Zones.Find(name)
+	if !ok {
+		return zone, false
+	}
+	rule, _, ok := constants.Forwarders.Match(name)
+	if ok && (len(rule.Suffix) > len(zone.Name) || zone.Implicit && rule.Suffix == zone.Name) {
+		return manager.Zone{}, false
+	}
+	return zone, true
+}
+
+// apexAnswers returns the SOA and NS records of zone that answer qtype,
+// and the DNSKEY and NSEC3PARAM records of signed zones. They are kept
+// with the zone rather than as stored records; NS records stored for the
+// apex take precedence over the zone's name servers.
+func apexAnswers(zone manager.Zone, records []manager.Record, qtype dnsmsg.Type) []dnsmsg.ResourceRecord {
+	var answers []dnsmsg.ResourceRecord
+	if qtype == dnsmsg.TypeSOA || qtype == dnsmsg.TypeANY {
+		answers = append(answers, zone.SOA())
+	}
+	if qtype == dnsmsg.TypeNS || qtype == dnsmsg.TypeANY {
+		if !slices.ContainsFunc(records, func(r manager.Record) bool { return r.Type == "NS" }) {
+			answers = append(answers, zone.NSRecords()...)
+		}
+	}
+	if sz, ok := signedZone(zone); ok {
+		if qtype == dnsmsg.TypeDNSKEY || qtype == dnsmsg.TypeANY {
+			answers = append(answers, sz.DNSKEYs(zone.TTL)...)
+		}
+		if qtype == dnsmsg.TypeNSEC3PARAM || qtype == dnsmsg.TypeANY {
+			if rr, ok := sz.NSEC3PARAM(zone.TTL); ok {
+				answers = append(answers, rr)
+			}
+		}
+	}
+	return answers
+}
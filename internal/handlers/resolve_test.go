@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/upstream"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+var testAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+// setStore makes the record store available. Queries are answered from
+// the records in memory, so no connection is needed.
+func setStore(t *testing.T) {
+	t.Helper()
+	saved := constants.Redis
+	constants.Redis = &manager.Redis{}
+	t.Cleanup(func() { constants.Redis = saved })
+}
+
+// resolverFunc is an upstream answering with a function.
+type resolverFunc func(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error)
+
+func (f resolverFunc) Exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	return f(ctx, req)
+}
+
+// setResolver sends the queries for names outside our zones to r.
+func setResolver(t *testing.T, r upstream.Resolver) {
+	t.Helper()
+	saved, savedCache := constants.Resolver, constants.Cache
+	constants.Resolver, constants.Cache = r, nil
+	t.Cleanup(func() { constants.Resolver, constants.Cache = saved, savedCache })
+}
+
+// upstreamAnswer answers A queries with 198.51.100.1, and names starting
+// with "nx" with NXDOMAIN.
+func upstreamAnswer(_ context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	resp := req.Reply()
+	q := req.Questions[0]
+	switch {
+	case strings.HasPrefix(q.Name, "nx"):
+		resp.Header.RCode = dnsmsg.RCodeNameError
+	case q.Type == dnsmsg.TypeA:
+		resp.Answers = []dnsmsg.ResourceRecord{dnsmsg.NewRR(q.Name, 60, &dnsmsg.A{IP: net.IPv4(198, 51, 100, 1)})}
+	}
+	return resp, nil
+}
+
+// rcodeFixture serves the zone example.com with a few records, and answers
+// everything else upstream.
+func rcodeFixture(t *testing.T) {
+	t.Helper()
+	setZones(t, manager.Zone{Name: "example.com", NS: []string{"ns1.example.com"}})
+	setRecords(t, map[string][]manager.Record{
+		"www.example.com":       {{Type: "A", TTL: 300, IP: "192.0.2.1"}},
+		"alias.example.com":     {{Type: "CNAME", TTL: 300, Target: "www.example.com"}},
+		"out.example.com":       {{Type: "CNAME", TTL: 300, Target: "www.example.net"}},
+		"host.lab.example.com":  {{Type: "A", TTL: 300, IP: "192.0.2.2"}},
+		"printer.outside.local": {{Type: "A", TTL: 300, IP: "192.0.2.3"}},
+	})
+	setStore(t)
+	setResolver(t, resolverFunc(upstreamAnswer))
+}
+
+func packQuery(t *testing.T, m *dnsmsg.Message) []byte {
+	t.Helper()
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestResolveRCodes(t *testing.T) {
+	rcodeFixture(t)
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   dnsmsg.Type
+		rcode   dnsmsg.RCode
+		answers int
+		soa     bool
+	}{
+		{"answer", "www.example.com", dnsmsg.TypeA, dnsmsg.RCodeSuccess, 1, false},
+		{"cname chain", "alias.example.com", dnsmsg.TypeA, dnsmsg.RCodeSuccess, 2, false},
+		{"cname chased upstream", "out.example.com", dnsmsg.TypeA, dnsmsg.RCodeSuccess, 2, false},
+		{"apex soa", "example.com", dnsmsg.TypeSOA, dnsmsg.RCodeSuccess, 1, false},
+		{"nodata", "www.example.com", dnsmsg.TypeAAAA, dnsmsg.RCodeSuccess, 0, true},
+		{"nodata at apex", "example.com", dnsmsg.TypeTXT, dnsmsg.RCodeSuccess, 0, true},
+		{"nodata at empty non-terminal", "lab.example.com", dnsmsg.TypeA, dnsmsg.RCodeSuccess, 0, true},
+		{"nxdomain in zone", "missing.example.com", dnsmsg.TypeA, dnsmsg.RCodeNameError, 0, true},
+		{"nxdomain below a name", "a.www.example.com", dnsmsg.TypeA, dnsmsg.RCodeNameError, 0, true},
+		{"local record outside zones", "printer.outside.local", dnsmsg.TypeA, dnsmsg.RCodeSuccess, 1, false},
+		{"forwarded", "www.example.net", dnsmsg.TypeA, dnsmsg.RCodeSuccess, 1, false},
+		{"upstream nxdomain", "nx.example.net", dnsmsg.TypeA, dnsmsg.RCodeNameError, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := testQuery(tt.qname, tt.qtype)
+			query.Header.ID = 0x4242
+			resp := Resolve(context.Background(), query, testAddr)
+			if resp.Header.ID != 0x4242 || !resp.Header.Response {
+				t.Errorf("response header %+v", resp.Header)
+			}
+			if resp.Header.RCode != tt.rcode || len(resp.Answers) != tt.answers {
+				t.Fatalf("got %s with %d answers, want %s with %d", resp.Header.RCode, len(resp.Answers), tt.rcode, tt.answers)
+			}
+			hasSOA := len(resp.Authority) == 1 && resp.Authority[0].Type == dnsmsg.TypeSOA
+			if hasSOA != tt.soa {
+				t.Errorf("authority %v, want SOA %t", resp.Authority, tt.soa)
+			}
+			if inZone := dnsmsg.IsSubdomain(tt.qname, "example.com"); resp.Header.Authoritative != inZone {
+				t.Errorf("AA %t for %s", resp.Header.Authoritative, tt.qname)
+			}
+		})
+	}
+}
+
+func TestResolveServFail(t *testing.T) {
+	rcodeFixture(t)
+	failing := resolverFunc(func(context.Context, *dnsmsg.Message) (*dnsmsg.Message, error) {
+		return nil, errors.New("all upstreams failed")
+	})
+
+	tests := []struct {
+		name     string
+		qname    string
+		resolver upstream.Resolver
+		noStore  bool
+	}{
+		{"upstream failure", "www.example.net", failing, false},
+		{"no upstream", "www.example.net", nil, false},
+		// A CNAME leaving our data is chased upstream.
+		{"upstream failure after cname", "out.example.com", failing, false},
+		{"store unavailable in zone", "www.example.com", resolverFunc(upstreamAnswer), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setResolver(t, tt.resolver)
+			if tt.noStore {
+				saved := constants.Redis
+				constants.Redis = nil
+				t.Cleanup(func() { constants.Redis = saved })
+			}
+			resp := Resolve(context.Background(), testQuery(tt.qname, dnsmsg.TypeA), testAddr)
+			if resp.Header.RCode != dnsmsg.RCodeServerFailure || len(resp.Answers) != 0 {
+				t.Errorf("got %s with %d answers, want SERVFAIL", resp.Header.RCode, len(resp.Answers))
+			}
+		})
+	}
+
+	// Outside our zones the store is not needed.
+	constants.Redis = nil
+	if resp := Resolve(context.Background(), testQuery("www.example.net", dnsmsg.TypeA), testAddr); resp.Header.RCode != dnsmsg.RCodeSuccess {
+		t.Errorf("forwarded query without the store got %s", resp.Header.RCode)
+	}
+}
+
+func TestProcessQueryRCodes(t *testing.T) {
+	rcodeFixture(t)
+
+	valid := packQuery(t, testQuery("www.example.com", dnsmsg.TypeA))
+	withOpcode := func(op dnsmsg.Opcode) []byte {
+		q := testQuery("www.example.com", dnsmsg.TypeA)
+		q.Header.Opcode = op
+		return packQuery(t, q)
+	}
+	twoQuestions := testQuery("www.example.com", dnsmsg.TypeA)
+	twoQuestions.Questions = append(twoQuestions.Questions, twoQuestions.Questions[0])
+	chaos := testQuery("version.bind", dnsmsg.TypeTXT)
+	chaos.Questions[0].Class = dnsmsg.ClassCHAOS
+	response := testQuery("www.example.com", dnsmsg.TypeA)
+	response.Header.Response = true
+
+	tests := []struct {
+		name  string
+		req   []byte
+		rcode dnsmsg.RCode
+		// silent is set when no response must be sent.
+		silent bool
+	}{
+		{"valid", valid, dnsmsg.RCodeSuccess, false},
+		{"truncated question", valid[:len(valid)-3], dnsmsg.RCodeFormatError, false},
+		{"additional count without records", append(append([]byte(nil), valid[:11]...), append([]byte{1}, valid[12:]...)...), dnsmsg.RCodeFormatError, false},
+		{"shorter than a header", valid[:5], 0, true},
+		{"response", packQuery(t, response), 0, true},
+		{"status opcode", withOpcode(dnsmsg.OpcodeStatus), dnsmsg.RCodeNotImplemented, false},
+		{"unassigned opcode", withOpcode(3), dnsmsg.RCodeNotImplemented, false},
+		{"two questions", packQuery(t, twoQuestions), dnsmsg.RCodeFormatError, false},
+		{"chaos class", packQuery(t, chaos), dnsmsg.RCodeRefused, false},
+		{"axfr over udp", packQuery(t, testQuery("example.com", dnsmsg.TypeAXFR)), dnsmsg.RCodeRefused, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := HandleDNSMessage(context.Background(), tt.req, testAddr, "udp")
+			if tt.silent {
+				if res != nil {
+					t.Fatalf("answered %x", res)
+				}
+				return
+			}
+			resp, err := dnsmsg.Parse(res)
+			if err != nil {
+				t.Fatalf("unparsable response: %v", err)
+			}
+			if resp.Header.RCode != tt.rcode || !resp.Header.Response || resp.Header.ID != 1 {
+				t.Errorf("got header %+v, want %s", resp.Header, tt.rcode)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/secondary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errSecondaryZone = errors.New("zone is a secondary and is changed only by its primaries")
+
+var errZoneExpired = errors.New("secondary zone has expired")
+
+// ReadOnly returns an error when the records of domainName come from the
+// primary of a secondary zone and cannot be changed locally.
+func ReadOnly(domainName string) error {
+	if z, ok := constants.Zones.Find(domainName); ok && z.Secondary() {
+		return errSecondaryZone
+	}
+	return nil
+}
+
+// ApplyTransfer stores a transfer of the secondary zone z received from a
+// primary. A full transfer replaces every record of the zone, an
+// incremental one applies its changes in order. The zone takes the SOA
+// parameters and serial of the primary as they are.
+func ApplyTransfer(z manager.Zone, t *secondary.Transfer) (manager.Zone, error) {
+	if constants.Redis == nil {
+		return z, errStorageUnavailable
+	}
+	defer zoneLocks.lock(z.Name)()
+
+	current, ok := constants.Zones.Get(z.Name)
+	if !ok || !current.Secondary() {
+		return z, errZoneNotFound
+	}
+
+	updated := current
+	updated.Refreshed = time.Now()
+	if !t.UpToDate() {
+		updated.MName, updated.RName = t.SOA.MName, t.SOA.RName
+		updated.Serial = t.SOA.Serial
+		updated.Refresh, updated.Retry, updated.Expire = t.SOA.Refresh, t.SOA.Retry, t.SOA.Expire
+		updated.Minimum, updated.TTL = t.SOA.Minimum, t.SOA.TTL
+		// The NS records of the apex are transferred with the others.
+		updated.NS = nil
+	}
+
+	switch {
+	case t.Full:
+		if err := replaceZoneRecords(current, t.Records); err != nil {
+			return current, err
+		}
+	case len(t.Incremental) > 0:
+		if t.Incremental[0].From != current.Serial {
+			return current, fmt.Errorf("incremental transfer starts at serial %d, zone is at %d", t.Incremental[0].From, current.Serial)
+		}
+		for _, entry := range t.Incremental {
+			if err := applyJournalEntry(entry); err != nil {
+				return current, err
+			}
+		}
+	}
+
+	if err := storeZone(updated); err != nil {
+		return current, err
+	}
+	if !t.UpToDate() {
+		commitJournal(current, updated)
+		notifySecondaries(updated)
+	}
+	return updated, nil
+}
+
+// replaceZoneRecords makes records the only records of the zone z.
+func replaceZoneRecords(z manager.Zone, records map[string][]manager.Record) error {
+	for domainName := range zoneRecords(z) {
+		if _, ok := records[domainName]; !ok {
+			if err := writeRecords(domainName, nil); err != nil {
+				return err
+			}
+		}
+	}
+	for domainName, rs := range records {
+		if err := writeRecords(domainName, rs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyJournalEntry deletes and adds the records of one change.
+func applyJournalEntry(entry manager.JournalEntry) error {
+	changed := make(map[string][]manager.Record)
+	lookup := func(name string) []manager.Record {
+		if rs, ok := changed[name]; ok {
+			return rs
+		}
+		rs, _ := constants.ContextManager.Lookup(name)
+		return slices.Clone(rs)
+	}
+
+	for _, r := range entry.Deleted {
+		changed[r.Name] = slices.DeleteFunc(lookup(r.Name), r.Record.SameData)
+	}
+	for _, r := range entry.Added {
+		rs := slices.DeleteFunc(lookup(r.Name), r.Record.SameData)
+		changed[r.Name] = append(rs, r.Record)
+	}
+
+	for domainName, rs := range changed {
+		if err := writeRecords(dnsmsg.CanonicalName(domainName), rs); err != nil {
+			log.Error().Msgf("Error applying change %d -> %d to %s -> %v", entry.From, entry.To, domainName, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// handleNotify answers a NOTIFY announcing that a secondary zone changed
+// on its primary, and refreshes the zone when it comes from one of the
+// primaries (RFC 1996 section 3.7).
+func handleNotify(query *dnsmsg.Message, addr net.Addr) *dnsmsg.Message {
+	if len(query.Questions) != 1 || query.Questions[0].Type != dnsmsg.TypeSOA {
+		return errorReply(query, dnsmsg.RCodeFormatError)
+	}
+	name := query.Questions[0].Name
+	if constants.Secondaries == nil || !constants.Secondaries.Notify(name, addrIP(addr)) {
+		log.Warn().Msgf("Refusing NOTIFY for %s from %s", name, addr.String())
+		return errorReply(query, dnsmsg.RCodeRefused)
+	}
+
+	log.Info().Msgf("Received NOTIFY for %s from %s", name, addr.String())
+	resp := query.Reply()
+	resp.Header.Authoritative = true
+	resp.Header.RecursionAvailable = false
+	return resp
+}
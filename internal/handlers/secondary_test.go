@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// setZones serves zones until the test ends.
+func setZones(t *testing.T, zones ...manager.Zone) {
+	t.Helper()
+	saved := constants.Zones
+	constants.Zones = manager.NewZoneManager()
+	t.Cleanup(func() { constants.Zones = saved })
+	for _, z := range zones {
+		if err := z.Normalize(); err != nil {
+			t.Fatal(err)
+		}
+		constants.Zones.Set(z)
+	}
+}
+
+func testQuery(name string, t dnsmsg.Type) *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: name, Type: t, Class: dnsmsg.ClassINET}},
+	}
+}
+
+func TestExpiredSecondaryIsServFail(t *testing.T) {
+	// Last reached a second more than the SOA expire time ago.
+	setZones(t, manager.Zone{
+		Name:      "example.com",
+		Primaries: []string{"192.0.2.53"},
+		Expire:    3600,
+		Refreshed: time.Now().Add(-3601 * time.Second),
+	})
+
+	for _, name := range []string{"example.com", "www.example.com"} {
+		query := testQuery(name, dnsmsg.TypeA)
+		if _, err := resolve(context.Background(), query); !errors.Is(err, errZoneExpired) {
+			t.Errorf("resolving %s in an expired zone: error %v, want %v", name, err, errZoneExpired)
+		}
+		resp := Resolve(context.Background(), query, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if resp.Header.RCode != dnsmsg.RCodeServerFailure || len(resp.Answers) != 0 {
+			t.Errorf("answer for %s in an expired zone: %v", name, resp)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxTransferMessage is the size zone transfer messages are filled up to,
+// leaving room for the TSIG record within the 64KiB a stream message can
+// carry.
+const maxTransferMessage = 16 * 1024
+
+// HandleStreamMessage runs a query received over a stream transport. Zone
+// transfers may be answered with several messages, which must be written
+// in order; every other query gets the single response of
+// HandleDNSMessage.
+func HandleStreamMessage(ctx context.Context, req []byte, addr net.Addr, network string) [][]byte {
+	query, err := dnsmsg.Parse(req)
+	if err == nil && !query.Header.Response && query.Header.Opcode == dnsmsg.OpcodeQuery &&
+		len(query.Questions) == 1 && isTransfer(query.Questions[0].Type) {
+		return transferZone(req, query, addr)
+	}
+
+	res := HandleDNSMessage(ctx, req, addr, network)
+	if res == nil {
+		return nil
+	}
+	return [][]byte{res}
+}
+
+func isTransfer(t dnsmsg.Type) bool {
+	return t == dnsmsg.TypeAXFR || t == dnsmsg.TypeIXFR
+}
+
+// transferZone answers an AXFR or IXFR request. Only stored zones are
+// transferred, and only to the secondaries allowed by the transfer ACL,
+// authenticated with TSIG when the request is signed or signing is
+// required.
+func transferZone(req []byte, query *dnsmsg.Message, addr net.Addr) (res [][]byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Msgf("Panic recovered in zone transfer for %s: %v", addr.String(), r)
+			res = nil
+		}
+	}()
+
+	q := query.Questions[0]
+	log.Info().Msgf("Zone transfer requested by %s: %s %s", addr.String(), q.Name, q.Type)
+
+	now := time.Now()
+	signer, reject, err := authenticate(req, query, now)
+	if err != nil {
+		log.Warn().Msgf("Refusing zone transfer of %s to %s -> %v", q.Name, addr.String(), err)
+		return packTransfer([]*dnsmsg.Message{reject}, signer)
+	}
+	if signer == nil && constants.Config.Transfer.RequireTSIG {
+		log.Warn().Msgf("Refusing unsigned zone transfer of %s to %s", q.Name, addr.String())
+		return packTransfer([]*dnsmsg.Message{errorReply(query, dnsmsg.RCodeNotAuth)}, nil)
+	}
+
+	if !constants.TransferACL.Allows(addrIP(addr)) {
+		log.Warn().Msgf("Refusing zone transfer of %s to %s, which is not an allowed secondary", q.Name, addr.String())
+		return packTransfer([]*dnsmsg.Message{errorReply(query, dnsmsg.RCodeRefused)}, signer)
+	}
+
+	z, ok := constants.Zones.Get(q.Name)
+	if !ok || z.Implicit {
+		return packTransfer([]*dnsmsg.Message{errorReply(query, dnsmsg.RCodeNotAuth)}, signer)
+	}
+	if z.Expired(now) {
+		return packTransfer([]*dnsmsg.Message{errorReply(query, dnsmsg.RCodeServerFailure)}, signer)
+	}
+
+	var records []dnsmsg.ResourceRecord
+	incremental := false
+	if q.Type == dnsmsg.TypeIXFR {
+		records, incremental = incrementalRecords(query, z)
+	}
+	if !incremental {
+		records = fullRecords(z)
+	}
+
+	messages := splitTransfer(query, records)
+	log.Info().Msgf("Transferring zone %s serial %d to %s in %d messages", z.Name, z.Serial, addr.String(), len(messages))
+	return packTransfer(messages, signer)
+}
+
+// packTransfer packs the messages of a transfer, signing each of them when
+// signer is set.
+func packTransfer(messages []*dnsmsg.Message, signer *responseSigner) [][]byte {
+	res := make([][]byte, 0, len(messages))
+	for _, m := range messages {
+		var b []byte
+		var err error
+		if signer != nil {
+			b, err = signer.pack(m, 0xFFFF)
+		} else {
+			b, err = m.Pack()
+		}
+		if err != nil {
+			log.Error().Msgf("Error building zone transfer message -> %v", err)
+			return res
+		}
+		res = append(res, b)
+	}
+	return res
+}
+
+// fullRecords returns the records of an AXFR: the SOA, every record of the
+// zone and the SOA again (RFC 5936 section 2.2).
+func fullRecords(z manager.Zone) []dnsmsg.ResourceRecord {
+	records := transferRecords(z)
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, manager.CompareNames)
+
+	rrs := []dnsmsg.ResourceRecord{z.SOA()}
+	for _, name := range names {
+		for _, r := range records[name] {
+			rr, err := r.RR(name)
+			if err != nil {
+				log.Error().Msgf("Skipping invalid %s record for %s -> %v", r.Type, name, err)
+				continue
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+	return append(rrs, z.SOA())
+}
+
+// incrementalRecords returns the records of an IXFR from the serial in the
+// authority section of query (RFC 1995 section 4). A client that is up to
+// date gets the SOA alone. ok is false when the journal does not reach
+// back to the client's serial, in which case the whole zone is sent.
+func incrementalRecords(query *dnsmsg.Message, z manager.Zone) ([]dnsmsg.ResourceRecord, bool) {
+	var serial uint32
+	found := false
+	for _, rr := range query.Authority {
+		if soa, ok := rr.Data.(*dnsmsg.SOA); ok {
+			serial, found = soa.Serial, true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	if serial == z.Serial || manager.SerialGreater(serial, z.Serial) {
+		return []dnsmsg.ResourceRecord{z.SOA()}, true
+	}
+
+	entries, ok := constants.Journal.Since(z.Name, serial)
+	if !ok || entries[len(entries)-1].To != z.Serial {
+		return nil, false
+	}
+
+	rrs := []dnsmsg.ResourceRecord{z.SOA()}
+	for _, e := range entries {
+		rrs = append(rrs, e.Old.SOA())
+		rrs = appendZoneRecords(rrs, e.Deleted)
+		rrs = append(rrs, e.New.SOA())
+		rrs = appendZoneRecords(rrs, e.Added)
+	}
+	return append(rrs, z.SOA()), true
+}
+
+func appendZoneRecords(rrs []dnsmsg.ResourceRecord, records []manager.ZoneRecord) []dnsmsg.ResourceRecord {
+	for _, r := range records {
+		rr, err := r.RR(r.Name)
+		if err != nil {
+			log.Error().Msgf("Skipping invalid %s record for %s -> %v", r.Type, r.Name, err)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// splitTransfer spreads records over as many responses to query as
+// needed. Only the first response repeats the question.
+func splitTransfer(query *dnsmsg.Message, records []dnsmsg.ResourceRecord) []*dnsmsg.Message {
+	resp := query.Reply()
+	resp.Header.Authoritative = true
+	resp.Header.RecursionAvailable = false
+	messages := []*dnsmsg.Message{resp}
+
+	size := 0
+	for _, rr := range records {
+		rrSize := recordSize(rr)
+		if size+rrSize > maxTransferMessage && len(resp.Answers) > 0 {
+			next := *resp
+			next.Questions = nil
+			next.Answers = nil
+			resp = &next
+			messages = append(messages, resp)
+			size = 0
+		}
+		resp.Answers = append(resp.Answers, rr)
+		size += rrSize
+	}
+	return messages
+}
+
+// recordSize returns the size of rr in wire format without compression,
+// which bounds what it adds to a message.
+func recordSize(rr dnsmsg.ResourceRecord) int {
+	b, err := (&dnsmsg.Message{Answers: []dnsmsg.ResourceRecord{rr}}).Pack()
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// addrIP returns the IP address of a client.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/notify"
+	"net"
+	"testing"
+)
+
+func TestImplicitZoneIsNotReplicated(t *testing.T) {
+	setZones(t)
+	constants.Zones.SetImplicit([]string{"lan"})
+	notifier, targets := constants.Notifier, constants.NotifyTargets
+	constants.Notifier, constants.NotifyTargets = notify.New(), []string{"192.0.2.53:53"}
+	acl := constants.TransferACL
+	constants.TransferACL, _ = manager.ParseACL([]string{"127.0.0.1"})
+	t.Cleanup(func() {
+		constants.Notifier, constants.NotifyTargets = notifier, targets
+		constants.TransferACL = acl
+	})
+
+	// A change bumps the serial in memory only; nothing is stored, which
+	// would fail without Redis, and no secondary is notified.
+	touchZone("printer.lan")
+	if z, _ := constants.Zones.Get("lan"); z.Serial != 2 {
+		t.Errorf("serial after a change is %d, want 2", z.Serial)
+	}
+	if status := constants.Notifier.Status(); len(status) != 0 {
+		t.Errorf("NOTIFY sent for a zone from the configuration: %+v", status)
+	}
+
+	for _, qtype := range []dnsmsg.Type{dnsmsg.TypeAXFR, dnsmsg.TypeIXFR} {
+		query := testQuery("lan", qtype)
+		req, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := transferZone(req, query, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353})
+		if len(res) != 1 {
+			t.Fatalf("%s answered with %d messages, want 1", qtype, len(res))
+		}
+		resp, err := dnsmsg.Parse(res[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.RCode != dnsmsg.RCodeNotAuth || len(resp.Answers) != 0 {
+			t.Errorf("%s of a zone from the configuration: %v", qtype, resp)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/tsig"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// tsigKey is the Redis hash holding the TSIG keys added through the API,
+// keyed by key name.
+const tsigKey = "tsig"
+
+var errConfigKey = errors.New("the key is defined in the configuration file")
+
+// responseSigner signs the responses to a request that carried a TSIG
+// record, reporting rcode as the TSIG error.
+type responseSigner struct {
+	*tsig.Signer
+	rcode dnsmsg.RCode
+}
+
+// pack signs msg, cutting it down to fit in limit bytes first.
+func (s *responseSigner) pack(msg *dnsmsg.Message, limit int) ([]byte, error) {
+	return s.SignLimit(msg, s.rcode, time.Now(), limit)
+}
+
+// authenticate checks the TSIG record of a request. The signer is nil for
+// unsigned requests. When the signature cannot be verified err is set and
+// resp is the NOTAUTH response to send instead, to be packed with the
+// signer when there is one: only a BADTIME response can be signed, since
+// the key is known and the signature was valid (RFC 8945 section 5.2.3).
+func authenticate(req []byte, query *dnsmsg.Message, now time.Time) (signer *responseSigner, resp *dnsmsg.Message, err error) {
+	key, t, err := tsig.Verify(req, query, constants.TSIGKeys, now)
+	switch {
+	case errors.Is(err, tsig.ErrUnsigned):
+		return nil, nil, nil
+	case err == nil:
+		return &responseSigner{Signer: tsig.NewSigner(key, t.MAC)}, nil, nil
+	}
+
+	resp = errorReply(query, dnsmsg.RCodeNotAuth)
+	rcode := tsig.RCode(err)
+	switch rcode {
+	case dnsmsg.RCodeSuccess:
+		resp.Header.RCode = dnsmsg.RCodeFormatError
+	case dnsmsg.RCodeBadTime:
+		signer = &responseSigner{Signer: tsig.NewSigner(key, t.MAC), rcode: rcode}
+	default:
+		name, _, _ := tsig.Find(query)
+		resp.Additional = append(resp.Additional, tsig.ErrorRecord(name, t, rcode, query.Header.ID, now))
+	}
+	return signer, resp, err
+}
+
+// signerKey returns the name of the key a request was signed with.
+func signerKey(query *dnsmsg.Message) string {
+	name, _, _ := tsig.Find(query)
+	return dnsmsg.CanonicalName(name)
+}
+
+// AddTSIGKey stores k, generating a secret when it has none, and returns
+// the stored key. Keys from the configuration file cannot be replaced.
+func AddTSIGKey(k tsig.Key) (tsig.Key, error) {
+	if len(k.Secret) == 0 {
+		secret, err := tsig.GenerateSecret(k.Algorithm)
+		if err != nil {
+			return k, err
+		}
+		k.Secret = secret
+	}
+	if err := k.Normalize(); err != nil {
+		return k, err
+	}
+	if ConfigKey(k.Name) {
+		return k, errConfigKey
+	}
+	if constants.Redis == nil {
+		return k, errStorageUnavailable
+	}
+
+	value, err := json.Marshal(k)
+	if err != nil {
+		return k, err
+	}
+	if err := constants.Redis.HSet(context.Background(), tsigKey, k.Name, string(value)); err != nil {
+		log.Error().Msgf("Error storing TSIG key %s -> %v", k.Name, err)
+		return k, err
+	}
+	return k, constants.TSIGKeys.Set(k)
+}
+
+// RemoveTSIGKey deletes the key name and reports whether it existed. Keys
+// from the configuration file cannot be removed.
+func RemoveTSIGKey(name string) (bool, error) {
+	name = dnsmsg.CanonicalName(name)
+	if ConfigKey(name) {
+		return true, errConfigKey
+	}
+	if constants.Redis == nil {
+		return false, errStorageUnavailable
+	}
+
+	if err := constants.Redis.HDel(context.Background(), tsigKey, name); err != nil {
+		return false, err
+	}
+	return constants.TSIGKeys.Remove(name), nil
+}
+
+// LoadTSIGKeys reads the keys added through the API from Redis. Keys of
+// the configuration file take precedence over stored keys of the same
+// name.
+func LoadTSIGKeys() error {
+	if constants.Redis == nil {
+		return errStorageUnavailable
+	}
+
+	res, err := constants.Redis.HGetAll(context.Background(), tsigKey)
+	if err != nil {
+		log.Error().Msgf("Error while loading TSIG keys -> %v", err)
+		return err
+	}
+
+	for name, value := range res {
+		var k tsig.Key
+		if err := json.Unmarshal([]byte(value), &k); err != nil {
+			log.Error().Msgf("Skipping invalid TSIG key %s -> %v", name, err)
+			continue
+		}
+		if ConfigKey(k.Name) {
+			continue
+		}
+		if err := constants.TSIGKeys.Set(k); err != nil {
+			log.Error().Msgf("Skipping invalid TSIG key %s -> %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ConfigKey reports whether the key name comes from the configuration
+// file rather than from Redis.
+func ConfigKey(name string) bool {
+	name = dnsmsg.CanonicalName(name)
+	for _, k := range constants.Config.TSIGKeys {
+		if dnsmsg.CanonicalName(k.Name) == name {
+			return true
+		}
+	}
+	return false
+}
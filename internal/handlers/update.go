@@ -0,0 +1,355 @@
+package handlers
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// updateMu serialises dynamic updates so that the prerequisites of one
+// update hold until its changes are stored.
+var updateMu sync.Mutex
+
+// handleUpdate applies a dynamic update (RFC 2136). The zone section names
+// the zone, the answer section carries the prerequisites and the authority
+// section the changes, which are stored like those made through the API.
+// Updates must be signed with a TSIG key, in which case signer is set, or
+// come from an address allowed to send unsigned updates.
+func handleUpdate(query *dnsmsg.Message, addr net.Addr, signer *responseSigner) *dnsmsg.Message {
+	if len(query.Questions) != 1 || query.Questions[0].Type != dnsmsg.TypeSOA {
+		log.Warn().Msgf("Update from %s without a zone", addr.String())
+		return errorReply(query, dnsmsg.RCodeFormatError)
+	}
+	zq := query.Questions[0]
+
+	if signer != nil {
+		if keys := constants.Config.Update.Keys; len(keys) > 0 && !slices.ContainsFunc(keys, func(k string) bool {
+			return dnsmsg.CanonicalName(k) == signerKey(query)
+		}) {
+			log.Warn().Msgf("Refusing update of %s from %s signed with key %s", zq.Name, addr.String(), signerKey(query))
+			return errorReply(query, dnsmsg.RCodeRefused)
+		}
+	} else if !constants.UpdateACL.Allows(addrIP(addr)) {
+		log.Warn().Msgf("Refusing unsigned update of %s from %s", zq.Name, addr.String())
+		return errorReply(query, dnsmsg.RCodeRefused)
+	}
+
+	z, ok := constants.Zones.Get(zq.Name)
+	if !ok || z.Secondary() || zq.Class != dnsmsg.ClassINET {
+		log.Warn().Msgf("Refusing update of %s from %s, which is not a local zone", zq.Name, addr.String())
+		return errorReply(query, dnsmsg.RCodeNotAuth)
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	// Changes made through the API lock only the name they change.
+	defer nameLocks.lockAll(updateNames(query))()
+
+	if rcode := checkPrerequisites(z, query.Answers); rcode != dnsmsg.RCodeSuccess {
+		log.Info().Msgf("Update of %s from %s failed its prerequisites: %s", z.Name, addr.String(), rcode)
+		return errorReply(query, rcode)
+	}
+	if rcode := checkUpdates(z, query.Authority); rcode != dnsmsg.RCodeSuccess {
+		log.Warn().Msgf("Rejecting update of %s from %s: %s", z.Name, addr.String(), rcode)
+		return errorReply(query, rcode)
+	}
+
+	changed, err := storeUpdates(z, applyUpdates(z, query.Authority))
+	if err != nil {
+		log.Error().Msgf("Error storing update of %s from %s -> %v", z.Name, addr.String(), err)
+		return errorReply(query, dnsmsg.RCodeServerFailure)
+	}
+
+	log.Info().Msgf("Updated %d names in zone %s for %s", changed, z.Name, addr.String())
+	resp := errorReply(query, dnsmsg.RCodeSuccess)
+	setResponseEDNS(query, resp)
+	return resp
+}
+
+// updateNames returns the names that the prerequisites and changes of an
+// update refer to.
+func updateNames(query *dnsmsg.Message) []string {
+	var names []string
+	for _, rr := range slices.Concat(query.Answers, query.Authority) {
+		names = append(names, dnsmsg.CanonicalName(rr.Name))
+	}
+	return names
+}
+
+// updateZone reports whether name belongs to z itself rather than to a
+// more specific zone, which is all an update of z may touch.
+func updateZone(z manager.Zone, name string) bool {
+	owner, ok := constants.Zones.Find(name)
+	return ok && owner.Name == z.Name
+}
+
+// checkPrerequisites evaluates the prerequisite section of an update
+// against the current contents of z (RFC 2136 section 3.2). Records that
+// must exist with given values are compared as whole RRsets, and can only
+// match the record types that can be stored.
+func checkPrerequisites(z manager.Zone, prereqs []dnsmsg.ResourceRecord) dnsmsg.RCode {
+	type rrset struct {
+		name  string
+		rtype string
+	}
+	expected := make(map[rrset][]manager.Record)
+
+	for _, rr := range prereqs {
+		name := dnsmsg.CanonicalName(rr.Name)
+		if rr.TTL != 0 {
+			return dnsmsg.RCodeFormatError
+		}
+		if !updateZone(z, name) {
+			return dnsmsg.RCodeNotZone
+		}
+
+		switch rr.Class {
+		case dnsmsg.ClassANY:
+			if rr.Data != nil {
+				return dnsmsg.RCodeFormatError
+			}
+			if rr.Type == dnsmsg.TypeANY {
+				if !nameInUse(z, name) {
+					return dnsmsg.RCodeNameError
+				}
+			} else if len(currentRRSet(z, name, rr.Type)) == 0 {
+				return dnsmsg.RCodeNXRRSet
+			}
+		case dnsmsg.ClassNONE:
+			if rr.Data != nil {
+				return dnsmsg.RCodeFormatError
+			}
+			if rr.Type == dnsmsg.TypeANY {
+				if nameInUse(z, name) {
+					return dnsmsg.RCodeYXDomain
+				}
+			} else if len(currentRRSet(z, name, rr.Type)) > 0 {
+				return dnsmsg.RCodeYXRRSet
+			}
+		case dnsmsg.ClassINET:
+			r, ok := manager.RecordFromRR(rr)
+			if !ok {
+				return dnsmsg.RCodeNXRRSet
+			}
+			key := rrset{name, r.Type}
+			if !slices.ContainsFunc(expected[key], r.SameData) {
+				expected[key] = append(expected[key], r)
+			}
+		default:
+			return dnsmsg.RCodeFormatError
+		}
+	}
+
+	for key, want := range expected {
+		t, _ := dnsmsg.ParseType(key.rtype)
+		have := currentRRSet(z, key.name, t)
+		if len(have) != len(want) {
+			return dnsmsg.RCodeNXRRSet
+		}
+		for _, r := range want {
+			if !slices.ContainsFunc(have, r.SameData) {
+				return dnsmsg.RCodeNXRRSet
+			}
+		}
+	}
+	return dnsmsg.RCodeSuccess
+}
+
+// nameInUse reports whether name owns any record of z. The apex always
+// does, since it owns the SOA record.
+func nameInUse(z manager.Zone, name string) bool {
+	records, _ := constants.ContextManager.Lookup(name)
+	return name == z.Name || len(records) > 0
+}
+
+// currentRRSet returns the records of type t that name owns in z. The SOA
+// record of the apex is not a stored record and is returned as an empty
+// record of type SOA.
+func currentRRSet(z manager.Zone, name string, t dnsmsg.Type) []manager.Record {
+	if t == dnsmsg.TypeSOA {
+		if name == z.Name {
+			return []manager.Record{{Type: "SOA"}}
+		}
+		return nil
+	}
+
+	stored, _ := constants.ContextManager.Lookup(name)
+	var records []manager.Record
+	for _, r := range stored {
+		if r.Type == t.String() {
+			records = append(records, r)
+		}
+	}
+	if t == dnsmsg.TypeNS && name == z.Name && len(records) == 0 {
+		return zoneNS(z)
+	}
+	return records
+}
+
+// checkUpdates checks the update section before anything is changed, so
+// that an update is applied either completely or not at all (RFC 2136
+// section 3.4.1). Records to add must be of a type that can be stored.
+func checkUpdates(z manager.Zone, updates []dnsmsg.ResourceRecord) dnsmsg.RCode {
+	for _, rr := range updates {
+		if !updateZone(z, dnsmsg.CanonicalName(rr.Name)) {
+			return dnsmsg.RCodeNotZone
+		}
+
+		switch rr.Class {
+		case dnsmsg.ClassINET:
+			if metaType(rr.Type) || rr.Data == nil {
+				return dnsmsg.RCodeFormatError
+			}
+			if rr.Type == dnsmsg.TypeSOA {
+				continue
+			}
+			if _, ok := manager.RecordFromRR(rr); !ok {
+				log.Warn().Msgf("Cannot store %s record for %s from an update", rr.Type, rr.Name)
+				return dnsmsg.RCodeRefused
+			}
+		case dnsmsg.ClassANY:
+			if rr.TTL != 0 || rr.Data != nil || rr.Type == dnsmsg.TypeAXFR || rr.Type == dnsmsg.TypeIXFR {
+				return dnsmsg.RCodeFormatError
+			}
+		case dnsmsg.ClassNONE:
+			if rr.TTL != 0 || metaType(rr.Type) {
+				return dnsmsg.RCodeFormatError
+			}
+		default:
+			return dnsmsg.RCodeFormatError
+		}
+	}
+	return dnsmsg.RCodeSuccess
+}
+
+// metaType reports whether t is a query or meta type that no record can
+// have.
+func metaType(t dnsmsg.Type) bool {
+	switch t {
+	case dnsmsg.TypeANY, dnsmsg.TypeAXFR, dnsmsg.TypeIXFR, dnsmsg.TypeOPT, dnsmsg.TypeTSIG:
+		return true
+	}
+	return false
+}
+
+// applyUpdates applies the checked update section of an update to z in
+// order (RFC 2136 section 3.4.2) and returns the new records of every name
+// it touched. The SOA record is maintained by the server, so changes to
+// it are ignored, and the apex always keeps at least one name server.
+func applyUpdates(z manager.Zone, updates []dnsmsg.ResourceRecord) map[string][]manager.Record {
+	changed := make(map[string][]manager.Record)
+	current := func(name string) []manager.Record {
+		if records, ok := changed[name]; ok {
+			return records
+		}
+		records, _ := constants.ContextManager.Lookup(name)
+		return slices.Clone(records)
+	}
+	// withApexNS makes the name servers of the zone explicit before the NS
+	// records of the apex are changed, since stored NS records replace
+	// them.
+	withApexNS := func(name string, records []manager.Record) []manager.Record {
+		if name != z.Name || slices.ContainsFunc(records, isType("NS")) {
+			return records
+		}
+		return append(records, zoneNS(z)...)
+	}
+
+	for _, rr := range updates {
+		name := dnsmsg.CanonicalName(rr.Name)
+		if rr.Type == dnsmsg.TypeSOA {
+			continue
+		}
+		records := current(name)
+
+		switch rr.Class {
+		case dnsmsg.ClassINET:
+			r, _ := manager.RecordFromRR(rr)
+			hasCNAME := slices.ContainsFunc(records, isType("CNAME"))
+			if r.Type == "CNAME" {
+				if name == z.Name || len(records) > 0 && !hasCNAME {
+					continue
+				}
+				records = slices.DeleteFunc(records, isType("CNAME"))
+			} else if hasCNAME {
+				continue
+			}
+			if r.Type == "NS" {
+				records = withApexNS(name, records)
+			}
+			if i := slices.IndexFunc(records, r.SameData); i >= 0 {
+				records[i].TTL = r.TTL
+			} else {
+				records = append(records, r)
+			}
+		case dnsmsg.ClassANY:
+			if rr.Type == dnsmsg.TypeANY {
+				if name == z.Name {
+					records = slices.DeleteFunc(records, func(r manager.Record) bool { return r.Type != "NS" })
+				} else {
+					records = nil
+				}
+			} else {
+				if name == z.Name && rr.Type == dnsmsg.TypeNS {
+					continue
+				}
+				records = slices.DeleteFunc(records, isType(rr.Type.String()))
+			}
+		case dnsmsg.ClassNONE:
+			r, ok := manager.RecordFromRR(rr)
+			if !ok {
+				continue
+			}
+			if r.Type == "NS" {
+				records = withApexNS(name, records)
+				if name == z.Name && countType(records, "NS") == 1 {
+					continue
+				}
+			}
+			records = slices.DeleteFunc(records, r.SameData)
+		}
+		changed[name] = records
+	}
+	return changed
+}
+
+func isType(t string) func(manager.Record) bool {
+	return func(r manager.Record) bool { return r.Type == t }
+}
+
+func countType(records []manager.Record, t string) int {
+	n := 0
+	for _, r := range records {
+		if r.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// storeUpdates stores the records of the names an update changed and
+// advances the serial of z once for the whole update. Updates that leave
+// the zone as it was do not change the serial (RFC 2136 section 3.6). It
+// returns how many names changed.
+func storeUpdates(z manager.Zone, updated map[string][]manager.Record) (int, error) {
+	defer zoneLocks.lock(z.Name)()
+	changed := 0
+	for name, records := range updated {
+		if stored, _ := constants.ContextManager.Lookup(name); manager.EqualRecords(stored, records) {
+			continue
+		}
+		if err := writeRecords(name, records); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	if changed > 0 {
+		advanceSerial(z.Name)
+	}
+	return changed, nil
+}
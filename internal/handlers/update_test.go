@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"net"
+	"testing"
+)
+
+// setRecords serves records until the test ends.
+func setRecords(t *testing.T, records map[string][]manager.Record) {
+	t.Helper()
+	saved := constants.ContextManager
+	constants.ContextManager = manager.NewContextManager()
+	t.Cleanup(func() { constants.ContextManager = saved })
+	for name, rs := range records {
+		constants.ContextManager.AddRP(name, rs)
+	}
+}
+
+// updateFixture serves the zone example.com, with the child zone
+// sub.example.com, and a few records.
+func updateFixture(t *testing.T) manager.Zone {
+	t.Helper()
+	z := manager.Zone{Name: "example.com", NS: []string{"ns1.example.com"}}
+	setZones(t, z, manager.Zone{Name: "sub.example.com"})
+	setRecords(t, map[string][]manager.Record{
+		"www.example.com": {
+			{Type: "A", TTL: 300, IP: "192.0.2.1"},
+			{Type: "A", TTL: 300, IP: "192.0.2.2"},
+			{Type: "TXT", TTL: 300, Text: manager.Text{"hello"}},
+		},
+		"alias.example.com": {{Type: "CNAME", TTL: 300, Target: "www.example.com"}},
+	})
+	z, _ = constants.Zones.Get("example.com")
+	return z
+}
+
+// prereq builds a prerequisite record; data is nil for the classes ANY
+// and NONE.
+func prereq(name string, t dnsmsg.Type, class dnsmsg.Class, data dnsmsg.RData) dnsmsg.ResourceRecord {
+	return dnsmsg.ResourceRecord{Name: name, Type: t, Class: class, Data: data}
+}
+
+func aData(ip string) dnsmsg.RData {
+	return &dnsmsg.A{IP: net.ParseIP(ip).To4()}
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	z := updateFixture(t)
+	const (
+		www   = "www.example.com"
+		none  = "missing.example.com"
+		apex  = "example.com"
+		child = "host.sub.example.com"
+	)
+	withTTL := prereq(www, dnsmsg.TypeA, dnsmsg.ClassANY, nil)
+	withTTL.TTL = 300
+
+	tests := []struct {
+		name    string
+		prereqs []dnsmsg.ResourceRecord
+		want    dnsmsg.RCode
+	}{
+		{"none", nil, dnsmsg.RCodeSuccess},
+
+		// Name is in use (section 2.4.4).
+		{"name in use", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeANY, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeSuccess},
+		{"apex in use", []dnsmsg.ResourceRecord{prereq(apex, dnsmsg.TypeANY, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeSuccess},
+		{"name not in use", []dnsmsg.ResourceRecord{prereq(none, dnsmsg.TypeANY, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeNameError},
+
+		// RRset exists, value independent (section 2.4.1).
+		{"rrset exists", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeA, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeSuccess},
+		{"rrset missing", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeMX, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeNXRRSet},
+		{"apex SOA", []dnsmsg.ResourceRecord{prereq(apex, dnsmsg.TypeSOA, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeSuccess},
+		{"apex NS from the zone", []dnsmsg.ResourceRecord{prereq(apex, dnsmsg.TypeNS, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeSuccess},
+		{"SOA below the apex", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeSOA, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeNXRRSet},
+
+		// Name is not in use (section 2.4.5).
+		{"name free", []dnsmsg.ResourceRecord{prereq(none, dnsmsg.TypeANY, dnsmsg.ClassNONE, nil)}, dnsmsg.RCodeSuccess},
+		{"name taken", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeANY, dnsmsg.ClassNONE, nil)}, dnsmsg.RCodeYXDomain},
+		{"apex taken", []dnsmsg.ResourceRecord{prereq(apex, dnsmsg.TypeANY, dnsmsg.ClassNONE, nil)}, dnsmsg.RCodeYXDomain},
+
+		// RRset does not exist (section 2.4.3).
+		{"rrset absent", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeAAAA, dnsmsg.ClassNONE, nil)}, dnsmsg.RCodeSuccess},
+		{"rrset present", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeTXT, dnsmsg.ClassNONE, nil)}, dnsmsg.RCodeYXRRSet},
+
+		// RRset exists, value dependent (section 2.4.2): the whole RRset
+		// must match, in any order and counting duplicates once.
+		{"rrset equal", []dnsmsg.ResourceRecord{
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.2")),
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.1")),
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.1")),
+		}, dnsmsg.RCodeSuccess},
+		{"rrset subset", []dnsmsg.ResourceRecord{
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.1")),
+		}, dnsmsg.RCodeNXRRSet},
+		{"rrset superset", []dnsmsg.ResourceRecord{
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.1")),
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.2")),
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.3")),
+		}, dnsmsg.RCodeNXRRSet},
+		{"rrset other value", []dnsmsg.ResourceRecord{
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.1")),
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.9")),
+		}, dnsmsg.RCodeNXRRSet},
+		{"rrset of a missing name", []dnsmsg.ResourceRecord{
+			prereq(none, dnsmsg.TypeA, dnsmsg.ClassINET, aData("192.0.2.1")),
+		}, dnsmsg.RCodeNXRRSet},
+		{"CNAME value", []dnsmsg.ResourceRecord{
+			prereq("alias.example.com", dnsmsg.TypeCNAME, dnsmsg.ClassINET, &dnsmsg.CNAME{Target: "www.example.com"}),
+		}, dnsmsg.RCodeSuccess},
+
+		// Several prerequisites must all hold.
+		{"all hold", []dnsmsg.ResourceRecord{
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassANY, nil),
+			prereq(none, dnsmsg.TypeANY, dnsmsg.ClassNONE, nil),
+		}, dnsmsg.RCodeSuccess},
+		{"second fails", []dnsmsg.ResourceRecord{
+			prereq(www, dnsmsg.TypeA, dnsmsg.ClassANY, nil),
+			prereq(www, dnsmsg.TypeANY, dnsmsg.ClassNONE, nil),
+		}, dnsmsg.RCodeYXDomain},
+
+		// Malformed prerequisites (section 3.2.1 and 3.2.2).
+		{"TTL set", []dnsmsg.ResourceRecord{withTTL}, dnsmsg.RCodeFormatError},
+		{"data with class ANY", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeA, dnsmsg.ClassANY, aData("192.0.2.1"))}, dnsmsg.RCodeFormatError},
+		{"data with class NONE", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeA, dnsmsg.ClassNONE, aData("192.0.2.1"))}, dnsmsg.RCodeFormatError},
+		{"other class", []dnsmsg.ResourceRecord{prereq(www, dnsmsg.TypeA, dnsmsg.ClassCHAOS, nil)}, dnsmsg.RCodeFormatError},
+		{"outside the zone", []dnsmsg.ResourceRecord{prereq("www.example.net", dnsmsg.TypeA, dnsmsg.ClassANY, nil)}, dnsmsg.RCodeNotZone},
+		{"in a child zone", []dnsmsg.ResourceRecord{prereq(child, dnsmsg.TypeANY, dnsmsg.ClassNONE, nil)}, dnsmsg.RCodeNotZone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPrerequisites(z, tt.prereqs); got != tt.want {
+				t.Errorf("checkPrerequisites = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyUpdates(t *testing.T) {
+	z := updateFixture(t)
+	add := func(name string, data dnsmsg.RData) dnsmsg.ResourceRecord {
+		return dnsmsg.NewRR(name, 300, data)
+	}
+
+	tests := []struct {
+		name    string
+		updates []dnsmsg.ResourceRecord
+		want    map[string][]manager.Record
+	}{
+		{"add to an RRset", []dnsmsg.ResourceRecord{add("www.example.com", aData("192.0.2.3"))}, map[string][]manager.Record{
+			"www.example.com": {
+				{Type: "A", TTL: 300, IP: "192.0.2.1"},
+				{Type: "A", TTL: 300, IP: "192.0.2.2"},
+				{Type: "TXT", TTL: 300, Text: manager.Text{"hello"}},
+				{Type: "A", TTL: 300, IP: "192.0.2.3"},
+			},
+		}},
+		{"delete an RRset", []dnsmsg.ResourceRecord{prereq("www.example.com", dnsmsg.TypeA, dnsmsg.ClassANY, nil)}, map[string][]manager.Record{
+			"www.example.com": {{Type: "TXT", TTL: 300, Text: manager.Text{"hello"}}},
+		}},
+		{"delete one record", []dnsmsg.ResourceRecord{prereq("www.example.com", dnsmsg.TypeA, dnsmsg.ClassNONE, aData("192.0.2.1"))}, map[string][]manager.Record{
+			"www.example.com": {
+				{Type: "A", TTL: 300, IP: "192.0.2.2"},
+				{Type: "TXT", TTL: 300, Text: manager.Text{"hello"}},
+			},
+		}},
+		{"delete a name", []dnsmsg.ResourceRecord{prereq("www.example.com", dnsmsg.TypeANY, dnsmsg.ClassANY, nil)}, map[string][]manager.Record{
+			"www.example.com": nil,
+		}},
+		{"data next to a CNAME is ignored", []dnsmsg.ResourceRecord{add("alias.example.com", aData("192.0.2.3"))}, map[string][]manager.Record{}},
+		{"the SOA is ignored", []dnsmsg.ResourceRecord{add("example.com", z.SOA().Data)}, map[string][]manager.Record{}},
+		{"the last apex NS stays", []dnsmsg.ResourceRecord{prereq("example.com", dnsmsg.TypeNS, dnsmsg.ClassNONE, &dnsmsg.NS{Host: "ns1.example.com"})}, map[string][]manager.Record{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rcode := checkUpdates(z, tt.updates); rcode != dnsmsg.RCodeSuccess {
+				t.Fatalf("checkUpdates = %s", rcode)
+			}
+			got := applyUpdates(z, tt.updates)
+			if len(got) != len(tt.want) {
+				t.Fatalf("changed %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if !manager.EqualRecords(got[name], want) {
+					t.Errorf("%s changed to %+v, want %+v", name, got[name], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/zonefile"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errZoneNotFound = errors.New("zone not found")
+
+// ImportZone stores the zone and the records read from a zone file. The
+// records of every name in the file replace those stored for it, and with
+// replace set the names of the zone missing from the file are deleted. The
+// zone is created when it does not exist, taking its parameters from the
+// SOA record of the file, and its serial advances once for the whole
+// import. NS records at the apex become the name servers of the zone. It
+// returns the zone and the number of records stored.
+func ImportZone(name string, f *zonefile.File, replace bool) (manager.Zone, int, error) {
+	name = dnsmsg.CanonicalName(name)
+	z, exists := constants.Zones.Get(name)
+	if !exists {
+		z = manager.Zone{Name: name}
+	}
+	if z.Secondary() {
+		return z, 0, errSecondaryZone
+	}
+	if f.SOA != nil {
+		if f.SOA.Name != name {
+			return z, 0, fmt.Errorf("SOA record of %s does not belong to zone %s", f.SOA.Name, name)
+		}
+		soa := *f.SOA
+		soa.NS = z.NS
+		z = soa
+	}
+	if err := z.Normalize(); err != nil {
+		return z, 0, err
+	}
+
+	records := make(map[string][]manager.Record)
+	var ns []string
+	for _, e := range f.Entries {
+		if !dnsmsg.IsSubdomain(e.Name, name) {
+			return z, 0, fmt.Errorf("%s is outside zone %s", e.Name, name)
+		}
+		if e.Name == name && e.Record.Type == "NS" {
+			ns = append(ns, e.Record.Target)
+			continue
+		}
+		records[e.Name] = append(records[e.Name], e.Record)
+	}
+	if ns != nil {
+		z.NS = ns
+	}
+	if f.SOA != nil || ns != nil {
+		// The apex is described by the file even if it has no other
+		// records, so its stored records are replaced as well.
+		if _, ok := records[name]; !ok {
+			records[name] = nil
+		}
+	}
+
+	if constants.Redis == nil {
+		return z, 0, errStorageUnavailable
+	}
+	// The zone stays locked until the import is journaled as one change.
+	defer zoneLocks.lock(name)()
+
+	if replace {
+		for domainName := range constants.ContextManager.Subtree(name) {
+			if _, ok := records[domainName]; ok {
+				continue
+			}
+			if owner, _ := constants.Zones.Find(domainName); owner.Name != name {
+				continue
+			}
+			if err := writeRecords(domainName, nil); err != nil {
+				return z, 0, err
+			}
+		}
+	}
+
+	count := 0
+	for domainName, rs := range records {
+		if err := writeRecords(domainName, rs); err != nil {
+			return z, count, err
+		}
+		count += len(rs)
+	}
+
+	z, err := addZone(z)
+	if err != nil {
+		return z, count, err
+	}
+	log.Info().Msgf("Imported %d records into zone %s, serial %d", count, z.Name, z.Serial)
+	return z, count, nil
+}
+
+// ExportZone writes the zone name and the records stored below it, except
+// those of more specific zones, as a zone file.
+func ExportZone(w io.Writer, name string) error {
+	z, ok := constants.Zones.Get(name)
+	if !ok {
+		return errZoneNotFound
+	}
+	return zonefile.Write(w, z, zoneRecords(z))
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"errors"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+)
+
+// zonesKey is the Redis hash holding the authoritative zones, keyed by
+// zone name.
+const zonesKey = "zones"
+
+// journalKey is the Redis hash holding the change journal of every zone,
+// keyed by zone name.
+const journalKey = "journal"
+
+var errImplicitZone = errors.New("zone comes from the configuration")
+
+// AddZone creates or updates a zone. Updating a zone always advances its
+// serial so that secondaries notice the change.
+func AddZone(z manager.Zone) (manager.Zone, error) {
+	if err := z.Normalize(); err != nil {
+		return z, err
+	}
+	if constants.Redis == nil {
+		return z, errStorageUnavailable
+	}
+	defer zoneLocks.lock(z.Name)()
+	return addZone(z)
+}
+
+// addZone stores the normalized zone z. The caller holds its lock.
+func addZone(z manager.Zone) (manager.Zone, error) {
+	z.Implicit = false
+	old, exists := constants.Zones.Get(z.Name)
+	switch {
+	case exists && z.Secondary() && old.Secondary():
+		// The contents of a secondary zone come from its primaries;
+		// only how they are reached and who is notified can change.
+		primaries, key, notify := z.Primaries, z.TSIGKey, z.Notify
+		z = old
+		z.Primaries, z.TSIGKey, z.Notify = primaries, key, notify
+	case exists && !manager.SerialGreater(z.Serial, old.Serial):
+		z.Serial = manager.NextSerial(old.Serial)
+	}
+
+	if err := storeZone(z); err != nil {
+		return z, err
+	}
+	if !exists {
+		forgetCachedSubtree(z.Name)
+	}
+	switch {
+	case exists && !old.Implicit && z.Serial != old.Serial:
+		commitJournal(old, z)
+		notifySecondaries(z)
+	case !exists || old.Implicit:
+		snapshotZone(z)
+	}
+	if constants.Secondaries != nil {
+		constants.Secondaries.Set(z)
+	}
+	return z, nil
+}
+
+// RemoveZone deletes the zone name. The records below it are kept but are
+// no longer answered authoritatively.
+func RemoveZone(name string) (bool, error) {
+	name = dnsmsg.CanonicalName(name)
+	defer zoneLocks.lock(name)()
+
+	z, ok := constants.Zones.Get(name)
+	if !ok {
+		return false, nil
+	}
+	if z.Implicit {
+		return false, errImplicitZone
+	}
+	if constants.Redis == nil {
+		return false, errStorageUnavailable
+	}
+
+	if err := constants.Redis.HDel(context.Background(), zonesKey, z.Name); err != nil {
+		return false, err
+	}
+	constants.Zones.Remove(z.Name)
+	constants.Zones.SetImplicit(implicitZones())
+	// Names of the zone are looked up in the cache again from now on.
+	forgetCachedSubtree(z.Name)
+	if _, ok := constants.Zones.Get(z.Name); !ok {
+		// The keys are of no use without the zone; a local zone taking
+		// its place keeps them.
+		if _, err := UnsignZone(z.Name); err != nil {
+			log.Error().Msgf("Error deleting DNSSEC keys of zone %s -> %v", z.Name, err)
+		}
+	}
+	constants.Journal.Remove(z.Name)
+	dropJournal(z.Name)
+	if constants.Secondaries != nil {
+		constants.Secondaries.Remove(z.Name)
+	}
+	if constants.Notifier != nil {
+		constants.Notifier.Forget(z.Name)
+	}
+	return true, nil
+}
+
+// implicitZones returns the zones that are served without being stored:
+// the configured local zones and the private reverse zones.
+func implicitZones() []string {
+	zones := constants.Config.LocalZones
+	if constants.Config.PrivateReverseZones {
+		zones = append(slices.Clone(zones), manager.PrivateReverseZones...)
+	}
+	return zones
+}
+
+// LoadZones reads the zones from Redis on top of the implicit zones.
+func LoadZones() error {
+	constants.Zones.SetImplicit(implicitZones())
+	if constants.Redis == nil {
+		return errStorageUnavailable
+	}
+
+	res, err := constants.Redis.HGetAll(context.Background(), zonesKey)
+	if err != nil {
+		log.Error().Msgf("Error while loading zones -> %v", err)
+		return err
+	}
+
+	constants.Zones.Load(res)
+
+	journals, err := constants.Redis.HGetAll(context.Background(), journalKey)
+	if err != nil {
+		log.Error().Msgf("Error while loading zone journals -> %v", err)
+		return err
+	}
+	constants.Journal.Load(journals)
+	for _, z := range constants.Zones.List() {
+		if !z.Implicit {
+			snapshotZone(z)
+		}
+	}
+	return nil
+}
+
+// LoadSecondaries starts keeping the secondary zones in sync with their
+// primaries.
+func LoadSecondaries() {
+	for _, z := range constants.Zones.List() {
+		if z.Secondary() {
+			constants.Secondaries.Set(z)
+		}
+	}
+}
+
+// touchZone advances the serial of the zone containing domainName after
+// its records changed.
+func touchZone(domainName string) {
+	found, ok := constants.Zones.Find(domainName)
+	if !ok {
+		return
+	}
+	defer zoneLocks.lock(found.Name)()
+	advanceSerial(found.Name)
+}
+
+// advanceSerial advances the serial of the zone name and journals the
+// change. The caller holds the lock of the zone, which it also held while
+// writing the records, so that the journal entry holds its change and no
+// other.
+func advanceSerial(name string) {
+	// The zone is read again under its lock, so that every change advances
+	// the serial stored by the one before it.
+	old, ok := constants.Zones.Get(name)
+	if !ok {
+		return
+	}
+	z := old
+	z.Serial = manager.NextSerial(old.Serial)
+	if z.Implicit {
+		// Zones from the configuration are not stored, so their serial
+		// starts over with every start. They are never transferred and
+		// nobody is notified of them; storing the zone through AddZone
+		// makes its serial last.
+		constants.Zones.Set(z)
+		return
+	}
+	if err := storeZone(z); err != nil {
+		log.Error().Msgf("Error storing serial %d of zone %s -> %v", z.Serial, z.Name, err)
+		return
+	}
+	commitJournal(old, z)
+	notifySecondaries(z)
+}
+
+// notifySecondaries tells the secondaries of z that its serial advanced.
+func notifySecondaries(z manager.Zone) {
+	if constants.Notifier == nil {
+		return
+	}
+	targets := z.Notify
+	if len(targets) == 0 {
+		targets = constants.NotifyTargets
+	}
+	constants.Notifier.Notify(z, targets)
+}
+
+func storeZone(z manager.Zone) error {
+	value, err := manager.EncodeZone(z)
+	if err != nil {
+		return err
+	}
+	if err := constants.Redis.HSet(context.Background(), zonesKey, z.Name, value); err != nil {
+		log.Error().Msgf("Error storing zone %s -> %v", z.Name, err)
+		return err
+	}
+	constants.Zones.Set(z)
+	return nil
+}
+
+// zoneRecords returns the records stored below the zone z, leaving out
+// those of more specific zones.
+func zoneRecords(z manager.Zone) map[string][]manager.Record {
+	records := constants.ContextManager.Subtree(z.Name)
+	for domainName := range records {
+		if owner, _ := constants.Zones.Find(domainName); owner.Name != z.Name {
+			delete(records, domainName)
+		}
+	}
+	return records
+}
+
+// transferRecords returns the records of the zone z as they are
+// transferred to secondaries: the stored records plus the name servers of
+// the zone when no NS records are stored for the apex.
+func transferRecords(z manager.Zone) map[string][]manager.Record {
+	records := zoneRecords(z)
+	if !slices.ContainsFunc(records[z.Name], func(r manager.Record) bool { return r.Type == "NS" }) {
+		records[z.Name] = append(records[z.Name], zoneNS(z)...)
+	}
+	return records
+}
+
+// zoneNS returns the name servers of the zone z as records, which the apex
+// serves unless NS records are stored for it.
+func zoneNS(z manager.Zone) []manager.Record {
+	var records []manager.Record
+	for _, rr := range z.NSRecords() {
+		ns := rr.Data.(*dnsmsg.NS)
+		records = append(records, manager.Record{Type: "NS", TTL: int(rr.TTL), Target: ns.Host})
+	}
+	return records
+}
+
+// snapshotZone starts the journal of z from its current contents.
+func snapshotZone(z manager.Zone) {
+	if !constants.Journal.Snapshot(z, transferRecords(z)) {
+		log.Warn().Msgf("Dropping journal of zone %s, which does not lead to serial %d", z.Name, z.Serial)
+		dropJournal(z.Name)
+	}
+}
+
+// commitJournal records the change of the zone from old to z in its
+// journal.
+func commitJournal(old, z manager.Zone) {
+	journal := constants.Journal.Commit(old, z, transferRecords(z))
+	if journal == nil {
+		dropJournal(z.Name)
+		return
+	}
+	value, err := manager.EncodeJournal(journal)
+	if err != nil {
+		log.Error().Msgf("Error encoding journal of zone %s -> %v", z.Name, err)
+		return
+	}
+	if err := constants.Redis.HSet(context.Background(), journalKey, z.Name, value); err != nil {
+		log.Error().Msgf("Error storing journal of zone %s -> %v", z.Name, err)
+	}
+}
+
+func dropJournal(name string) {
+	if err := constants.Redis.HDel(context.Background(), journalKey, name); err != nil {
+		log.Error().Msgf("Error deleting journal of zone %s -> %v", name, err)
+	}
+}
@@ -0,0 +1,222 @@
+// Package hosts reads records from files in the /etc/hosts format and
+// reloads them when the files change.
+package hosts
+
+import (
+	"bufio"
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Parse reads a hosts file. Every line holds an IPv4 or IPv6 address
+// followed by one or more names, and everything after a '#' is a comment.
+// Lines that cannot be understood are logged and skipped, as the resolver
+// library does.
+func Parse(r io.Reader, ttl int) (map[string][]manager.Record, error) {
+	records := make(map[string][]manager.Record)
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			log.Warn().Msgf("Skipping hosts line %d without names", number)
+			continue
+		}
+
+		r := manager.Record{IP: fields[0], TTL: ttl}
+		if err := r.Normalize(); err != nil {
+			log.Warn().Msgf("Skipping hosts line %d -> %v", number, err)
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = dnsmsg.CanonicalName(name)
+			if _, err := dnsmsg.SplitLabels(name); err != nil || name == "" {
+				log.Warn().Msgf("Skipping invalid name %q on hosts line %d", name, number)
+				continue
+			}
+			records[name] = appendRecord(records[name], r)
+		}
+	}
+	return records, scanner.Err()
+}
+
+func appendRecord(records []manager.Record, r manager.Record) []manager.Record {
+	if slices.ContainsFunc(records, r.SameData) {
+		return records
+	}
+	return append(records, r)
+}
+
+// FileStatus describes a watched hosts file.
+type FileStatus struct {
+	Path     string    `json:"path"`
+	Names    int       `json:"names"`
+	Modified time.Time `json:"modified,omitzero"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type file struct {
+	path    string
+	modTime time.Time
+	size    int64
+	records map[string][]manager.Record
+	err     error
+}
+
+// Source serves the records of a set of hosts files and reloads them when
+// they change on disk.
+type Source struct {
+	ttl      int
+	onChange func(map[string][]manager.Record)
+
+	mu    sync.Mutex
+	files []*file
+}
+
+type Option func(*Source)
+
+// WithTTL sets the TTL of the records read from the files.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Source) {
+		s.ttl = int(ttl / time.Second)
+	}
+}
+
+// New returns a source for paths. onChange receives the records of all
+// files, merged, whenever they are loaded or change.
+func New(paths []string, onChange func(map[string][]manager.Record), options ...Option) *Source {
+	s := &Source{onChange: onChange, ttl: manager.DefaultTTL}
+	for _, path := range paths {
+		s.files = append(s.files, &file{path: path})
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Load reads the files that changed since they were last read and passes
+// the merged records on if any did.
+func (s *Source) Load() {
+	s.mu.Lock()
+	changed := false
+	for _, f := range s.files {
+		if s.reload(f) {
+			changed = true
+		}
+	}
+	var merged map[string][]manager.Record
+	if changed {
+		merged = s.merge()
+	}
+	s.mu.Unlock()
+
+	if changed {
+		s.onChange(merged)
+	}
+}
+
+// reload reads f again if its size or modification time changed and
+// reports whether its records may have changed. It must be called with
+// s.mu held.
+func (s *Source) reload(f *file) bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		if f.err != nil && errors.Is(f.err, os.ErrNotExist) && errors.Is(err, os.ErrNotExist) {
+			return false
+		}
+		log.Error().Msgf("Error reading hosts file %s -> %v", f.path, err)
+		f.records, f.err, f.modTime, f.size = nil, err, time.Time{}, 0
+		return true
+	}
+	if f.err == nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return false
+	}
+
+	var records map[string][]manager.Record
+	fh, err := os.Open(f.path)
+	if err == nil {
+		defer fh.Close()
+		records, err = Parse(fh, s.ttl)
+	}
+	if err != nil {
+		// Keep serving what was read before until the file can be read
+		// again.
+		log.Error().Msgf("Error reading hosts file %s -> %v", f.path, err)
+		f.err = err
+		return false
+	}
+
+	f.records, f.modTime, f.size, f.err = records, info.ModTime(), info.Size(), nil
+	log.Info().Msgf("Loaded %d names from hosts file %s", len(f.records), f.path)
+	return true
+}
+
+// merge combines the records of all files. It must be called with s.mu
+// held.
+func (s *Source) merge() map[string][]manager.Record {
+	merged := make(map[string][]manager.Record)
+	for _, f := range s.files {
+		for name, records := range f.records {
+			for _, r := range records {
+				merged[name] = appendRecord(merged[name], r)
+			}
+		}
+	}
+	return merged
+}
+
+// Watch checks the files for changes every interval until ctx is done.
+func (s *Source) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Load()
+			}
+		}
+	}()
+}
+
+// Status describes the watched files. It is safe to call on a nil source.
+func (s *Source) Status() []FileStatus {
+	if s == nil {
+		return []FileStatus{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := make([]FileStatus, len(s.files))
+	for i, f := range s.files {
+		status[i] = FileStatus{
+			Path:     f.path,
+			Names:    len(f.records),
+			Modified: f.modTime,
+		}
+		if f.err != nil {
+			status[i].Error = f.err.Error()
+		}
+	}
+	return status
+}
@@ -0,0 +1,140 @@
+package hosts
+
+import (
+	"dns-server/internal/manager"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func a(ip string, ttl int) manager.Record    { return manager.Record{Type: "A", TTL: ttl, IP: ip} }
+func aaaa(ip string, ttl int) manager.Record { return manager.Record{Type: "AAAA", TTL: ttl, IP: ip} }
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string][]manager.Record
+	}{
+		{"ipv4", "192.0.2.1 host.lan\n", map[string][]manager.Record{"host.lan": {a("192.0.2.1", 60)}}},
+		{"ipv6", "2001:db8::1\thost.lan", map[string][]manager.Record{"host.lan": {aaaa("2001:db8::1", 60)}}},
+		{"aliases", "192.0.2.1 host.lan host", map[string][]manager.Record{
+			"host.lan": {a("192.0.2.1", 60)},
+			"host":     {a("192.0.2.1", 60)},
+		}},
+		{"comments and blank lines", "# router\n\n   \n192.0.2.1 host.lan # the NAS\n#192.0.2.2 old.lan\n", map[string][]manager.Record{
+			"host.lan": {a("192.0.2.1", 60)},
+		}},
+		{"names are canonical", "192.0.2.1 Host.LAN.", map[string][]manager.Record{"host.lan": {a("192.0.2.1", 60)}}},
+		{"addresses of a name", "192.0.2.1 host.lan\n192.0.2.2 host.lan\n2001:db8::1 host.lan\n192.0.2.1 HOST.lan", map[string][]manager.Record{
+			"host.lan": {a("192.0.2.1", 60), a("192.0.2.2", 60), aaaa("2001:db8::1", 60)},
+		}},
+		{"bad lines are skipped", "not-an-ip host.lan\n192.0.2.1\nfe80::1%eth0 link.lan\n192.0.2.2 " + strings.Repeat("x", 64) + ".lan ok.lan", map[string][]manager.Record{
+			"ok.lan": {a("192.0.2.2", 60)},
+		}},
+		{"empty", "", map[string][]manager.Record{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input), 60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.EqualFunc(got, tt.want, manager.EqualRecords) {
+				t.Errorf("Parse = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Parse(strings.NewReader("192.0.2.1 "+strings.Repeat("x", 70000)), 60); err == nil {
+		t.Error("Parse of an overlong line succeeded")
+	}
+}
+
+// writeHosts writes content to path and dates it age before now, so that
+// rewrites within the same second look modified.
+func writeHosts(t *testing.T, path, content string, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSourceReload(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "hosts"), filepath.Join(dir, "hosts.lan")
+	writeHosts(t, first, "192.0.2.1 nas.lan\n", time.Hour)
+	writeHosts(t, second, "192.0.2.1 nas.lan\n192.0.2.2 printer.lan\n", time.Hour)
+
+	var calls []map[string][]manager.Record
+	s := New([]string{first, second}, func(records map[string][]manager.Record) {
+		calls = append(calls, records)
+	}, WithTTL(5*time.Minute))
+
+	steps := []struct {
+		name   string
+		change func()
+		// want is the merged records passed on, or nil if none should be.
+		want   map[string][]manager.Record
+		errors []bool
+	}{
+		{"first load merges the files", func() {}, map[string][]manager.Record{
+			"nas.lan":     {a("192.0.2.1", 300)},
+			"printer.lan": {a("192.0.2.2", 300)},
+		}, []bool{false, false}},
+		{"unchanged files", func() {}, nil, []bool{false, false}},
+		{"edited file", func() { writeHosts(t, first, "192.0.2.9 nas.lan\n", 30*time.Minute) }, map[string][]manager.Record{
+			"nas.lan":     {a("192.0.2.9", 300), a("192.0.2.1", 300)},
+			"printer.lan": {a("192.0.2.2", 300)},
+		}, []bool{false, false}},
+		// An unreadable file keeps serving what was last read.
+		{"unreadable file", func() {
+			writeHosts(t, first, "192.0.2.9 "+strings.Repeat("x", 70000), 20*time.Minute)
+		}, nil, []bool{true, false}},
+		{"repaired file", func() { writeHosts(t, first, "192.0.2.8 nas.lan\n", 20*time.Minute) }, map[string][]manager.Record{
+			"nas.lan":     {a("192.0.2.8", 300), a("192.0.2.1", 300)},
+			"printer.lan": {a("192.0.2.2", 300)},
+		}, []bool{false, false}},
+		{"removed file", func() { os.Remove(second) }, map[string][]manager.Record{
+			"nas.lan": {a("192.0.2.8", 300)},
+		}, []bool{false, true}},
+		{"still removed", func() {}, nil, []bool{false, true}},
+		{"recreated file", func() { writeHosts(t, second, "2001:db8::2 printer.lan\n", 10*time.Minute) }, map[string][]manager.Record{
+			"nas.lan":     {a("192.0.2.8", 300)},
+			"printer.lan": {aaaa("2001:db8::2", 300)},
+		}, []bool{false, false}},
+	}
+	for _, step := range steps {
+		calls = nil
+		step.change()
+		s.Load()
+
+		switch {
+		case step.want == nil && len(calls) != 0:
+			t.Errorf("%s: records passed on: %v", step.name, calls)
+		case step.want != nil && len(calls) != 1:
+			t.Errorf("%s: records passed on %d times, want once", step.name, len(calls))
+		case step.want != nil && !maps.EqualFunc(calls[0], step.want, manager.EqualRecords):
+			t.Errorf("%s: records %v, want %v", step.name, calls[0], step.want)
+		}
+		for i, status := range s.Status() {
+			if (status.Error != "") != step.errors[i] {
+				t.Errorf("%s: status %+v", step.name, status)
+			}
+		}
+	}
+}
+
+func TestStatusOfNilSource(t *testing.T) {
+	var s *Source
+	if status := s.Status(); status == nil || len(status) != 0 {
+		t.Errorf("Status = %#v, want an empty list", status)
+	}
+}
@@ -0,0 +1,47 @@
+package manager
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL is a list of addresses and networks, such as the secondaries allowed
+// to transfer zones.
+type ACL []*net.IPNet
+
+// ParseACL reads entries that are either IP addresses or CIDR ranges.
+func ParseACL(entries []string) (ACL, error) {
+	acl := make(ACL, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			acl = append(acl, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		acl = append(acl, network)
+	}
+	return acl, nil
+}
+
+// Allows reports whether ip is covered by one of the entries.
+func (acl ACL) Allows(ip net.IP) bool {
+	for _, network := range acl {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,36 +1,212 @@
 package manager
 
-import "sync"
+import (
+	"dns-server/internal/dnsmsg"
+	"maps"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
 
 type ContextManager struct {
-	context map[string]string
-	mu      sync.RWMutex
+	context map[string][]Record
+	// hosts holds the records read from hosts files. They answer for names
+	// that have no records in Redis.
+	hosts map[string][]Record
+	// reverse holds the PTR records synthesized from the A and AAAA
+	// records of both sources, keyed by reverse name.
+	reverse map[string][]Record
+	// tree indexes the names of all three.
+	tree *nameTree
+	// generation changes whenever the records of any source do.
+	generation uint64
+	mu         sync.RWMutex
 }
 
 func NewContextManager() *ContextManager {
-	return &ContextManager{}
+	return &ContextManager{
+		context: make(map[string][]Record),
+		hosts:   make(map[string][]Record),
+		reverse: make(map[string][]Record),
+		tree:    newNameTree(),
+	}
 }
 
-func (m *ContextManager) AddRP(domainName string, port string) {
+// AddRP replaces the records stored for domainName.
+func (m *ContextManager) AddRP(domainName string, records []Record) {
+	domainName = dnsmsg.CanonicalName(domainName)
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.context[domainName] = port
+	m.unindexPTR(domainName)
+	m.context[domainName] = records
+	m.tree.insert(domainName)
+	m.indexPTR(domainName)
+	m.generation++
 }
 
 func (m *ContextManager) RemoveRP(domainName string) {
+	domainName = dnsmsg.CanonicalName(domainName)
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.unindexPTR(domainName)
 	delete(m.context, domainName)
+	if !m.has(domainName) {
+		m.tree.remove(domainName)
+	}
+	m.indexPTR(domainName)
+	m.generation++
+}
+
+// SetHosts replaces the records read from hosts files. Names that also
+// have records in Redis keep being answered from Redis.
+func (m *ContextManager) SetHosts(records map[string][]Record) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts = records
+	m.rebuild()
+	m.generation++
+}
+
+// Lookup returns the records stored in Redis for domainName.
+func (m *ContextManager) Lookup(domainName string) ([]Record, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records, ok := m.context[dnsmsg.CanonicalName(domainName)]
+	return records, ok
+}
+
+// Match looks domainName up the way a query for it is answered: by exact
+// name, or else through a wildcard record at its closest encloser (RFC
+// 4592). Names that only have descendants exist without records.
+func (m *ContextManager) Match(domainName string) ([]Record, MatchKind) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	owner, kind := m.tree.match(domainName)
+	return m.records(owner), kind
+}
+
+// records returns the records answering for name: those stored in Redis,
+// else those from hosts files, else the synthesized PTR records. It must
+// be called with m.mu held.
+func (m *ContextManager) records(name string) []Record {
+	if records, ok := m.context[name]; ok {
+		return records
+	}
+	if records, ok := m.hosts[name]; ok {
+		return records
+	}
+	return m.reverse[name]
+}
+
+// has reports whether any source has records for name. It must be called
+// with m.mu held.
+func (m *ContextManager) has(name string) bool {
+	return len(m.records(name)) > 0
+}
+
+// Subtree returns a copy of the records stored in Redis for name and the
+// names below it.
+func (m *ContextManager) Subtree(name string) map[string][]Record {
+	name = dnsmsg.CanonicalName(name)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	subtree := make(map[string][]Record)
+	for domainName, records := range m.context {
+		if dnsmsg.IsSubdomain(domainName, name) {
+			subtree[domainName] = records
+		}
+	}
+	return subtree
 }
 
-func (m *ContextManager) GetContext() map[string]string {
+// Wildcard returns the owner of the wildcard record that answers queries
+// for domainName, if any.
+func (m *ContextManager) Wildcard(domainName string) (string, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.context
+	owner, kind := m.tree.match(domainName)
+	return owner, kind == WildcardMatch
 }
 
+// Served returns the records answering for name and the names below it,
+// from every source, as queries see them.
+func (m *ContextManager) Served(name string) map[string][]Record {
+	name = dnsmsg.CanonicalName(name)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	served := make(map[string][]Record)
+	for _, source := range []map[string][]Record{m.context, m.hosts, m.reverse} {
+		for domainName := range source {
+			if _, ok := served[domainName]; !ok && dnsmsg.IsSubdomain(domainName, name) {
+				if records := m.records(domainName); len(records) > 0 {
+					served[domainName] = records
+				}
+			}
+		}
+	}
+	return served
+}
+
+func (m *ContextManager) GetContext() map[string][]Record {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return maps.Clone(m.context)
+}
+
+// LoadContext replaces the stored records with the contents of the Redis
+// "dns" hash. Entries that cannot be decoded are logged and skipped.
 func (m *ContextManager) LoadContext(value map[string]string) {
+	context := make(map[string][]Record, len(value))
+	for domainName, raw := range value {
+		records, err := DecodeRecords(raw)
+		if err != nil {
+			log.Error().Msgf("Skipping invalid records for %s -> %v", domainName, err)
+			continue
+		}
+		domainName = dnsmsg.CanonicalName(domainName)
+		context[domainName] = records
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.context = value
+	// Reloads mostly find the records as they were kept in memory.
+	if !maps.EqualFunc(m.context, context, EqualRecords) {
+		m.generation++
+	}
+	m.context = context
+	m.rebuild()
+}
+
+// Generation returns a number that changes whenever any record changes, so
+// that data derived from the records can tell when it is stale.
+func (m *ContextManager) Generation() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.generation
+}
+
+// rebuild indexes every name from scratch after a source was replaced. It
+// must be called with m.mu held.
+func (m *ContextManager) rebuild() {
+	m.tree = buildTree(m.context, m.hosts)
+	m.reverse = make(map[string][]Record)
+	for _, source := range []map[string][]Record{m.context, m.hosts} {
+		for domainName := range source {
+			m.indexPTR(domainName)
+		}
+	}
+}
+
+func buildTree(sources ...map[string][]Record) *nameTree {
+	tree := newNameTree()
+	for _, records := range sources {
+		for domainName := range records {
+			tree.insert(domainName)
+		}
+	}
+	return tree
 }
@@ -0,0 +1,251 @@
+package manager
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/upstream"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Forwarder sends queries for every name under Suffix to its own servers
+// instead of the default upstreams.
+type Forwarder struct {
+	Suffix  string   `json:"suffix"`
+	Servers []string `json:"servers"`
+	// NoCache keeps answers from these servers out of the cache.
+	NoCache bool `json:"no_cache,omitempty"`
+}
+
+// ForwarderSuffix canonicalises a rule suffix. A leading "*." is accepted
+// and dropped, since a rule always covers the whole subtree.
+func ForwarderSuffix(suffix string) string {
+	return dnsmsg.CanonicalName(strings.TrimPrefix(strings.TrimSpace(suffix), "*."))
+}
+
+// Normalize canonicalises the suffix and checks that the rule is usable.
+func (f *Forwarder) Normalize() error {
+	f.Suffix = ForwarderSuffix(f.Suffix)
+	if f.Suffix == "" {
+		return fmt.Errorf("forwarder requires a domain suffix")
+	}
+	if _, err := dnsmsg.SplitLabels(f.Suffix); err != nil {
+		return fmt.Errorf("invalid suffix %q", f.Suffix)
+	}
+	if len(f.Servers) == 0 {
+		return fmt.Errorf("forwarder for %s requires at least one server", f.Suffix)
+	}
+	servers := make([]string, len(f.Servers))
+	for i, s := range f.Servers {
+		servers[i] = strings.TrimSpace(s)
+	}
+	f.Servers = servers
+	return nil
+}
+
+type forwardRule struct {
+	Forwarder
+	pool *upstream.Pool
+	// stop ends the health checks of pool, when they were started.
+	stop context.CancelFunc
+}
+
+// retire stops using the rule. Queries still running on its pool finish,
+// and their connections are closed afterwards.
+func (r *forwardRule) retire() {
+	if r.stop != nil {
+		r.stop()
+	}
+	r.pool.Close()
+}
+
+// ForwarderManager holds the conditional forwarding rules and an upstream
+// pool for each of them.
+type ForwarderManager struct {
+	rules   map[string]*forwardRule
+	options []upstream.PoolOption
+	// checks and interval drive the health checks of every rule pool once
+	// StartHealthChecks was called.
+	checks   context.Context
+	interval time.Duration
+	mu       sync.RWMutex
+}
+
+// NewForwarderManager creates an empty rule set. options apply to the pool
+// built for every rule.
+func NewForwarderManager(options ...upstream.PoolOption) *ForwarderManager {
+	return &ForwarderManager{
+		rules:   make(map[string]*forwardRule),
+		options: options,
+	}
+}
+
+func (m *ForwarderManager) newRule(f Forwarder) (*forwardRule, error) {
+	if err := f.Normalize(); err != nil {
+		return nil, err
+	}
+	upstreams := make([]*upstream.Upstream, 0, len(f.Servers))
+	for _, addr := range f.Servers {
+		u, err := upstream.New(addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+	pool, err := upstream.NewPool(upstreams, m.options...)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardRule{Forwarder: f, pool: pool}, nil
+}
+
+// StartHealthChecks probes the servers of every rule, present and future,
+// at interval until ctx is done, so that a server marked down is used again
+// once it answers.
+func (m *ForwarderManager) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks, m.interval = ctx, interval
+	for _, rule := range m.rules {
+		m.startChecks(rule)
+	}
+}
+
+// startChecks starts the health checks of rule. It must be called with
+// m.mu held.
+func (m *ForwarderManager) startChecks(rule *forwardRule) {
+	if m.checks == nil || m.interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(m.checks)
+	rule.stop = cancel
+	rule.pool.StartHealthChecks(ctx, m.interval)
+}
+
+// Set adds or replaces the rule for f.Suffix.
+func (m *ForwarderManager) Set(f Forwarder) error {
+	rule, err := m.newRule(f)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.rules[rule.Suffix]; ok {
+		old.retire()
+	}
+	m.rules[rule.Suffix] = rule
+	m.startChecks(rule)
+	return nil
+}
+
+// Remove deletes the rule for suffix and reports whether it existed.
+func (m *ForwarderManager) Remove(suffix string) bool {
+	suffix = ForwarderSuffix(suffix)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rule, ok := m.rules[suffix]
+	if ok {
+		rule.retire()
+		delete(m.rules, suffix)
+	}
+	return ok
+}
+
+// Match returns the rule with the longest suffix covering name and the
+// pool serving it.
+func (m *ForwarderManager) Match(name string) (Forwarder, *upstream.Pool, bool) {
+	name = dnsmsg.CanonicalName(name)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.rules) == 0 {
+		return Forwarder{}, nil, false
+	}
+	for {
+		if rule, ok := m.rules[name]; ok {
+			return rule.Forwarder, rule.pool, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return Forwarder{}, nil, false
+		}
+		name = name[i+1:]
+	}
+}
+
+// List returns the rules sorted by suffix.
+func (m *ForwarderManager) List() []Forwarder {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]Forwarder, 0, len(m.rules))
+	for _, rule := range m.rules {
+		list = append(list, rule.Forwarder)
+	}
+	slices.SortFunc(list, func(a, b Forwarder) int {
+		return strings.Compare(a.Suffix, b.Suffix)
+	})
+	return list
+}
+
+// Status reports the health of the upstreams of every rule.
+func (m *ForwarderManager) Status() map[string][]upstream.Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	status := make(map[string][]upstream.Status, len(m.rules))
+	for suffix, rule := range m.rules {
+		status[suffix] = rule.pool.Status()
+	}
+	return status
+}
+
+// Load replaces the rules with the contents of the Redis "forwarders"
+// hash. Entries that cannot be decoded are logged and skipped.
+func (m *ForwarderManager) Load(value map[string]string) {
+	rules := make(map[string]*forwardRule, len(value))
+	for suffix, raw := range value {
+		f, err := DecodeForwarder(raw)
+		if err == nil {
+			var rule *forwardRule
+			rule, err = m.newRule(f)
+			if err == nil {
+				rules[rule.Suffix] = rule
+				continue
+			}
+		}
+		log.Error().Msgf("Skipping invalid forwarder for %s -> %v", suffix, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rule := range m.rules {
+		rule.retire()
+	}
+	m.rules = rules
+	for _, rule := range m.rules {
+		m.startChecks(rule)
+	}
+}
+
+// DecodeForwarder parses a value stored in the Redis "forwarders" hash.
+func DecodeForwarder(value string) (Forwarder, error) {
+	var f Forwarder
+	err := json.Unmarshal([]byte(value), &f)
+	return f, err
+}
+
+// EncodeForwarder serialises f for storage in the Redis "forwarders" hash.
+func EncodeForwarder(f Forwarder) (string, error) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,231 @@
+package manager
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/upstream"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers A queries over UDP with ip while up is set, and
+// drops them otherwise.
+type fakeResolver struct {
+	addr    string
+	up      atomic.Bool
+	queries atomic.Int64
+}
+
+func newFakeResolver(t *testing.T, ip string) *fakeResolver {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	r := &fakeResolver{addr: pc.LocalAddr().String()}
+	r.up.Store(true)
+
+	go func() {
+		buf := make([]byte, 0xFFFF)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			r.queries.Add(1)
+			req, err := dnsmsg.Parse(buf[:n])
+			if err != nil || !r.up.Load() {
+				continue
+			}
+			resp := req.Reply()
+			resp.Answers = []dnsmsg.ResourceRecord{
+				dnsmsg.NewRR(req.Questions[0].Name, 60, &dnsmsg.A{IP: net.ParseIP(ip).To4()}),
+			}
+			if b, err := resp.Pack(); err == nil {
+				pc.WriteTo(b, addr)
+			}
+		}
+	}()
+	return r
+}
+
+func newTestForwarders(t *testing.T) *ForwarderManager {
+	t.Helper()
+	m := NewForwarderManager(upstream.WithTimeout(100*time.Millisecond), upstream.WithRetries(0))
+	t.Cleanup(func() { m.Load(nil) })
+	return m
+}
+
+// forwardedTo exchanges a query for name through the rule matching it and
+// returns the address in the answer.
+func forwardedTo(t *testing.T, m *ForwarderManager, name string) string {
+	t.Helper()
+	_, pool, ok := m.Match(name)
+	if !ok {
+		t.Fatalf("no rule for %s", name)
+	}
+	resp, err := pool.Exchange(context.Background(), &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: name, Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Answers[0].Data.(*dnsmsg.A).IP.String()
+}
+
+func TestForwarderNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		f      Forwarder
+		suffix string
+		ok     bool
+	}{
+		{"canonical", Forwarder{Suffix: "Corp.Example.", Servers: []string{" 10.0.0.2 "}}, "corp.example", true},
+		{"wildcard prefix", Forwarder{Suffix: "*.corp.example", Servers: []string{"10.0.0.2"}}, "corp.example", true},
+		{"no suffix", Forwarder{Suffix: ".", Servers: []string{"10.0.0.2"}}, "", false},
+		{"no servers", Forwarder{Suffix: "corp.example"}, "corp.example", false},
+		{"bad label", Forwarder{Suffix: "a..example", Servers: []string{"10.0.0.2"}}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.f.Normalize()
+			if (err == nil) != tt.ok {
+				t.Fatalf("Normalize error %v, want ok %t", err, tt.ok)
+			}
+			if tt.ok && (tt.f.Suffix != tt.suffix || tt.f.Servers[0] != "10.0.0.2") {
+				t.Errorf("normalized to %+v", tt.f)
+			}
+		})
+	}
+}
+
+func TestForwarderLongestSuffix(t *testing.T) {
+	corp := newFakeResolver(t, "192.0.2.1")
+	lab := newFakeResolver(t, "192.0.2.2")
+	m := newTestForwarders(t)
+	for _, f := range []Forwarder{
+		{Suffix: "corp.example", Servers: []string{corp.addr}},
+		{Suffix: "lab.corp.example", Servers: []string{lab.addr}, NoCache: true},
+	} {
+		if err := m.Set(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		suffix  string
+		noCache bool
+	}{
+		{"corp.example", "corp.example", false},
+		{"WWW.Corp.Example.", "corp.example", false},
+		{"lab.corp.example", "lab.corp.example", true},
+		{"a.b.lab.corp.example", "lab.corp.example", true},
+		{"xlab.corp.example", "corp.example", false},
+		{"example", "", false},
+		{"corp.example.net", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, pool, ok := m.Match(tt.name)
+			if ok != (tt.suffix != "") || rule.Suffix != tt.suffix || rule.NoCache != tt.noCache {
+				t.Fatalf("Match = %+v, %t; want suffix %q, no_cache %t", rule, ok, tt.suffix, tt.noCache)
+			}
+			if ok && pool == nil {
+				t.Fatal("rule without a pool")
+			}
+		})
+	}
+	if got := forwardedTo(t, m, "a.lab.corp.example"); got != "192.0.2.2" {
+		t.Errorf("a.lab.corp.example forwarded to the server answering %s", got)
+	}
+	if got := forwardedTo(t, m, "www.corp.example"); got != "192.0.2.1" {
+		t.Errorf("www.corp.example forwarded to the server answering %s", got)
+	}
+}
+
+func TestForwarderReplaceAndRemove(t *testing.T) {
+	first := newFakeResolver(t, "192.0.2.1")
+	second := newFakeResolver(t, "192.0.2.2")
+	m := newTestForwarders(t)
+
+	if err := m.Set(Forwarder{Suffix: "corp.example", Servers: []string{first.addr}}); err != nil {
+		t.Fatal(err)
+	}
+	_, old, _ := m.Match("corp.example")
+	if err := m.Set(Forwarder{Suffix: "corp.example", Servers: []string{second.addr}, NoCache: true}); err != nil {
+		t.Fatal(err)
+	}
+	rule, pool, _ := m.Match("www.corp.example")
+	if pool == old || !rule.NoCache || !slices.Equal(rule.Servers, []string{second.addr}) {
+		t.Errorf("replaced rule is %+v", rule)
+	}
+	if got := forwardedTo(t, m, "www.corp.example"); got != "192.0.2.2" {
+		t.Errorf("forwarded to the server answering %s after the rule was replaced", got)
+	}
+	if list := m.List(); len(list) != 1 {
+		t.Errorf("%d rules after replacing one, want 1", len(list))
+	}
+
+	// A query still holding the old pool is answered, with a connection
+	// that is closed afterwards.
+	if _, err := old.Exchange(context.Background(), &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 2},
+		Questions: []dnsmsg.Question{{Name: "corp.example", Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}},
+	}); err != nil {
+		t.Errorf("in-flight query on the replaced pool: %v", err)
+	}
+
+	if !m.Remove("*.Corp.Example.") {
+		t.Fatal("Remove reported no rule")
+	}
+	if _, _, ok := m.Match("www.corp.example"); ok {
+		t.Error("rule still matches after removal")
+	}
+	if m.Remove("corp.example") {
+		t.Error("removing a missing rule reported success")
+	}
+}
+
+func TestForwarderHealthChecks(t *testing.T) {
+	server := newFakeResolver(t, "192.0.2.1")
+	m := newTestForwarders(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Rules added after the checks started are probed as well.
+	m.StartHealthChecks(ctx, 20*time.Millisecond)
+	if err := m.Set(Forwarder{Suffix: "corp.example", Servers: []string{server.addr}}); err != nil {
+		t.Fatal(err)
+	}
+
+	healthy := func() bool { return m.Status()["corp.example"][0].Healthy }
+	waitFor := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for healthy() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("server healthy = %t, want %t", healthy(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	server.up.Store(false)
+	waitFor(false)
+	server.up.Store(true)
+	waitFor(true)
+
+	// Removing the rule stops probing its servers.
+	m.Remove("corp.example")
+	time.Sleep(50 * time.Millisecond)
+	before := server.queries.Load()
+	time.Sleep(100 * time.Millisecond)
+	if n := server.queries.Load() - before; n != 0 {
+		t.Errorf("%d probes after the rule was removed", n)
+	}
+}
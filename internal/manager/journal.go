@@ -0,0 +1,217 @@
+package manager
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ZoneRecord is a record together with the name that owns it.
+type ZoneRecord struct {
+	Name string `json:"name"`
+	Record
+}
+
+// UnmarshalJSON reads the name besides the record, whose own UnmarshalJSON
+// would otherwise be used for the whole object.
+func (r *ZoneRecord) UnmarshalJSON(b []byte) error {
+	var name struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	r.Name = name.Name
+	return json.Unmarshal(b, &r.Record)
+}
+
+// JournalEntry is one change of a zone, from serial From to serial To. It
+// holds what IXFR needs to bring a secondary from one version of the zone
+// to the next (RFC 1995).
+type JournalEntry struct {
+	From    uint32       `json:"from"`
+	To      uint32       `json:"to"`
+	Old     Zone         `json:"old"`
+	New     Zone         `json:"new"`
+	Deleted []ZoneRecord `json:"deleted,omitempty"`
+	Added   []ZoneRecord `json:"added,omitempty"`
+}
+
+// JournalManager keeps the recent changes of every zone. The changes are
+// derived by comparing the records of a zone whenever its serial advances
+// with a snapshot taken at the previous serial.
+type JournalManager struct {
+	size      int
+	journals  map[string][]JournalEntry
+	snapshots map[string]map[string]ZoneRecord
+	mu        sync.Mutex
+}
+
+type JournalOption func(*JournalManager)
+
+// WithJournalSize sets how many changes are kept per zone.
+func WithJournalSize(size int) JournalOption {
+	return func(m *JournalManager) {
+		if size > 0 {
+			m.size = size
+		}
+	}
+}
+
+func NewJournalManager(options ...JournalOption) *JournalManager {
+	m := &JournalManager{
+		size:      100,
+		journals:  make(map[string][]JournalEntry),
+		snapshots: make(map[string]map[string]ZoneRecord),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Snapshot records the contents of z at its current serial, against which
+// the next change is computed. A journal that does not end at the serial
+// of z, e.g. because the zone was changed while the server was down, is
+// dropped and false is returned.
+func (m *JournalManager) Snapshot(z Zone, records map[string][]Record) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshots[z.Name] = recordSet(records)
+	journal := m.journals[z.Name]
+	if len(journal) > 0 && journal[len(journal)-1].To != z.Serial {
+		delete(m.journals, z.Name)
+		return false
+	}
+	return true
+}
+
+// Commit adds the change from old to z, whose records are now records, to
+// the journal of the zone and returns the updated journal. Without a
+// snapshot of old the change cannot be computed; the journal is dropped
+// and nil is returned.
+func (m *JournalManager) Commit(old, z Zone, records map[string][]Record) []JournalEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := recordSet(records)
+	previous, ok := m.snapshots[z.Name]
+	m.snapshots[z.Name] = current
+	if !ok {
+		delete(m.journals, z.Name)
+		return nil
+	}
+
+	entry := JournalEntry{From: old.Serial, To: z.Serial, Old: old, New: z}
+	for key, r := range previous {
+		if _, ok := current[key]; !ok {
+			entry.Deleted = append(entry.Deleted, r)
+		}
+	}
+	for key, r := range current {
+		if _, ok := previous[key]; !ok {
+			entry.Added = append(entry.Added, r)
+		}
+	}
+	sortZoneRecords(entry.Deleted)
+	sortZoneRecords(entry.Added)
+
+	journal := m.journals[z.Name]
+	if len(journal) > 0 && journal[len(journal)-1].To != old.Serial {
+		journal = nil
+	}
+	journal = append(journal, entry)
+	if len(journal) > m.size {
+		journal = slices.Clone(journal[len(journal)-m.size:])
+	}
+	m.journals[z.Name] = journal
+	return slices.Clone(journal)
+}
+
+// Since returns the changes that lead from serial to the latest version
+// of the zone name. ok is false when the journal does not reach back to
+// serial.
+func (m *JournalManager) Since(name string, serial uint32) ([]JournalEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	journal := m.journals[name]
+	for i, entry := range journal {
+		if entry.From == serial {
+			return slices.Clone(journal[i:]), true
+		}
+	}
+	return nil, false
+}
+
+// Remove forgets the journal and snapshot of the zone name.
+func (m *JournalManager) Remove(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.journals, name)
+	delete(m.snapshots, name)
+}
+
+// Load replaces the journals with the contents of the Redis "journal"
+// hash. Entries that cannot be decoded are logged and skipped.
+func (m *JournalManager) Load(value map[string]string) {
+	journals := make(map[string][]JournalEntry, len(value))
+	for name, raw := range value {
+		var journal []JournalEntry
+		if err := json.Unmarshal([]byte(raw), &journal); err != nil {
+			log.Error().Msgf("Skipping invalid journal of zone %s -> %v", name, err)
+			continue
+		}
+		journals[name] = journal
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.journals = journals
+}
+
+// EncodeJournal serialises journal for storage in the Redis "journal"
+// hash.
+func EncodeJournal(journal []JournalEntry) (string, error) {
+	b, err := json.Marshal(journal)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// recordSet indexes records by their name and data, so that two versions
+// of a zone can be compared.
+func recordSet(records map[string][]Record) map[string]ZoneRecord {
+	set := make(map[string]ZoneRecord)
+	for name, rs := range records {
+		for _, r := range rs {
+			// NoPTR does not change what is transferred.
+			r.NoPTR = false
+			zr := ZoneRecord{Name: name, Record: r}
+			key, err := json.Marshal(zr)
+			if err != nil {
+				continue
+			}
+			set[string(key)] = zr
+		}
+	}
+	return set
+}
+
+// sortZoneRecords orders records by name and type, the order they are
+// transferred in.
+func sortZoneRecords(records []ZoneRecord) {
+	slices.SortStableFunc(records, func(a, b ZoneRecord) int {
+		if c := CompareNames(a.Name, b.Name); c != 0 {
+			return c
+		}
+		if a.Type < b.Type {
+			return -1
+		}
+		if a.Type > b.Type {
+			return 1
+		}
+		return 0
+	})
+}
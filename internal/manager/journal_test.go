@@ -0,0 +1,155 @@
+package manager
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// replay applies the changes of journal to records the way a secondary
+// applies an incremental transfer.
+func replay(t *testing.T, records map[string][]Record, journal []JournalEntry) map[string][]Record {
+	t.Helper()
+	out := make(map[string][]Record, len(records))
+	for name, rs := range records {
+		out[name] = slices.Clone(rs)
+	}
+	for _, entry := range journal {
+		for _, r := range entry.Deleted {
+			rs := out[r.Name]
+			i := slices.IndexFunc(rs, r.Record.Equal)
+			if i < 0 {
+				t.Fatalf("change %d -> %d deletes %s %+v, which is not there", entry.From, entry.To, r.Name, r.Record)
+			}
+			out[r.Name] = slices.Delete(rs, i, i+1)
+			if len(out[r.Name]) == 0 {
+				delete(out, r.Name)
+			}
+		}
+		for _, r := range entry.Added {
+			out[r.Name] = append(out[r.Name], r.Record)
+		}
+	}
+	return out
+}
+
+// sameRecords compares two versions of a zone as they are transferred,
+// regardless of record order.
+func sameRecords(a, b map[string][]Record) bool {
+	return maps.EqualFunc(recordSet(a), recordSet(b), func(x, y ZoneRecord) bool {
+		return x.Name == y.Name && x.Record.Equal(y.Record)
+	})
+}
+
+func TestJournalReplaysDiff(t *testing.T) {
+	z := Zone{Name: "example.com", Serial: 1}
+	v1 := map[string][]Record{
+		"example.com":      {{Type: "A", TTL: 300, IP: "192.0.2.1"}, {Type: "MX", TTL: 300, Priority: 10, Target: "mail.example.com"}},
+		"www.example.com":  {{Type: "CNAME", TTL: 300, Target: "example.com"}},
+		"mail.example.com": {{Type: "A", TTL: 300, IP: "192.0.2.25"}},
+		"old.example.com":  {{Type: "TXT", TTL: 300, Text: Text{"going away"}}},
+	}
+	v2 := map[string][]Record{
+		// A changed TTL is a deletion and an addition.
+		"example.com":      {{Type: "A", TTL: 600, IP: "192.0.2.1"}, {Type: "MX", TTL: 300, Priority: 10, Target: "mail.example.com"}},
+		"www.example.com":  {{Type: "CNAME", TTL: 300, Target: "example.com"}},
+		"mail.example.com": {{Type: "A", TTL: 300, IP: "192.0.2.26"}, {Type: "AAAA", TTL: 300, IP: "2001:db8::25"}},
+		"new.example.com":  {{Type: "TXT", TTL: 300, Text: Text{"just arrived"}}},
+	}
+	v3 := map[string][]Record{
+		"example.com": {{Type: "A", TTL: 600, IP: "192.0.2.1"}},
+		// NoPTR is not transferred, so setting it alone is no change.
+		"mail.example.com": {{Type: "A", TTL: 300, IP: "192.0.2.26", NoPTR: true}, {Type: "AAAA", TTL: 300, IP: "2001:db8::25"}},
+		"new.example.com":  {{Type: "TXT", TTL: 300, Text: Text{"just arrived"}}},
+	}
+
+	m := NewJournalManager()
+	if !m.Snapshot(z, v1) {
+		t.Fatal("snapshot of a zone without journal was refused")
+	}
+	z2 := Zone{Name: z.Name, Serial: 2}
+	journal := m.Commit(z, z2, v2)
+	if len(journal) != 1 || journal[0].From != 1 || journal[0].To != 2 {
+		t.Fatalf("journal after one change: %+v", journal)
+	}
+	if got := replay(t, v1, journal); !sameRecords(got, v2) {
+		t.Errorf("replaying 1 -> 2 gave\n%+v\nwant\n%+v", got, v2)
+	}
+	for _, list := range [][]ZoneRecord{journal[0].Deleted, journal[0].Added} {
+		if !slices.IsSortedFunc(list, func(a, b ZoneRecord) int { return CompareNames(a.Name, b.Name) }) {
+			t.Errorf("changes not in transfer order: %+v", list)
+		}
+	}
+
+	z3 := Zone{Name: z.Name, Serial: 3}
+	journal = m.Commit(z2, z3, v3)
+	for _, r := range slices.Concat(journal[1].Deleted, journal[1].Added) {
+		if r.Name == "mail.example.com" {
+			t.Errorf("setting NoPTR was journaled as %+v", r)
+		}
+	}
+
+	// Every serial still in the journal leads to the latest version.
+	from1, ok := m.Since(z.Name, 1)
+	if !ok || len(from1) != 2 {
+		t.Fatalf("Since(1) = %+v, %v", from1, ok)
+	}
+	if got := replay(t, v1, from1); !sameRecords(got, v3) {
+		t.Errorf("replaying 1 -> 3 gave\n%+v\nwant\n%+v", got, v3)
+	}
+	from2, ok := m.Since(z.Name, 2)
+	if !ok || len(from2) != 1 {
+		t.Fatalf("Since(2) = %+v, %v", from2, ok)
+	}
+	if got := replay(t, v2, from2); !sameRecords(got, v3) {
+		t.Errorf("replaying 2 -> 3 gave\n%+v\nwant\n%+v", got, v3)
+	}
+	if _, ok := m.Since(z.Name, 3); ok {
+		t.Error("Since found a change from the latest serial")
+	}
+}
+
+func TestJournalSize(t *testing.T) {
+	m := NewJournalManager(WithJournalSize(2))
+	z := Zone{Name: "example.com", Serial: 1}
+	m.Snapshot(z, nil)
+	for serial := uint32(2); serial <= 4; serial++ {
+		next := Zone{Name: z.Name, Serial: serial}
+		m.Commit(z, next, map[string][]Record{"example.com": {{Type: "A", IP: "192.0.2.1", TTL: int(serial)}}})
+		z = next
+	}
+	if _, ok := m.Since(z.Name, 1); ok {
+		t.Error("journal kept more changes than its size")
+	}
+	if journal, ok := m.Since(z.Name, 2); !ok || len(journal) != 2 {
+		t.Errorf("Since(2) = %+v, %v", journal, ok)
+	}
+}
+
+func TestJournalBreaks(t *testing.T) {
+	m := NewJournalManager()
+	z1, z2, z3 := Zone{Name: "example.com", Serial: 1}, Zone{Name: "example.com", Serial: 2}, Zone{Name: "example.com", Serial: 3}
+
+	// Without a snapshot of the old version nothing can be computed.
+	if journal := m.Commit(z1, z2, nil); journal != nil {
+		t.Errorf("commit without snapshot returned %+v", journal)
+	}
+
+	m.Snapshot(z1, nil)
+	m.Commit(z1, z2, map[string][]Record{"a.example.com": {{Type: "A", IP: "192.0.2.1"}}})
+
+	// A change that does not continue the journal starts it over.
+	journal := m.Commit(Zone{Name: "example.com", Serial: 7}, Zone{Name: "example.com", Serial: 8}, nil)
+	if len(journal) != 1 || journal[0].From != 7 {
+		t.Errorf("journal after a gap: %+v", journal)
+	}
+
+	// So does a snapshot at a serial the journal does not end at, e.g.
+	// after the zone changed while the server was down.
+	if m.Snapshot(z3, nil) {
+		t.Error("snapshot at serial 3 kept a journal ending at 8")
+	}
+	if _, ok := m.Since(z1.Name, 7); ok {
+		t.Error("dropped journal is still served")
+	}
+}
@@ -0,0 +1,244 @@
+package manager
+
+import (
+	"dns-server/internal/dnsmsg"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// DefaultTTL is used for records that do not specify their own TTL. A TTL
+// of 0 is kept as it is: the answer is not to be cached.
+const DefaultTTL = 60
+
+// maxStringLen is the length limit of a character-string (RFC 1035 section
+// 3.3).
+const maxStringLen = 255
+
+// Record is a single typed resource record stored for a domain. Only the
+// fields relevant to Type are set:
+//
+//	A, AAAA          IP
+//	CNAME, NS, PTR   Target
+//	MX               Priority, Target
+//	SRV              Priority, Weight, Port, Target
+//	TXT              Text, one entry per character-string
+//	CAA              Flags, Tag, Value
+//
+// PTR records are synthesized for the addresses of A and AAAA records
+// unless NoPTR is set.
+type Record struct {
+	Type     string `json:"type"`
+	TTL      int    `json:"ttl"`
+	IP       string `json:"ip,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Priority uint16 `json:"priority,omitempty"`
+	Weight   uint16 `json:"weight,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+	Text     Text   `json:"text,omitempty"`
+	Flags    uint8  `json:"flags,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Value    string `json:"value,omitempty"`
+	// NoPTR keeps an A or AAAA record from answering reverse lookups for
+	// its address.
+	NoPTR bool `json:"no_ptr,omitempty"`
+}
+
+// RecordTypes lists the record types that can be stored.
+var RecordTypes = []string{"A", "AAAA", "CNAME", "MX", "TXT", "SRV", "PTR", "NS", "CAA"}
+
+// Normalize fills in defaults and checks that the fields required by the
+// record type are present and well formed.
+func (r *Record) Normalize() error {
+	r.Type = strings.ToUpper(strings.TrimSpace(r.Type))
+	r.Target = dnsmsg.CanonicalName(strings.TrimSpace(r.Target))
+	if r.Type == "" && r.IP != "" {
+		r.Type = "A"
+		if ip := net.ParseIP(r.IP); ip != nil && ip.To4() == nil {
+			r.Type = "AAAA"
+		}
+	}
+	if r.TTL < 0 {
+		r.TTL = 0
+	}
+
+	switch r.Type {
+	case "A":
+		if ip := net.ParseIP(r.IP); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address %q", r.IP)
+		}
+	case "AAAA":
+		if ip := net.ParseIP(r.IP); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address %q", r.IP)
+		}
+	case "CNAME", "NS", "PTR", "MX", "SRV":
+		if _, err := dnsmsg.SplitLabels(r.Target); err != nil || (r.Target == "" && r.Type != "SRV") {
+			return fmt.Errorf("invalid target %q", r.Target)
+		}
+	case "TXT":
+		if len(r.Text) == 0 {
+			return fmt.Errorf("TXT record requires text")
+		}
+		for _, s := range r.Text {
+			if len(s) > maxStringLen {
+				return fmt.Errorf("TXT character-string longer than %d bytes", maxStringLen)
+			}
+		}
+	case "CAA":
+		if r.Tag == "" {
+			return fmt.Errorf("CAA record requires a tag")
+		}
+	default:
+		return fmt.Errorf("unsupported record type %q, expected one of %s", r.Type, strings.Join(RecordTypes, ", "))
+	}
+	if r.Type != "A" && r.Type != "AAAA" {
+		r.NoPTR = false
+	}
+	return nil
+}
+
+// SameData reports whether r and o describe the same record, ignoring TTL
+// and NoPTR.
+func (r Record) SameData(o Record) bool {
+	r.TTL, o.TTL = 0, 0
+	r.NoPTR, o.NoPTR = false, false
+	return r.Equal(o)
+}
+
+// Equal reports whether r and o are the same record.
+func (r Record) Equal(o Record) bool {
+	return r.Type == o.Type && r.TTL == o.TTL && r.IP == o.IP && r.Target == o.Target &&
+		r.Priority == o.Priority && r.Weight == o.Weight && r.Port == o.Port &&
+		slices.Equal(r.Text, o.Text) &&
+		r.Flags == o.Flags && r.Tag == o.Tag && r.Value == o.Value && r.NoPTR == o.NoPTR
+}
+
+// EqualRecords reports whether a and b hold the same records in the same
+// order.
+func EqualRecords(a, b []Record) bool {
+	return slices.EqualFunc(a, b, Record.Equal)
+}
+
+// RR converts r into a wire-format resource record owned by name.
+func (r Record) RR(name string) (dnsmsg.ResourceRecord, error) {
+	var data dnsmsg.RData
+	switch r.Type {
+	case "A":
+		data = &dnsmsg.A{IP: net.ParseIP(r.IP).To4()}
+	case "AAAA":
+		data = &dnsmsg.AAAA{IP: net.ParseIP(r.IP)}
+	case "CNAME":
+		data = &dnsmsg.CNAME{Target: r.Target}
+	case "NS":
+		data = &dnsmsg.NS{Host: r.Target}
+	case "PTR":
+		data = &dnsmsg.PTR{Target: r.Target}
+	case "MX":
+		data = &dnsmsg.MX{Preference: r.Priority, Exchange: r.Target}
+	case "SRV":
+		data = &dnsmsg.SRV{Priority: r.Priority, Weight: r.Weight, Port: r.Port, Target: r.Target}
+	case "TXT":
+		data = &dnsmsg.TXT{Text: slices.Clone(r.Text)}
+	case "CAA":
+		data = &dnsmsg.CAA{Flags: r.Flags, Tag: r.Tag, Value: r.Value}
+	default:
+		return dnsmsg.ResourceRecord{}, fmt.Errorf("unsupported record type %q", r.Type)
+	}
+
+	return dnsmsg.NewRR(name, uint32(max(r.TTL, 0)), data), nil
+}
+
+// RecordFromRR converts a wire-format record back into a Record. ok is
+// false for types that cannot be stored.
+func RecordFromRR(rr dnsmsg.ResourceRecord) (Record, bool) {
+	r := Record{Type: rr.Type.String(), TTL: int(rr.TTL)}
+	switch data := rr.Data.(type) {
+	case *dnsmsg.A:
+		r.IP = data.IP.String()
+	case *dnsmsg.AAAA:
+		r.IP = data.IP.String()
+	case *dnsmsg.CNAME:
+		r.Target = data.Target
+	case *dnsmsg.NS:
+		r.Target = data.Host
+	case *dnsmsg.PTR:
+		r.Target = data.Target
+	case *dnsmsg.MX:
+		r.Priority, r.Target = data.Preference, data.Exchange
+	case *dnsmsg.SRV:
+		r.Priority, r.Weight, r.Port, r.Target = data.Priority, data.Weight, data.Port, data.Target
+	case *dnsmsg.TXT:
+		r.Text = slices.Clone(data.Text)
+	case *dnsmsg.CAA:
+		r.Flags, r.Tag, r.Value = data.Flags, data.Tag, data.Value
+	default:
+		return r, false
+	}
+	return r, r.Normalize() == nil
+}
+
+// Text holds the character-strings of a TXT record. In JSON it is a list
+// of strings; a single string is accepted as well, as stored by earlier
+// versions, and broken into character-strings of at most 255 bytes.
+type Text []string
+
+func (t *Text) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
+		var parts []string
+		if err := json.Unmarshal(b, &parts); err != nil {
+			return err
+		}
+		*t = parts
+		return nil
+	}
+	var parts []string
+	for len(text) > maxStringLen {
+		parts = append(parts, text[:maxStringLen])
+		text = text[maxStringLen:]
+	}
+	*t = append(parts, text)
+	return nil
+}
+
+// UnmarshalJSON reads a record, giving it DefaultTTL when the ttl field is
+// missing; an explicit TTL of 0 is kept.
+func (r *Record) UnmarshalJSON(b []byte) error {
+	type plain Record
+	v := plain{TTL: DefaultTTL}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = Record(v)
+	return nil
+}
+
+// DecodeRecords parses the value stored in the Redis "dns" hash. Older
+// entries hold a bare IP address and are read as a single A/AAAA record.
+func DecodeRecords(value string) ([]Record, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") {
+		r := Record{IP: value, TTL: DefaultTTL}
+		if err := r.Normalize(); err != nil {
+			return nil, err
+		}
+		return []Record{r}, nil
+	}
+
+	var records []Record
+	if err := json.Unmarshal([]byte(value), &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// EncodeRecords serialises records for storage in the Redis "dns" hash.
+func EncodeRecords(records []Record) (string, error) {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
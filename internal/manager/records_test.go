@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"dns-server/internal/dnsmsg"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRecords(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name  string
+		value string
+		want  []Record
+	}{
+		{"bare address", "192.0.2.1", []Record{{Type: "A", TTL: DefaultTTL, IP: "192.0.2.1"}}},
+		{"missing ttl", `[{"type":"A","ip":"192.0.2.1"}]`, []Record{{Type: "A", TTL: DefaultTTL, IP: "192.0.2.1"}}},
+		{"ttl 0", `[{"type":"A","ttl":0,"ip":"192.0.2.1"}]`, []Record{{Type: "A", TTL: 0, IP: "192.0.2.1"}}},
+		{"text list", `[{"type":"TXT","ttl":300,"text":["a b","","c"]}]`, []Record{{Type: "TXT", TTL: 300, Text: Text{"a b", "", "c"}}}},
+		// Text stored as one string is broken into character-strings.
+		{"text string", `[{"type":"TXT","ttl":300,"text":"hello"}]`, []Record{{Type: "TXT", TTL: 300, Text: Text{"hello"}}}},
+		{"long text string", `[{"type":"TXT","text":"` + long + `"}]`, []Record{{Type: "TXT", TTL: DefaultTTL, Text: Text{long[:255], long[255:]}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeRecords(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !EqualRecords(got, tt.want) {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	records := []Record{
+		{Type: "A", TTL: 0, IP: "192.0.2.1"},
+		{Type: "TXT", TTL: 300, Text: Text{"v=DKIM1; ", "p=MIGf", ""}},
+		{Type: "TXT", TTL: 300, Text: Text{strings.Repeat("y", 255), "z"}},
+	}
+
+	value, err := EncodeRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeRecords(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !EqualRecords(decoded, records) {
+		t.Errorf("stored %s, read back %+v", value, decoded)
+	}
+
+	for _, r := range records {
+		rr, err := r.RR("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rr.TTL != uint32(r.TTL) {
+			t.Errorf("%s record has TTL %d, want %d", r.Type, rr.TTL, r.TTL)
+		}
+		if txt, ok := rr.Data.(*dnsmsg.TXT); ok && !slices.Equal(txt.Text, r.Text) {
+			t.Errorf("TXT character-strings %q, want %q", txt.Text, r.Text)
+		}
+		back, ok := RecordFromRR(rr)
+		if !ok || !back.Equal(r) {
+			t.Errorf("record %+v came back from the wire as %+v", r, back)
+		}
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		text Text
+		ok   bool
+	}{
+		{Text{"hello"}, true},
+		{Text{""}, true},
+		{Text{strings.Repeat("x", 255)}, true},
+		{Text{strings.Repeat("x", 256)}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		r := Record{Type: "TXT", Text: tt.text}
+		if err := r.Normalize(); (err == nil) != tt.ok {
+			t.Errorf("Normalize(%d strings) error %v, want ok %t", len(tt.text), err, tt.ok)
+		}
+	}
+}
+
+func TestJournalEntryDecoding(t *testing.T) {
+	journal := []JournalEntry{{
+		From: 1, To: 2,
+		Added: []ZoneRecord{{Name: "www.example.com", Record: Record{Type: "TXT", TTL: 0, Text: Text{"a", "b"}}}},
+	}}
+	value, err := EncodeJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewJournalManager()
+	m.Load(map[string]string{"example.com": value})
+	got, ok := m.Since("example.com", 1)
+	if !ok || len(got) != 1 || len(got[0].Added) != 1 {
+		t.Fatalf("journal read back as %+v", got)
+	}
+	if zr := got[0].Added[0]; zr.Name != "www.example.com" || !zr.Record.Equal(journal[0].Added[0].Record) {
+		t.Errorf("record read back as %+v", zr)
+	}
+}
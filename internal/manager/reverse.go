@@ -0,0 +1,123 @@
+package manager
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// PrivateReverseZones are the reverse zones of private and special purpose
+// address ranges. Queries for them must not leak to the internet, so they
+// are answered locally (RFC 6303 section 4).
+var PrivateReverseZones = []string{
+	// RFC 1918
+	"10.in-addr.arpa",
+	"16.172.in-addr.arpa", "17.172.in-addr.arpa", "18.172.in-addr.arpa", "19.172.in-addr.arpa",
+	"20.172.in-addr.arpa", "21.172.in-addr.arpa", "22.172.in-addr.arpa", "23.172.in-addr.arpa",
+	"24.172.in-addr.arpa", "25.172.in-addr.arpa", "26.172.in-addr.arpa", "27.172.in-addr.arpa",
+	"28.172.in-addr.arpa", "29.172.in-addr.arpa", "30.172.in-addr.arpa", "31.172.in-addr.arpa",
+	"168.192.in-addr.arpa",
+	// RFC 5735: this network, loopback, link local, documentation and
+	// broadcast
+	"0.in-addr.arpa",
+	"127.in-addr.arpa",
+	"254.169.in-addr.arpa",
+	"2.0.192.in-addr.arpa",
+	"100.51.198.in-addr.arpa",
+	"113.0.203.in-addr.arpa",
+	"255.255.255.255.in-addr.arpa",
+	// RFC 4291: unspecified and loopback
+	"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+	"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+	// RFC 4193 unique local, RFC 4291 link local and RFC 3849
+	// documentation
+	"d.f.ip6.arpa",
+	"8.e.f.ip6.arpa", "9.e.f.ip6.arpa", "a.e.f.ip6.arpa", "b.e.f.ip6.arpa",
+	"8.b.d.0.1.0.0.2.ip6.arpa",
+}
+
+// ReverseName returns the name PTR records for ip live under: in-addr.arpa
+// for IPv4 and nibble by nibble in ip6.arpa for IPv6.
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hex = "0123456789abcdef"
+	var sb strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		sb.WriteByte(hex[ip[i]&0x0F])
+		sb.WriteByte('.')
+		sb.WriteByte(hex[ip[i]>>4])
+		sb.WriteByte('.')
+	}
+	sb.WriteString("ip6.arpa")
+	return sb.String()
+}
+
+// synthesizedPTR is a PTR record derived from an address record.
+type synthesizedPTR struct {
+	reverse string
+	ptr     Record
+}
+
+// synthesizePTR returns the PTR records for the addresses in records that
+// want one. Wildcards do not name a single host and get none.
+func synthesizePTR(domainName string, records []Record) []synthesizedPTR {
+	if strings.HasPrefix(domainName, "*.") {
+		return nil
+	}
+	var ptrs []synthesizedPTR
+	for _, r := range records {
+		if (r.Type != "A" && r.Type != "AAAA") || r.NoPTR {
+			continue
+		}
+		if ip := net.ParseIP(r.IP); ip != nil {
+			ptrs = append(ptrs, synthesizedPTR{
+				reverse: ReverseName(ip),
+				ptr:     Record{Type: "PTR", Target: domainName, TTL: r.TTL},
+			})
+		}
+	}
+	return ptrs
+}
+
+// indexPTR synthesizes PTR records for the addresses domainName currently
+// answers with. It must be called with m.mu held.
+func (m *ContextManager) indexPTR(domainName string) {
+	for _, s := range synthesizePTR(domainName, m.addresses(domainName)) {
+		if slices.ContainsFunc(m.reverse[s.reverse], s.ptr.SameData) {
+			continue
+		}
+		m.reverse[s.reverse] = append(m.reverse[s.reverse], s.ptr)
+		m.tree.insert(s.reverse)
+	}
+}
+
+// unindexPTR drops the PTR records synthesized for domainName. It must be
+// called with m.mu held.
+func (m *ContextManager) unindexPTR(domainName string) {
+	for _, s := range synthesizePTR(domainName, m.addresses(domainName)) {
+		ptrs := slices.DeleteFunc(slices.Clone(m.reverse[s.reverse]), func(r Record) bool {
+			return r.Target == domainName
+		})
+		if len(ptrs) > 0 {
+			m.reverse[s.reverse] = ptrs
+			continue
+		}
+		delete(m.reverse, s.reverse)
+		if !m.has(s.reverse) {
+			m.tree.remove(s.reverse)
+		}
+	}
+}
+
+// addresses returns the records domainName answers with, which are the
+// ones stored in Redis when there are any. It must be called with m.mu
+// held.
+func (m *ContextManager) addresses(domainName string) []Record {
+	if records, ok := m.context[domainName]; ok {
+		return records
+	}
+	return m.hosts[domainName]
+}
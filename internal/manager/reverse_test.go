@@ -0,0 +1,104 @@
+package manager
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		want string
+	}{
+		{net.ParseIP("192.0.2.1"), "1.2.0.192.in-addr.arpa"},
+		{net.IPv4(10, 20, 30, 40).To4(), "40.30.20.10.in-addr.arpa"},
+		// IPv4-mapped addresses are reversed as IPv4.
+		{net.ParseIP("::ffff:192.0.2.1"), "1.2.0.192.in-addr.arpa"},
+		{net.ParseIP("2001:db8::567:89ab"), "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+		{net.ParseIP("::1"), "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa"},
+		{net.ParseIP("fe80::ABCD"), "d.c.b.a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa"},
+	}
+	for _, tt := range tests {
+		if got := ReverseName(tt.ip); got != tt.want {
+			t.Errorf("ReverseName(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// ptrTargets returns the targets of the PTR records answering for name.
+func ptrTargets(m *ContextManager, name string) []string {
+	records, _ := m.Match(name)
+	var targets []string
+	for _, r := range records {
+		if r.Type == "PTR" {
+			targets = append(targets, r.Target)
+		}
+	}
+	slices.Sort(targets)
+	return targets
+}
+
+func TestSynthesizedPTR(t *testing.T) {
+	const (
+		first  = "1.2.0.192.in-addr.arpa"
+		second = "5.2.0.192.in-addr.arpa"
+		hosts  = "9.2.0.192.in-addr.arpa"
+		ipv6   = "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+	)
+	m := NewContextManager()
+
+	steps := []struct {
+		name   string
+		change func()
+		// want maps reverse names to the targets of their PTR records.
+		want map[string][]string
+	}{
+		{"address record", func() {
+			m.AddRP("host.lan", []Record{{Type: "A", TTL: 300, IP: "192.0.2.1"}, {Type: "AAAA", TTL: 300, IP: "2001:db8::1"}})
+		}, map[string][]string{first: {"host.lan"}, ipv6: {"host.lan"}}},
+		{"second name for the address", func() {
+			m.AddRP("nas.lan", []Record{{Type: "A", TTL: 300, IP: "192.0.2.1"}})
+		}, map[string][]string{first: {"host.lan", "nas.lan"}}},
+		{"changed address", func() {
+			m.AddRP("host.lan", []Record{{Type: "A", TTL: 300, IP: "192.0.2.5"}})
+		}, map[string][]string{first: {"nas.lan"}, second: {"host.lan"}, ipv6: nil}},
+		{"no_ptr", func() {
+			m.AddRP("nas.lan", []Record{{Type: "A", TTL: 300, IP: "192.0.2.1", NoPTR: true}})
+		}, map[string][]string{first: nil, second: {"host.lan"}}},
+		{"wildcard", func() {
+			m.AddRP("*.lan", []Record{{Type: "A", TTL: 300, IP: "192.0.2.1"}})
+		}, map[string][]string{first: nil}},
+		{"removed name", func() { m.RemoveRP("host.lan") }, map[string][]string{second: nil}},
+		{"hosts file", func() {
+			m.SetHosts(map[string][]Record{"printer.lan": {{Type: "A", TTL: 60, IP: "192.0.2.9"}}})
+		}, map[string][]string{hosts: {"printer.lan"}}},
+		// Records in Redis take the place of those from hosts files.
+		{"stored records override hosts", func() {
+			m.AddRP("printer.lan", []Record{{Type: "A", TTL: 300, IP: "192.0.2.5"}})
+		}, map[string][]string{hosts: nil, second: {"printer.lan"}}},
+		{"hosts records back", func() { m.RemoveRP("printer.lan") }, map[string][]string{hosts: {"printer.lan"}, second: nil}},
+	}
+	for _, step := range steps {
+		step.change()
+		for name, want := range step.want {
+			if got := ptrTargets(m, name); !slices.Equal(got, want) {
+				t.Errorf("%s: PTR targets of %s = %v, want %v", step.name, name, got, want)
+			}
+			if _, kind := m.Match(name); (kind == ExactMatch) != (len(want) > 0) {
+				t.Errorf("%s: %s matched as %d", step.name, name, kind)
+			}
+		}
+	}
+
+	// The PTR record keeps the TTL of the address record.
+	if records, _ := m.Match(hosts); len(records) != 1 || records[0].TTL != 60 {
+		t.Errorf("synthesized records %+v, want one with TTL 60", records)
+	}
+	// A PTR record stored for a reverse name answers instead of the
+	// synthesized ones.
+	m.AddRP(hosts, []Record{{Type: "PTR", TTL: 300, Target: "printer.example.com"}})
+	if got := ptrTargets(m, hosts); !slices.Equal(got, []string{"printer.example.com"}) {
+		t.Errorf("PTR targets of %s = %v, want the stored record", hosts, got)
+	}
+}
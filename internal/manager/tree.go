@@ -0,0 +1,142 @@
+package manager
+
+import (
+	"dns-server/internal/dnsmsg"
+	"slices"
+	"strings"
+)
+
+// MatchKind describes how a name was found in the record tree.
+type MatchKind int
+
+const (
+	// NoMatch means the name does not exist (NXDOMAIN).
+	NoMatch MatchKind = iota
+	// ExactMatch means records are stored for the name itself.
+	ExactMatch
+	// WildcardMatch means the records come from the wildcard at the
+	// closest encloser of the name (RFC 4592 section 3.3.1).
+	WildcardMatch
+	// EmptyNonTerminal means the name owns no records but has descendants
+	// that do, so it exists without data (NODATA).
+	EmptyNonTerminal
+)
+
+// nameTree indexes owner names by their labels in reverse order, so that
+// "www.dev.local" is stored under local -> dev -> www. It answers the
+// closest encloser questions wildcard matching needs without scanning
+// every name.
+type nameTree struct {
+	root *treeNode
+}
+
+type treeNode struct {
+	children map[string]*treeNode
+	// owner is the canonical name of the node when records are stored
+	// for it, and empty for empty non-terminals.
+	owner string
+}
+
+func newNameTree() *nameTree {
+	return &nameTree{root: &treeNode{}}
+}
+
+// reversedLabels returns the lowercase labels of name, top-level first.
+func reversedLabels(name string) []string {
+	labels, err := dnsmsg.SplitLabels(dnsmsg.CanonicalName(name))
+	if err != nil {
+		return nil
+	}
+	out := make([]string, len(labels))
+	for i, label := range labels {
+		out[len(labels)-1-i] = string(label)
+	}
+	return out
+}
+
+func (t *nameTree) insert(name string) {
+	n := t.root
+	for _, label := range reversedLabels(name) {
+		child, ok := n.children[label]
+		if !ok {
+			child = &treeNode{}
+			if n.children == nil {
+				n.children = make(map[string]*treeNode)
+			}
+			n.children[label] = child
+		}
+		n = child
+	}
+	n.owner = dnsmsg.CanonicalName(name)
+}
+
+// remove deletes name and prunes the nodes that no longer lead to any
+// owner.
+func (t *nameTree) remove(name string) {
+	labels := reversedLabels(name)
+	path := []*treeNode{t.root}
+	n := t.root
+	for _, label := range labels {
+		child, ok := n.children[label]
+		if !ok {
+			return
+		}
+		path = append(path, child)
+		n = child
+	}
+	n.owner = ""
+
+	for i := len(labels); i > 0; i-- {
+		node := path[i]
+		if node.owner != "" || len(node.children) > 0 {
+			return
+		}
+		delete(path[i-1].children, labels[i-1])
+	}
+}
+
+// match finds name in the tree. It returns the owner whose records apply,
+// which is the wildcard owner for wildcard matches.
+func (t *nameTree) match(name string) (string, MatchKind) {
+	labels := reversedLabels(name)
+	n := t.root
+	for _, label := range labels {
+		child, ok := n.children[label]
+		if !ok {
+			// n is the closest encloser; only its wildcard child can
+			// produce the name (RFC 4592 section 3.3.1).
+			wild, ok := n.children["*"]
+			if !ok {
+				return "", NoMatch
+			}
+			if wild.owner == "" {
+				// The wildcard is itself an empty non-terminal.
+				return "", EmptyNonTerminal
+			}
+			return wild.owner, WildcardMatch
+		}
+		n = child
+	}
+	if n.owner != "" {
+		return n.owner, ExactMatch
+	}
+	if len(n.children) > 0 {
+		return "", EmptyNonTerminal
+	}
+	return "", NoMatch
+}
+
+// CompareNames orders names so that a name comes right before the names
+// below it, which keeps the records of a subtree together.
+func CompareNames(a, b string) int {
+	la, lb := strings.Split(a, "."), strings.Split(b, ".")
+	slices.Reverse(la)
+	slices.Reverse(lb)
+	if a == "" {
+		la = nil
+	}
+	if b == "" {
+		lb = nil
+	}
+	return slices.Compare(la, lb)
+}
@@ -0,0 +1,158 @@
+package manager
+
+import "testing"
+
+// rfc4592Names are the owners of the example zone of RFC 4592 section
+// 2.2.1.
+var rfc4592Names = []string{
+	"example",
+	"*.example",
+	"sub.*.example",
+	"host1.example",
+	"_ssh._tcp.host1.example",
+	"_ssh._tcp.host2.example",
+	"subdel.example",
+}
+
+func rfc4592Tree() *nameTree {
+	t := newNameTree()
+	for _, name := range rfc4592Names {
+		t.insert(name)
+	}
+	return t
+}
+
+type matchCase struct {
+	name  string
+	owner string
+	kind  MatchKind
+}
+
+func checkMatches(t *testing.T, tree *nameTree, tests []matchCase) {
+	t.Helper()
+	for _, tt := range tests {
+		owner, kind := tree.match(tt.name)
+		if owner != tt.owner || kind != tt.kind {
+			t.Errorf("match(%s) = %q, %d; want %q, %d", tt.name, owner, kind, tt.owner, tt.kind)
+		}
+	}
+}
+
+func TestNameTreeMatch(t *testing.T) {
+	checkMatches(t, rfc4592Tree(), []matchCase{
+		// The queries of RFC 4592 section 2.2.1 that the wildcard answers.
+		{"host3.example", "*.example", WildcardMatch},
+		{"foo.bar.example", "*.example", WildcardMatch},
+		{"HOST3.Example.", "*.example", WildcardMatch},
+
+		// An exact match beats the wildcard, even without the queried
+		// data.
+		{"host1.example", "host1.example", ExactMatch},
+		{"example", "example", ExactMatch},
+		{"*.example", "*.example", ExactMatch},
+		// sub.*.example is an ordinary name below the wildcard owner.
+		{"sub.*.example", "sub.*.example", ExactMatch},
+
+		// The wildcard does not match through an existing node: the
+		// closest encloser of these names has no wildcard child.
+		{"_telnet._tcp.host1.example", "", NoMatch},
+		{"a.host1.example", "", NoMatch},
+		{"host.subdel.example", "", NoMatch},
+		{"ghost.*.example", "", NoMatch},
+
+		// Empty non-terminals exist without data and block the wildcard
+		// for the names below them.
+		{"host2.example", "", EmptyNonTerminal},
+		{"_tcp.host2.example", "", EmptyNonTerminal},
+		{"_tcp.host1.example", "", EmptyNonTerminal},
+		{"foo.host2.example", "", NoMatch},
+		{"_udp.host2.example", "", NoMatch},
+
+		// Names outside the zone.
+		{"example.com", "", NoMatch},
+		{"host3.example.net", "", NoMatch},
+	})
+}
+
+func TestNameTreeInsertRemove(t *testing.T) {
+	tree := rfc4592Tree()
+
+	// Without its records host1.example is produced by the wildcard, once
+	// its descendants are gone too.
+	tree.remove("host1.example")
+	checkMatches(t, tree, []matchCase{{"host1.example", "", EmptyNonTerminal}})
+	tree.remove("_ssh._tcp.host1.example")
+	checkMatches(t, tree, []matchCase{
+		{"host1.example", "*.example", WildcardMatch},
+		{"_tcp.host1.example", "*.example", WildcardMatch},
+	})
+
+	// Removing the only name below an empty non-terminal prunes it.
+	tree.remove("_ssh._tcp.host2.example")
+	checkMatches(t, tree, []matchCase{{"foo.host2.example", "*.example", WildcardMatch}})
+
+	// A wildcard below host2.example takes over its subtree.
+	tree.insert("*.host2.example")
+	checkMatches(t, tree, []matchCase{
+		{"foo.host2.example", "*.host2.example", WildcardMatch},
+		{"a.b.host2.example", "*.host2.example", WildcardMatch},
+		{"host2.example", "", EmptyNonTerminal},
+		{"host3.example", "*.example", WildcardMatch},
+	})
+
+	// A wildcard owner without records of its own still exists while
+	// sub.*.example does, so it answers without data.
+	tree.remove("*.example")
+	checkMatches(t, tree, []matchCase{
+		{"host3.example", "", EmptyNonTerminal},
+		{"sub.*.example", "sub.*.example", ExactMatch},
+	})
+	tree.remove("sub.*.example")
+	checkMatches(t, tree, []matchCase{{"host3.example", "", NoMatch}})
+
+	// Removing a name that is not there changes nothing.
+	tree.remove("missing.example")
+	tree.remove("a.b.c.example")
+	checkMatches(t, tree, []matchCase{
+		{"example", "example", ExactMatch},
+		{"subdel.example", "subdel.example", ExactMatch},
+		{"foo.host2.example", "*.host2.example", WildcardMatch},
+	})
+
+	// Removing everything leaves an empty tree.
+	for _, name := range []string{"example", "subdel.example", "*.host2.example"} {
+		tree.remove(name)
+	}
+	if len(tree.root.children) != 0 {
+		t.Errorf("nodes left after removing every name: %v", tree.root.children)
+	}
+}
+
+func TestContextManagerMatch(t *testing.T) {
+	m := NewContextManager()
+	m.AddRP("*.dev.local", []Record{{Type: "A", TTL: 60, IP: "192.0.2.1"}})
+	m.AddRP("api.dev.local", []Record{{Type: "A", TTL: 60, IP: "192.0.2.2"}})
+
+	tests := []struct {
+		name string
+		want []Record
+		kind MatchKind
+	}{
+		{"web.dev.local", []Record{{Type: "A", TTL: 60, IP: "192.0.2.1"}}, WildcardMatch},
+		{"api.dev.local", []Record{{Type: "A", TTL: 60, IP: "192.0.2.2"}}, ExactMatch},
+		{"x.api.dev.local", nil, NoMatch},
+		{"local", nil, EmptyNonTerminal},
+	}
+	for _, tt := range tests {
+		got, kind := m.Match(tt.name)
+		if kind != tt.kind || !EqualRecords(got, tt.want) {
+			t.Errorf("Match(%s) = %+v, %d; want %+v, %d", tt.name, got, kind, tt.want, tt.kind)
+		}
+	}
+
+	// Once the wildcard is removed its names no longer exist.
+	m.RemoveRP("*.dev.local")
+	if _, kind := m.Match("web.dev.local"); kind != NoMatch {
+		t.Errorf("web.dev.local matched %d after the wildcard was removed", kind)
+	}
+}
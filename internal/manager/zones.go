@@ -0,0 +1,376 @@
+package manager
+
+import (
+	"dns-server/internal/dnsmsg"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Zone is a zone the server is authoritative for. Names below it that have
+// no records are answered with NXDOMAIN instead of being forwarded.
+type Zone struct {
+	Name string `json:"name"`
+	// NS lists the name servers published at the apex. MName is used when
+	// it is empty.
+	NS      []string `json:"ns,omitempty"`
+	MName   string   `json:"mname"`
+	RName   string   `json:"rname"`
+	Serial  uint32   `json:"serial"`
+	Refresh uint32   `json:"refresh"`
+	Retry   uint32   `json:"retry"`
+	Expire  uint32   `json:"expire"`
+	// Minimum is the negative caching TTL (RFC 2308).
+	Minimum uint32 `json:"minimum"`
+	// TTL is the TTL of the SOA and NS records.
+	TTL uint32 `json:"ttl"`
+	// Implicit zones come from the local_zones configuration and are not
+	// stored in Redis. Their serial only lives in memory, so they are not
+	// transferred to secondaries or announced with NOTIFY.
+	Implicit bool `json:"implicit,omitempty"`
+	// Primaries makes the zone a secondary: its contents are transferred
+	// from these servers, given as IP or IP:port, and cannot be changed
+	// locally.
+	Primaries []string `json:"primaries,omitempty"`
+	// TSIGKey names the key shared with the other servers of the zone:
+	// transfers from the primaries and the NOTIFY messages sent to the
+	// secondaries are signed with it.
+	TSIGKey string `json:"tsig_key,omitempty"`
+	// Notify lists the secondaries, as IP or IP:port, told about changes
+	// of the zone. The transfer configuration applies when it is empty.
+	Notify []string `json:"notify,omitempty"`
+	// Refreshed is when a secondary zone was last found to be up to date
+	// with a primary. It is zero until the first transfer.
+	Refreshed time.Time `json:"refreshed,omitzero"`
+}
+
+// Normalize canonicalises the zone name and fills in SOA defaults.
+func (z *Zone) Normalize() error {
+	z.Name = dnsmsg.CanonicalName(strings.TrimSpace(z.Name))
+	if z.Name == "" {
+		return fmt.Errorf("zone name is required")
+	}
+	if _, err := dnsmsg.SplitLabels(z.Name); err != nil {
+		return fmt.Errorf("invalid zone name %q", z.Name)
+	}
+
+	z.MName = dnsmsg.CanonicalName(strings.TrimSpace(z.MName))
+	if z.MName == "" {
+		z.MName = "ns." + z.Name
+	}
+	// The first dot of an RNAME separates the mailbox from the domain, so
+	// an address written as user@domain is accepted too.
+	z.RName = dnsmsg.CanonicalName(strings.Replace(strings.TrimSpace(z.RName), "@", ".", 1))
+	if z.RName == "" {
+		z.RName = "hostmaster." + z.Name
+	}
+	for _, name := range append([]string{z.MName, z.RName}, z.NS...) {
+		if _, err := dnsmsg.SplitLabels(name); err != nil {
+			return fmt.Errorf("invalid name %q in zone %s", name, z.Name)
+		}
+	}
+	for i, primary := range z.Primaries {
+		addr, err := ServerAddr(primary)
+		if err != nil {
+			return err
+		}
+		z.Primaries[i] = addr
+	}
+	for i, secondary := range z.Notify {
+		addr, err := ServerAddr(secondary)
+		if err != nil {
+			return err
+		}
+		z.Notify[i] = addr
+	}
+	if z.TSIGKey != "" {
+		z.TSIGKey = dnsmsg.CanonicalName(strings.TrimSpace(z.TSIGKey))
+	}
+
+	ns := make([]string, len(z.NS))
+	for i, host := range z.NS {
+		ns[i] = dnsmsg.CanonicalName(host)
+	}
+	z.NS = ns
+
+	if z.Serial == 0 {
+		z.Serial = 1
+	}
+	if z.Refresh == 0 {
+		z.Refresh = 3600
+	}
+	if z.Retry == 0 {
+		z.Retry = 600
+	}
+	if z.Expire == 0 {
+		z.Expire = 86400
+	}
+	if z.Minimum == 0 {
+		z.Minimum = DefaultTTL
+	}
+	if z.TTL == 0 {
+		z.TTL = 3600
+	}
+	return nil
+}
+
+// ServerAddr turns the IP or IP:port of a primary or secondary server into
+// an address to dial, defaulting to port 53.
+func ServerAddr(server string) (string, error) {
+	server = strings.TrimSpace(server)
+	if ip := net.ParseIP(server); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid server %q, expected an IP address and optional port", server)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port in server %q", server)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Secondary reports whether the zone is transferred from primaries.
+func (z Zone) Secondary() bool {
+	return len(z.Primaries) > 0
+}
+
+// Expired reports whether a secondary zone must not be served: it was
+// never transferred, or the primaries could not be reached for longer than
+// the SOA expire time (RFC 1035 section 3.3.13).
+func (z Zone) Expired(now time.Time) bool {
+	if !z.Secondary() {
+		return false
+	}
+	return z.Refreshed.IsZero() || now.Sub(z.Refreshed) > time.Duration(z.Expire)*time.Second
+}
+
+// ZoneFromSOA returns the zone parameters carried by an SOA record.
+func ZoneFromSOA(rr dnsmsg.ResourceRecord) (Zone, bool) {
+	soa, ok := rr.Data.(*dnsmsg.SOA)
+	if !ok {
+		return Zone{}, false
+	}
+	return Zone{
+		Name:    dnsmsg.CanonicalName(rr.Name),
+		MName:   soa.MName,
+		RName:   soa.RName,
+		Serial:  soa.Serial,
+		Refresh: soa.Refresh,
+		Retry:   soa.Retry,
+		Expire:  soa.Expire,
+		Minimum: soa.Minimum,
+		TTL:     rr.TTL,
+	}, true
+}
+
+// SOA returns the SOA record of the zone.
+func (z Zone) SOA() dnsmsg.ResourceRecord {
+	return dnsmsg.NewRR(z.Name, z.TTL, &dnsmsg.SOA{
+		MName:   z.MName,
+		RName:   z.RName,
+		Serial:  z.Serial,
+		Refresh: z.Refresh,
+		Retry:   z.Retry,
+		Expire:  z.Expire,
+		Minimum: z.Minimum,
+	})
+}
+
+// NegativeSOA returns the SOA record placed in the authority section of
+// NXDOMAIN and NODATA answers. Its TTL is the negative caching TTL (RFC
+// 2308 section 3).
+func (z Zone) NegativeSOA() dnsmsg.ResourceRecord {
+	rr := z.SOA()
+	rr.TTL = min(z.TTL, z.Minimum)
+	return rr
+}
+
+// NSRecords returns the NS records published at the apex.
+func (z Zone) NSRecords() []dnsmsg.ResourceRecord {
+	hosts := z.NS
+	if len(hosts) == 0 {
+		hosts = []string{z.MName}
+	}
+	rrs := make([]dnsmsg.ResourceRecord, len(hosts))
+	for i, host := range hosts {
+		rrs[i] = dnsmsg.NewRR(z.Name, z.TTL, &dnsmsg.NS{Host: host})
+	}
+	return rrs
+}
+
+// NextSerial increments a serial using sequence space arithmetic (RFC
+// 1982), skipping zero which some secondaries treat as unset.
+func NextSerial(serial uint32) uint32 {
+	serial++
+	if serial == 0 {
+		serial = 1
+	}
+	return serial
+}
+
+// SerialGreater reports whether serial a is newer than b in sequence space
+// arithmetic (RFC 1982).
+func SerialGreater(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// ZoneManager holds the zones the server is authoritative for.
+type ZoneManager struct {
+	zones map[string]*Zone
+	// generation changes whenever a zone is added, replaced or removed.
+	generation uint64
+	mu         sync.RWMutex
+}
+
+func NewZoneManager() *ZoneManager {
+	return &ZoneManager{
+		zones: make(map[string]*Zone),
+	}
+}
+
+// SetImplicit adds a zone with default SOA parameters for every name in
+// names, unless a stored zone of the same name exists.
+func (m *ZoneManager) SetImplicit(names []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		z := &Zone{Name: name, Implicit: true}
+		if err := z.Normalize(); err != nil {
+			log.Error().Msgf("Skipping invalid local zone %q -> %v", name, err)
+			continue
+		}
+		if _, ok := m.zones[z.Name]; !ok {
+			m.zones[z.Name] = z
+			m.generation++
+		}
+	}
+}
+
+// Set adds or replaces a zone.
+func (m *ZoneManager) Set(z Zone) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zones[z.Name] = &z
+	m.generation++
+}
+
+// Remove deletes the zone name and reports whether it existed.
+func (m *ZoneManager) Remove(name string) bool {
+	name = dnsmsg.CanonicalName(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.zones[name]
+	delete(m.zones, name)
+	if ok {
+		m.generation++
+	}
+	return ok
+}
+
+// Get returns the zone called name.
+func (m *ZoneManager) Get(name string) (Zone, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	z, ok := m.zones[dnsmsg.CanonicalName(name)]
+	if !ok {
+		return Zone{}, false
+	}
+	return *z, true
+}
+
+// Find returns the most specific zone name falls under.
+func (m *ZoneManager) Find(name string) (Zone, bool) {
+	name = dnsmsg.CanonicalName(name)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.zones) == 0 {
+		return Zone{}, false
+	}
+	for {
+		if z, ok := m.zones[name]; ok {
+			return *z, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return Zone{}, false
+		}
+		name = name[i+1:]
+	}
+}
+
+// List returns the zones sorted by name.
+func (m *ZoneManager) List() []Zone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]Zone, 0, len(m.zones))
+	for _, z := range m.zones {
+		list = append(list, *z)
+	}
+	slices.SortFunc(list, func(a, b Zone) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+// Load replaces the stored zones with the contents of the Redis "zones"
+// hash, keeping implicit zones that are not overridden. Entries that
+// cannot be decoded are logged and skipped.
+func (m *ZoneManager) Load(value map[string]string) {
+	zones := make(map[string]*Zone, len(value))
+	for name, raw := range value {
+		z, err := DecodeZone(raw)
+		if err == nil {
+			err = z.Normalize()
+		}
+		if err != nil {
+			log.Error().Msgf("Skipping invalid zone %s -> %v", name, err)
+			continue
+		}
+		zones[z.Name] = &z
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, z := range m.zones {
+		if _, ok := zones[name]; !ok && z.Implicit {
+			zones[name] = z
+		}
+	}
+	m.zones = zones
+	m.generation++
+}
+
+// Generation returns a number that changes whenever the set of zones or
+// any zone does, so that data derived from them can tell when it is stale.
+func (m *ZoneManager) Generation() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.generation
+}
+
+// DecodeZone parses a value stored in the Redis "zones" hash.
+func DecodeZone(value string) (Zone, error) {
+	var z Zone
+	err := json.Unmarshal([]byte(value), &z)
+	return z, err
+}
+
+// EncodeZone serialises z for storage in the Redis "zones" hash.
+func EncodeZone(z Zone) (string, error) {
+	b, err := json.Marshal(z)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
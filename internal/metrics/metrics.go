@@ -0,0 +1,66 @@
+package metrics
+
+import "sync/atomic"
+
+// Listener counts connection level events for a stream based DNS listener.
+type Listener struct {
+	connections       atomic.Int64
+	activeConnections atomic.Int64
+	rejected          atomic.Int64
+	handshakes        atomic.Int64
+	handshakeErrors   atomic.Int64
+	resumedSessions   atomic.Int64
+	queries           atomic.Int64
+}
+
+// ListenerSnapshot is a point-in-time copy of a Listener's counters.
+type ListenerSnapshot struct {
+	Connections       int64 `json:"connections"`
+	ActiveConnections int64 `json:"active_connections"`
+	Rejected          int64 `json:"rejected"`
+	Handshakes        int64 `json:"handshakes"`
+	HandshakeErrors   int64 `json:"handshake_errors"`
+	ResumedSessions   int64 `json:"resumed_sessions"`
+	Queries           int64 `json:"queries"`
+}
+
+func (l *Listener) ConnectionOpened() {
+	l.connections.Add(1)
+	l.activeConnections.Add(1)
+}
+
+func (l *Listener) ConnectionClosed() {
+	l.activeConnections.Add(-1)
+}
+
+func (l *Listener) ConnectionRejected() {
+	l.rejected.Add(1)
+}
+
+// Handshake records the outcome of a TLS handshake.
+func (l *Listener) Handshake(err error, resumed bool) {
+	if err != nil {
+		l.handshakeErrors.Add(1)
+		return
+	}
+	l.handshakes.Add(1)
+	if resumed {
+		l.resumedSessions.Add(1)
+	}
+}
+
+func (l *Listener) Query() {
+	l.queries.Add(1)
+}
+
+func (l *Listener) Snapshot() ListenerSnapshot {
+	return ListenerSnapshot{
+		Connections:       l.connections.Load(),
+		ActiveConnections: l.activeConnections.Load(),
+		Rejected:          l.rejected.Load(),
+		Handshakes:        l.handshakes.Load(),
+		HandshakeErrors:   l.handshakeErrors.Load(),
+		ResumedSessions:   l.resumedSessions.Load(),
+		Queries:           l.queries.Load(),
+	}
+}
@@ -0,0 +1,325 @@
+// Package notify tells secondary servers that a zone changed, so that they
+// transfer it without waiting for their next refresh (RFC 1996).
+package notify
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/tsig"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// States of a NOTIFY.
+const (
+	StatePending      = "pending"
+	StateAcknowledged = "acknowledged"
+	StateFailed       = "failed"
+)
+
+// Status describes the last NOTIFY sent to one secondary for one zone.
+type Status struct {
+	Zone         string    `json:"zone"`
+	Serial       uint32    `json:"serial"`
+	Target       string    `json:"target"`
+	State        string    `json:"state"`
+	Attempts     int       `json:"attempts"`
+	LastAttempt  time.Time `json:"last_attempt,omitzero"`
+	Acknowledged time.Time `json:"acknowledged,omitzero"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+type job struct {
+	status Status
+	cancel context.CancelFunc
+}
+
+// Notifier sends NOTIFY messages over UDP and retries them until the
+// secondary answers. Messages for zones with a TSIG key are signed.
+type Notifier struct {
+	retries  int
+	timeout  time.Duration
+	interval time.Duration
+	keyring  *tsig.Keyring
+	key      string
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+type Option func(*Notifier)
+
+// WithRetries sets how many times an unanswered NOTIFY is resent.
+func WithRetries(retries int) Option {
+	return func(n *Notifier) {
+		if retries >= 0 {
+			n.retries = retries
+		}
+	}
+}
+
+// WithTimeout sets how long to wait for the answer to a NOTIFY.
+func WithTimeout(timeout time.Duration) Option {
+	return func(n *Notifier) {
+		if timeout > 0 {
+			n.timeout = timeout
+		}
+	}
+}
+
+// WithRetryInterval sets the wait before the first retry, which doubles
+// with every further retry.
+func WithRetryInterval(interval time.Duration) Option {
+	return func(n *Notifier) {
+		if interval > 0 {
+			n.interval = interval
+		}
+	}
+}
+
+// WithKeyring sets the keys NOTIFY messages are signed with.
+func WithKeyring(keyring *tsig.Keyring) Option {
+	return func(n *Notifier) {
+		n.keyring = keyring
+	}
+}
+
+// WithKey names the key NOTIFY messages are signed with for zones that do
+// not name their own.
+func WithKey(name string) Option {
+	return func(n *Notifier) {
+		n.key = name
+	}
+}
+
+func New(options ...Option) *Notifier {
+	n := &Notifier{
+		retries:  5,
+		timeout:  2 * time.Second,
+		interval: time.Second,
+		keyring:  tsig.NewKeyring(),
+		jobs:     make(map[string]*job),
+	}
+	for _, option := range options {
+		option(n)
+	}
+	return n
+}
+
+// Notify tells targets that z is now at its current serial. A NOTIFY
+// still being retried for an older serial of the zone is abandoned, and
+// secondaries no longer among targets are forgotten.
+func (n *Notifier) Notify(z manager.Zone, targets []string) {
+	key, err := n.signingKey(z)
+	if err != nil {
+		log.Error().Msgf("Cannot sign NOTIFY for %s -> %v", z.Name, err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, j := range n.jobs {
+		if j.status.Zone == z.Name && !slices.Contains(targets, j.status.Target) {
+			j.cancel()
+			delete(n.jobs, id)
+		}
+	}
+	for _, target := range targets {
+		id := z.Name + " " + target
+		if old, ok := n.jobs[id]; ok {
+			old.cancel()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		j := &job{
+			status: Status{Zone: z.Name, Serial: z.Serial, Target: target, State: StatePending},
+			cancel: cancel,
+		}
+		n.jobs[id] = j
+		if err != nil {
+			j.status.State, j.status.LastError = StateFailed, err.Error()
+			continue
+		}
+		go n.send(ctx, j, z.SOA(), key)
+	}
+}
+
+// signingKey returns the key NOTIFY messages for z are signed with, which
+// is nil when they are not signed.
+func (n *Notifier) signingKey(z manager.Zone) (*tsig.Key, error) {
+	name := z.TSIGKey
+	if name == "" {
+		name = n.key
+	}
+	if name == "" {
+		return nil, nil
+	}
+	key, ok := n.keyring.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown TSIG key %s", name)
+	}
+	return &key, nil
+}
+
+// Forget drops the state kept for the zone name, e.g. after it was
+// deleted.
+func (n *Notifier) Forget(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key, j := range n.jobs {
+		if j.status.Zone == name {
+			j.cancel()
+			delete(n.jobs, key)
+		}
+	}
+}
+
+// Status describes the last NOTIFY of every zone and secondary, sorted by
+// zone. It is safe to call on a nil notifier.
+func (n *Notifier) Status() []Status {
+	if n == nil {
+		return []Status{}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	list := make([]Status, 0, len(n.jobs))
+	for _, j := range n.jobs {
+		list = append(list, j.status)
+	}
+	slices.SortFunc(list, func(a, b Status) int {
+		if c := strings.Compare(a.Zone, b.Zone); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Target, b.Target)
+	})
+	return list
+}
+
+// send delivers one NOTIFY, retrying with a growing interval until the
+// secondary answers or the retries run out.
+func (n *Notifier) send(ctx context.Context, j *job, soa dnsmsg.ResourceRecord, key *tsig.Key) {
+	wait := n.interval
+	for attempt := 0; attempt <= n.retries; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			wait *= 2
+		}
+
+		err := n.exchange(ctx, j.status.Target, soa, key)
+		if ctx.Err() != nil {
+			return
+		}
+
+		n.mu.Lock()
+		j.status.Attempts++
+		j.status.LastAttempt = time.Now()
+		if err == nil {
+			j.status.State, j.status.Acknowledged, j.status.LastError = StateAcknowledged, time.Now(), ""
+			n.mu.Unlock()
+			log.Debug().Msgf("NOTIFY for %s serial %d acknowledged by %s", j.status.Zone, j.status.Serial, j.status.Target)
+			return
+		}
+		j.status.LastError = err.Error()
+		if permanent(err) {
+			j.status.State = StateFailed
+			n.mu.Unlock()
+			log.Warn().Msgf("NOTIFY for %s rejected by %s -> %v", j.status.Zone, j.status.Target, err)
+			return
+		}
+		n.mu.Unlock()
+	}
+
+	n.mu.Lock()
+	j.status.State = StateFailed
+	n.mu.Unlock()
+	log.Warn().Msgf("Giving up NOTIFY for %s serial %d to %s after %d attempts", j.status.Zone, j.status.Serial, j.status.Target, n.retries+1)
+}
+
+// rcodeError is an answer to a NOTIFY with an error code. Resending the
+// NOTIFY would not change it.
+type rcodeError dnsmsg.RCode
+
+func (e rcodeError) Error() string {
+	return fmt.Sprintf("secondary answered %s", dnsmsg.RCode(e))
+}
+
+// permanent reports whether resending a NOTIFY cannot change the outcome
+// of err: the secondary answered with an error, or its answer failed TSIG
+// verification.
+func permanent(err error) bool {
+	var rcode rcodeError
+	return errors.As(err, &rcode) || tsig.RCode(err) != dnsmsg.RCodeSuccess
+}
+
+// exchange sends a NOTIFY carrying soa to target and waits for its answer.
+// With key set the NOTIFY is signed and the answer must be too.
+func (n *Notifier) exchange(ctx context.Context, target string, soa dnsmsg.ResourceRecord, key *tsig.Key) error {
+	query := &dnsmsg.Message{
+		Header: dnsmsg.Header{
+			ID:            uint16(rand.Uint32()),
+			Opcode:        dnsmsg.OpcodeNotify,
+			Authoritative: true,
+		},
+		Questions: []dnsmsg.Question{{Name: soa.Name, Type: dnsmsg.TypeSOA, Class: dnsmsg.ClassINET}},
+		Answers:   []dnsmsg.ResourceRecord{soa},
+	}
+	var signer *tsig.Signer
+	var req []byte
+	var err error
+	if key != nil {
+		req, signer, err = tsig.SignRequest(*key, query, time.Now())
+	} else {
+		req, err = query.Pack()
+	}
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	conn.SetDeadline(time.Now().Add(n.timeout))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	buf := make([]byte, 65535)
+	for {
+		size, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		resp, err := dnsmsg.Parse(buf[:size])
+		if err != nil || !resp.Header.Response || resp.Header.ID != query.Header.ID || resp.Header.Opcode != dnsmsg.OpcodeNotify {
+			// Not the answer to this NOTIFY; keep waiting.
+			continue
+		}
+		if signer != nil {
+			if err := signer.Verify(buf[:size], resp, time.Now()); err != nil {
+				return err
+			}
+		}
+		if resp.Header.RCode != dnsmsg.RCodeSuccess {
+			return rcodeError(resp.Header.RCode)
+		}
+		return nil
+	}
+}
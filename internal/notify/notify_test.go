@@ -0,0 +1,298 @@
+package notify
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/tsig"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notice is a NOTIFY received by a fakeSecondary.
+type notice struct {
+	serial uint32
+	at     time.Time
+}
+
+// fakeSecondary receives NOTIFY messages over UDP. answer returns the
+// response to the n-th one, counting from 1, or nil to drop it.
+type fakeSecondary struct {
+	addr   string
+	answer func(n int, raw []byte, req *dnsmsg.Message) []byte
+
+	mu      sync.Mutex
+	notices []notice
+}
+
+func newFakeSecondary(t *testing.T, answer func(n int, raw []byte, req *dnsmsg.Message) []byte) *fakeSecondary {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	s := &fakeSecondary{addr: pc.LocalAddr().String(), answer: answer}
+
+	go func() {
+		buf := make([]byte, 0xFFFF)
+		for {
+			size, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := dnsmsg.Parse(buf[:size])
+			if err != nil || req.Header.Opcode != dnsmsg.OpcodeNotify || len(req.Answers) == 0 {
+				continue
+			}
+			s.mu.Lock()
+			s.notices = append(s.notices, notice{serial: req.Answers[0].Data.(*dnsmsg.SOA).Serial, at: time.Now()})
+			n := len(s.notices)
+			s.mu.Unlock()
+			if resp := s.answer(n, buf[:size], req); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return s
+}
+
+func (s *fakeSecondary) received() []notice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]notice(nil), s.notices...)
+}
+
+func reply(req *dnsmsg.Message, rcode dnsmsg.RCode) []byte {
+	resp := req.Reply()
+	resp.Header.Authoritative, resp.Header.RCode = true, rcode
+	b, _ := resp.Pack()
+	return b
+}
+
+func ack(_ int, _ []byte, req *dnsmsg.Message) []byte { return reply(req, dnsmsg.RCodeSuccess) }
+
+func drop(int, []byte, *dnsmsg.Message) []byte { return nil }
+
+func testZone(serial uint32) manager.Zone {
+	z := manager.Zone{Name: "example.com", Serial: serial}
+	z.Normalize()
+	return z
+}
+
+// status returns the status of the NOTIFY of example.com to target.
+func status(n *Notifier, target string) (Status, bool) {
+	for _, s := range n.Status() {
+		if s.Zone == "example.com" && s.Target == target {
+			return s, true
+		}
+	}
+	return Status{}, false
+}
+
+// waitFor polls the status of the NOTIFY to target until done accepts it.
+func waitFor(t *testing.T, n *Notifier, target string, done func(Status) bool) Status {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		s, _ := status(n, target)
+		if done(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("NOTIFY status %+v", s)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func inState(state string) func(Status) bool {
+	return func(s Status) bool { return s.State == state }
+}
+
+func TestNotifyRetriesWithBackoff(t *testing.T) {
+	// The first two NOTIFY messages go unanswered.
+	secondary := newFakeSecondary(t, func(n int, raw []byte, req *dnsmsg.Message) []byte {
+		if n < 3 {
+			return nil
+		}
+		return reply(req, dnsmsg.RCodeSuccess)
+	})
+	n := New(WithTimeout(30*time.Millisecond), WithRetryInterval(40*time.Millisecond), WithRetries(5))
+	n.Notify(testZone(7), []string{secondary.addr})
+
+	s := waitFor(t, n, secondary.addr, inState(StateAcknowledged))
+	if s.Attempts != 3 || s.Serial != 7 || s.LastError != "" || s.Acknowledged.IsZero() {
+		t.Errorf("status %+v, want acknowledged after 3 attempts", s)
+	}
+	got := secondary.received()
+	if len(got) != 3 {
+		t.Fatalf("secondary received %d NOTIFY messages, want 3", len(got))
+	}
+	// Each retry waits the timeout plus an interval that doubles.
+	first, second := got[1].at.Sub(got[0].at), got[2].at.Sub(got[1].at)
+	if first < 70*time.Millisecond || second < first+30*time.Millisecond {
+		t.Errorf("retried after %v and %v, want at least 70ms and a doubled interval", first, second)
+	}
+}
+
+func TestNotifyGivesUp(t *testing.T) {
+	secondary := newFakeSecondary(t, drop)
+	n := New(WithTimeout(20*time.Millisecond), WithRetryInterval(10*time.Millisecond), WithRetries(2))
+	n.Notify(testZone(1), []string{secondary.addr})
+
+	s := waitFor(t, n, secondary.addr, inState(StateFailed))
+	if s.Attempts != 3 || s.LastError == "" {
+		t.Errorf("status %+v, want failed after 3 attempts", s)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := len(secondary.received()); got != 3 {
+		t.Errorf("secondary received %d NOTIFY messages, want 3", got)
+	}
+}
+
+func TestNotifyErrorAnswerIsPermanent(t *testing.T) {
+	secondary := newFakeSecondary(t, func(_ int, _ []byte, req *dnsmsg.Message) []byte {
+		return reply(req, dnsmsg.RCodeRefused)
+	})
+	n := New(WithTimeout(20*time.Millisecond), WithRetryInterval(10*time.Millisecond), WithRetries(3))
+	n.Notify(testZone(1), []string{secondary.addr})
+
+	s := waitFor(t, n, secondary.addr, inState(StateFailed))
+	if s.Attempts != 1 || !strings.Contains(s.LastError, dnsmsg.RCodeRefused.String()) {
+		t.Errorf("status %+v, want failed after one REFUSED answer", s)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := len(secondary.received()); got != 1 {
+		t.Errorf("secondary received %d NOTIFY messages, want 1", got)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{rcodeError(dnsmsg.RCodeNotAuth), true},
+		{tsig.ErrBadSig, true},
+		{tsig.ErrBadTime, true},
+		{tsig.ErrUnsigned, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := permanent(tt.err); got != tt.want {
+			t.Errorf("permanent(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNewerSerialCancelsRetries(t *testing.T) {
+	// Serial 1 is never answered, serial 2 is.
+	secondary := newFakeSecondary(t, func(_ int, _ []byte, req *dnsmsg.Message) []byte {
+		if req.Answers[0].Data.(*dnsmsg.SOA).Serial == 1 {
+			return nil
+		}
+		return reply(req, dnsmsg.RCodeSuccess)
+	})
+	n := New(WithTimeout(20*time.Millisecond), WithRetryInterval(20*time.Millisecond), WithRetries(50))
+	n.Notify(testZone(1), []string{secondary.addr})
+	waitFor(t, n, secondary.addr, func(s Status) bool { return s.Attempts > 0 })
+
+	n.Notify(testZone(2), []string{secondary.addr})
+	s := waitFor(t, n, secondary.addr, inState(StateAcknowledged))
+	if s.Serial != 2 || s.Attempts != 1 {
+		t.Errorf("status %+v, want serial 2 acknowledged at once", s)
+	}
+
+	// An attempt for serial 1 may have been on its way already.
+	time.Sleep(30 * time.Millisecond)
+	before := len(secondary.received())
+	time.Sleep(150 * time.Millisecond)
+	for _, got := range secondary.received()[before:] {
+		t.Errorf("NOTIFY for serial %d sent after serial 2 was acknowledged", got.serial)
+	}
+	if len(n.Status()) != 1 {
+		t.Errorf("%d statuses for one zone and secondary", len(n.Status()))
+	}
+}
+
+func TestNotifyForgetsDroppedTargets(t *testing.T) {
+	kept := newFakeSecondary(t, ack)
+	dropped := newFakeSecondary(t, drop)
+	n := New(WithTimeout(20*time.Millisecond), WithRetryInterval(20*time.Millisecond), WithRetries(50))
+	n.Notify(testZone(1), []string{kept.addr, dropped.addr})
+	waitFor(t, n, dropped.addr, func(s Status) bool { return s.Attempts > 0 })
+
+	n.Notify(testZone(2), []string{kept.addr})
+	if _, ok := status(n, dropped.addr); ok {
+		t.Error("status kept for a secondary no longer notified")
+	}
+	waitFor(t, n, kept.addr, func(s Status) bool { return s.Serial == 2 && s.State == StateAcknowledged })
+
+	time.Sleep(30 * time.Millisecond)
+	before := len(dropped.received())
+	time.Sleep(150 * time.Millisecond)
+	if got := len(dropped.received()) - before; got != 0 {
+		t.Errorf("%d retries to a secondary no longer notified", got)
+	}
+}
+
+func TestSignedNotify(t *testing.T) {
+	key := tsig.Key{Name: "transfer-key", Algorithm: tsig.HMACSHA256, Secret: []byte("0123456789abcdef0123456789abcdef")}
+	if err := key.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	wrong := key
+	wrong.Secret = []byte("fedcba9876543210fedcba9876543210")
+	keyring := tsig.NewKeyring()
+	if err := keyring.Set(key); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		signWith tsig.Key
+		state    string
+	}{
+		{"valid signature", key, StateAcknowledged},
+		// A forged answer is not retried.
+		{"wrong secret", wrong, StateFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secondary := newFakeSecondary(t, func(_ int, raw []byte, req *dnsmsg.Message) []byte {
+				_, rr, err := tsig.Verify(raw, req, keyring, time.Now())
+				if err != nil {
+					return reply(req, dnsmsg.RCodeNotAuth)
+				}
+				resp := req.Reply()
+				resp.Header.Authoritative = true
+				b, _ := tsig.NewSigner(tt.signWith, rr.MAC).Sign(resp, dnsmsg.RCodeSuccess, time.Now())
+				return b
+			})
+			n := New(WithTimeout(20*time.Millisecond), WithRetryInterval(10*time.Millisecond), WithRetries(3),
+				WithKeyring(keyring), WithKey("transfer-key"))
+			n.Notify(testZone(1), []string{secondary.addr})
+
+			s := waitFor(t, n, secondary.addr, inState(tt.state))
+			if s.Attempts != 1 {
+				t.Errorf("status %+v after %d attempts, want 1", s, s.Attempts)
+			}
+		})
+	}
+
+	// A zone naming a key that does not exist is not notified at all.
+	secondary := newFakeSecondary(t, ack)
+	n := New(WithKeyring(keyring))
+	z := testZone(1)
+	z.TSIGKey = "missing-key"
+	n.Notify(z, []string{secondary.addr})
+	if s, _ := status(n, secondary.addr); s.State != StateFailed || !strings.Contains(s.LastError, "missing-key") {
+		t.Errorf("status %+v, want failed for the unknown key", s)
+	}
+}
@@ -0,0 +1,451 @@
+// Package recursor resolves names iteratively, starting from the root
+// servers and following referrals down to the authoritative servers,
+// instead of relying on an upstream resolver.
+package recursor
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/upstream"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxReferrals bounds how many delegations are followed for one name.
+	maxReferrals = 30
+	// maxQueries bounds the queries sent to authoritative servers while
+	// answering one client query, so that broken or hostile delegations
+	// cannot make us send an unbounded amount of traffic.
+	maxQueries = 128
+	// maxDepth bounds nested lookups of name server addresses.
+	maxDepth = 5
+	// maxCNAMEChain bounds how many CNAME records are followed.
+	maxCNAMEChain = 8
+	// maxDelegations bounds the size of the delegation cache.
+	maxDelegations = 10000
+	// maxDelegationTTL caps how long a delegation is cached.
+	maxDelegationTTL = 24 * time.Hour
+	// resolveTimeout bounds the whole resolution of one client query.
+	resolveTimeout = 10 * time.Second
+)
+
+var (
+	ErrTooManyQueries   = errors.New("recursor: query budget exhausted")
+	ErrTooManyReferrals = errors.New("recursor: too many referrals")
+	ErrNoServers        = errors.New("recursor: no reachable name servers")
+)
+
+// DefaultRootHints are the IPv4 addresses of the root servers a to m.
+var DefaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+// delegation records the name servers of a zone learnt from a referral.
+type delegation struct {
+	zone    string
+	addrs   []string
+	expires time.Time
+}
+
+// Recursor is an iterative resolver. It implements upstream.Resolver.
+type Recursor struct {
+	rootHints []string
+	port      string
+	timeout   time.Duration
+
+	roots []string
+
+	mu          sync.Mutex
+	delegations map[string]*delegation
+}
+
+type Option func(*Recursor)
+
+func New(options ...Option) (*Recursor, error) {
+	r := &Recursor{
+		rootHints:   DefaultRootHints,
+		port:        "53",
+		timeout:     2 * time.Second,
+		delegations: make(map[string]*delegation),
+	}
+
+	for _, option := range options {
+		option(r)
+	}
+
+	for _, hint := range r.rootHints {
+		addr, err := r.serverAddr(hint)
+		if err != nil {
+			return nil, err
+		}
+		r.roots = append(r.roots, addr)
+	}
+	if len(r.roots) == 0 {
+		return nil, errors.New("recursor: no root hints configured")
+	}
+
+	return r, nil
+}
+
+// WithRootHints replaces the root server addresses. Entries are IPs or
+// IP:port pairs, which allows pointing the resolver at a private or test
+// hierarchy.
+func WithRootHints(hints []string) Option {
+	return func(r *Recursor) {
+		if len(hints) > 0 {
+			r.rootHints = hints
+		}
+	}
+}
+
+// WithPort sets the port authoritative servers are queried on.
+func WithPort(port int) Option {
+	return func(r *Recursor) {
+		if port > 0 {
+			r.port = strconv.Itoa(port)
+		}
+	}
+}
+
+// WithTimeout bounds a single query to one authoritative server.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Recursor) {
+		if timeout > 0 {
+			r.timeout = timeout
+		}
+	}
+}
+
+func (r *Recursor) serverAddr(hint string) (string, error) {
+	if ip := net.ParseIP(hint); ip != nil {
+		return net.JoinHostPort(ip.String(), r.port), nil
+	}
+	host, port, err := net.SplitHostPort(hint)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("recursor: invalid root hint %q", hint)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// state is shared by every lookup made to answer one client query.
+type state struct {
+	do      bool
+	queries int
+}
+
+// Exchange resolves the question of req and returns a response carrying
+// its ID.
+func (r *Recursor) Exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	if len(req.Questions) != 1 {
+		return nil, fmt.Errorf("recursor: expected one question, got %d", len(req.Questions))
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	st := &state{}
+	if e := req.EDNS(); e != nil {
+		st.do = e.DO
+	}
+
+	resp, err := r.resolve(ctx, st, req.Questions[0], 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.ID = req.Header.ID
+	resp.Header.Response = true
+	resp.Header.Opcode = req.Header.Opcode
+	resp.Header.RecursionDesired = req.Header.RecursionDesired
+	resp.Header.RecursionAvailable = true
+	resp.Questions = req.Questions
+	return resp, nil
+}
+
+// resolve answers q, following CNAME chains across zones.
+func (r *Recursor) resolve(ctx context.Context, st *state, q dnsmsg.Question, depth int) (*dnsmsg.Message, error) {
+	out := &dnsmsg.Message{}
+	name := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		resp, err := r.iterate(ctx, st, dnsmsg.Question{Name: name, Type: q.Type, Class: q.Class}, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		rrs, next, complete := follow(resp, name, q.Type)
+		out.Answers = append(out.Answers, rrs...)
+		if complete {
+			return out, nil
+		}
+		if next != name {
+			// The chain leaves the data of this server; continue from
+			// the root of the new name.
+			log.Debug().Msgf("Following CNAME %s -> %s", name, next)
+			name = next
+			continue
+		}
+
+		out.Header.RCode = resp.Header.RCode
+		for _, rr := range resp.Authority {
+			if rr.Type == dnsmsg.TypeSOA {
+				out.Authority = append(out.Authority, rr)
+			}
+		}
+		return out, nil
+	}
+	return out, nil
+}
+
+// follow collects the records answering qtype for name from resp, walking
+// any CNAME chain the response contains. next is the last name reached and
+// complete reports whether data for it was found.
+func follow(resp *dnsmsg.Message, name string, qtype dnsmsg.Type) (rrs []dnsmsg.ResourceRecord, next string, complete bool) {
+	for i := 0; i < maxCNAMEChain; i++ {
+		var cname *dnsmsg.CNAME
+		var cnameRR dnsmsg.ResourceRecord
+		owner := dnsmsg.CanonicalName(name)
+		for _, rr := range resp.Answers {
+			if dnsmsg.CanonicalName(rr.Name) != owner {
+				continue
+			}
+			if rr.Type == qtype || qtype == dnsmsg.TypeANY {
+				rrs = append(rrs, rr)
+				complete = true
+			} else if c, ok := rr.Data.(*dnsmsg.CNAME); ok {
+				cname, cnameRR = c, rr
+			}
+		}
+		if complete || cname == nil {
+			return rrs, name, complete
+		}
+		rrs = append(rrs, cnameRR)
+		name = cname.Target
+	}
+	return rrs, name, false
+}
+
+// iterate asks the closest known name servers for q and follows referrals
+// until a server answers authoritatively.
+func (r *Recursor) iterate(ctx context.Context, st *state, q dnsmsg.Question, depth int) (*dnsmsg.Message, error) {
+	zone, addrs := r.closest(q.Name)
+	for i := 0; i < maxReferrals; i++ {
+		resp, err := r.query(ctx, st, addrs, q)
+		if err != nil {
+			return nil, fmt.Errorf("querying servers for %q: %w", zone, err)
+		}
+		if resp.Header.RCode == dnsmsg.RCodeNameError || len(resp.Answers) > 0 {
+			return resp, nil
+		}
+
+		sub, hosts, ttl := referral(resp, zone, q.Name)
+		if sub == "" {
+			// No data and no delegation: the name exists without
+			// records of this type.
+			return resp, nil
+		}
+
+		log.Debug().Msgf("Referral for %s from %q to %q", q.Name, zone, sub)
+		addrs, err = r.delegate(ctx, st, zone, sub, hosts, ttl, resp, depth)
+		if err != nil {
+			return nil, err
+		}
+		zone = sub
+	}
+	return nil, ErrTooManyReferrals
+}
+
+// referral extracts a delegation from resp. Only delegations to a zone
+// strictly below zone that still contains name are accepted, so a server
+// cannot redirect us to data it is not responsible for.
+func referral(resp *dnsmsg.Message, zone, name string) (sub string, hosts []string, ttl uint32) {
+	for _, rr := range resp.Authority {
+		ns, ok := rr.Data.(*dnsmsg.NS)
+		if !ok {
+			continue
+		}
+		owner := dnsmsg.CanonicalName(rr.Name)
+		if owner == zone || !dnsmsg.IsSubdomain(owner, zone) || !dnsmsg.IsSubdomain(name, owner) {
+			continue
+		}
+		if sub == "" {
+			sub, ttl = owner, rr.TTL
+		}
+		if owner != sub {
+			continue
+		}
+		hosts = append(hosts, dnsmsg.CanonicalName(ns.Host))
+		ttl = min(ttl, rr.TTL)
+	}
+	return sub, hosts, ttl
+}
+
+// delegate finds the addresses of the name servers hosts of sub and
+// caches the delegation. Glue is only trusted when it lies within zone,
+// the zone of the server that sent it; other name servers are resolved
+// separately.
+func (r *Recursor) delegate(ctx context.Context, st *state, zone, sub string, hosts []string, ttl uint32, resp *dnsmsg.Message, depth int) ([]string, error) {
+	var addrs []string
+	for _, rr := range resp.Additional {
+		owner := dnsmsg.CanonicalName(rr.Name)
+		if !dnsmsg.IsSubdomain(owner, zone) || !slices.Contains(hosts, owner) {
+			continue
+		}
+		switch data := rr.Data.(type) {
+		case *dnsmsg.A:
+			addrs = append(addrs, net.JoinHostPort(data.IP.String(), r.port))
+		case *dnsmsg.AAAA:
+			addrs = append(addrs, net.JoinHostPort(data.IP.String(), r.port))
+		}
+	}
+
+	if len(addrs) == 0 {
+		if depth >= maxDepth {
+			return nil, fmt.Errorf("recursor: name server lookups for %q nested too deeply", sub)
+		}
+		for _, host := range hosts {
+			if dnsmsg.IsSubdomain(host, sub) {
+				// In-bailiwick name server without glue; it cannot be
+				// resolved without itself.
+				continue
+			}
+			addrs = append(addrs, r.lookupAddrs(ctx, st, host, depth+1)...)
+			if len(addrs) > 0 {
+				break
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w for %q", ErrNoServers, sub)
+	}
+
+	r.store(&delegation{
+		zone:    sub,
+		addrs:   addrs,
+		expires: time.Now().Add(min(time.Duration(ttl)*time.Second, maxDelegationTTL)),
+	})
+	return addrs, nil
+}
+
+// lookupAddrs resolves the IPv4 addresses of the name server host.
+func (r *Recursor) lookupAddrs(ctx context.Context, st *state, host string, depth int) []string {
+	resp, err := r.resolve(ctx, st, dnsmsg.Question{Name: host, Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}, depth)
+	if err != nil {
+		log.Debug().Msgf("Could not resolve name server %s: %v", host, err)
+		return nil
+	}
+	var addrs []string
+	for _, rr := range resp.Answers {
+		if a, ok := rr.Data.(*dnsmsg.A); ok {
+			addrs = append(addrs, net.JoinHostPort(a.IP.String(), r.port))
+		}
+	}
+	return addrs
+}
+
+// query sends q to the servers in addrs, in random order, until one gives
+// a usable reply.
+func (r *Recursor) query(ctx context.Context, st *state, addrs []string, q dnsmsg.Question) (*dnsmsg.Message, error) {
+	lastErr := ErrNoServers
+	for _, i := range rand.Perm(len(addrs)) {
+		if st.queries >= maxQueries {
+			return nil, ErrTooManyQueries
+		}
+		st.queries++
+
+		req := &dnsmsg.Message{
+			Header:    dnsmsg.Header{ID: uint16(rand.Uint32())},
+			Questions: []dnsmsg.Question{q},
+		}
+		req.SetEDNS(&dnsmsg.EDNS{UDPSize: 1232, DO: st.do})
+
+		qctx, cancel := context.WithTimeout(ctx, r.timeout)
+		resp, err := upstream.Exchange(qctx, addrs[i], req)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		switch resp.Header.RCode {
+		case dnsmsg.RCodeSuccess, dnsmsg.RCodeNameError:
+			return resp, nil
+		}
+		lastErr = fmt.Errorf("%s answered %s", addrs[i], resp.Header.RCode)
+	}
+	return nil, lastErr
+}
+
+// closest returns the deepest cached delegation covering name, falling back
+// to the root servers.
+func (r *Recursor) closest(name string) (string, []string) {
+	name = dnsmsg.CanonicalName(name)
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		if d, ok := r.delegations[name]; ok {
+			if now.Before(d.expires) {
+				return d.zone, d.addrs
+			}
+			delete(r.delegations, name)
+		}
+		if name == "" {
+			return "", r.roots
+		}
+		if i := indexDot(name); i >= 0 {
+			name = name[i+1:]
+		} else {
+			name = ""
+		}
+	}
+}
+
+func (r *Recursor) store(d *delegation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.delegations) >= maxDelegations {
+		now := time.Now()
+		for zone, cached := range r.delegations {
+			if !now.Before(cached.expires) {
+				delete(r.delegations, zone)
+			}
+		}
+		if len(r.delegations) >= maxDelegations {
+			r.delegations = make(map[string]*delegation)
+		}
+	}
+	r.delegations[d.zone] = d
+}
+
+// Delegations returns the number of cached delegations.
+func (r *Recursor) Delegations() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.delegations)
+}
+
+// indexDot returns the index of the first unescaped dot in name.
+func indexDot(name string) int {
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			return i
+		}
+	}
+	return -1
+}
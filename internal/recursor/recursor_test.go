@@ -0,0 +1,377 @@
+package recursor
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAuth is an authoritative server for some zones of a test hierarchy.
+// NS records below a zone apex are delegations, answered with referrals
+// carrying every A record of the name servers as glue.
+type fakeAuth struct {
+	zones   []string
+	records []dnsmsg.ResourceRecord
+	queries atomic.Int64
+}
+
+func (s *fakeAuth) handle(req *dnsmsg.Message) *dnsmsg.Message {
+	s.queries.Add(1)
+	resp := req.Reply()
+	resp.Header.RecursionAvailable = false
+	q := req.Questions[0]
+	name := dnsmsg.CanonicalName(q.Name)
+
+	zone, ok := "", false
+	for _, z := range s.zones {
+		if dnsmsg.IsSubdomain(name, z) && (!ok || len(z) > len(zone)) {
+			zone, ok = z, true
+		}
+	}
+	if !ok {
+		resp.Header.RCode = dnsmsg.RCodeRefused
+		return resp
+	}
+
+	cut := ""
+	for _, rr := range s.records {
+		owner := dnsmsg.CanonicalName(rr.Name)
+		if rr.Type == dnsmsg.TypeNS && owner != zone && dnsmsg.IsSubdomain(owner, zone) &&
+			dnsmsg.IsSubdomain(name, owner) && len(owner) > len(cut) {
+			cut = owner
+		}
+	}
+	if cut != "" {
+		for _, rr := range s.records {
+			if ns, ok := rr.Data.(*dnsmsg.NS); ok && dnsmsg.CanonicalName(rr.Name) == cut {
+				resp.Authority = append(resp.Authority, rr)
+				for _, glue := range s.records {
+					if glue.Type == dnsmsg.TypeA && dnsmsg.CanonicalName(glue.Name) == ns.Host {
+						resp.Additional = append(resp.Additional, glue)
+					}
+				}
+			}
+		}
+		return resp
+	}
+
+	resp.Header.Authoritative = true
+	exists := false
+	for _, rr := range s.records {
+		if dnsmsg.CanonicalName(rr.Name) != name {
+			continue
+		}
+		exists = true
+		if rr.Type == q.Type || rr.Type == dnsmsg.TypeCNAME {
+			resp.Answers = append(resp.Answers, rr)
+		}
+	}
+	if len(resp.Answers) == 0 {
+		if !exists {
+			resp.Header.RCode = dnsmsg.RCodeNameError
+		}
+		resp.Authority = append(resp.Authority, dnsmsg.NewRR(zone, 60, &dnsmsg.SOA{
+			MName: "ns." + zone, RName: "hostmaster." + zone, Serial: 1, Minimum: 60,
+		}))
+	}
+	return resp
+}
+
+// serve runs s on UDP at ip:port until the test ends.
+func (s *fakeAuth) serve(t *testing.T, ip string, port int) error {
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 0xFFFF)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := dnsmsg.Parse(buf[:n])
+			if err != nil {
+				continue
+			}
+			if b, err := s.handle(req).Pack(); err == nil {
+				pc.WriteTo(b, addr)
+			}
+		}
+	}()
+	return nil
+}
+
+func a(name, ip string) dnsmsg.ResourceRecord {
+	return dnsmsg.NewRR(name, 300, &dnsmsg.A{IP: net.ParseIP(ip).To4()})
+}
+
+func ns(zone, host string) dnsmsg.ResourceRecord {
+	return dnsmsg.NewRR(zone, 3600, &dnsmsg.NS{Host: host})
+}
+
+func cname(name, target string) dnsmsg.ResourceRecord {
+	return dnsmsg.NewRR(name, 300, &dnsmsg.CNAME{Target: target})
+}
+
+// hierarchy is a root, two TLDs and their zones, each server on its own
+// loopback address and all on the same port.
+type hierarchy struct {
+	port    int
+	servers map[string]*fakeAuth
+}
+
+func newHierarchy(t *testing.T) *hierarchy {
+	t.Helper()
+	h := &hierarchy{servers: map[string]*fakeAuth{
+		"127.0.0.1": {zones: []string{""}, records: []dnsmsg.ResourceRecord{
+			ns("test", "ns.nic.test"), a("ns.nic.test", "127.0.0.2"),
+			ns("other", "ns.nic.other"), a("ns.nic.other", "127.0.0.4"),
+		}},
+		"127.0.0.2": {zones: []string{"test"}, records: []dnsmsg.ResourceRecord{
+			ns("example.test", "ns1.example.test"), a("ns1.example.test", "127.0.0.3"),
+			// Served from a name server in another TLD, with glue the
+			// test servers have no authority for.
+			ns("glueless.test", "ns.hoster.other"), a("ns.hoster.other", "127.0.0.9"),
+			// Each delegated to a name server inside the other.
+			ns("a.test", "ns.b.test"),
+			ns("b.test", "ns.a.test"),
+		}},
+		"127.0.0.3": {zones: []string{"example.test"}, records: []dnsmsg.ResourceRecord{
+			a("ns1.example.test", "127.0.0.3"),
+			a("www.example.test", "192.0.2.1"),
+			a("mail.example.test", "192.0.2.4"),
+			cname("alias.example.test", "www.hosted.other"),
+			cname("loop1.example.test", "loop2.example.test"),
+			cname("loop2.example.test", "loop1.example.test"),
+		}},
+		"127.0.0.4": {zones: []string{"other"}, records: []dnsmsg.ResourceRecord{
+			ns("hoster.other", "ns.hoster.other"), a("ns.hoster.other", "127.0.0.5"),
+			ns("hosted.other", "ns.hoster.other"),
+		}},
+		"127.0.0.5": {zones: []string{"hoster.other", "hosted.other", "glueless.test"}, records: []dnsmsg.ResourceRecord{
+			a("ns.hoster.other", "127.0.0.5"),
+			a("www.hosted.other", "192.0.2.3"),
+			a("www.glueless.test", "192.0.2.2"),
+		}},
+	}}
+
+	// Every server must get the same port on its own address.
+	for attempt := 0; ; attempt++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.port = pc.LocalAddr().(*net.UDPAddr).Port
+		pc.Close()
+
+		err = nil
+		for ip, s := range h.servers {
+			if err = s.serve(t, ip, h.port); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return h
+		}
+		if attempt == 10 {
+			t.Fatalf("could not start the fake hierarchy: %v", err)
+		}
+	}
+}
+
+func (h *hierarchy) recursor(t *testing.T) *Recursor {
+	t.Helper()
+	r, err := New(
+		WithRootHints([]string{net.JoinHostPort("127.0.0.1", strconv.Itoa(h.port))}),
+		WithPort(h.port),
+		WithTimeout(500*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func (h *hierarchy) queries(ip string) int64 {
+	return h.servers[ip].queries.Load()
+}
+
+func lookup(t *testing.T, r *Recursor, name string, qtype dnsmsg.Type) (*dnsmsg.Message, error) {
+	t.Helper()
+	req := &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 0x4242, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: name, Type: qtype, Class: dnsmsg.ClassINET}},
+	}
+	resp, err := r.Exchange(context.Background(), req)
+	if err == nil && resp.Header.ID != 0x4242 {
+		t.Errorf("reply ID %#x, want the ID of the query", resp.Header.ID)
+	}
+	return resp, err
+}
+
+// addresses returns the A records answering for name in resp.
+func addresses(resp *dnsmsg.Message) []string {
+	var ips []string
+	for _, rr := range resp.Answers {
+		if a, ok := rr.Data.(*dnsmsg.A); ok {
+			ips = append(ips, rr.Name+"="+a.IP.String())
+		}
+	}
+	return ips
+}
+
+func TestFollowsReferrals(t *testing.T) {
+	h := newHierarchy(t)
+	r := h.recursor(t)
+
+	resp, err := lookup(t, r, "www.example.test", dnsmsg.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(addresses(resp)); got != "[www.example.test=192.0.2.1]" {
+		t.Errorf("answers %s, want www.example.test=192.0.2.1", got)
+	}
+	if !resp.Header.RecursionAvailable || resp.Header.RCode != dnsmsg.RCodeSuccess {
+		t.Errorf("header %+v", resp.Header)
+	}
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		if h.queries(ip) != 1 {
+			t.Errorf("%s got %d queries, want one", ip, h.queries(ip))
+		}
+	}
+
+	// The delegation of example.test is cached, so the next name in it
+	// goes straight to its server.
+	if _, err := lookup(t, r, "mail.example.test", dnsmsg.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	if h.queries("127.0.0.1") != 1 || h.queries("127.0.0.2") != 1 || h.queries("127.0.0.3") != 2 {
+		t.Errorf("second lookup went past the cached delegation: root %d, tld %d, zone %d",
+			h.queries("127.0.0.1"), h.queries("127.0.0.2"), h.queries("127.0.0.3"))
+	}
+	if r.Delegations() != 2 {
+		t.Errorf("%d delegations cached, want test and example.test", r.Delegations())
+	}
+}
+
+func TestNegativeAnswers(t *testing.T) {
+	h := newHierarchy(t)
+	r := h.recursor(t)
+
+	resp, err := lookup(t, r, "missing.example.test", dnsmsg.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.RCode != dnsmsg.RCodeNameError || len(resp.Authority) != 1 || resp.Authority[0].Type != dnsmsg.TypeSOA {
+		t.Errorf("got %v, want NXDOMAIN with the SOA of the zone", resp)
+	}
+
+	resp, err = lookup(t, r, "www.example.test", dnsmsg.TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.RCode != dnsmsg.RCodeSuccess || len(resp.Answers) != 0 || len(resp.Authority) != 1 {
+		t.Errorf("got %v, want NODATA with the SOA of the zone", resp)
+	}
+}
+
+func TestGluelessDelegation(t *testing.T) {
+	h := newHierarchy(t)
+	r := h.recursor(t)
+
+	// The glue for ns.hoster.other comes from the servers of test, which
+	// have no say over other, so the name server is looked up itself.
+	resp, err := lookup(t, r, "www.glueless.test", dnsmsg.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(addresses(resp)); got != "[www.glueless.test=192.0.2.2]" {
+		t.Errorf("answers %s, want www.glueless.test=192.0.2.2", got)
+	}
+	if h.queries("127.0.0.4") == 0 {
+		t.Error("name server address was not resolved through its own TLD")
+	}
+}
+
+func TestCNAMEAcrossZones(t *testing.T) {
+	h := newHierarchy(t)
+	r := h.recursor(t)
+
+	resp, err := lookup(t, r, "alias.example.test", dnsmsg.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 2 || resp.Answers[0].Type != dnsmsg.TypeCNAME {
+		t.Fatalf("answers %v, want the CNAME followed by its target", resp.Answers)
+	}
+	if got := fmt.Sprint(addresses(resp)); got != "[www.hosted.other=192.0.2.3]" {
+		t.Errorf("answers %s, want www.hosted.other=192.0.2.3", got)
+	}
+}
+
+func TestCNAMELoop(t *testing.T) {
+	h := newHierarchy(t)
+	r := h.recursor(t)
+
+	resp, err := lookup(t, r, "loop1.example.test", dnsmsg.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) > maxCNAMEChain || len(addresses(resp)) != 0 {
+		t.Errorf("got %d answers, want at most %d CNAME records", len(resp.Answers), maxCNAMEChain)
+	}
+}
+
+func TestDelegationLoop(t *testing.T) {
+	h := newHierarchy(t)
+	r := h.recursor(t)
+
+	// a.test and b.test each need the other's name server to be found.
+	start := time.Now()
+	_, err := lookup(t, r, "www.a.test", dnsmsg.TypeA)
+	if !errors.Is(err, ErrNoServers) && !errors.Is(err, ErrTooManyQueries) {
+		t.Errorf("error %v, want the lookup to give up", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("lookup took %v", elapsed)
+	}
+	var total int64
+	for ip := range h.servers {
+		total += h.queries(ip)
+	}
+	if total > maxQueries {
+		t.Errorf("sent %d queries, over the budget of %d", total, maxQueries)
+	}
+}
+
+func TestUnreachableServers(t *testing.T) {
+	r, err := New(WithRootHints([]string{"127.0.0.1:1"}), WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookup(t, r, "www.example.test", dnsmsg.TypeA); err == nil {
+		t.Error("lookup without reachable root servers succeeded")
+	}
+}
+
+func TestReferral(t *testing.T) {
+	resp := &dnsmsg.Message{Authority: []dnsmsg.ResourceRecord{
+		ns("test", "ns.evil"),           // the zone itself
+		ns("other", "ns.evil"),          // outside the zone
+		ns("b.example.test", "ns.evil"), // does not contain the name
+		ns("example.test", "ns1.example.test"),
+		ns("example.test", "ns2.example.test"),
+	}}
+	sub, hosts, _ := referral(resp, "test", "www.example.test")
+	if sub != "example.test" || fmt.Sprint(hosts) != "[ns1.example.test ns2.example.test]" {
+		t.Errorf("referral to %q with %v, want example.test with its two servers", sub, hosts)
+	}
+}
@@ -0,0 +1,244 @@
+package secondary
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/tsig"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// Transfer is the contents of a zone received from a primary. A full
+// transfer carries every record of the zone; an incremental one the
+// changes since the serial the secondary asked with. A transfer with
+// neither means the secondary is up to date.
+type Transfer struct {
+	// SOA holds the zone parameters of the primary, including its serial.
+	SOA         manager.Zone
+	Full        bool
+	Records     map[string][]manager.Record
+	Incremental []manager.JournalEntry
+}
+
+// UpToDate reports whether the primary had nothing newer to send.
+func (t *Transfer) UpToDate() bool {
+	return !t.Full && len(t.Incremental) == 0
+}
+
+// client talks to one primary over TCP, signing its requests when a key is
+// set.
+type client struct {
+	addr    string
+	key     *tsig.Key
+	timeout time.Duration
+}
+
+// querySOA asks the primary for the SOA record of zone.
+func (c *client) querySOA(ctx context.Context, zone string) (manager.Zone, error) {
+	query := newQuery(zone, dnsmsg.TypeSOA)
+	var soa manager.Zone
+	found := false
+	err := c.exchange(ctx, query, func(m *dnsmsg.Message) (bool, error) {
+		for _, rr := range m.Answers {
+			if z, ok := manager.ZoneFromSOA(rr); ok && z.Name == zone {
+				soa, found = z, true
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return soa, err
+	}
+	if !found {
+		return soa, fmt.Errorf("primary %s has no SOA record for %s", c.addr, zone)
+	}
+	return soa, nil
+}
+
+// transfer fetches zone from the primary. With current set, an IXFR from
+// the serial of current is requested, and the primary may answer with the
+// changes since then or with the whole zone; otherwise an AXFR is made.
+func (c *client) transfer(ctx context.Context, zone string, current *manager.Zone) (*Transfer, error) {
+	query := newQuery(zone, dnsmsg.TypeAXFR)
+	var serial uint32
+	if current != nil {
+		query.Questions[0].Type = dnsmsg.TypeIXFR
+		query.Authority = []dnsmsg.ResourceRecord{current.SOA()}
+		serial = current.Serial
+	}
+
+	var rrs []dnsmsg.ResourceRecord
+	soas := 0
+	err := c.exchange(ctx, query, func(m *dnsmsg.Message) (bool, error) {
+		for _, rr := range m.Answers {
+			if len(rrs) == 0 && rr.Type != dnsmsg.TypeSOA {
+				return false, fmt.Errorf("transfer of %s does not start with an SOA record", zone)
+			}
+			if rr.Type == dnsmsg.TypeSOA {
+				soas++
+			}
+			rrs = append(rrs, rr)
+		}
+		if len(rrs) == 0 {
+			return false, nil
+		}
+		first, _ := manager.ZoneFromSOA(rrs[0])
+		if len(rrs) == 1 {
+			// A lone SOA no newer than ours answers an IXFR when there
+			// is nothing to transfer (RFC 1995 section 2).
+			return current != nil && !manager.SerialGreater(first.Serial, serial), nil
+		}
+		// Both AXFR and IXFR end with the SOA record of the new version,
+		// which then appears an even number of times.
+		last, ok := manager.ZoneFromSOA(rrs[len(rrs)-1])
+		return ok && last.Serial == first.Serial && soas%2 == 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseTransfer(zone, rrs, serial, current != nil)
+}
+
+// parseTransfer interprets the records of an AXFR or IXFR response.
+func parseTransfer(zone string, rrs []dnsmsg.ResourceRecord, serial uint32, incremental bool) (*Transfer, error) {
+	soa, _ := manager.ZoneFromSOA(rrs[0])
+	t := &Transfer{SOA: soa}
+	if len(rrs) == 1 {
+		return t, nil
+	}
+
+	second, isSOA := manager.ZoneFromSOA(rrs[1])
+	if incremental && isSOA && len(rrs) > 2 && second.Serial == serial {
+		return parseIncremental(zone, rrs, t)
+	}
+
+	t.Full = true
+	t.Records = make(map[string][]manager.Record)
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if rr.Type == dnsmsg.TypeSOA {
+			return nil, fmt.Errorf("unexpected SOA record in transfer of %s", zone)
+		}
+		if r, ok := storable(zone, rr); ok {
+			name := dnsmsg.CanonicalName(rr.Name)
+			t.Records[name] = append(t.Records[name], r)
+		}
+	}
+	return t, nil
+}
+
+// parseIncremental reads the sequences of deletions and additions of an
+// IXFR response (RFC 1995 section 4).
+func parseIncremental(zone string, rrs []dnsmsg.ResourceRecord, t *Transfer) (*Transfer, error) {
+	var entry *manager.JournalEntry
+	adding := false
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if z, ok := manager.ZoneFromSOA(rr); ok {
+			// The old SOA starts the deletions of a change and the new
+			// SOA its additions.
+			if entry == nil || adding {
+				if entry != nil {
+					t.Incremental = append(t.Incremental, *entry)
+				}
+				entry = &manager.JournalEntry{From: z.Serial, Old: z}
+				adding = false
+			} else {
+				entry.To, entry.New = z.Serial, z
+				adding = true
+			}
+			continue
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("malformed incremental transfer of %s", zone)
+		}
+		r, ok := storable(zone, rr)
+		if !ok {
+			continue
+		}
+		zr := manager.ZoneRecord{Name: dnsmsg.CanonicalName(rr.Name), Record: r}
+		if adding {
+			entry.Added = append(entry.Added, zr)
+		} else {
+			entry.Deleted = append(entry.Deleted, zr)
+		}
+	}
+	if entry == nil || !adding {
+		return nil, fmt.Errorf("malformed incremental transfer of %s", zone)
+	}
+	t.Incremental = append(t.Incremental, *entry)
+	return t, nil
+}
+
+// storable converts a transferred record, skipping types that cannot be
+// stored and records outside the zone.
+func storable(zone string, rr dnsmsg.ResourceRecord) (manager.Record, bool) {
+	if !dnsmsg.IsSubdomain(rr.Name, zone) {
+		return manager.Record{}, false
+	}
+	return manager.RecordFromRR(rr)
+}
+
+func newQuery(zone string, t dnsmsg.Type) *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: uint16(rand.Uint32())},
+		Questions: []dnsmsg.Question{{Name: zone, Type: t, Class: dnsmsg.ClassINET}},
+	}
+}
+
+// exchange sends query to the primary and passes every response message
+// to handle until it reports that the response is complete.
+func (c *client) exchange(ctx context.Context, query *dnsmsg.Message, handle func(*dnsmsg.Message) (bool, error)) error {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	var signer *tsig.Signer
+	var req []byte
+	if c.key != nil {
+		if req, signer, err = tsig.SignRequest(*c.key, query, time.Now()); err != nil {
+			return err
+		}
+	} else if req, err = query.Pack(); err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := dnsmsg.WriteStream(conn, req); err != nil {
+		return err
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.timeout))
+		raw, err := dnsmsg.ReadStream(conn)
+		if err != nil {
+			return err
+		}
+		m, err := dnsmsg.Parse(raw)
+		if err != nil {
+			return err
+		}
+		if m.Header.ID != query.Header.ID || !m.Header.Response {
+			return errors.New("response does not match the query")
+		}
+		if signer != nil {
+			if err := signer.Verify(raw, m, time.Now()); err != nil {
+				return err
+			}
+		}
+		if m.Header.RCode != dnsmsg.RCodeSuccess {
+			return fmt.Errorf("primary %s answered %s", c.addr, m.Header.RCode)
+		}
+		done, err := handle(m)
+		if err != nil || done {
+			return err
+		}
+	}
+}
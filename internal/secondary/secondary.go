@@ -0,0 +1,297 @@
+// Package secondary keeps secondary zones in sync with their primaries
+// using the SOA timers, zone transfers and NOTIFY (RFC 1034 section 4.3.5,
+// RFC 1995, RFC 1996).
+package secondary
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/tsig"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ApplyFunc stores a transfer of zone z and returns the zone as stored.
+// An up-to-date transfer only records that z was refreshed.
+type ApplyFunc func(z manager.Zone, t *Transfer) (manager.Zone, error)
+
+// Status describes the synchronisation of a secondary zone.
+type Status struct {
+	Zone        string    `json:"zone"`
+	Serial      uint32    `json:"serial"`
+	Primary     string    `json:"primary,omitempty"`
+	LastCheck   time.Time `json:"last_check,omitzero"`
+	NextCheck   time.Time `json:"next_check,omitzero"`
+	Refreshed   time.Time `json:"refreshed,omitzero"`
+	Expired     bool      `json:"expired"`
+	LastError   string    `json:"last_error,omitempty"`
+	Transfers   int       `json:"transfers"`
+	Incremental int       `json:"incremental_transfers"`
+}
+
+type zoneState struct {
+	zone   manager.Zone
+	notify chan struct{}
+	cancel context.CancelFunc
+	status Status
+}
+
+// Manager runs one refresh loop per secondary zone.
+type Manager struct {
+	apply   ApplyFunc
+	keyring *tsig.Keyring
+	timeout time.Duration
+
+	mu    sync.Mutex
+	ctx   context.Context
+	zones map[string]*zoneState
+}
+
+type Option func(*Manager)
+
+// WithKeyring sets the keys transfers can be signed with.
+func WithKeyring(keyring *tsig.Keyring) Option {
+	return func(m *Manager) {
+		m.keyring = keyring
+	}
+}
+
+// WithTimeout bounds every read and write of a transfer.
+func WithTimeout(timeout time.Duration) Option {
+	return func(m *Manager) {
+		if timeout > 0 {
+			m.timeout = timeout
+		}
+	}
+}
+
+func New(apply ApplyFunc, options ...Option) *Manager {
+	m := &Manager{
+		apply:   apply,
+		keyring: tsig.NewKeyring(),
+		timeout: 10 * time.Second,
+		zones:   make(map[string]*zoneState),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Start runs the refresh loops of the zones set so far, and of those set
+// later, until ctx is done.
+func (m *Manager) Start(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ctx = ctx
+	for _, st := range m.zones {
+		m.run(st)
+	}
+}
+
+// Set starts keeping z in sync, or updates its settings. Zones without
+// primaries are removed.
+func (m *Manager) Set(z manager.Zone) {
+	if !z.Secondary() {
+		m.Remove(z.Name)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.zones[z.Name]
+	if ok && slices.Equal(st.zone.Primaries, z.Primaries) && st.zone.TSIGKey == z.TSIGKey {
+		st.zone = z
+		return
+	}
+	if ok {
+		st.cancel()
+	}
+	st = &zoneState{
+		zone:   z,
+		notify: make(chan struct{}, 1),
+		status: Status{Zone: z.Name, Serial: z.Serial, Refreshed: z.Refreshed},
+	}
+	m.zones[z.Name] = st
+	if m.ctx != nil {
+		m.run(st)
+	}
+}
+
+// Remove stops keeping the zone name in sync.
+func (m *Manager) Remove(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st, ok := m.zones[name]; ok {
+		if st.cancel != nil {
+			st.cancel()
+		}
+		delete(m.zones, name)
+	}
+}
+
+// Notify handles a NOTIFY for the zone name from ip and reports whether
+// it was accepted: the zone must be a secondary and ip one of its
+// primaries. The zone is then refreshed right away (RFC 1996 section 3.7).
+func (m *Manager) Notify(name string, ip net.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.zones[dnsmsg.CanonicalName(name)]
+	if !ok || !slices.ContainsFunc(st.zone.Primaries, func(addr string) bool {
+		host, _, _ := net.SplitHostPort(addr)
+		return net.ParseIP(host).Equal(ip)
+	}) {
+		return false
+	}
+	select {
+	case st.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Status describes the secondary zones sorted by name. It is safe to call
+// on a nil manager.
+func (m *Manager) Status() []Status {
+	if m == nil {
+		return []Status{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Status, 0, len(m.zones))
+	now := time.Now()
+	for _, st := range m.zones {
+		status := st.status
+		status.Expired = st.zone.Expired(now)
+		list = append(list, status)
+	}
+	slices.SortFunc(list, func(a, b Status) int {
+		return strings.Compare(a.Zone, b.Zone)
+	})
+	return list
+}
+
+// run starts the refresh loop of st. It must be called with m.mu held.
+func (m *Manager) run(st *zoneState) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	st.cancel = cancel
+	go m.loop(ctx, st)
+}
+
+// loop refreshes the zone straight away, then again after the SOA refresh
+// interval, or the retry interval when the refresh failed, or whenever a
+// NOTIFY arrives.
+func (m *Manager) loop(ctx context.Context, st *zoneState) {
+	for {
+		wait := m.refresh(ctx, st)
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.mu.Lock()
+		st.status.NextCheck = time.Now().Add(wait)
+		m.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-st.notify:
+			timer.Stop()
+			log.Info().Msgf("Refreshing secondary zone %s after NOTIFY", st.zone.Name)
+		case <-timer.C:
+		}
+	}
+}
+
+// refresh brings the zone up to date with the first primary that answers
+// and returns how long to wait before the next refresh.
+func (m *Manager) refresh(ctx context.Context, st *zoneState) time.Duration {
+	m.mu.Lock()
+	z := st.zone
+	m.mu.Unlock()
+
+	var errs []error
+	for _, primary := range z.Primaries {
+		updated, t, err := m.refreshFrom(ctx, z, primary)
+		if ctx.Err() != nil {
+			return 0
+		}
+
+		m.mu.Lock()
+		st.status.LastCheck = time.Now()
+		st.status.Primary = primary
+		if err != nil {
+			m.mu.Unlock()
+			log.Warn().Msgf("Error refreshing secondary zone %s from %s -> %v", z.Name, primary, err)
+			errs = append(errs, err)
+			continue
+		}
+		st.zone = updated
+		st.status.Serial, st.status.Refreshed, st.status.LastError = updated.Serial, updated.Refreshed, ""
+		if t != nil && t.Full {
+			st.status.Transfers++
+		} else if t != nil && !t.UpToDate() {
+			st.status.Incremental++
+		}
+		m.mu.Unlock()
+		return time.Duration(updated.Refresh) * time.Second
+	}
+
+	err := errors.Join(errs...)
+	m.mu.Lock()
+	st.status.LastError = err.Error()
+	m.mu.Unlock()
+	if z.Expired(time.Now()) {
+		log.Error().Msgf("Secondary zone %s has expired and is not served -> %v", z.Name, err)
+	}
+	return time.Duration(z.Retry) * time.Second
+}
+
+// refreshFrom checks the serial of the primary and transfers the zone when
+// it is newer, or when the zone was never transferred.
+func (m *Manager) refreshFrom(ctx context.Context, z manager.Zone, primary string) (manager.Zone, *Transfer, error) {
+	c := &client{addr: primary, timeout: m.timeout}
+	if z.TSIGKey != "" {
+		key, ok := m.keyring.Get(z.TSIGKey)
+		if !ok {
+			return z, nil, fmt.Errorf("unknown TSIG key %s", z.TSIGKey)
+		}
+		c.key = &key
+	}
+
+	var current *manager.Zone
+	if !z.Refreshed.IsZero() {
+		soa, err := c.querySOA(ctx, z.Name)
+		if err != nil {
+			return z, nil, err
+		}
+		if !manager.SerialGreater(soa.Serial, z.Serial) {
+			updated, err := m.apply(z, &Transfer{SOA: soa})
+			return updated, nil, err
+		}
+		current = &z
+	}
+
+	t, err := c.transfer(ctx, z.Name, current)
+	if err != nil {
+		return z, nil, err
+	}
+	updated, err := m.apply(z, t)
+	if err != nil {
+		return z, t, err
+	}
+	if !t.UpToDate() {
+		log.Info().Msgf("Transferred secondary zone %s serial %d from %s", z.Name, updated.Serial, primary)
+	}
+	return updated, t, nil
+}
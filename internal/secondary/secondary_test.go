@@ -0,0 +1,446 @@
+package secondary
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"dns-server/internal/tsig"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testZone = "example.com"
+
+// version is the contents of the zone at one serial.
+type version struct {
+	soa     manager.Zone
+	records map[string][]manager.Record
+}
+
+func (v version) rrs() []dnsmsg.ResourceRecord {
+	var rrs []dnsmsg.ResourceRecord
+	names := slices.Sorted(maps.Keys(v.records))
+	for _, name := range names {
+		for _, r := range v.records[name] {
+			rr, err := r.RR(name)
+			if err != nil {
+				panic(err)
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// fakePrimary serves the SOA record, AXFR and IXFR of one zone over TCP,
+// sending transfers a few records per message. With a key set every
+// request must be signed with it and every response is signed.
+type fakePrimary struct {
+	t   *testing.T
+	ln  net.Listener
+	key *tsig.Key
+
+	mu       sync.Mutex
+	versions []version
+	// The counters count the requests of each type.
+	soa, axfr, ixfr atomic.Int64
+}
+
+func newPrimary(t *testing.T, key *tsig.Key, first version) *fakePrimary {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePrimary{t: t, ln: ln, key: key, versions: []version{first}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakePrimary) addr() string {
+	return p.ln.Addr().String()
+}
+
+// publish makes the next version of the zone current.
+func (p *fakePrimary) publish(records map[string][]manager.Record) version {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last := p.versions[len(p.versions)-1]
+	soa := last.soa
+	soa.Serial++
+	v := version{soa: soa, records: records}
+	p.versions = append(p.versions, v)
+	return v
+}
+
+func (p *fakePrimary) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		raw, err := dnsmsg.ReadStream(conn)
+		if err != nil {
+			return
+		}
+		query, err := dnsmsg.Parse(raw)
+		if err != nil {
+			p.t.Errorf("primary received a malformed query: %v", err)
+			return
+		}
+
+		var signer *tsig.Signer
+		if p.key != nil {
+			keyring := tsig.NewKeyring()
+			keyring.Set(*p.key)
+			key, t, err := tsig.Verify(raw, query, keyring, time.Now())
+			if err != nil {
+				p.t.Errorf("primary received a request that does not verify: %v", err)
+				return
+			}
+			signer = tsig.NewSigner(key, t.MAC)
+		}
+
+		for _, m := range p.answer(query) {
+			var b []byte
+			if signer != nil {
+				b, err = signer.Sign(m, dnsmsg.RCodeSuccess, time.Now())
+			} else {
+				b, err = m.Pack()
+			}
+			if err == nil {
+				err = dnsmsg.WriteStream(conn, b)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// answer builds the response messages to query.
+func (p *fakePrimary) answer(query *dnsmsg.Message) []*dnsmsg.Message {
+	p.mu.Lock()
+	versions := slices.Clone(p.versions)
+	p.mu.Unlock()
+	current := versions[len(versions)-1]
+
+	q := query.Questions[0]
+	var rrs []dnsmsg.ResourceRecord
+	switch q.Type {
+	case dnsmsg.TypeSOA:
+		p.soa.Add(1)
+		rrs = []dnsmsg.ResourceRecord{current.soa.SOA()}
+	case dnsmsg.TypeIXFR:
+		p.ixfr.Add(1)
+		rrs = incremental(versions, query)
+	case dnsmsg.TypeAXFR:
+		p.axfr.Add(1)
+	}
+	if rrs == nil {
+		rrs = slices.Concat([]dnsmsg.ResourceRecord{current.soa.SOA()}, current.rrs(), []dnsmsg.ResourceRecord{current.soa.SOA()})
+	}
+
+	// Three records per message, so that transfers span several.
+	var messages []*dnsmsg.Message
+	for len(rrs) > 0 {
+		n := min(3, len(rrs))
+		m := query.Reply()
+		m.Header.Authoritative = true
+		m.Answers, rrs = rrs[:n], rrs[n:]
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// incremental returns the IXFR response from the serial in the authority
+// section of query (RFC 1995 section 4), or nil when the changes since
+// then are not known and the whole zone must be sent.
+func incremental(versions []version, query *dnsmsg.Message) []dnsmsg.ResourceRecord {
+	if len(query.Authority) != 1 {
+		return nil
+	}
+	from, ok := manager.ZoneFromSOA(query.Authority[0])
+	if !ok {
+		return nil
+	}
+	current := versions[len(versions)-1]
+	if from.Serial == current.soa.Serial {
+		return []dnsmsg.ResourceRecord{current.soa.SOA()}
+	}
+	i := slices.IndexFunc(versions, func(v version) bool { return v.soa.Serial == from.Serial })
+	if i < 0 {
+		return nil
+	}
+
+	rrs := []dnsmsg.ResourceRecord{current.soa.SOA()}
+	for ; i < len(versions)-1; i++ {
+		old, next := versions[i], versions[i+1]
+		rrs = append(rrs, old.soa.SOA())
+		rrs = append(rrs, missing(old.rrs(), next.rrs())...)
+		rrs = append(rrs, next.soa.SOA())
+		rrs = append(rrs, missing(next.rrs(), old.rrs())...)
+	}
+	return append(rrs, current.soa.SOA())
+}
+
+// missing returns the records of a that are not in b.
+func missing(a, b []dnsmsg.ResourceRecord) []dnsmsg.ResourceRecord {
+	var out []dnsmsg.ResourceRecord
+	for _, rr := range a {
+		if !slices.ContainsFunc(b, func(o dnsmsg.ResourceRecord) bool { return fmt.Sprint(rr) == fmt.Sprint(o) }) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// store keeps the secondary copy of the zone the way the server stores
+// transfers.
+type store struct {
+	mu      sync.Mutex
+	zone    manager.Zone
+	records map[string][]manager.Record
+}
+
+func (s *store) apply(z manager.Zone, t *Transfer) (manager.Zone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updated := z
+	updated.Refreshed = time.Now()
+	if !t.UpToDate() {
+		primaries := z.Primaries
+		updated = t.SOA
+		updated.Primaries, updated.TSIGKey, updated.Refreshed = primaries, z.TSIGKey, time.Now()
+	}
+	if t.Full {
+		s.records = t.Records
+	}
+	for _, entry := range t.Incremental {
+		if entry.From != z.Serial {
+			return z, errors.New("incremental transfer does not start at the stored serial")
+		}
+		for _, r := range entry.Deleted {
+			s.records[r.Name] = slices.DeleteFunc(s.records[r.Name], r.Record.SameData)
+			if len(s.records[r.Name]) == 0 {
+				delete(s.records, r.Name)
+			}
+		}
+		for _, r := range entry.Added {
+			s.records[r.Name] = append(s.records[r.Name], r.Record)
+		}
+		z.Serial = entry.To
+	}
+	s.zone = updated
+	return updated, nil
+}
+
+func (s *store) serial() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.zone.Serial
+}
+
+// matches reports whether the stored records are those of v.
+func (s *store) matches(v version) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.zone.Serial == v.soa.Serial && len(missing(v.rrs(), version{records: s.records}.rrs())) == 0 &&
+		len(missing(version{records: s.records}.rrs(), v.rrs())) == 0
+}
+
+func firstVersion(refresh, retry, expire uint32) version {
+	soa := manager.Zone{Name: testZone, Serial: 100, Refresh: refresh, Retry: retry, Expire: expire}
+	if err := soa.Normalize(); err != nil {
+		panic(err)
+	}
+	return version{soa: soa, records: map[string][]manager.Record{
+		testZone: {
+			{Type: "NS", TTL: 3600, Target: "ns1.example.com"},
+			{Type: "MX", TTL: 3600, Priority: 10, Target: "mail.example.com"},
+		},
+		"ns1.example.com":  {{Type: "A", TTL: 3600, IP: "192.0.2.53"}},
+		"mail.example.com": {{Type: "A", TTL: 3600, IP: "192.0.2.25"}},
+		"www.example.com":  {{Type: "A", TTL: 300, IP: "192.0.2.80"}, {Type: "AAAA", TTL: 300, IP: "2001:db8::80"}},
+	}}
+}
+
+// startSecondary keeps the zone of p in sync until the test ends.
+func startSecondary(t *testing.T, p *fakePrimary, options ...Option) (*Manager, *store) {
+	t.Helper()
+	s := &store{}
+	m := New(s.apply, append([]Option{WithTimeout(2 * time.Second)}, options...)...)
+	z := manager.Zone{Name: testZone, Primaries: []string{p.addr()}}
+	if p.key != nil {
+		z.TSIGKey = p.key.Name
+	}
+	if err := z.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m.Set(z)
+	m.Start(ctx)
+	return m, s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInitialTransfer(t *testing.T) {
+	key := tsig.Key{Name: "transfer-key", Algorithm: tsig.HMACSHA256, Secret: []byte("0123456789abcdef0123456789abcdef")}
+	if err := key.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	keyring := tsig.NewKeyring()
+	keyring.Set(key)
+
+	first := firstVersion(3600, 600, 86400)
+	p := newPrimary(t, &key, first)
+	m, s := startSecondary(t, p, WithKeyring(keyring))
+
+	waitFor(t, "the initial transfer", func() bool { return s.matches(first) })
+	// A zone that was never transferred is fetched whole, without asking
+	// for the SOA record first.
+	if p.axfr.Load() != 1 || p.ixfr.Load() != 0 || p.soa.Load() != 0 {
+		t.Errorf("primary answered %d AXFR, %d IXFR and %d SOA queries, want one AXFR", p.axfr.Load(), p.ixfr.Load(), p.soa.Load())
+	}
+	waitFor(t, "the status", func() bool { return m.Status()[0].Transfers == 1 })
+	status := m.Status()[0]
+	if status.Serial != first.soa.Serial || status.Primary != p.addr() || status.LastError != "" || status.Expired {
+		t.Errorf("status %+v", status)
+	}
+	if status.NextCheck.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("next check at %v, want one refresh interval away", status.NextCheck)
+	}
+}
+
+func TestIncrementalTransfer(t *testing.T) {
+	// Checked every second, so the serial bump is picked up by the
+	// refresh timer.
+	first := firstVersion(1, 1, 86400)
+	p := newPrimary(t, nil, first)
+	m, s := startSecondary(t, p)
+	waitFor(t, "the initial transfer", func() bool { return s.matches(first) })
+
+	records := maps.Clone(first.records)
+	delete(records, "mail.example.com")
+	records["www.example.com"] = []manager.Record{{Type: "A", TTL: 300, IP: "192.0.2.81"}}
+	records["new.example.com"] = []manager.Record{{Type: "TXT", TTL: 300, Text: manager.Text{"added"}}}
+	second := p.publish(records)
+
+	waitFor(t, "the incremental transfer", func() bool { return s.matches(second) })
+	if p.axfr.Load() != 1 || p.ixfr.Load() != 1 {
+		t.Errorf("primary answered %d AXFR and %d IXFR requests, want one of each", p.axfr.Load(), p.ixfr.Load())
+	}
+	if p.soa.Load() == 0 {
+		t.Error("secondary transferred the zone without checking the serial first")
+	}
+	waitFor(t, "the status", func() bool { return m.Status()[0].Incremental == 1 })
+
+	// Refreshes while the serial is unchanged only query the SOA record.
+	checks := p.soa.Load()
+	waitFor(t, "another refresh", func() bool { return p.soa.Load() > checks })
+	if p.axfr.Load() != 1 || p.ixfr.Load() != 1 {
+		t.Errorf("up to date zone was transferred again: %d AXFR, %d IXFR", p.axfr.Load(), p.ixfr.Load())
+	}
+}
+
+func TestNotifyTriggersRefresh(t *testing.T) {
+	first := firstVersion(3600, 600, 86400)
+	p := newPrimary(t, nil, first)
+	m, s := startSecondary(t, p)
+	waitFor(t, "the initial transfer", func() bool { return s.matches(first) })
+
+	records := maps.Clone(first.records)
+	records["notified.example.com"] = []manager.Record{{Type: "A", TTL: 300, IP: "192.0.2.99"}}
+	second := p.publish(records)
+
+	// Only the primaries of the zone are listened to.
+	if m.Notify(testZone, net.IPv4(192, 0, 2, 1)) {
+		t.Error("NOTIFY from a stranger was accepted")
+	}
+	if m.Notify("other.test", net.IPv4(127, 0, 0, 1)) {
+		t.Error("NOTIFY for an unknown zone was accepted")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s.serial() != first.soa.Serial {
+		t.Fatal("zone was refreshed before the primary sent NOTIFY")
+	}
+
+	if !m.Notify("Example.COM.", net.IPv4(127, 0, 0, 1)) {
+		t.Fatal("NOTIFY from the primary was refused")
+	}
+	waitFor(t, "the refresh after NOTIFY", func() bool { return s.matches(second) })
+	if p.ixfr.Load() != 1 {
+		t.Errorf("primary answered %d IXFR requests, want 1", p.ixfr.Load())
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	// The zone expires one second after the primary was last reached.
+	first := firstVersion(1, 1, 1)
+	p := newPrimary(t, nil, first)
+	m, s := startSecondary(t, p)
+	waitFor(t, "the initial transfer", func() bool { return s.matches(first) })
+	if m.Status()[0].Expired {
+		t.Fatal("zone expired right after its transfer")
+	}
+
+	p.ln.Close()
+	waitFor(t, "the zone to expire", func() bool { return m.Status()[0].Expired })
+	status := m.Status()[0]
+	if status.LastError == "" {
+		t.Error("status of an expired zone has no error")
+	}
+	s.mu.Lock()
+	expired := s.zone.Expired(time.Now())
+	s.mu.Unlock()
+	if !expired {
+		t.Error("stored zone is not expired, so it would still be served")
+	}
+}
+
+func TestParseTransferRejectsMalformed(t *testing.T) {
+	v := firstVersion(3600, 600, 86400)
+	soa := v.soa.SOA()
+	rr := v.rrs()[0]
+
+	// An SOA in the middle of a full transfer.
+	if _, err := parseTransfer(testZone, []dnsmsg.ResourceRecord{soa, rr, soa, rr, soa}, 0, false); err == nil {
+		t.Error("full transfer with an inner SOA record was accepted")
+	}
+	// Deletions without the additions that must follow them.
+	old := v.soa
+	old.Serial--
+	if _, err := parseTransfer(testZone, []dnsmsg.ResourceRecord{soa, old.SOA(), rr, soa}, old.Serial, true); err == nil {
+		t.Error("incremental transfer without additions was accepted")
+	}
+	// Records outside the zone are dropped.
+	outside := dnsmsg.NewRR("example.net", 300, &dnsmsg.A{IP: net.IPv4(192, 0, 2, 1).To4()})
+	tr, err := parseTransfer(testZone, []dnsmsg.ResourceRecord{soa, rr, outside, soa}, 0, false)
+	if err != nil || len(tr.Records) != 1 {
+		t.Errorf("transfer with an out-of-zone record: %+v, %v", tr, err)
+	}
+}
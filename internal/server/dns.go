@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/handlers"
+	"dns-server/internal/metrics"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DNSServer runs the plain DNS listeners. UDP and TCP share the same
+// address and the same query handling in the handlers package.
+type DNSServer struct {
+	addr            string
+	tcpIdleTimeout  time.Duration
+	tcpWriteTimeout time.Duration
+	tcpMaxConns     int
+	tcpMaxPipelined int
+
+	tlsAddr            string
+	certFile           string
+	keyFile            string
+	certReloadInterval time.Duration
+}
+
+type DNSServerOption func(*DNSServer)
+
+func NewDNSServer(options ...DNSServerOption) *DNSServer {
+	s := &DNSServer{
+		addr:            ":53",
+		tcpIdleTimeout:  10 * time.Second,
+		tcpWriteTimeout: 5 * time.Second,
+		tcpMaxConns:     256,
+		tcpMaxPipelined: 16,
+
+		tlsAddr:            ":853",
+		certReloadInterval: time.Minute,
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+func WithDNSAddr(addr string) DNSServerOption {
+	return func(s *DNSServer) {
+		s.addr = addr
+	}
+}
+
+func WithTCPIdleTimeout(timeout time.Duration) DNSServerOption {
+	return func(s *DNSServer) {
+		s.tcpIdleTimeout = timeout
+	}
+}
+
+func WithTCPMaxConnections(maxConns int) DNSServerOption {
+	return func(s *DNSServer) {
+		s.tcpMaxConns = maxConns
+	}
+}
+
+func WithTCPMaxPipelined(maxPipelined int) DNSServerOption {
+	return func(s *DNSServer) {
+		s.tcpMaxPipelined = maxPipelined
+	}
+}
+
+func WithTLSAddr(addr string) DNSServerOption {
+	return func(s *DNSServer) {
+		s.tlsAddr = addr
+	}
+}
+
+func WithTLSCertificate(certFile, keyFile string) DNSServerOption {
+	return func(s *DNSServer) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+func WithCertReloadInterval(interval time.Duration) DNSServerOption {
+	return func(s *DNSServer) {
+		s.certReloadInterval = interval
+	}
+}
+
+func (s *DNSServer) GetTLSAddr() string {
+	return s.tlsAddr
+}
+
+func (s *DNSServer) GetAddr() string {
+	return s.addr
+}
+
+// ServeUDP answers queries received over UDP until ctx is cancelled.
+func (s *DNSServer) ServeUDP(ctx context.Context, wg *sync.WaitGroup) error {
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	log.Info().Msgf("DNS server listening on %s (udp)", s.addr)
+
+	buf := make([]byte, 65535)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+			// Set a read timeout to allow periodic context checking
+			pc.SetReadDeadline(time.Now().Add(1 * time.Second))
+			n, clientAddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					// Timeout occurred, continue to check context
+					continue
+				}
+				// Other error, log and continue
+				log.Error().Msgf("Error reading from connection: %v", err)
+				continue
+			}
+			// The buffer is reused for the next datagram, so the handler
+			// gets its own copy.
+			req := append([]byte(nil), buf[:n]...)
+			wg.Add(1)
+			go handlers.HandleDNSQuery(ctx, wg, pc, clientAddr, req)
+		}
+	}
+}
+
+// ServeTCP answers queries received over TCP until ctx is cancelled.
+func (s *DNSServer) ServeTCP(ctx context.Context, wg *sync.WaitGroup) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("DNS server listening on %s (tcp)", s.addr)
+
+	return s.serveListener(ctx, wg, ln, "tcp", nil)
+}
+
+// serveListener accepts stream connections from ln, enforcing the
+// connection limit, and serves each one on its own goroutine. TLS
+// connections are handshaken first. stats may be nil.
+func (s *DNSServer) serveListener(ctx context.Context, wg *sync.WaitGroup, ln net.Listener, network string, stats *metrics.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	slots := make(chan struct{}, s.tcpMaxConns)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Error().Msgf("Error accepting %s connection: %v", network, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			log.Warn().Msgf("Rejecting %s connection from %s: limit of %d reached", network, conn.RemoteAddr(), s.tcpMaxConns)
+			if stats != nil {
+				stats.ConnectionRejected()
+			}
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if stats != nil {
+				stats.ConnectionOpened()
+				defer stats.ConnectionClosed()
+			}
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if err := s.handshake(ctx, tlsConn, stats); err != nil {
+					log.Debug().Msgf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+			}
+			s.serveStream(ctx, conn, network, stats)
+		}()
+	}
+}
+
+// serveStream reads length-prefixed queries from conn until the client is
+// idle for too long. Queries are processed concurrently, up to the
+// pipelining limit, and each response is written as soon as it is ready,
+// so responses may be returned out of order (RFC 7766 section 6.2.1.1).
+func (s *DNSServer) serveStream(ctx context.Context, conn net.Conn, network string, stats *metrics.Listener) {
+	var inflight sync.WaitGroup
+	defer conn.Close()
+	defer inflight.Wait()
+
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	var writeMu sync.Mutex
+	pipeline := make(chan struct{}, s.tcpMaxPipelined)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.tcpIdleTimeout))
+		req, err := dnsmsg.ReadStream(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					log.Debug().Msgf("Closing stream from %s: %v", conn.RemoteAddr(), err)
+				}
+			}
+			return
+		}
+
+		if stats != nil {
+			stats.Query()
+		}
+
+		pipeline <- struct{}{}
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer func() { <-pipeline }()
+
+			responses := handlers.HandleStreamMessage(ctx, req, conn.RemoteAddr(), network)
+
+			// The messages of a zone transfer must not be interleaved
+			// with other responses.
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			for _, res := range responses {
+				conn.SetWriteDeadline(time.Now().Add(s.tcpWriteTimeout))
+				if err := dnsmsg.WriteStream(conn, res); err != nil {
+					log.Debug().Msgf("Error writing response to %s: %v", conn.RemoteAddr(), err)
+					return
+				}
+			}
+		}()
+	}
+}
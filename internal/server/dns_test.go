@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayResolver answers like answerResolver, after sleeping for names
+// starting with "slow".
+type delayResolver time.Duration
+
+func (d delayResolver) Exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	if strings.HasPrefix(req.Questions[0].Name, "slow") {
+		time.Sleep(time.Duration(d))
+	}
+	return answerResolver{}.Exchange(ctx, req)
+}
+
+// startTCP runs a plain TCP listener with the given options until the test
+// ends.
+func startTCP(t *testing.T, options ...DNSServerOption) string {
+	t.Helper()
+	resolver := constants.Resolver
+	constants.Resolver = delayResolver(200 * time.Millisecond)
+	t.Cleanup(func() { constants.Resolver = resolver })
+
+	addr := freeAddr(t)
+	s := NewDNSServer(append([]DNSServerOption{WithDNSAddr(addr)}, options...)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	done := make(chan error, 1)
+	go func() { done <- s.ServeTCP(ctx, &wg) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("ServeTCP: %v", err)
+		}
+		wg.Wait()
+	})
+
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if i == 100 {
+			t.Fatalf("TCP listener did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pipeline writes one length-prefixed query per name in a single write,
+// with IDs counting from 1, and returns the IDs of the responses in the
+// order they arrive.
+func pipeline(t *testing.T, conn net.Conn, names []string) []uint16 {
+	t.Helper()
+	var frames []byte
+	for i, name := range names {
+		req := &dnsmsg.Message{
+			Header:    dnsmsg.Header{ID: uint16(i + 1), RecursionDesired: true},
+			Questions: []dnsmsg.Question{{Name: name, Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}},
+		}
+		b, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, byte(len(b)>>8), byte(len(b)))
+		frames = append(frames, b...)
+	}
+	if _, err := conn.Write(frames); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []uint16
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for range names {
+		raw, err := dnsmsg.ReadStream(conn)
+		if err != nil {
+			t.Fatalf("after %d responses: %v", len(ids), err)
+		}
+		resp, err := dnsmsg.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.RCode != dnsmsg.RCodeSuccess || len(resp.Answers) != 1 || resp.Questions[0].Name != names[resp.Header.ID-1] {
+			t.Errorf("response %d: %v", resp.Header.ID, resp)
+		}
+		ids = append(ids, resp.Header.ID)
+	}
+	return ids
+}
+
+func TestServeStreamPipelining(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxPipeline int
+		names       []string
+		// inOrder is set when the responses must follow the queries, and
+		// last is the ID of the response that must come last, if any.
+		inOrder bool
+		last    uint16
+	}{
+		{"fast queries", 16, []string{"a.example", "b.example", "c.example"}, false, 0},
+		// A slow query does not hold back the ones behind it.
+		{"slow first", 16, []string{"slow.example", "b.example", "c.example"}, false, 1},
+		// Without pipelining the queries are answered one at a time.
+		{"serial", 1, []string{"slow.example", "b.example", "c.example"}, true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startTCP(t, WithTCPMaxPipelined(tt.maxPipeline))
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			got := pipeline(t, conn, tt.names)
+			seen := map[uint16]bool{}
+			for i, id := range got {
+				seen[id] = true
+				if tt.inOrder && id != uint16(i+1) {
+					t.Errorf("responses in order %v, want the order of the queries", got)
+				}
+			}
+			if len(seen) != len(tt.names) {
+				t.Errorf("responses %v, want one per query", got)
+			}
+			if tt.last != 0 && got[len(got)-1] != tt.last {
+				t.Errorf("responses in order %v, want %d last", got, tt.last)
+			}
+		})
+	}
+}
+
+func TestServeStreamIdleTimeout(t *testing.T) {
+	addr := startTCP(t, WithTCPIdleTimeout(50*time.Millisecond))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The connection stays open while queries keep coming.
+	for i := 0; i < 3; i++ {
+		query(t, conn, uint16(i+1), "example.com")
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection read returned %v, want EOF", err)
+	}
+}
+
+func TestServeStreamConnectionLimit(t *testing.T) {
+	addr := startTCP(t, WithTCPMaxConnections(1))
+	// The probe of startTCP may still hold the only slot for a moment.
+	var first net.Conn
+	for i := 0; first == nil; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err != nil && err != io.EOF {
+			// A rejected connection is closed at once, a served one
+			// waits for a query.
+			first = conn
+			break
+		}
+		conn.Close()
+		if i == 100 {
+			t.Fatal("no connection was accepted")
+		}
+	}
+	defer first.Close()
+	query(t, first, 1, "example.com")
+
+	// The second connection is closed without an answer while the first
+	// one holds the only slot.
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Error("connection over the limit was served")
+	}
+	query(t, first, 2, "example.com")
+}
@@ -20,6 +20,8 @@ type Server struct {
 	annInterval int
 	name        string
 	id          uuid.UUID
+	certFile    string
+	keyFile     string
 }
 
 type ServerOption func(*Server)
@@ -58,6 +60,15 @@ func WithPort(port int) ServerOption {
 	}
 }
 
+// WithHTTPSCertificate serves the backend over HTTPS, which browsers require
+// for DNS over HTTPS.
+func WithHTTPSCertificate(certFile, keyFile string) ServerOption {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
 func (s *Server) GetAddr() string {
 	return s.addr
 }
@@ -104,12 +115,15 @@ func (s *Server) StartBackend() error {
 	// Configure CORS
 	g.Use(cors.New(cors.Config{
 		AllowOrigins:  []string{"*"},                                                           // Allowed origins
-		AllowMethods:  []string{"GET", "POST", "DELETE", "OPTIONS"},                            // Allowed HTTP methods
+		AllowMethods:  []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},                     // Allowed HTTP methods
 		AllowHeaders:  []string{"Origin", "Content-Type", "Authorization"},                     // Allowed headers
 		ExposeHeaders: []string{"Content-Length", "Access-Control-Allow-Origin", "SOAPAction"}, // Headers exposed to the browser
 	}))
 
 	api.HandleFuncs(g)
 	addr := fmt.Sprintf("%s:%d", s.addr, s.port)
+	if s.certFile != "" && s.keyFile != "" {
+		return g.RunTLS(addr, s.certFile, s.keyFile)
+	}
 	return g.Run(addr)
 }
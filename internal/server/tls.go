@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"dns-server/internal/constants"
+	"dns-server/internal/metrics"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// certReloader serves a certificate loaded from disk and reloads it when
+// either file changes, so renewed certificates apply without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the key pair again if either file is newer than the one in
+// use. A broken pair is reported and the previous certificate kept.
+func (r *certReloader) reload() error {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && !modTime.After(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %w", r.certFile, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	log.Info().Msgf("Loaded TLS certificate %s", r.certFile)
+	return nil
+}
+
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				log.Error().Msgf("Error reloading TLS certificate -> %v", err)
+			}
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ServeTLS answers DNS-over-TLS queries (RFC 7858) until ctx is cancelled.
+// Connections are served exactly like plain TCP once the handshake is done.
+func (s *DNSServer) ServeTLS(ctx context.Context, wg *sync.WaitGroup) error {
+	reloader, err := newCertReloader(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	go reloader.watch(ctx, s.certReloadInterval)
+
+	// Session tickets are enabled by default, giving TLS 1.3 resumption.
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"dot"},
+	}
+
+	ln, err := tls.Listen("tcp", s.tlsAddr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("DNS server listening on %s (tls)", s.tlsAddr)
+
+	return s.serveListener(ctx, wg, ln, "tls", constants.DoTMetrics)
+}
+
+// handshake completes the TLS handshake of conn within the idle timeout
+// and records the outcome in stats.
+func (s *DNSServer) handshake(ctx context.Context, conn *tls.Conn, stats *metrics.Listener) error {
+	hsCtx, cancel := context.WithTimeout(ctx, s.tcpIdleTimeout)
+	defer cancel()
+
+	err := conn.HandshakeContext(hsCtx)
+	stats.Handshake(err, conn.ConnectionState().DidResume)
+	return err
+}
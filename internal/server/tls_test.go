@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"dns-server/internal/constants"
+	"dns-server/internal/dnsmsg"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeCert generates a self-signed certificate for localhost with the
+// given serial number and writes it and its key to dir.
+func writeCert(t *testing.T, dir string, serial int64) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Files rewritten within the same second must still look newer.
+	future := time.Now().Add(time.Duration(serial) * time.Second)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile, cert
+}
+
+// answerResolver answers every query with a fixed A record.
+type answerResolver struct{}
+
+func (answerResolver) Exchange(_ context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	resp := req.Reply()
+	resp.Answers = []dnsmsg.ResourceRecord{
+		dnsmsg.NewRR(req.Questions[0].Name, 60, &dnsmsg.A{IP: net.IPv4(192, 0, 2, 53).To4()}),
+	}
+	return resp, nil
+}
+
+// freeAddr returns a local TCP address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startDoT runs a DNS-over-TLS listener with the given certificate files
+// until the test ends.
+func startDoT(t *testing.T, certFile, keyFile string) string {
+	t.Helper()
+	resolver := constants.Resolver
+	constants.Resolver = answerResolver{}
+	t.Cleanup(func() { constants.Resolver = resolver })
+
+	addr := freeAddr(t)
+	s := NewDNSServer(
+		WithTLSAddr(addr),
+		WithTLSCertificate(certFile, keyFile),
+		WithCertReloadInterval(20*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	done := make(chan error, 1)
+	go func() { done <- s.ServeTLS(ctx, &wg) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("ServeTLS: %v", err)
+		}
+		wg.Wait()
+	})
+
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if i == 100 {
+			t.Fatalf("DoT listener did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func clientConfig(roots ...*x509.Certificate) *tls.Config {
+	pool := x509.NewCertPool()
+	for _, c := range roots {
+		pool.AddCert(c)
+	}
+	return &tls.Config{
+		RootCAs:            pool,
+		ServerName:         "localhost",
+		NextProtos:         []string{"dot"},
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+}
+
+// query sends one length-prefixed query over conn and returns the reply.
+func query(t *testing.T, conn net.Conn, id uint16, name string) *dnsmsg.Message {
+	t.Helper()
+	req := &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: name, Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}},
+	}
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 7858 frames messages like TCP: a two byte length, then the
+	// message.
+	if _, err := conn.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	raw, err := dnsmsg.ReadStream(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := dnsmsg.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestDoTQuery(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t, t.TempDir(), 1)
+	addr := startDoT(t, certFile, keyFile)
+	before := constants.DoTMetrics.Snapshot()
+
+	config := clientConfig(cert)
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	state := conn.ConnectionState()
+	if state.Version != tls.VersionTLS13 {
+		t.Errorf("negotiated TLS version %x, want TLS 1.3", state.Version)
+	}
+	if state.NegotiatedProtocol != "dot" {
+		t.Errorf("negotiated ALPN %q, want dot", state.NegotiatedProtocol)
+	}
+
+	// Two queries on one connection, each answered with its own ID.
+	for id := uint16(1); id <= 2; id++ {
+		resp := query(t, conn, id, "example.com")
+		if resp.Header.ID != id || resp.Header.RCode != dnsmsg.RCodeSuccess || len(resp.Answers) != 1 {
+			t.Fatalf("reply %d: %v", id, resp)
+		}
+		if a, ok := resp.Answers[0].Data.(*dnsmsg.A); !ok || !a.IP.Equal(net.IPv4(192, 0, 2, 53)) {
+			t.Errorf("answer %v, want 192.0.2.53", resp.Answers[0])
+		}
+	}
+	conn.Close()
+
+	// The session ticket received on the first connection resumes the
+	// second one.
+	conn, err = tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("second handshake: %v", err)
+	}
+	query(t, conn, 3, "example.com")
+	if !conn.ConnectionState().DidResume {
+		t.Error("second connection did not resume the TLS session")
+	}
+	conn.Close()
+
+	after := constants.DoTMetrics.Snapshot()
+	if after.Handshakes-before.Handshakes != 2 || after.Queries-before.Queries != 3 {
+		t.Errorf("metrics went from %+v to %+v, want 2 handshakes and 3 queries", before, after)
+	}
+	if after.ResumedSessions-before.ResumedSessions != 1 {
+		t.Errorf("resumed sessions went from %d to %d, want one more", before.ResumedSessions, after.ResumedSessions)
+	}
+}
+
+func TestDoTHandshakeFailure(t *testing.T) {
+	certFile, keyFile, _ := writeCert(t, t.TempDir(), 1)
+	addr := startDoT(t, certFile, keyFile)
+	before := constants.DoTMetrics.Snapshot()
+
+	// A client that does not trust the certificate aborts the handshake.
+	_, _, stranger := writeCert(t, t.TempDir(), 2)
+	if conn, err := tls.Dial("tcp", addr, clientConfig(stranger)); err == nil {
+		conn.Close()
+		t.Fatal("handshake with an untrusted certificate succeeded")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for constants.DoTMetrics.Snapshot().HandshakeErrors == before.HandshakeErrors {
+		if time.Now().After(deadline) {
+			t.Fatal("failed handshake was not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDoTCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, first := writeCert(t, dir, 1)
+	addr := startDoT(t, certFile, keyFile)
+
+	served := func(roots ...*x509.Certificate) *big.Int {
+		t.Helper()
+		config := clientConfig(roots...)
+		config.ClientSessionCache = nil
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return nil
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+	if got := served(first); got == nil || got.Int64() != 1 {
+		t.Fatalf("served certificate %v, want serial 1", got)
+	}
+
+	// Replacing the files switches new connections to the new certificate.
+	_, _, second := writeCert(t, dir, 2)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if got := served(first, second); got != nil && got.Int64() == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate was not loaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// A broken pair is reported and the last good certificate kept.
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	time.Sleep(100 * time.Millisecond)
+	if got := served(second); got == nil || got.Int64() != 2 {
+		t.Errorf("served certificate %v after a broken renewal, want serial 2", got)
+	}
+}
+
+func TestCertReloaderKeepsCertificateOnError(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeCert(t, dir, 1)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := r.GetCertificate(nil)
+
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+	if err := r.reload(); err == nil {
+		t.Error("reload of a broken key succeeded")
+	}
+	if got, _ := r.GetCertificate(nil); got != cert {
+		t.Error("broken reload replaced the certificate")
+	}
+
+	if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("loading a missing certificate succeeded")
+	}
+}
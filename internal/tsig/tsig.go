@@ -0,0 +1,454 @@
+// Package tsig authenticates DNS messages with shared secret transaction
+// signatures (RFC 8945).
+package tsig
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"dns-server/internal/dnsmsg"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Algorithm names (RFC 8945 section 6). HMACSHA256 is the one every
+// implementation must support and the default.
+const (
+	HMACSHA1   = "hmac-sha1"
+	HMACSHA224 = "hmac-sha224"
+	HMACSHA256 = "hmac-sha256"
+	HMACSHA384 = "hmac-sha384"
+	HMACSHA512 = "hmac-sha512"
+)
+
+// DefaultFudge is the clock skew, in seconds, allowed between the signer
+// and the verifier.
+const DefaultFudge = 300
+
+var algorithms = map[string]func() hash.Hash{
+	HMACSHA1:   sha1.New,
+	HMACSHA224: sha256.New224,
+	HMACSHA256: sha256.New,
+	HMACSHA384: sha512.New384,
+	HMACSHA512: sha512.New,
+}
+
+var (
+	ErrBadKey  = errors.New("tsig: unknown key or algorithm")
+	ErrBadSig  = errors.New("tsig: signature does not match")
+	ErrBadTime = errors.New("tsig: signature time outside the allowed window")
+	// ErrMACSize is returned for a MAC longer than the algorithm output or
+	// truncated further than RFC 8945 section 5.2.2.1 allows.
+	ErrMACSize = errors.New("tsig: invalid MAC size")
+	// ErrUnsigned is returned by Verify for messages without a TSIG record.
+	ErrUnsigned = errors.New("tsig: message is not signed")
+)
+
+// RCode returns the TSIG error code carried in responses for err.
+func RCode(err error) dnsmsg.RCode {
+	switch {
+	case errors.Is(err, ErrBadKey):
+		return dnsmsg.RCodeBadKey
+	case errors.Is(err, ErrBadTime):
+		return dnsmsg.RCodeBadTime
+	case errors.Is(err, ErrBadSig):
+		return dnsmsg.RCodeBadSig
+	}
+	return dnsmsg.RCodeSuccess
+}
+
+// Key is a shared secret known to both ends of a transaction.
+type Key struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	Secret    []byte `json:"secret"`
+}
+
+// Normalize canonicalises the key and algorithm names and checks that the
+// algorithm is supported.
+func (k *Key) Normalize() error {
+	k.Name = dnsmsg.CanonicalName(strings.TrimSpace(k.Name))
+	if _, err := dnsmsg.SplitLabels(k.Name); err != nil || k.Name == "" {
+		return fmt.Errorf("invalid key name %q", k.Name)
+	}
+	k.Algorithm = dnsmsg.CanonicalName(strings.TrimSpace(k.Algorithm))
+	if k.Algorithm == "" {
+		k.Algorithm = HMACSHA256
+	}
+	if _, ok := algorithms[k.Algorithm]; !ok {
+		return fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+	}
+	if len(k.Secret) == 0 {
+		return fmt.Errorf("key %s has no secret", k.Name)
+	}
+	return nil
+}
+
+func (k Key) mac() hash.Hash {
+	return hmac.New(algorithms[k.Algorithm], k.Secret)
+}
+
+// GenerateSecret returns a random secret for algorithm, as long as its
+// output. An empty algorithm means HMACSHA256.
+func GenerateSecret(algorithm string) ([]byte, error) {
+	algorithm = dnsmsg.CanonicalName(strings.TrimSpace(algorithm))
+	if algorithm == "" {
+		algorithm = HMACSHA256
+	}
+	h, ok := algorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	secret := make([]byte, h().Size())
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Keyring holds the keys messages may be signed with, by name.
+type Keyring struct {
+	keys map[string]Key
+	mu   sync.RWMutex
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[string]Key),
+	}
+}
+
+// Set adds or replaces a key.
+func (r *Keyring) Set(k Key) error {
+	if err := k.Normalize(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[k.Name] = k
+	return nil
+}
+
+// Remove deletes the key name and reports whether it existed.
+func (r *Keyring) Remove(name string) bool {
+	name = dnsmsg.CanonicalName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.keys[name]
+	delete(r.keys, name)
+	return ok
+}
+
+// Get returns the key called name.
+func (r *Keyring) Get(name string) (Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	k, ok := r.keys[dnsmsg.CanonicalName(name)]
+	return k, ok
+}
+
+// List returns the keys sorted by name.
+func (r *Keyring) List() []Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]Key, 0, len(r.keys))
+	for _, k := range r.keys {
+		list = append(list, k)
+	}
+	slices.SortFunc(list, func(a, b Key) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+// Find returns the TSIG record of msg, which must be the last record of
+// the additional section, and its owner name.
+func Find(msg *dnsmsg.Message) (string, *dnsmsg.TSIG, bool) {
+	if len(msg.Additional) == 0 {
+		return "", nil, false
+	}
+	rr := msg.Additional[len(msg.Additional)-1]
+	t, ok := rr.Data.(*dnsmsg.TSIG)
+	if !ok || rr.Type != dnsmsg.TypeTSIG {
+		return "", nil, false
+	}
+	return rr.Name, t, true
+}
+
+// Verify checks the signature of a request. raw is the message as
+// received and msg its parsed form. On success it returns the key that
+// signed the request and its TSIG record, which responses are signed
+// against. When the key is known but the signature fails, the key and
+// record are returned with the error so that the error response can be
+// signed where RFC 8945 requires it.
+func Verify(raw []byte, msg *dnsmsg.Message, keyring *Keyring, now time.Time) (Key, *dnsmsg.TSIG, error) {
+	name, t, ok := Find(msg)
+	if !ok {
+		return Key{}, nil, ErrUnsigned
+	}
+	key, ok := keyring.Get(name)
+	if !ok || key.Algorithm != dnsmsg.CanonicalName(t.Algorithm) {
+		return Key{}, t, ErrBadKey
+	}
+
+	unsigned, err := dnsmsg.WithoutLastRecord(raw)
+	if err != nil {
+		return key, t, err
+	}
+	binary.BigEndian.PutUint16(unsigned, t.OriginalID)
+
+	h := key.mac()
+	h.Write(unsigned)
+	writeVariables(h, key, t)
+	if err := checkMAC(h.Sum(nil), t.MAC); err != nil {
+		return key, t, err
+	}
+	if !inWindow(t, now) {
+		return key, t, ErrBadTime
+	}
+	return key, t, nil
+}
+
+// checkMAC compares a received MAC with the computed one. A MAC may be
+// truncated to half the algorithm output, but not below 10 bytes (RFC 8945
+// section 5.2.2.1).
+func checkMAC(computed, mac []byte) error {
+	if len(mac) > len(computed) || len(mac) < max(10, len(computed)/2) {
+		return ErrMACSize
+	}
+	if !hmac.Equal(computed[:len(mac)], mac) {
+		return ErrBadSig
+	}
+	return nil
+}
+
+func inWindow(t *dnsmsg.TSIG, now time.Time) bool {
+	signed := int64(t.TimeSigned)
+	diff := now.Unix() - signed
+	return diff <= int64(t.Fudge) && -diff <= int64(t.Fudge)
+}
+
+// Signer signs the responses to a request. A response that spans several
+// messages, such as a zone transfer, is signed by calling Sign for every
+// message in order, each signature covering the one before it (RFC 8945
+// section 5.3.1).
+type Signer struct {
+	key   Key
+	prior []byte
+	first bool
+	// pending holds the messages received without a TSIG record since the
+	// last signed one, which the next signature covers.
+	pending  []byte
+	unsigned int
+}
+
+// NewSigner returns a signer for the responses to a request that carried
+// requestMAC, or for a request when requestMAC is nil.
+func NewSigner(key Key, requestMAC []byte) *Signer {
+	return &Signer{key: key, prior: requestMAC, first: true}
+}
+
+// Sign appends a TSIG record to msg and returns the packed result. rcode
+// is the TSIG error to report, normally RCodeSuccess.
+func (s *Signer) Sign(msg *dnsmsg.Message, rcode dnsmsg.RCode, now time.Time) ([]byte, error) {
+	unsigned, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &dnsmsg.TSIG{
+		Algorithm:  s.key.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      DefaultFudge,
+		OriginalID: msg.Header.ID,
+		Error:      rcode,
+	}
+	if rcode == dnsmsg.RCodeBadTime {
+		// The server time lets the client see how far off its clock is.
+		t.OtherData = binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))[2:]
+	}
+
+	h := s.key.mac()
+	if s.prior != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(s.prior))))
+		h.Write(s.prior)
+	}
+	h.Write(unsigned)
+	if s.first {
+		writeVariables(h, s.key, t)
+	} else {
+		writeTimers(h, t)
+	}
+	t.MAC = h.Sum(nil)
+	s.prior, s.first = t.MAC, false
+
+	signed := *msg
+	signed.Additional = append(slices.Clip(msg.Additional), dnsmsg.ResourceRecord{
+		Name:  s.key.Name,
+		Type:  dnsmsg.TypeTSIG,
+		Class: dnsmsg.ClassANY,
+		Data:  t,
+	})
+	return signed.Pack()
+}
+
+// SignLimit is Sign for responses that must fit in limit bytes, such as
+// UDP responses. The message is cut down as by PackLimit, leaving room for
+// the TSIG record, before it is signed.
+func (s *Signer) SignLimit(msg *dnsmsg.Message, rcode dnsmsg.RCode, now time.Time, limit int) ([]byte, error) {
+	b, err := msg.PackLimit(limit - s.recordSize(rcode))
+	if err != nil {
+		return nil, err
+	}
+	trimmed, err := dnsmsg.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	return s.Sign(trimmed, rcode, now)
+}
+
+// recordSize returns the size of the TSIG record Sign adds.
+func (s *Signer) recordSize(rcode dnsmsg.RCode) int {
+	size := len(wireName(s.key.Name)) + 10 + len(wireName(s.key.Algorithm)) + 16 + s.key.mac().Size()
+	if rcode == dnsmsg.RCodeBadTime {
+		size += 6
+	}
+	return size
+}
+
+// SignRequest signs a request with key and returns it packed, along with
+// the signer its responses are verified with.
+func SignRequest(key Key, msg *dnsmsg.Message, now time.Time) ([]byte, *Signer, error) {
+	s := NewSigner(key, nil)
+	b, err := s.Sign(msg, dnsmsg.RCodeSuccess, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, NewSigner(key, s.MAC()), nil
+}
+
+// MAC returns the signature of the last message signed or verified, which
+// the responses to a signed request are verified against.
+func (s *Signer) MAC() []byte {
+	return s.prior
+}
+
+// maxUnsigned is how many messages of a multi-message response may go
+// without a TSIG record (RFC 8945 section 5.3.1).
+const maxUnsigned = 99
+
+// Verify checks the signature of the next message of a response, where
+// raw is the message as received and msg its parsed form. Only the first
+// message must be signed; the ones in between signed messages are covered
+// by the next signature.
+func (s *Signer) Verify(raw []byte, msg *dnsmsg.Message, now time.Time) error {
+	name, t, ok := Find(msg)
+	if !ok {
+		if s.first || s.unsigned >= maxUnsigned {
+			return ErrUnsigned
+		}
+		s.pending = append(s.pending, raw...)
+		s.unsigned++
+		return nil
+	}
+	if t.Error != dnsmsg.RCodeSuccess && t.Error != dnsmsg.RCodeBadTime {
+		return rcodeError(t.Error)
+	}
+	if dnsmsg.CanonicalName(name) != s.key.Name || dnsmsg.CanonicalName(t.Algorithm) != s.key.Algorithm {
+		return ErrBadKey
+	}
+
+	unsigned, err := dnsmsg.WithoutLastRecord(raw)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(unsigned, t.OriginalID)
+
+	h := s.key.mac()
+	if s.prior != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(s.prior))))
+		h.Write(s.prior)
+	}
+	h.Write(s.pending)
+	h.Write(unsigned)
+	if s.first {
+		writeVariables(h, s.key, t)
+	} else {
+		writeTimers(h, t)
+	}
+	if err := checkMAC(h.Sum(nil), t.MAC); err != nil {
+		return err
+	}
+	s.prior, s.first, s.pending, s.unsigned = t.MAC, false, nil, 0
+
+	if t.Error == dnsmsg.RCodeBadTime || !inWindow(t, now) {
+		return ErrBadTime
+	}
+	return nil
+}
+
+func rcodeError(rcode dnsmsg.RCode) error {
+	switch rcode {
+	case dnsmsg.RCodeBadKey:
+		return ErrBadKey
+	case dnsmsg.RCodeBadTime:
+		return ErrBadTime
+	}
+	return ErrBadSig
+}
+
+// writeVariables adds the TSIG variables of RFC 8945 section 4.3.3 to h.
+func writeVariables(h hash.Hash, key Key, t *dnsmsg.TSIG) {
+	h.Write(wireName(key.Name))
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(dnsmsg.ClassANY)))
+	h.Write(binary.BigEndian.AppendUint32(nil, 0))
+	h.Write(wireName(t.Algorithm))
+	writeTimers(h, t)
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(t.Error)))
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(t.OtherData))))
+	h.Write(t.OtherData)
+}
+
+// writeTimers adds the time signed and fudge, which is all that later
+// messages of a multi-message response cover besides the data.
+func writeTimers(h hash.Hash, t *dnsmsg.TSIG) {
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(t.TimeSigned>>32)))
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(t.TimeSigned)))
+	h.Write(binary.BigEndian.AppendUint16(nil, t.Fudge))
+}
+
+// wireName returns name in canonical, uncompressed wire form.
+func wireName(name string) []byte {
+	labels, _ := dnsmsg.SplitLabels(dnsmsg.CanonicalName(name))
+	var b []byte
+	for _, l := range labels {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// ErrorRecord returns the unsigned TSIG record answering a request whose
+// key is unknown or whose signature failed (RFC 8945 section 5.2.3).
+func ErrorRecord(name string, req *dnsmsg.TSIG, rcode dnsmsg.RCode, id uint16, now time.Time) dnsmsg.ResourceRecord {
+	return dnsmsg.ResourceRecord{
+		Name:  name,
+		Type:  dnsmsg.TypeTSIG,
+		Class: dnsmsg.ClassANY,
+		Data: &dnsmsg.TSIG{
+			Algorithm:  req.Algorithm,
+			TimeSigned: uint64(now.Unix()),
+			Fudge:      DefaultFudge,
+			OriginalID: id,
+			Error:      rcode,
+		},
+	}
+}
@@ -0,0 +1,314 @@
+package tsig
+
+import (
+	"dns-server/internal/dnsmsg"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+var allAlgorithms = []string{HMACSHA1, HMACSHA224, HMACSHA256, HMACSHA384, HMACSHA512}
+
+// signedAt is the time the test vectors were signed at.
+var signedAt = time.Unix(1700000000, 0)
+
+func testKey(t *testing.T, algorithm string) Key {
+	t.Helper()
+	k := Key{Name: "test-key.", Algorithm: algorithm, Secret: []byte("0123456789abcdef0123456789abcdef")}
+	if err := k.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func testKeyring(t *testing.T, keys ...Key) *Keyring {
+	t.Helper()
+	keyring := NewKeyring()
+	for _, k := range keys {
+		if err := keyring.Set(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keyring
+}
+
+func testRequest() *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: "example.com", Type: dnsmsg.TypeSOA, Class: dnsmsg.ClassINET}},
+	}
+}
+
+func testResponse() *dnsmsg.Message {
+	m := testRequest()
+	m.Header.Response, m.Header.Authoritative = true, true
+	return m
+}
+
+func parse(t *testing.T, raw []byte) *dnsmsg.Message {
+	t.Helper()
+	m, err := dnsmsg.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func macOf(t *testing.T, raw []byte) []byte {
+	t.Helper()
+	_, rr, ok := Find(parse(t, raw))
+	if !ok {
+		t.Fatal("signed message has no TSIG record")
+	}
+	return rr.MAC
+}
+
+// TestVectors checks the MACs against ones computed independently over
+// the digest input laid out in RFC 8945 section 4.3.3: the message, the
+// key name, class ANY, TTL 0, the algorithm name, the 48-bit time signed,
+// the fudge, the error and the empty other data.
+func TestVectors(t *testing.T) {
+	vectors := map[string]string{
+		HMACSHA1:   "3b51283aa64ff93600c451ed03a667f3a2156130",
+		HMACSHA224: "359f51d96bdaa936f4154c90f94329ad5b5d57bcef64142c85708fc2",
+		HMACSHA256: "0b14a36b1c9305d1a70b8e025cde30800f3d64ccb2848b1ee1e026fce7278e60",
+		HMACSHA384: "d9f56c7ae7aff5c0789c387b78e05a3e8d3d8cd42f607a82167d3bcf379a35243a32479f69727df6017a9b782ec95efb",
+		HMACSHA512: "eb5f5f1e94221c8bb2c9a07120654fdb715438f16c17c536658efb529780ec6801350547b7c6a57083819e4fc667afd7ccc8e783961072726b2afc7b5fa7cd35",
+	}
+	for _, algorithm := range allAlgorithms {
+		raw, _, err := SignRequest(testKey(t, algorithm), testRequest(), signedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(macOf(t, raw)); got != vectors[algorithm] {
+			t.Errorf("%s MAC %s, want %s", algorithm, got, vectors[algorithm])
+		}
+	}
+}
+
+// TestMultiMessageVectors checks a response of two messages: the first
+// covers the request MAC and the TSIG variables, the second the MAC of
+// the first and only the timers (RFC 8945 section 5.3.1).
+func TestMultiMessageVectors(t *testing.T) {
+	key := testKey(t, HMACSHA256)
+	raw, client, err := SignRequest(key, testRequest(), signedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewSigner(key, macOf(t, raw))
+	want := []string{
+		"7365aec089b8f296035fb3c0d917d06fea4f7a7a4642ce8033b0c5b96b551597",
+		"6620e0c276ef8810b984e007e5239c7a3853e0baf6a3eb62871afef861b60fb4",
+	}
+	for i, w := range want {
+		now := signedAt.Add(time.Duration(i) * time.Second)
+		res, err := server.Sign(testResponse(), dnsmsg.RCodeSuccess, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(macOf(t, res)); got != w {
+			t.Errorf("message %d MAC %s, want %s", i+1, got, w)
+		}
+		if err := client.Verify(res, parse(t, res), now); err != nil {
+			t.Errorf("message %d does not verify: %v", i+1, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, algorithm := range allAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			key := testKey(t, algorithm)
+			now := time.Now()
+			raw, client, err := SignRequest(key, testRequest(), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, rr, err := Verify(raw, parse(t, raw), testKeyring(t, key), now)
+			if err != nil {
+				t.Fatalf("request does not verify: %v", err)
+			}
+			if got.Name != "test-key" || rr.OriginalID != 0x1234 || rr.Fudge != DefaultFudge {
+				t.Errorf("verified with key %q and record %+v", got.Name, rr)
+			}
+
+			res, err := NewSigner(got, rr.MAC).Sign(testResponse(), dnsmsg.RCodeSuccess, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Verify(res, parse(t, res), now); err != nil {
+				t.Errorf("response does not verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	key := testKey(t, HMACSHA256)
+	keyring := testKeyring(t, key)
+	raw, _, err := SignRequest(key, testRequest(), signedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first label of the question starts right after the header.
+	tampered := append([]byte(nil), raw...)
+	tampered[13] ^= 0x20
+	// A forwarder may change the ID, which the original ID stands in for.
+	newID := append([]byte(nil), raw...)
+	newID[0], newID[1] = 0xab, 0xcd
+
+	other := key
+	other.Secret = []byte("another secret of the right size!")
+	otherRaw, _, _ := SignRequest(other, testRequest(), signedAt)
+	sha1Key := testKey(t, HMACSHA1)
+	sha1Raw, _, _ := SignRequest(sha1Key, testRequest(), signedAt)
+	unknown := testKey(t, HMACSHA256)
+	unknown.Name = "unknown-key"
+	unknownRaw, _, _ := SignRequest(unknown, testRequest(), signedAt)
+	unsigned, _ := testRequest().Pack()
+
+	fudge := time.Duration(DefaultFudge) * time.Second
+	tests := []struct {
+		name  string
+		raw   []byte
+		now   time.Time
+		err   error
+		rcode dnsmsg.RCode
+	}{
+		{"valid", raw, signedAt, nil, dnsmsg.RCodeSuccess},
+		{"new ID", newID, signedAt, nil, dnsmsg.RCodeSuccess},
+		{"edge of the fudge", raw, signedAt.Add(fudge), nil, dnsmsg.RCodeSuccess},
+		{"edge of the fudge before", raw, signedAt.Add(-fudge), nil, dnsmsg.RCodeSuccess},
+		{"tampered", tampered, signedAt, ErrBadSig, dnsmsg.RCodeBadSig},
+		{"wrong secret", otherRaw, signedAt, ErrBadSig, dnsmsg.RCodeBadSig},
+		{"after the fudge", raw, signedAt.Add(fudge + time.Second), ErrBadTime, dnsmsg.RCodeBadTime},
+		{"before the fudge", raw, signedAt.Add(-fudge - time.Second), ErrBadTime, dnsmsg.RCodeBadTime},
+		{"wrong algorithm", sha1Raw, signedAt, ErrBadKey, dnsmsg.RCodeBadKey},
+		{"unknown key", unknownRaw, signedAt, ErrBadKey, dnsmsg.RCodeBadKey},
+		{"unsigned", unsigned, signedAt, ErrUnsigned, dnsmsg.RCodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Verify(tt.raw, parse(t, tt.raw), keyring, tt.now)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+			if got := RCode(err); got != tt.rcode {
+				t.Errorf("RCode %s, want %s", got, tt.rcode)
+			}
+		})
+	}
+}
+
+func TestTruncatedMAC(t *testing.T) {
+	key := testKey(t, HMACSHA256)
+	keyring := testKeyring(t, key)
+	raw, _, err := SignRequest(key, testRequest(), signedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// withMAC replaces the MAC of the signed request.
+	withMAC := func(mac []byte) []byte {
+		m := parse(t, raw)
+		m.Additional[len(m.Additional)-1].Data.(*dnsmsg.TSIG).MAC = mac
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	mac := macOf(t, raw)
+
+	tests := []struct {
+		name string
+		mac  []byte
+		err  error
+	}{
+		{"half", mac[:16], nil},
+		{"shorter than half", mac[:15], ErrMACSize},
+		{"longer", append(mac, 0), ErrMACSize},
+		{"half and wrong", append(append([]byte(nil), mac[:15]...), mac[15]^1), ErrBadSig},
+	}
+	for _, tt := range tests {
+		b := withMAC(tt.mac)
+		if _, _, err := Verify(b, parse(t, b), keyring, signedAt); !errors.Is(err, tt.err) {
+			t.Errorf("%s MAC: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestResponseVerification(t *testing.T) {
+	key := testKey(t, HMACSHA256)
+	raw, client, err := SignRequest(key, testRequest(), signedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSigner(key, macOf(t, raw))
+	first, _ := server.Sign(testResponse(), dnsmsg.RCodeSuccess, signedAt)
+	second, _ := server.Sign(testResponse(), dnsmsg.RCodeSuccess, signedAt)
+
+	// Later messages are chained to the ones before, so they do not
+	// verify out of order.
+	if err := client.Verify(second, parse(t, second), signedAt); !errors.Is(err, ErrBadSig) {
+		t.Errorf("second message before the first: error %v, want %v", err, ErrBadSig)
+	}
+
+	_, client, _ = SignRequest(key, testRequest(), signedAt)
+	unsigned, _ := testResponse().Pack()
+	if err := client.Verify(unsigned, parse(t, unsigned), signedAt); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned first message: error %v, want %v", err, ErrUnsigned)
+	}
+
+	// A response signed against another request does not verify.
+	_, client, _ = SignRequest(key, testRequest(), signedAt.Add(time.Second))
+	if err := client.Verify(first, parse(t, first), signedAt); !errors.Is(err, ErrBadSig) {
+		t.Errorf("response to another request: error %v, want %v", err, ErrBadSig)
+	}
+
+	// A BADTIME error response reports the clock of the server.
+	_, client, _ = SignRequest(key, testRequest(), signedAt)
+	server = NewSigner(key, macOf(t, raw))
+	late := signedAt.Add(time.Hour)
+	badTime, err := server.Sign(testResponse(), dnsmsg.RCodeBadTime, late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Verify(badTime, parse(t, badTime), signedAt); !errors.Is(err, ErrBadTime) {
+		t.Errorf("BADTIME response: error %v, want %v", err, ErrBadTime)
+	}
+	_, rr, _ := Find(parse(t, badTime))
+	if len(rr.OtherData) != 6 || uint64(rr.OtherData[2])<<24|uint64(rr.OtherData[3])<<16|uint64(rr.OtherData[4])<<8|uint64(rr.OtherData[5]) != uint64(late.Unix()) {
+		t.Errorf("BADTIME other data %x, want the server time %d", rr.OtherData, late.Unix())
+	}
+}
+
+func TestSignLimit(t *testing.T) {
+	key := testKey(t, HMACSHA512)
+	resp := testResponse()
+	for i := 0; i < 40; i++ {
+		resp.Answers = append(resp.Answers, dnsmsg.NewRR("example.com", 300, &dnsmsg.TXT{Text: []string{"some text that takes up room"}}))
+	}
+	raw, _, err := SignRequest(key, testRequest(), signedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSigner(key, macOf(t, raw)).SignLimit(resp, dnsmsg.RCodeSuccess, signedAt, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > 512 {
+		t.Errorf("signed response is %d bytes, limit 512", len(b))
+	}
+	m := parse(t, b)
+	if !m.Header.Truncated {
+		t.Error("cut down response is not marked truncated")
+	}
+	if _, _, ok := Find(m); !ok {
+		t.Error("cut down response lost its TSIG record")
+	}
+}
@@ -0,0 +1,174 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"dns-server/internal/dnsmsg"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// dohMediaType is the content type of wire-format DoH messages (RFC 8484).
+const dohMediaType = "application/dns-message"
+
+// dialer connects to host:port. When bootstrap addresses are given they are
+// dialled in order instead of resolving host, so that an upstream named by
+// hostname does not depend on the system resolver, which may be this very
+// server.
+type dialer struct {
+	host      string
+	port      string
+	bootstrap []string
+}
+
+func (d *dialer) dial(ctx context.Context, network string) (net.Conn, error) {
+	var nd net.Dialer
+	if len(d.bootstrap) == 0 {
+		return nd.DialContext(ctx, network, net.JoinHostPort(d.host, d.port))
+	}
+
+	var errs []error
+	for _, ip := range d.bootstrap {
+		conn, err := nd.DialContext(ctx, network, net.JoinHostPort(ip, d.port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// rootCAs are the certificate authorities upstream certificates are
+// verified against; nil uses the system roots.
+var rootCAs *x509.CertPool
+
+// tlsConfig verifies the upstream certificate against serverName and caches
+// sessions so reconnects can resume.
+func tlsConfig(serverName string, nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            rootCAs,
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         nextProtos,
+		ClientSessionCache: tls.NewLRUClientSessionCache(maxIdleConns),
+	}
+}
+
+// newTLSTransport sends queries over DNS over TLS (RFC 7858), reusing
+// connections between queries.
+func newTLSTransport(d *dialer, serverName string) *streamTransport {
+	cfg := tlsConfig(serverName, "dot")
+	return &streamTransport{pool: &connPool{
+		dial: func(ctx context.Context) (net.Conn, error) {
+			raw, err := d.dial(ctx, "tcp")
+			if err != nil {
+				return nil, err
+			}
+			conn := tls.Client(raw, cfg)
+			if err := conn.HandshakeContext(ctx); err != nil {
+				raw.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+		idle: make(chan net.Conn, maxIdleConns),
+	}}
+}
+
+// httpsTransport sends queries as DNS over HTTPS POST requests (RFC 8484).
+// The HTTP client keeps connections alive and multiplexes over HTTP/2.
+type httpsTransport struct {
+	url    string
+	client *http.Client
+	closed atomic.Bool
+}
+
+func newHTTPSTransport(endpoint string, d *dialer, serverName string) *httpsTransport {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.dial(ctx, network)
+		},
+		TLSClientConfig:     tlsConfig(serverName),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &httpsTransport{url: endpoint, client: &http.Client{Transport: tr}}
+}
+
+func (t *httpsTransport) exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	httpResp, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		httpResp.Body.Close()
+		if t.closed.Load() {
+			// The connection went back to a transport that was closed
+			// meanwhile.
+			t.client.CloseIdleConnections()
+		}
+	}()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream %s answered HTTP %d", t.url, httpResp.StatusCode)
+	}
+	if ct := httpResp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("upstream %s answered with content type %q", t.url, ct)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, 0xFFFF+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > 0xFFFF {
+		return nil, dnsmsg.ErrTooLarge
+	}
+	resp, err := dnsmsg.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !matches(req, resp) {
+		return nil, errMismatch
+	}
+	return resp, nil
+}
+
+func (t *httpsTransport) close() {
+	t.closed.Store(true)
+	t.client.CloseIdleConnections()
+}
+
+// parseHTTPS validates a DoH endpoint URL and returns its host and port.
+func parseHTTPS(raw string) (host, port string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid DoH upstream %q", raw)
+	}
+	port = u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return u.Hostname(), port, nil
+}
@@ -0,0 +1,261 @@
+package upstream
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"dns-server/internal/dnsmsg"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for dns.test, which is
+// also made the only trusted root until the test ends.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := rootCAs
+	rootCAs = x509.NewCertPool()
+	rootCAs.AddCert(cert)
+	t.Cleanup(func() { rootCAs = saved })
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// fakeDoT is a DNS over TLS upstream on a local port that answers every
+// query with 192.0.2.53.
+type fakeDoT struct {
+	port  string
+	conns atomic.Int64
+}
+
+func newFakeDoT(t *testing.T) *fakeDoT {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{"dot"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	s := &fakeDoT{port: port}
+
+	reply := answer("192.0.2.53", 0)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					raw, err := dnsmsg.ReadStream(conn)
+					if err != nil {
+						return
+					}
+					req, err := dnsmsg.Parse(raw)
+					if err != nil {
+						return
+					}
+					b, _ := reply(req, "tls").Pack()
+					dnsmsg.WriteStream(conn, b)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// newFakeDoH runs a DNS over HTTPS upstream on a local port. handle writes
+// the HTTP response to each query.
+func newFakeDoH(t *testing.T, handle func(w http.ResponseWriter, req *dnsmsg.Message)) string {
+	t.Helper()
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		req, err := dnsmsg.Parse(raw)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohMediaType || err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		handle(w, req)
+	}))
+	s.EnableHTTP2 = true
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	return port
+}
+
+func writeDoH(w http.ResponseWriter, contentType string, resp *dnsmsg.Message) {
+	b, _ := resp.Pack()
+	w.Header().Set("Content-Type", contentType)
+	w.Write(b)
+}
+
+func TestTLSUpstream(t *testing.T) {
+	s := newFakeDoT(t)
+
+	tests := []struct {
+		name    string
+		address string
+		opts    []Option
+		ok      bool
+	}{
+		{"bootstrap address", "tls://dns.test:" + s.port, []Option{WithBootstrap([]string{"127.0.0.1"})}, true},
+		// Unreachable bootstrap addresses are skipped.
+		{"second bootstrap address", "tls://dns.test:" + s.port, []Option{WithBootstrap([]string{"127.0.0.2", "127.0.0.1"})}, true},
+		{"ip address with server name", "tls://127.0.0.1:" + s.port, []Option{WithServerName("dns.test")}, true},
+		{"certificate for another name", "tls://127.0.0.1:" + s.port, []Option{WithServerName("other.test")}, false},
+		{"ip address without server name", "tls://127.0.0.1:" + s.port, nil, false},
+		{"no bootstrap address works", "tls://dns.test:" + s.port, []Option{WithBootstrap([]string{"127.0.0.2"})}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := New(tt.address, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			resp, err := u.Exchange(ctx, testQuery(1))
+			if (err == nil) != tt.ok {
+				t.Fatalf("Exchange error %v, want success %t", err, tt.ok)
+			}
+			if err == nil && answeredBy(t, resp) != "192.0.2.53" {
+				t.Errorf("reply %v", resp)
+			}
+		})
+	}
+}
+
+func TestTLSUpstreamReusesConnection(t *testing.T) {
+	s := newFakeDoT(t)
+	u, err := New("tls://dns.test:"+s.port, WithBootstrap([]string{"127.0.0.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	for id := uint16(1); id <= 3; id++ {
+		resp, err := u.Exchange(context.Background(), testQuery(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.ID != id {
+			t.Errorf("reply ID %d, want %d", resp.Header.ID, id)
+		}
+	}
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("%d connections for 3 queries, want 1", got)
+	}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle func(w http.ResponseWriter, req *dnsmsg.Message)
+		ok     bool
+	}{
+		{"answer", func(w http.ResponseWriter, req *dnsmsg.Message) {
+			writeDoH(w, dohMediaType, answer("192.0.2.53", 0)(req, "https"))
+		}, true},
+		{"http error", func(w http.ResponseWriter, _ *dnsmsg.Message) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}, false},
+		{"wrong content type", func(w http.ResponseWriter, req *dnsmsg.Message) {
+			writeDoH(w, "application/json", answer("192.0.2.53", 0)(req, "https"))
+		}, false},
+		{"reply to another query", func(w http.ResponseWriter, req *dnsmsg.Message) {
+			resp := answer("192.0.2.53", 0)(req, "https")
+			resp.Header.ID++
+			writeDoH(w, dohMediaType, resp)
+		}, false},
+		{"unparsable reply", func(w http.ResponseWriter, _ *dnsmsg.Message) {
+			w.Header().Set("Content-Type", dohMediaType)
+			w.Write([]byte{1, 2, 3})
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := newFakeDoH(t, tt.handle)
+			u, err := New("https://dns.test:"+port+"/dns-query", WithBootstrap([]string{"127.0.0.2", "127.0.0.1"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			resp, err := u.Exchange(ctx, testQuery(1))
+			if (err == nil) != tt.ok {
+				t.Fatalf("Exchange error %v, want success %t", err, tt.ok)
+			}
+			if err == nil && answeredBy(t, resp) != "192.0.2.53" {
+				t.Errorf("reply %v", resp)
+			}
+		})
+	}
+}
+
+func TestNewEncryptedUpstream(t *testing.T) {
+	tests := []struct {
+		address string
+		opts    []Option
+		err     string
+	}{
+		{"tls://dns.test", []Option{WithBootstrap([]string{"dns.test"})}, "invalid bootstrap address"},
+		{"https://dns.test/dns-query", []Option{WithBootstrap([]string{"192.0.2.1", ""})}, "invalid bootstrap address"},
+		{"https:///dns-query", nil, "invalid DoH upstream"},
+		{"https://dns.test/dns-query", []Option{WithBootstrap([]string{"192.0.2.1", "2001:db8::1"})}, ""},
+	}
+	for _, tt := range tests {
+		u, err := New(tt.address, tt.opts...)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("New(%q): %v", tt.address, err)
+				continue
+			}
+			u.Close()
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("New(%q) error %v, want %q", tt.address, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package upstream
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrAllFailed is returned when no upstream produced a usable reply.
+var ErrAllFailed = errors.New("upstream: all upstreams failed")
+
+// Resolver answers queries on behalf of clients. It is implemented by Pool
+// and by the recursive resolver.
+type Resolver interface {
+	Exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error)
+}
+
+// Strategy selects the order in which upstreams are tried.
+type Strategy string
+
+const (
+	// StrategyFailover tries the upstreams in configured order.
+	StrategyFailover Strategy = "failover"
+	// StrategyRoundRobin rotates the first upstream on every query.
+	StrategyRoundRobin Strategy = "round_robin"
+	// StrategyFastest prefers the upstream with the lowest response time.
+	StrategyFastest Strategy = "fastest"
+	// StrategyParallel queries all upstreams at once and takes the first
+	// usable reply.
+	StrategyParallel Strategy = "parallel"
+)
+
+// Pool forwards queries to a set of upstreams.
+type Pool struct {
+	upstreams []*Upstream
+	strategy  Strategy
+	timeout   time.Duration
+	retries   int
+
+	next atomic.Uint32
+}
+
+type PoolOption func(*Pool)
+
+func NewPool(upstreams []*Upstream, options ...PoolOption) (*Pool, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("upstream: no upstreams configured")
+	}
+
+	p := &Pool{
+		upstreams: upstreams,
+		strategy:  StrategyFailover,
+		timeout:   2 * time.Second,
+		retries:   1,
+	}
+
+	for _, option := range options {
+		option(p)
+	}
+
+	switch p.strategy {
+	case StrategyFailover, StrategyRoundRobin, StrategyFastest, StrategyParallel:
+	default:
+		return nil, fmt.Errorf("upstream: unknown strategy %q", p.strategy)
+	}
+
+	return p, nil
+}
+
+func WithStrategy(strategy Strategy) PoolOption {
+	return func(p *Pool) {
+		p.strategy = strategy
+	}
+}
+
+// WithTimeout bounds how long a single attempt against one upstream waits.
+func WithTimeout(timeout time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.timeout = timeout
+	}
+}
+
+// WithRetries sets how many extra attempts each upstream gets.
+func WithRetries(retries int) PoolOption {
+	return func(p *Pool) {
+		p.retries = retries
+	}
+}
+
+// Exchange forwards req and returns the first usable reply, carrying the
+// ID of req. Each attempt uses a fresh random ID so replies cannot be
+// confused with, or spoofed as, another query's.
+func (p *Pool) Exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	if p.strategy == StrategyParallel {
+		return p.race(ctx, req)
+	}
+
+	var lastErr error = ErrAllFailed
+	for _, u := range p.order() {
+		for attempt := 0; attempt <= p.retries; attempt++ {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			resp, err := p.try(ctx, u, req)
+			if err == nil {
+				return resp, nil
+			}
+			log.Debug().Msgf("Upstream %s failed for %s: %v", u.Address(), req.Questions[0].Name, err)
+			lastErr = err
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrAllFailed, lastErr)
+}
+
+// try runs a single attempt against u. Replies that indicate a broken
+// upstream (SERVFAIL, REFUSED) count as failures so the next one is tried.
+func (p *Pool) try(ctx context.Context, u *Upstream, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	out := *req
+	out.Header.ID = uint16(rand.Uint32())
+	resp, err := u.Exchange(ctx, &out)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Header.RCode {
+	case dnsmsg.RCodeServerFailure, dnsmsg.RCodeRefused:
+		return nil, fmt.Errorf("upstream %s answered %s", u.Address(), resp.Header.RCode)
+	}
+	resp.Header.ID = req.Header.ID
+	return resp, nil
+}
+
+// race queries every upstream concurrently and returns the first usable
+// reply, cancelling the others.
+func (p *Pool) race(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *dnsmsg.Message
+		err  error
+	}
+	candidates := p.order()
+	results := make(chan result, len(candidates))
+	for _, u := range candidates {
+		go func() {
+			resp, err := p.try(ctx, u, req)
+			results <- result{resp, err}
+		}()
+	}
+
+	var lastErr error = ErrAllFailed
+	for range candidates {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		lastErr = r.err
+	}
+	return nil, fmt.Errorf("%w: %v", ErrAllFailed, lastErr)
+}
+
+// order returns the upstreams in the order the strategy wants them tried.
+// Healthy upstreams always come before ones that are currently failing,
+// which are still tried as a last resort.
+func (p *Pool) order() []*Upstream {
+	ordered := slices.Clone(p.upstreams)
+	switch p.strategy {
+	case StrategyRoundRobin:
+		n := int(p.next.Add(1)-1) % len(ordered)
+		ordered = append(ordered[n:], ordered[:n]...)
+	case StrategyFastest:
+		slices.SortStableFunc(ordered, func(a, b *Upstream) int {
+			return int(a.RTT() - b.RTT())
+		})
+	}
+
+	slices.SortStableFunc(ordered, func(a, b *Upstream) int {
+		switch {
+		case a.Healthy() == b.Healthy():
+			return 0
+		case a.Healthy():
+			return -1
+		default:
+			return 1
+		}
+	})
+	return ordered
+}
+
+// StartHealthChecks probes every upstream at interval until ctx is done.
+// A successful probe clears the failure count so the upstream is used
+// again.
+func (p *Pool) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, u := range p.upstreams {
+					p.probe(ctx, u)
+				}
+			}
+		}
+	}()
+}
+
+func (p *Pool) probe(ctx context.Context, u *Upstream) {
+	probe := &dnsmsg.Message{
+		Header:    dnsmsg.Header{RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: "", Type: dnsmsg.TypeNS, Class: dnsmsg.ClassINET}},
+	}
+	wasHealthy := u.Healthy()
+	_, err := p.try(ctx, u, probe)
+	switch {
+	case err != nil && wasHealthy != u.Healthy():
+		log.Warn().Msgf("Upstream %s is down: %v", u.Address(), err)
+	case err == nil && !wasHealthy:
+		log.Info().Msgf("Upstream %s is back up", u.Address())
+	}
+}
+
+func (p *Pool) Status() []Status {
+	if p == nil {
+		return nil
+	}
+	statuses := make([]Status, len(p.upstreams))
+	for i, u := range p.upstreams {
+		statuses[i] = u.Status()
+	}
+	return statuses
+}
+
+// Close releases the connections of every upstream. Exchanges still in
+// flight may finish; their connections are closed instead of kept.
+func (p *Pool) Close() {
+	for _, u := range p.upstreams {
+		u.Close()
+	}
+}
@@ -0,0 +1,387 @@
+package upstream
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer is an upstream listening on UDP and TCP on the same local
+// port. handle builds the reply to each query; a nil reply is dropped.
+type fakeServer struct {
+	addr    string
+	handle  func(req *dnsmsg.Message, network string) *dnsmsg.Message
+	queries atomic.Int64
+}
+
+func newFakeServer(t *testing.T, handle func(req *dnsmsg.Message, network string) *dnsmsg.Message) *fakeServer {
+	t.Helper()
+	s := &fakeServer{handle: handle}
+
+	var pc net.PacketConn
+	var ln net.Listener
+	for i := 0; ; i++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+		if i == 10 {
+			t.Fatalf("no free port for UDP and TCP: %v", err)
+		}
+	}
+	s.addr = pc.LocalAddr().String()
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 0xFFFF)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.reply(buf[:n], "udp"); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					raw, err := dnsmsg.ReadStream(conn)
+					if err != nil {
+						return
+					}
+					if resp := s.reply(raw, "tcp"); resp != nil {
+						dnsmsg.WriteStream(conn, resp)
+					}
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) reply(raw []byte, network string) []byte {
+	s.queries.Add(1)
+	req, err := dnsmsg.Parse(raw)
+	if err != nil {
+		return nil
+	}
+	resp := s.handle(req, network)
+	if resp == nil {
+		return nil
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// answer returns a handler answering every query with ip, after delay.
+func answer(ip string, delay time.Duration) func(*dnsmsg.Message, string) *dnsmsg.Message {
+	return func(req *dnsmsg.Message, _ string) *dnsmsg.Message {
+		time.Sleep(delay)
+		resp := req.Reply()
+		resp.Answers = []dnsmsg.ResourceRecord{
+			dnsmsg.NewRR(req.Questions[0].Name, 60, &dnsmsg.A{IP: net.ParseIP(ip).To4()}),
+		}
+		return resp
+	}
+}
+
+func rcode(code dnsmsg.RCode) func(*dnsmsg.Message, string) *dnsmsg.Message {
+	return func(req *dnsmsg.Message, _ string) *dnsmsg.Message {
+		resp := req.Reply()
+		resp.Header.RCode = code
+		return resp
+	}
+}
+
+func drop(*dnsmsg.Message, string) *dnsmsg.Message { return nil }
+
+func newTestPool(t *testing.T, strategy Strategy, servers ...*fakeServer) *Pool {
+	t.Helper()
+	var upstreams []*Upstream
+	for _, s := range servers {
+		u, err := New(s.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	p, err := NewPool(upstreams, WithStrategy(strategy), WithTimeout(200*time.Millisecond), WithRetries(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func testQuery(id uint16) *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: "example.com", Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}},
+	}
+}
+
+// answeredBy returns the address in the answer of resp.
+func answeredBy(t *testing.T, resp *dnsmsg.Message) string {
+	t.Helper()
+	if len(resp.Answers) != 1 {
+		t.Fatalf("reply has %d answers: %v", len(resp.Answers), resp)
+	}
+	return resp.Answers[0].Data.(*dnsmsg.A).IP.String()
+}
+
+func TestPoolFailover(t *testing.T) {
+	broken := newFakeServer(t, rcode(dnsmsg.RCodeServerFailure))
+	dead := newFakeServer(t, drop)
+	good := newFakeServer(t, answer("192.0.2.3", 0))
+	p := newTestPool(t, StrategyFailover, broken, dead, good)
+
+	resp, err := p.Exchange(context.Background(), testQuery(0xBEEF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := answeredBy(t, resp); got != "192.0.2.3" {
+		t.Errorf("answered by %s, want the third upstream", got)
+	}
+	if resp.Header.ID != 0xBEEF {
+		t.Errorf("reply ID %#x, want the ID of the query", resp.Header.ID)
+	}
+	if broken.queries.Load() != 1 || dead.queries.Load() != 1 {
+		t.Errorf("failing upstreams got %d and %d queries, want one each", broken.queries.Load(), dead.queries.Load())
+	}
+}
+
+func TestPoolNXDOMAINIsAnAnswer(t *testing.T) {
+	first := newFakeServer(t, rcode(dnsmsg.RCodeNameError))
+	second := newFakeServer(t, answer("192.0.2.2", 0))
+	p := newTestPool(t, StrategyFailover, first, second)
+
+	resp, err := p.Exchange(context.Background(), testQuery(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.RCode != dnsmsg.RCodeNameError || second.queries.Load() != 0 {
+		t.Errorf("got %s with %d queries to the second upstream, want the NXDOMAIN of the first", resp.Header.RCode, second.queries.Load())
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	var servers []*fakeServer
+	for _, ip := range ips {
+		servers = append(servers, newFakeServer(t, answer(ip, 0)))
+	}
+	p := newTestPool(t, StrategyRoundRobin, servers...)
+
+	for i := range 2 * len(ips) {
+		resp, err := p.Exchange(context.Background(), testQuery(uint16(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := answeredBy(t, resp), ips[i%len(ips)]; got != want {
+			t.Errorf("query %d answered by %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestPoolFastest(t *testing.T) {
+	slow := newFakeServer(t, answer("192.0.2.1", 0))
+	fast := newFakeServer(t, answer("192.0.2.2", 0))
+	p := newTestPool(t, StrategyFastest, slow, fast)
+	p.upstreams[0].observeRTT(80 * time.Millisecond)
+	p.upstreams[1].observeRTT(time.Millisecond)
+
+	resp, err := p.Exchange(context.Background(), testQuery(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := answeredBy(t, resp); got != "192.0.2.2" {
+		t.Errorf("answered by %s, want the upstream with the lowest RTT", got)
+	}
+	if slow.queries.Load() != 0 {
+		t.Errorf("slow upstream got %d queries, want none", slow.queries.Load())
+	}
+}
+
+func TestPoolParallel(t *testing.T) {
+	slow := newFakeServer(t, answer("192.0.2.1", 150*time.Millisecond))
+	broken := newFakeServer(t, rcode(dnsmsg.RCodeRefused))
+	fast := newFakeServer(t, answer("192.0.2.3", 0))
+	p := newTestPool(t, StrategyParallel, slow, broken, fast)
+
+	start := time.Now()
+	resp, err := p.Exchange(context.Background(), testQuery(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := answeredBy(t, resp); got != "192.0.2.3" {
+		t.Errorf("answered by %s, want the fastest usable upstream", got)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("race took %v, it should not wait for the slow upstream", elapsed)
+	}
+	if resp.Header.ID != 7 {
+		t.Errorf("reply ID %d, want 7", resp.Header.ID)
+	}
+
+	// The cancelled loser is not counted as failing.
+	time.Sleep(200 * time.Millisecond)
+	if !p.upstreams[0].Healthy() || p.upstreams[0].Status().Errors != 0 {
+		t.Errorf("race loser marked as failing: %+v", p.upstreams[0].Status())
+	}
+}
+
+func TestTruncatedRetriedOverTCP(t *testing.T) {
+	s := newFakeServer(t, func(req *dnsmsg.Message, network string) *dnsmsg.Message {
+		if network == "udp" {
+			resp := req.Reply()
+			resp.Header.Truncated = true
+			return resp
+		}
+		return answer("192.0.2.9", 0)(req, network)
+	})
+	p := newTestPool(t, StrategyFailover, s)
+
+	resp, err := p.Exchange(context.Background(), testQuery(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Truncated || answeredBy(t, resp) != "192.0.2.9" {
+		t.Errorf("got %v, want the full answer from TCP", resp)
+	}
+	if s.queries.Load() != 2 {
+		t.Errorf("server got %d queries, want one over UDP and one over TCP", s.queries.Load())
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	var up atomic.Bool
+	flaky := newFakeServer(t, func(req *dnsmsg.Message, network string) *dnsmsg.Message {
+		if !up.Load() {
+			return nil
+		}
+		return answer("192.0.2.1", 0)(req, network)
+	})
+	backup := newFakeServer(t, answer("192.0.2.2", 0))
+	p := newTestPool(t, StrategyFailover, flaky, backup)
+
+	for i := range maxFailures {
+		if _, err := p.Exchange(context.Background(), testQuery(uint16(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.upstreams[0].Healthy() {
+		t.Fatalf("upstream still healthy after %d failures", maxFailures)
+	}
+
+	// A failing upstream is skipped while a healthy one is left.
+	before := flaky.queries.Load()
+	resp, err := p.Exchange(context.Background(), testQuery(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answeredBy(t, resp) != "192.0.2.2" || flaky.queries.Load() != before {
+		t.Error("unhealthy upstream was tried before the healthy one")
+	}
+
+	// A successful probe brings it back.
+	up.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.StartHealthChecks(ctx, 20*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for !p.upstreams[0].Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("health probe did not mark the upstream healthy again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err = p.Exchange(context.Background(), testQuery(11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := answeredBy(t, resp); got != "192.0.2.1" {
+		t.Errorf("answered by %s after recovery, want the first upstream", got)
+	}
+}
+
+func TestPoolAllFail(t *testing.T) {
+	for _, strategy := range []Strategy{StrategyFailover, StrategyRoundRobin, StrategyFastest, StrategyParallel} {
+		t.Run(string(strategy), func(t *testing.T) {
+			p := newTestPool(t, strategy,
+				newFakeServer(t, rcode(dnsmsg.RCodeServerFailure)),
+				newFakeServer(t, drop),
+			)
+			_, err := p.Exchange(context.Background(), testQuery(1))
+			if !errors.Is(err, ErrAllFailed) {
+				t.Errorf("error %v, want %v", err, ErrAllFailed)
+			}
+		})
+	}
+}
+
+func TestMismatchedRepliesIgnored(t *testing.T) {
+	s := newFakeServer(t, func(req *dnsmsg.Message, _ string) *dnsmsg.Message {
+		resp := req.Reply()
+		resp.Header.ID++
+		return resp
+	})
+	p := newTestPool(t, StrategyFailover, s)
+
+	if _, err := p.Exchange(context.Background(), testQuery(1)); !errors.Is(err, ErrAllFailed) {
+		t.Errorf("error %v, want a spoofed reply to be ignored", err)
+	}
+}
+
+func TestNewPoolValidation(t *testing.T) {
+	if _, err := NewPool(nil); err == nil {
+		t.Error("pool without upstreams accepted")
+	}
+	u, _ := New("127.0.0.1:53")
+	if _, err := NewPool([]*Upstream{u}, WithStrategy("random")); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestClosedConnPoolClosesReturnedConnections(t *testing.T) {
+	p := &connPool{idle: make(chan net.Conn, maxIdleConns)}
+	kept, _ := net.Pipe()
+	p.put(kept)
+
+	// An exchange still running when the pool is retired returns its
+	// connection afterwards.
+	inFlight, _ := net.Pipe()
+	p.close()
+	p.put(inFlight)
+
+	for _, conn := range []net.Conn{kept, inFlight} {
+		if _, err := conn.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("connection left open after the pool was closed: %v", err)
+		}
+	}
+	if n := len(p.idle); n != 0 {
+		t.Errorf("%d idle connections kept by a closed pool", n)
+	}
+}
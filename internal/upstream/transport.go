@@ -0,0 +1,274 @@
+package upstream
+
+import (
+	"context"
+	"dns-server/internal/dnsmsg"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIdleConns is how many idle connections each transport keeps for reuse.
+const maxIdleConns = 8
+
+var errMismatch = errors.New("upstream: reply does not match query")
+
+// transport sends one query to an upstream server and waits for its reply.
+type transport interface {
+	exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error)
+	close()
+}
+
+// connPool keeps idle connections to a single server for reuse.
+type connPool struct {
+	dial func(ctx context.Context) (net.Conn, error)
+	idle chan net.Conn
+	// closed is set once the pool is retired. Exchanges still running on
+	// it then close their connections instead of returning them.
+	closed bool
+	mu     sync.Mutex
+}
+
+func newConnPool(network, addr string) *connPool {
+	return &connPool{
+		dial: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		idle: make(chan net.Conn, maxIdleConns),
+	}
+}
+
+// get returns an idle connection, or dials a new one. reused tells the
+// caller that the connection may have been closed by the server meanwhile.
+func (p *connPool) get(ctx context.Context) (conn net.Conn, reused bool, err error) {
+	select {
+	case conn := <-p.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err = p.dial(ctx)
+	return conn, false, err
+}
+
+// put returns a healthy connection to the pool, closing it if the pool is
+// already full or closed.
+func (p *connPool) put(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// withDeadline applies the ctx deadline to conn and interrupts blocked I/O
+// when ctx is cancelled early, e.g. because a parallel race was won.
+func withDeadline(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+}
+
+// matches reports whether resp answers req.
+func matches(req, resp *dnsmsg.Message) bool {
+	if !resp.Header.Response || resp.Header.ID != req.Header.ID {
+		return false
+	}
+	if len(resp.Questions) == 0 {
+		// Some servers omit the question in error replies.
+		return resp.Header.RCode != dnsmsg.RCodeSuccess
+	}
+	if len(req.Questions) != len(resp.Questions) {
+		return false
+	}
+	for i, q := range req.Questions {
+		r := resp.Questions[i]
+		if q.Type != r.Type || q.Class != r.Class || !strings.EqualFold(q.Name, r.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// udpTransport sends queries over pooled, connected UDP sockets.
+type udpTransport struct {
+	pool *connPool
+}
+
+func newUDPTransport(addr string) *udpTransport {
+	return &udpTransport{pool: newConnPool("udp", addr)}
+}
+
+func (t *udpTransport) exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := t.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := withDeadline(ctx, conn)
+	defer stop()
+
+	if _, err := conn.Write(b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp, err := dnsmsg.Parse(buf[:n])
+		if err != nil || !matches(req, resp) {
+			// Late replies to earlier queries on a reused socket, or
+			// spoofing attempts, are skipped.
+			continue
+		}
+		t.pool.put(conn)
+		return resp, nil
+	}
+}
+
+func (t *udpTransport) close() {
+	t.pool.close()
+}
+
+// streamTransport sends queries over pooled TCP (or TLS) connections, one
+// query at a time per connection.
+type streamTransport struct {
+	pool *connPool
+}
+
+func newTCPTransport(addr string) *streamTransport {
+	return &streamTransport{pool: newConnPool("tcp", addr)}
+}
+
+func (t *streamTransport) exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		conn, reused, err := t.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := streamExchange(ctx, conn, req, b)
+		if err != nil {
+			// The stream may still carry a reply to this query, so the
+			// connection cannot be reused.
+			conn.Close()
+			if reused && ctx.Err() == nil {
+				// The server most likely closed the idle connection;
+				// try again on another one.
+				continue
+			}
+			return nil, err
+		}
+		t.pool.put(conn)
+		return resp, nil
+	}
+}
+
+func streamExchange(ctx context.Context, conn net.Conn, req *dnsmsg.Message, b []byte) (*dnsmsg.Message, error) {
+	stop := withDeadline(ctx, conn)
+	defer stop()
+
+	if err := dnsmsg.WriteStream(conn, b); err != nil {
+		return nil, err
+	}
+	raw, err := dnsmsg.ReadStream(conn)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dnsmsg.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !matches(req, resp) {
+		return nil, errMismatch
+	}
+	return resp, nil
+}
+
+func (t *streamTransport) close() {
+	t.pool.close()
+}
+
+// parseAddress splits a configured upstream such as "1.1.1.1",
+// "udp://[2606:4700::1111]:53", "tcp://9.9.9.9" or "tls://dns.quad9.net"
+// into its scheme, host and port. The port defaults to 853 for tls and 53
+// otherwise.
+func parseAddress(raw string) (scheme, host, port string, err error) {
+	scheme = "udp"
+	rest := raw
+	if i := strings.Index(raw, "://"); i >= 0 {
+		scheme, rest = raw[:i], raw[i+3:]
+	}
+
+	port = "53"
+	if scheme == "tls" {
+		port = "853"
+	}
+
+	if ip := net.ParseIP(strings.Trim(rest, "[]")); ip != nil {
+		return scheme, ip.String(), port, nil
+	}
+	if !strings.Contains(rest, ":") {
+		return scheme, rest, port, nil
+	}
+	host, port, err = net.SplitHostPort(rest)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid upstream address %q: %w", raw, err)
+	}
+	return scheme, host, port, nil
+}
+
+// Exchange sends req to the server at addr over UDP and repeats it over
+// TCP when the reply is truncated. Unlike an Upstream it keeps no
+// connections open, which suits talking to many different servers.
+func Exchange(ctx context.Context, addr string, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	udp := newUDPTransport(addr)
+	defer udp.close()
+	resp, err := udp.exchange(ctx, req)
+	if err != nil || !resp.Header.Truncated {
+		return resp, err
+	}
+
+	tcp := newTCPTransport(addr)
+	defer tcp.close()
+	return tcp.exchange(ctx, req)
+}
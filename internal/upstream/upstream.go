@@ -0,0 +1,182 @@
+package upstream
+
+import (
+	"cmp"
+	"context"
+	"dns-server/internal/dnsmsg"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxFailures is the number of consecutive failures after which an
+// upstream is considered down until a health probe succeeds.
+const maxFailures = 3
+
+// Upstream is a single resolver queries can be forwarded to.
+type Upstream struct {
+	address   string
+	transport transport
+	// fallback is used to repeat a query whose UDP reply was truncated.
+	fallback transport
+
+	failures atomic.Int32
+	queries  atomic.Int64
+	errors   atomic.Int64
+
+	mu  sync.Mutex
+	rtt time.Duration
+}
+
+// Status is a snapshot of an upstream's health.
+type Status struct {
+	Address  string `json:"address"`
+	Healthy  bool   `json:"healthy"`
+	RTTMs    int64  `json:"rtt_ms"`
+	Queries  int64  `json:"queries"`
+	Errors   int64  `json:"errors"`
+	Failures int32  `json:"consecutive_failures"`
+}
+
+// Option configures an Upstream.
+type Option func(*options)
+
+type options struct {
+	serverName string
+	bootstrap  []string
+}
+
+// WithServerName sets the name the TLS certificate of an encrypted upstream
+// is verified against. It defaults to the host of the address.
+func WithServerName(name string) Option {
+	return func(o *options) {
+		o.serverName = name
+	}
+}
+
+// WithBootstrap sets IP addresses used to reach an upstream given by
+// hostname, so that it does not have to be resolved first.
+func WithBootstrap(ips []string) Option {
+	return func(o *options) {
+		o.bootstrap = ips
+	}
+}
+
+// New creates an upstream from an address such as "1.1.1.1", "9.9.9.9:53",
+// "tcp://9.9.9.9", "tls://dns.quad9.net" or
+// "https://cloudflare-dns.com/dns-query". Plain addresses use UDP and fall
+// back to TCP when a reply is truncated.
+func New(address string, opts ...Option) (*Upstream, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	for _, ip := range o.bootstrap {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid bootstrap address %q for %s", ip, address)
+		}
+	}
+
+	u := &Upstream{address: address}
+
+	if strings.HasPrefix(address, "https://") {
+		host, port, err := parseHTTPS(address)
+		if err != nil {
+			return nil, err
+		}
+		d := &dialer{host: host, port: port, bootstrap: o.bootstrap}
+		u.transport = newHTTPSTransport(address, d, cmp.Or(o.serverName, host))
+		return u, nil
+	}
+
+	scheme, host, port, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	hostPort := net.JoinHostPort(host, port)
+	switch scheme {
+	case "udp":
+		u.transport = newUDPTransport(hostPort)
+		u.fallback = newTCPTransport(hostPort)
+	case "tcp":
+		u.transport = newTCPTransport(hostPort)
+	case "tls":
+		d := &dialer{host: host, port: port, bootstrap: o.bootstrap}
+		u.transport = newTLSTransport(d, cmp.Or(o.serverName, host))
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q in %q", scheme, address)
+	}
+	return u, nil
+}
+
+func (u *Upstream) Address() string {
+	return u.address
+}
+
+func (u *Upstream) Healthy() bool {
+	return u.failures.Load() < maxFailures
+}
+
+// RTT returns the smoothed response time, or zero if never measured.
+func (u *Upstream) RTT() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.rtt
+}
+
+// Exchange sends req to the upstream, retrying over TCP if the reply is
+// truncated, and records the outcome for health tracking.
+func (u *Upstream) Exchange(ctx context.Context, req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	u.queries.Add(1)
+	start := time.Now()
+
+	resp, err := u.transport.exchange(ctx, req)
+	if err == nil && resp.Header.Truncated && u.fallback != nil {
+		resp, err = u.fallback.exchange(ctx, req)
+	}
+
+	if err != nil {
+		// A cancelled race loser is not the upstream's fault.
+		if ctx.Err() != context.Canceled {
+			u.errors.Add(1)
+			u.failures.Add(1)
+		}
+		return nil, err
+	}
+	u.failures.Store(0)
+	u.observeRTT(time.Since(start))
+	return resp, nil
+}
+
+// observeRTT folds a new sample into the moving average used by the
+// fastest strategy.
+func (u *Upstream) observeRTT(sample time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.rtt == 0 {
+		u.rtt = sample
+		return
+	}
+	u.rtt = (u.rtt*7 + sample) / 8
+}
+
+func (u *Upstream) Status() Status {
+	return Status{
+		Address:  u.address,
+		Healthy:  u.Healthy(),
+		RTTMs:    u.RTT().Milliseconds(),
+		Queries:  u.queries.Load(),
+		Errors:   u.errors.Load(),
+		Failures: u.failures.Load(),
+	}
+}
+
+func (u *Upstream) Close() {
+	u.transport.close()
+	if u.fallback != nil {
+		u.fallback.close()
+	}
+}
@@ -0,0 +1,145 @@
+package zonefile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// token is a field of a zone file line. raw is the field as written, with
+// escapes kept, which is how names are represented; value has the escapes
+// of a character-string resolved.
+type token struct {
+	raw    string
+	value  string
+	quoted bool
+}
+
+// line is a logical line of a zone file: a physical line, extended across
+// line breaks by parentheses. blank is set when it starts with white
+// space, meaning that it belongs to the previous owner name.
+type line struct {
+	number int
+	blank  bool
+	tokens []token
+}
+
+// tokenize splits a zone file into logical lines, dropping comments and
+// lines without fields.
+func tokenize(data []byte) ([]line, error) {
+	var lines []line
+	cur := line{number: 1}
+	number, depth := 1, 0
+	atStart := true
+
+	flush := func() {
+		if len(cur.tokens) > 0 {
+			lines = append(lines, cur)
+		}
+		cur = line{number: number}
+		atStart = true
+	}
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '\n':
+			number++
+			i++
+			if depth == 0 {
+				flush()
+			}
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			if atStart && depth == 0 && len(cur.tokens) == 0 {
+				cur.blank = true
+			}
+			i++
+		case c == ';':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			if depth == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parenthesis", number)
+			}
+			depth--
+			i++
+		case c == '"':
+			t, n, err := quoted(data[i:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", number, err)
+			}
+			number += strings.Count(string(data[i:i+n]), "\n")
+			cur.tokens = append(cur.tokens, t)
+			i += n
+		default:
+			start := i
+			for i < len(data) && !isDelimiter(data[i]) {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				i++
+			}
+			raw := string(data[start:i])
+			cur.tokens = append(cur.tokens, token{raw: raw, value: unescape(raw)})
+		}
+		atStart = false
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parenthesis", cur.number)
+	}
+	flush()
+	return lines, nil
+}
+
+func isDelimiter(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', ';', '(', ')', '"':
+		return true
+	}
+	return false
+}
+
+// quoted reads the quoted character-string at the start of data and
+// returns it with the number of bytes consumed.
+func quoted(data []byte) (token, int, error) {
+	for i := 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			raw := string(data[1:i])
+			return token{raw: raw, value: unescape(raw), quoted: true}, i + 1, nil
+		}
+	}
+	return token{}, 0, fmt.Errorf("unterminated quoted string")
+}
+
+// unescape resolves the \X and \DDD escapes of a character-string.
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			sb.WriteByte(c)
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+			if n <= 255 {
+				sb.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i+1])
+		i++
+	}
+	return sb.String()
+}
@@ -0,0 +1,426 @@
+// Package zonefile reads and writes zones in the master file format of RFC
+// 1035 section 5, as used by BIND.
+package zonefile
+
+import (
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth bounds nested $INCLUDE directives, which protects the
+// parser against files that include themselves.
+const maxIncludeDepth = 8
+
+// Entry is a record read from a zone file together with its owner name.
+type Entry struct {
+	Name   string
+	Record manager.Record
+}
+
+// File is the contents of a zone file.
+type File struct {
+	// SOA holds the zone parameters when the file has an SOA record. Its
+	// TTL is the TTL of the SOA record.
+	SOA     *manager.Zone
+	Entries []Entry
+}
+
+type Option func(*parser)
+
+// WithIncludeDir allows $INCLUDE directives, resolving relative file names
+// against dir. Without it $INCLUDE is rejected, since files named by an
+// uploaded zone must not be read from the server.
+func WithIncludeDir(dir string) Option {
+	return func(p *parser) {
+		p.includeDir = dir
+	}
+}
+
+type parser struct {
+	file       *File
+	includeDir string
+	depth      int
+
+	origin string
+	// ttl applies to records without a TTL of their own. hasTTL is set
+	// once a $TTL directive fixed it.
+	ttl    uint32
+	hasTTL bool
+	// owner is reused by records that start with white space.
+	owner string
+}
+
+// Parse reads a zone file. Relative names are completed with origin until
+// a $ORIGIN directive changes it.
+func Parse(r io.Reader, origin string, options ...Option) (*File, error) {
+	p := &parser{
+		file:   &File{},
+		origin: dnsmsg.CanonicalName(origin),
+		ttl:    manager.DefaultTTL,
+	}
+	p.owner = p.origin
+	for _, option := range options {
+		option(p)
+	}
+
+	if err := p.parse(r, "zone"); err != nil {
+		return nil, err
+	}
+	return p.file, nil
+}
+
+func (p *parser) parse(r io.Reader, source string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	lines, err := tokenize(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	for _, l := range lines {
+		if err := p.line(l); err != nil {
+			return fmt.Errorf("%s line %d: %w", source, l.number, err)
+		}
+	}
+	return nil
+}
+
+func (p *parser) line(l line) error {
+	first := l.tokens[0]
+	if !l.blank && !first.quoted && strings.HasPrefix(first.raw, "$") {
+		return p.directive(strings.ToUpper(first.raw), l.tokens[1:])
+	}
+
+	tokens := l.tokens
+	if !l.blank {
+		name, err := p.name(tokens[0])
+		if err != nil {
+			return err
+		}
+		p.owner = name
+		tokens = tokens[1:]
+	}
+	owner := p.owner
+
+	// The TTL and class may come in either order, and both are optional.
+	ttl, hasTTL, hasClass := p.ttl, false, false
+	for len(tokens) > 0 {
+		t := tokens[0].raw
+		if !hasClass && isClass(t) {
+			if !strings.EqualFold(t, "IN") {
+				return fmt.Errorf("unsupported class %s", t)
+			}
+			hasClass = true
+		} else if v, err := parseTTL(t); !hasTTL && err == nil {
+			ttl, hasTTL = v, true
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("missing record type")
+	}
+	if hasTTL && !p.hasTTL {
+		// Without $TTL, records inherit the last TTL given explicitly
+		// (RFC 1035 section 5.1).
+		p.ttl = ttl
+	}
+
+	rrType := strings.ToUpper(tokens[0].raw)
+	if rrType == "SOA" {
+		return p.soa(owner, ttl, tokens[1:])
+	}
+	r, err := p.record(rrType, tokens[1:])
+	if err != nil {
+		return err
+	}
+	r.TTL = int(ttl)
+	if err := r.Normalize(); err != nil {
+		return err
+	}
+	p.file.Entries = append(p.file.Entries, Entry{Name: owner, Record: r})
+	return nil
+}
+
+func (p *parser) directive(name string, args []token) error {
+	switch name {
+	case "$ORIGIN":
+		if len(args) != 1 {
+			return fmt.Errorf("$ORIGIN takes one name")
+		}
+		origin, err := p.name(args[0])
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+	case "$TTL":
+		if len(args) != 1 {
+			return fmt.Errorf("$TTL takes one TTL")
+		}
+		ttl, err := parseTTL(args[0].raw)
+		if err != nil {
+			return err
+		}
+		p.ttl, p.hasTTL = ttl, true
+	case "$INCLUDE":
+		return p.include(args)
+	default:
+		return fmt.Errorf("unknown directive %s", name)
+	}
+	return nil
+}
+
+// include parses the file named by a $INCLUDE directive. The included file
+// starts with the origin given to the directive, and the origin and owner
+// of the including file are restored afterwards (RFC 1035 section 5.1).
+func (p *parser) include(args []token) error {
+	if p.includeDir == "" {
+		return fmt.Errorf("$INCLUDE is not allowed here")
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("$INCLUDE takes a file name and an optional origin")
+	}
+	if p.depth >= maxIncludeDepth {
+		return fmt.Errorf("$INCLUDE nested too deeply")
+	}
+
+	origin, owner := p.origin, p.owner
+	defer func() { p.origin, p.owner = origin, owner }()
+	if len(args) == 2 {
+		name, err := p.name(args[1])
+		if err != nil {
+			return err
+		}
+		p.origin = name
+	}
+
+	path := args[0].value
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.includeDir, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p.depth++
+	defer func() { p.depth-- }()
+	return p.parse(f, path)
+}
+
+func (p *parser) soa(owner string, ttl uint32, args []token) error {
+	if len(args) != 7 {
+		return fmt.Errorf("SOA takes 7 fields, got %d", len(args))
+	}
+	mname, err := p.name(args[0])
+	if err != nil {
+		return err
+	}
+	rname, err := p.name(args[1])
+	if err != nil {
+		return err
+	}
+	serial, err := strconv.ParseUint(args[2].raw, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid serial %q", args[2].raw)
+	}
+	var timers [4]uint32
+	for i := range timers {
+		if timers[i], err = parseTTL(args[3+i].raw); err != nil {
+			return err
+		}
+	}
+	if p.file.SOA != nil {
+		return fmt.Errorf("more than one SOA record")
+	}
+
+	z := &manager.Zone{
+		Name:    owner,
+		MName:   mname,
+		RName:   rname,
+		Serial:  uint32(serial),
+		Refresh: timers[0],
+		Retry:   timers[1],
+		Expire:  timers[2],
+		Minimum: timers[3],
+		TTL:     ttl,
+	}
+	if err := z.Normalize(); err != nil {
+		return err
+	}
+	p.file.SOA = z
+	return nil
+}
+
+// record parses the RDATA of a record type the server can store.
+func (p *parser) record(rrType string, args []token) (manager.Record, error) {
+	r := manager.Record{Type: rrType}
+	var err error
+	switch rrType {
+	case "A", "AAAA":
+		if err = wantArgs(rrType, args, 1); err == nil {
+			r.IP = args[0].raw
+		}
+	case "CNAME", "NS", "PTR":
+		if err = wantArgs(rrType, args, 1); err == nil {
+			r.Target, err = p.name(args[0])
+		}
+	case "MX":
+		if err = wantArgs(rrType, args, 2); err == nil {
+			r.Priority, err = parseUint16(args[0].raw)
+		}
+		if err == nil {
+			r.Target, err = p.name(args[1])
+		}
+	case "SRV":
+		if err = wantArgs(rrType, args, 4); err == nil {
+			r.Priority, err = parseUint16(args[0].raw)
+		}
+		if err == nil {
+			r.Weight, err = parseUint16(args[1].raw)
+		}
+		if err == nil {
+			r.Port, err = parseUint16(args[2].raw)
+		}
+		if err == nil {
+			r.Target, err = p.name(args[3])
+		}
+	case "TXT":
+		if len(args) == 0 {
+			return r, fmt.Errorf("TXT record requires text")
+		}
+		for _, arg := range args {
+			r.Text = append(r.Text, arg.value)
+		}
+	case "CAA":
+		if err = wantArgs(rrType, args, 3); err == nil {
+			var flags uint64
+			flags, err = strconv.ParseUint(args[0].raw, 10, 8)
+			if err != nil {
+				err = fmt.Errorf("invalid CAA flags %q", args[0].raw)
+			}
+			r.Flags, r.Tag, r.Value = uint8(flags), args[1].value, args[2].value
+		}
+	default:
+		return r, fmt.Errorf("unsupported record type %q, expected one of SOA, %s", rrType, strings.Join(manager.RecordTypes, ", "))
+	}
+	return r, err
+}
+
+// name completes a name from the file with the current origin unless it
+// is absolute.
+func (p *parser) name(t token) (string, error) {
+	raw := t.raw
+	if t.quoted {
+		return "", fmt.Errorf("invalid name %q", t.value)
+	}
+	var name string
+	switch {
+	case raw == "@":
+		name = p.origin
+	case absolute(raw):
+		name = dnsmsg.CanonicalName(raw)
+	case p.origin == "":
+		name = dnsmsg.CanonicalName(raw)
+	default:
+		name = dnsmsg.CanonicalName(raw + "." + p.origin)
+	}
+	if _, err := dnsmsg.SplitLabels(name); err != nil {
+		return "", fmt.Errorf("invalid name %q", raw)
+	}
+	return name, nil
+}
+
+// absolute reports whether a name ends with a dot that is not escaped.
+func absolute(name string) bool {
+	if !strings.HasSuffix(name, ".") {
+		return false
+	}
+	escapes := 0
+	for i := len(name) - 2; i >= 0 && name[i] == '\\'; i-- {
+		escapes++
+	}
+	return escapes%2 == 0
+}
+
+func wantArgs(rrType string, args []token, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("%s record takes %d fields, got %d", rrType, n, len(args))
+	}
+	return nil
+}
+
+func isClass(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IN", "CH", "CS", "HS":
+		return true
+	}
+	return false
+}
+
+func parseUint16(s string) (uint16, error) {
+	v, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint16(v), nil
+}
+
+// parseTTL reads a TTL in seconds, also accepting the BIND unit suffixes
+// w, d, h, m and s as in "1h30m".
+func parseTTL(s string) (uint32, error) {
+	if s == "" || !isDigit(s[0]) {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+
+	var total, n uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isDigit(c) {
+			n = n*10 + uint64(c-'0')
+			digits = true
+		} else {
+			unit, ok := ttlUnits[c|0x20]
+			if !ok || !digits {
+				return 0, fmt.Errorf("invalid TTL %q", s)
+			}
+			total += n * unit
+			n, digits = 0, false
+		}
+		if n > 1<<32 || total > 1<<32 {
+			return 0, fmt.Errorf("TTL %q out of range", s)
+		}
+	}
+	if digits {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	if total >= 1<<32 {
+		return 0, fmt.Errorf("TTL %q out of range", s)
+	}
+	return uint32(total), nil
+}
+
+var ttlUnits = map[byte]uint64{
+	'w': 7 * 24 * 3600,
+	'd': 24 * 3600,
+	'h': 3600,
+	'm': 60,
+	's': 1,
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
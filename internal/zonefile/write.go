@@ -0,0 +1,136 @@
+package zonefile
+
+import (
+	"bufio"
+	"dns-server/internal/dnsmsg"
+	"dns-server/internal/manager"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Write writes zone z with the records stored for the names below it as a
+// zone file. Owner names are written relative to the zone and targets as
+// absolute names. The NS records of z are written unless records holds NS
+// records for the apex, which take precedence when answering.
+func Write(w io.Writer, z manager.Zone, records map[string][]manager.Record) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "; Zone %s, serial %d\n", z.Name, z.Serial)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", dnsmsg.Fqdn(z.Name))
+	fmt.Fprintf(bw, "$TTL %d\n", manager.DefaultTTL)
+	writeSOA(bw, "@", z)
+
+	hasNS := slices.ContainsFunc(records[z.Name], func(r manager.Record) bool {
+		return r.Type == "NS"
+	})
+	if !hasNS {
+		for _, rr := range z.NSRecords() {
+			fmt.Fprintf(bw, "@\t%d\tIN\tNS\t%s\n", rr.TTL, rr.Data)
+		}
+	}
+
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return manager.CompareNames(a, b)
+	})
+
+	for _, name := range names {
+		owner := relativeName(name, z.Name)
+		for _, r := range records[name] {
+			data, err := rdata(r)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			fmt.Fprintf(bw, "%s\t%d\tIN\t%s\t%s\n", owner, r.TTL, r.Type, data)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteFile writes the SOA record and entries of f as a zone file, with
+// every owner name absolute. A file parsed with its $INCLUDE directives
+// resolved can so be handed on as a single file.
+func WriteFile(w io.Writer, f *File) error {
+	bw := bufio.NewWriter(w)
+	if f.SOA != nil {
+		writeSOA(bw, dnsmsg.Fqdn(f.SOA.Name), *f.SOA)
+	}
+	for _, e := range f.Entries {
+		data, err := rdata(e.Record)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.Name, err)
+		}
+		fmt.Fprintf(bw, "%s\t%d\tIN\t%s\t%s\n", dnsmsg.Fqdn(e.Name), e.Record.TTL, e.Record.Type, data)
+	}
+	return bw.Flush()
+}
+
+func writeSOA(bw *bufio.Writer, owner string, z manager.Zone) {
+	fmt.Fprintf(bw, "%s\t%d\tIN\tSOA\t%s %s (\n", owner, z.TTL, dnsmsg.Fqdn(z.MName), dnsmsg.Fqdn(z.RName))
+	fmt.Fprintf(bw, "\t\t\t\t%d\t; serial\n", z.Serial)
+	fmt.Fprintf(bw, "\t\t\t\t%d\t; refresh\n", z.Refresh)
+	fmt.Fprintf(bw, "\t\t\t\t%d\t; retry\n", z.Retry)
+	fmt.Fprintf(bw, "\t\t\t\t%d\t; expire\n", z.Expire)
+	fmt.Fprintf(bw, "\t\t\t\t%d )\t; minimum\n", z.Minimum)
+}
+
+// rdata renders the data of r in presentation format.
+func rdata(r manager.Record) (string, error) {
+	switch r.Type {
+	case "A", "AAAA":
+		return r.IP, nil
+	case "CNAME", "NS", "PTR":
+		return dnsmsg.Fqdn(r.Target), nil
+	case "MX":
+		return fmt.Sprintf("%d %s", r.Priority, dnsmsg.Fqdn(r.Target)), nil
+	case "SRV":
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, dnsmsg.Fqdn(r.Target)), nil
+	case "TXT":
+		parts := make([]string, len(r.Text))
+		for i, text := range r.Text {
+			parts[i] = quote(text)
+		}
+		return strings.Join(parts, " "), nil
+	case "CAA":
+		return fmt.Sprintf("%d %s %s", r.Flags, r.Tag, quote(r.Value)), nil
+	}
+	return "", fmt.Errorf("unsupported record type %q", r.Type)
+}
+
+// relativeName writes name relative to origin when it is below it.
+func relativeName(name, origin string) string {
+	switch {
+	case name == origin:
+		return "@"
+	case origin == "":
+		return dnsmsg.Fqdn(name)
+	case strings.HasSuffix(name, "."+origin):
+		return strings.TrimSuffix(name, "."+origin)
+	}
+	return dnsmsg.Fqdn(name)
+}
+
+// quote renders s as a quoted character-string.
+func quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,341 @@
+package zonefile
+
+import (
+	"bytes"
+	"dns-server/internal/manager"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testZone() manager.Zone {
+	z := manager.Zone{
+		Name:    "example.com",
+		NS:      []string{"ns1.example.com", "ns2.example.net"},
+		RName:   "hostmaster@example.com",
+		Serial:  2024010101,
+		Refresh: 7200,
+		Retry:   900,
+		Expire:  1209600,
+		Minimum: 300,
+		TTL:     3600,
+	}
+	if err := z.Normalize(); err != nil {
+		panic(err)
+	}
+	return z
+}
+
+// testRecords holds a record of every type that can be stored, with
+// character-strings that need quoting and escaping.
+func testRecords() map[string][]manager.Record {
+	return map[string][]manager.Record{
+		"example.com": {
+			{Type: "A", TTL: 300, IP: "192.0.2.1"},
+			{Type: "AAAA", TTL: 300, IP: "2001:db8::1"},
+			{Type: "MX", TTL: 3600, Priority: 10, Target: "mail.example.com"},
+			{Type: "TXT", TTL: 300, Text: manager.Text{`v=spf1 include:"_spf.example.net" \ -all`}},
+			// The boundaries between character-strings are kept.
+			{Type: "TXT", TTL: 300, Text: manager.Text{"k=rsa; ", "p=MIGf", ""}},
+			{Type: "CAA", TTL: 3600, Flags: 128, Tag: "issue", Value: "letsencrypt.org; validationmethods=dns-01"},
+		},
+		"www.example.com": {
+			{Type: "CNAME", TTL: 600, Target: "example.com"},
+		},
+		"volatile.example.com": {
+			{Type: "A", TTL: 0, IP: "192.0.2.4"},
+		},
+		"*.dev.example.com": {
+			{Type: "A", TTL: 60, IP: "192.0.2.2"},
+		},
+		"_sip._tcp.example.com": {
+			{Type: "SRV", TTL: 300, Priority: 10, Weight: 60, Port: 5060, Target: "sip.example.net"},
+			{Type: "SRV", TTL: 300, Target: ""},
+		},
+		"1.2.0.192.in-addr.arpa.example.com": {
+			{Type: "PTR", TTL: 300, Target: "host.example.com"},
+		},
+		"sub.example.com": {
+			{Type: "NS", TTL: 86400, Target: "ns.sub.example.com"},
+		},
+		"ns.sub.example.com": {
+			{Type: "A", TTL: 86400, IP: "192.0.2.53"},
+		},
+		"long.example.com": {
+			// A full character-string, and bytes that must be written as
+			// \DDD escapes.
+			{Type: "TXT", TTL: 300, Text: manager.Text{strings.Repeat("0123456789", 25) + "01234", "\x00\tend\xff"}},
+		},
+	}
+}
+
+// records groups the entries of f by owner name.
+func records(f *File) map[string][]manager.Record {
+	m := make(map[string][]manager.Record)
+	for _, e := range f.Entries {
+		m[e.Name] = append(m[e.Name], e.Record)
+	}
+	return m
+}
+
+func TestWriteParseRoundTrip(t *testing.T) {
+	z := testZone()
+	stored := testRecords()
+
+	var buf bytes.Buffer
+	if err := Write(&buf, z, stored); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Parse(bytes.NewReader(buf.Bytes()), "")
+	if err != nil {
+		t.Fatalf("parse of written zone: %v\n%s", err, buf.String())
+	}
+
+	if f.SOA == nil {
+		t.Fatal("written zone has no SOA record")
+	}
+	if got, want := f.SOA.SOA(), z.SOA(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SOA read back as %v, want %v", got, want)
+	}
+
+	// The name servers of the zone come back as NS records of the apex.
+	want := testRecords()
+	var apex []manager.Record
+	for _, ns := range z.NS {
+		apex = append(apex, manager.Record{Type: "NS", TTL: int(z.TTL), Target: ns})
+	}
+	want[z.Name] = append(apex, want[z.Name]...)
+	got := records(f)
+	for name, rs := range want {
+		if !reflect.DeepEqual(got[name], rs) {
+			t.Errorf("%s read back as\n%+v\nwant\n%+v", name, got[name], rs)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("read back %d names, want %d", len(got), len(want))
+	}
+
+	// Writing what was read produces the same file, now with the NS
+	// records stored for the apex.
+	var again bytes.Buffer
+	if err := Write(&again, *f.SOA, got); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != buf.String() {
+		t.Errorf("second write differs:\n%s\nfirst:\n%s", again.String(), buf.String())
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	const zone = `
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		5	; serial
+		1h	; refresh
+		15m	; retry
+		1w	; expire
+		5m )	; minimum
+	IN	NS	ns1
+ns1		A	192.0.2.1	; the owner of the SOA does not carry over
+www	300	IN	A	192.0.2.2
+	IN	300	AAAA	2001:db8::2	; class and TTL in either order
+txt		TXT	( "first"
+		  "second" )
+$ORIGIN sub
+host		A	192.0.2.3
+@		MX	10 host
+$ORIGIN other.test.
+abs		CNAME	target
+`
+	f, err := Parse(strings.NewReader(zone), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.SOA == nil || f.SOA.Name != "example.com" || f.SOA.MName != "ns1.example.com" ||
+		f.SOA.RName != "hostmaster.example.com" || f.SOA.Serial != 5 || f.SOA.Refresh != 3600 ||
+		f.SOA.Retry != 900 || f.SOA.Expire != 604800 || f.SOA.Minimum != 300 || f.SOA.TTL != 3600 {
+		t.Errorf("SOA %+v", f.SOA)
+	}
+
+	want := []Entry{
+		{"example.com", manager.Record{Type: "NS", TTL: 3600, Target: "ns1.example.com"}},
+		{"ns1.example.com", manager.Record{Type: "A", TTL: 3600, IP: "192.0.2.1"}},
+		{"www.example.com", manager.Record{Type: "A", TTL: 300, IP: "192.0.2.2"}},
+		{"www.example.com", manager.Record{Type: "AAAA", TTL: 300, IP: "2001:db8::2"}},
+		{"txt.example.com", manager.Record{Type: "TXT", TTL: 3600, Text: manager.Text{"first", "second"}}},
+		{"host.sub.example.com", manager.Record{Type: "A", TTL: 3600, IP: "192.0.2.3"}},
+		{"sub.example.com", manager.Record{Type: "MX", TTL: 3600, Priority: 10, Target: "host.sub.example.com"}},
+		{"abs.other.test", manager.Record{Type: "CNAME", TTL: 3600, Target: "target.other.test"}},
+	}
+	if !reflect.DeepEqual(f.Entries, want) {
+		t.Errorf("entries\n%+v\nwant\n%+v", f.Entries, want)
+	}
+}
+
+func TestParseTTLWithoutDirective(t *testing.T) {
+	// Without $TTL a record inherits the last TTL given explicitly, and
+	// the first ones the default.
+	const zone = `
+a	A	192.0.2.1
+b	120	A	192.0.2.2
+c	A	192.0.2.3
+`
+	f, err := Parse(strings.NewReader(zone), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ttls []int
+	for _, e := range f.Entries {
+		ttls = append(ttls, e.Record.TTL)
+	}
+	if want := []int{manager.DefaultTTL, 120, 120}; !reflect.DeepEqual(ttls, want) {
+		t.Errorf("TTLs %v, want %v", ttls, want)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint32
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"3600", 3600, true},
+		{"1h30m", 5400, true},
+		{"1W2D3H4M5S", 788645, true},
+		{"4294967295", 4294967295, true},
+		{"4294967296", 0, false},
+		{"", 0, false},
+		{"h", 0, false},
+		{"1x", 0, false},
+		{"1h30", 0, false},
+		{"1hh", 0, false},
+		{"7102w", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseTTL(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseTTL(%q) = %d, %v, want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, zone, err string
+	}{
+		{"unbalanced open", "a A ( 192.0.2.1\n", "unbalanced parenthesis"},
+		{"unbalanced close", "a A 192.0.2.1 )\n", "unbalanced parenthesis"},
+		{"unterminated string", "a TXT \"text\n", "unterminated quoted string"},
+		{"unknown directive", "$GENERATE 1-10 a$ A 192.0.2.$\n", "unknown directive $GENERATE"},
+		{"other class", "a CH A 192.0.2.1\n", "unsupported class CH"},
+		{"missing type", "a 300 IN\n", "missing record type"},
+		{"unsupported type", "a HINFO cpu os\n", `unsupported record type "HINFO"`},
+		{"bad address", "a A 2001:db8::1\n", "invalid IPv4 address"},
+		{"fields", "a MX mail\n", "MX record takes 2 fields"},
+		{"two SOA", "@ SOA ns h 1 1 1 1 1\n@ SOA ns h 2 1 1 1 1\n", "more than one SOA record"},
+		{"short SOA", "@ SOA ns h 1 1 1 1\n", "SOA takes 7 fields"},
+		{"quoted name", "a CNAME \"target\"\n", "invalid name"},
+		{"include without dir", "$INCLUDE other.zone\n", "$INCLUDE is not allowed here"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.zone), "example.com")
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("hosts.zone", "host A 192.0.2.1\n$ORIGIN elsewhere.test.\nmoved A 192.0.2.2\n")
+	write("nested.zone", "$INCLUDE hosts.zone\n")
+
+	const zone = `
+www	A	192.0.2.10
+$INCLUDE hosts.zone
+$INCLUDE nested.zone lab
+	AAAA	2001:db8::10
+after	A	192.0.2.11
+`
+	f, err := Parse(strings.NewReader(zone), "example.com", WithIncludeDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range f.Entries {
+		names = append(names, e.Name)
+	}
+	// The origin given to $INCLUDE applies inside the file only, and the
+	// origin and owner of the including file are restored after it.
+	want := []string{
+		"www.example.com",
+		"host.example.com", "moved.elsewhere.test",
+		"host.lab.example.com", "moved.elsewhere.test",
+		"www.example.com", "after.example.com",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("owners %v, want %v", names, want)
+	}
+
+	// A file including itself stops at the depth limit.
+	write("loop.zone", "$INCLUDE loop.zone\n")
+	_, err = Parse(strings.NewReader("$INCLUDE loop.zone\n"), "example.com", WithIncludeDir(dir))
+	if err == nil || !strings.Contains(err.Error(), "$INCLUDE nested too deeply") {
+		t.Errorf("self-including file: error %v", err)
+	}
+	if strings.Count(err.Error(), "loop.zone line 1") != maxIncludeDepth {
+		t.Errorf("self-including file stopped at the wrong depth: %v", err)
+	}
+
+	_, err = Parse(strings.NewReader("$INCLUDE missing.zone\n"), "example.com", WithIncludeDir(dir))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing include: error %v", err)
+	}
+}
+
+func TestWriteFileResolvesIncludes(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hosts.zone"), []byte("host 120 A 192.0.2.1\n$ORIGIN elsewhere.test.\nmoved TXT \"a\" \"b\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	const zone = `
+$TTL 300
+@	IN	SOA	ns1 hostmaster 5 3600 900 604800 300
+	IN	NS	ns1
+ns1	0	A	192.0.2.53
+$INCLUDE hosts.zone lab
+`
+	f, err := Parse(strings.NewReader(zone), "example.com", WithIncludeDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.SOA == nil || len(f.Entries) != 4 {
+		t.Fatalf("parsed %+v", f)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFile(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	// The written file needs neither the included file nor an origin.
+	again, err := Parse(bytes.NewReader(buf.Bytes()), "")
+	if err != nil {
+		t.Fatalf("parse of written file: %v\n%s", err, buf.String())
+	}
+	if !reflect.DeepEqual(again, f) {
+		t.Errorf("read back as\n%+v\nwant\n%+v\nfrom\n%s", again, f, buf.String())
+	}
+}